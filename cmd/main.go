@@ -3,10 +3,11 @@ package main
 import (
 	"context"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
-	"sync"
+	stdSync "sync"
 	"syscall"
 	"time"
 
@@ -18,8 +19,11 @@ import (
 
 	"github.com/arimakouyou/pihole-sync/internal/api"
 	"github.com/arimakouyou/pihole-sync/internal/config"
+	"github.com/arimakouyou/pihole-sync/internal/history"
 	"github.com/arimakouyou/pihole-sync/internal/logger"
 	"github.com/arimakouyou/pihole-sync/internal/metrics"
+	"github.com/arimakouyou/pihole-sync/internal/pihole"
+	"github.com/arimakouyou/pihole-sync/internal/sync"
 )
 
 func main() {
@@ -44,42 +48,72 @@ func main() {
 	// Set default values for metrics configuration if not specified
 	setDefaultMetricsConfig(&cfg.Metrics)
 
-	server := api.NewServer(cfg)
+	// All components share one API session per Pi-hole through this pool
+	pool := pihole.NewPool()
+	pool.SetLogoutErrorHandler(func(host string, err error) {
+		logger.Logger.Warn("Failed to logout replaced Pi-hole session", zap.String("host", host), zap.Error(err))
+	})
 
+	// Sync runs are persisted so that the history survives restarts
+	store, err := history.Open(cfg.History.Path, cfg.History.MaxEntries)
+	if err != nil {
+		logger.Logger.Error("Failed to open sync history, runs will not be recorded", zap.Error(err))
+		store = nil
+	}
 	// Create context for graceful shutdown
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	var wg sync.WaitGroup
+	server := api.NewServer(ctx, cfg, pool, store)
 
-	// Start scheduled sync if enabled
+	var wg stdSync.WaitGroup
+
+	// Start scheduled sync for every cluster with a schedule
 	var cronScheduler *cron.Cron
-	if cfg.SyncTrigger.Schedule != "" {
-		cronScheduler = cron.New()
-		_, err := cronScheduler.AddFunc(cfg.SyncTrigger.Schedule, func() {
-			logger.Logger.Info("Running scheduled sync...")
-			result, err := server.GetSyncer().Sync()
+	var fileWatchClusters []string
+	for _, cluster := range server.GetClusters() {
+		trigger := cluster.Config().SyncTrigger
+		if trigger.PiholeFileWatch {
+			fileWatchClusters = append(fileWatchClusters, cluster.Name())
+		}
+		if trigger.Schedule == "" {
+			continue
+		}
+		if cronScheduler == nil {
+			cronScheduler = cron.New()
+		}
+		name := cluster.Name()
+		_, err := cronScheduler.AddFunc(trigger.Schedule, func() {
+			// Look the cluster up per run so that config reloads are followed
+			cluster, ok := server.GetCluster(name)
+			if !ok {
+				return
+			}
+			logger.Logger.Info("Running scheduled sync...", zap.String("cluster", name))
+			result, _, err := cluster.Coordinator().Submit(ctx, sync.SyncOptions{Trigger: sync.TriggerSchedule})
 			if err != nil {
-				logger.Logger.Error("Scheduled sync error", zap.Error(err))
+				logger.Logger.Error("Scheduled sync error", zap.String("cluster", name), zap.Error(err))
 				return
 			}
 			if result.Success {
-				logger.Logger.Info("Scheduled sync completed successfully", zap.String("message", result.Message))
+				logger.Logger.Info("Scheduled sync completed successfully", zap.String("cluster", name), zap.String("message", result.Message))
 			} else {
-				logger.Logger.Warn("Scheduled sync failed", zap.String("message", result.Message))
+				logger.Logger.Warn("Scheduled sync failed", zap.String("cluster", name), zap.String("message", result.Message))
 			}
 		})
 		if err != nil {
-			logger.Logger.Error("Failed to add scheduled sync", zap.Error(err))
+			logger.Logger.Error("Failed to add scheduled sync", zap.String("cluster", name), zap.Error(err))
 		} else {
-			cronScheduler.Start()
-			logger.Logger.Info("Started scheduled sync", zap.String("cron", cfg.SyncTrigger.Schedule))
+			logger.Logger.Info("Started scheduled sync", zap.String("cluster", name), zap.String("cron", trigger.Schedule))
 		}
 	}
+	if cronScheduler != nil {
+		cronScheduler.Start()
+	}
 
-	// Start Pi-hole file watcher if enabled
+	// Start Pi-hole file watcher if any cluster enabled it
 	var watcher *fsnotify.Watcher
-	if cfg.SyncTrigger.PiholeFileWatch {
+	if len(fileWatchClusters) > 0 {
 		var err error
 		watcher, err = fsnotify.NewWatcher()
 		if err != nil {
@@ -132,15 +166,8 @@ func main() {
 
 								debounceTimer = time.AfterFunc(debounceDelay, func() {
 									logger.Logger.Info("Debounce period completed, triggering sync after Pi-hole file changes")
-									result, err := server.GetSyncer().Sync()
-									if err != nil {
-										logger.Logger.Error("Pi-hole file change sync error", zap.Error(err))
-										return
-									}
-									if result.Success {
-										logger.Logger.Info("Pi-hole file change sync completed", zap.String("message", result.Message))
-									} else {
-										logger.Logger.Warn("Pi-hole file change sync failed", zap.String("message", result.Message))
+									for _, name := range fileWatchClusters {
+										go syncOnFileChange(ctx, server, name)
 									}
 								})
 							}
@@ -169,9 +196,13 @@ func main() {
 	var metricsCtx context.Context
 	if cfg.Metrics.Enabled {
 		metricsCtx, metricsCancel = context.WithCancel(ctx)
-		startMetricsCollection(cfg, &wg, metricsCtx)
+		startMetricsCollection(server, &wg, metricsCtx)
 	}
 
+	// Start drift detection between master and slaves where enabled
+	driftCtx, driftCancel := context.WithCancel(ctx)
+	startDriftDetection(server, &wg, driftCtx)
+
 	// Watch for configuration reloads
 	wg.Add(1)
 	go func() {
@@ -193,8 +224,13 @@ func main() {
 
 				if newConfig.Metrics.Enabled {
 					metricsCtx, metricsCancel = context.WithCancel(ctx)
-					startMetricsCollection(newConfig, &wg, metricsCtx)
+					startMetricsCollection(server, &wg, metricsCtx)
 				}
+
+				// Restart drift detection with the new detectors
+				driftCancel()
+				driftCtx, driftCancel = context.WithCancel(ctx)
+				startDriftDetection(server, &wg, driftCtx)
 			}
 		}
 	}()
@@ -208,6 +244,13 @@ func main() {
 	r.HandleFunc("/gravity", server.GravityGetHandler).Methods("GET")
 	r.HandleFunc("/gravity", server.GravityPostHandler).Methods("POST")
 	r.HandleFunc("/gravity/edit", server.GravityHandler)
+	r.HandleFunc("/api/drift", server.DriftHandler).Methods("GET")
+	r.HandleFunc("/api/master", server.MasterHandler).Methods("GET")
+	r.HandleFunc("/api/clusters", server.ClustersHandler).Methods("GET")
+	r.HandleFunc("/api/sync/history", server.SyncHistoryHandler).Methods("GET")
+	r.HandleFunc("/api/sync/jobs/{id}", server.SyncJobHandler).Methods("GET", "DELETE")
+	r.HandleFunc("/api/sync/events", server.SyncEventsHandler).Methods("GET")
+	r.HandleFunc("/history", server.HistoryHandler).Methods("GET")
 	r.HandleFunc("/backup", server.BackupHandler)
 	r.HandleFunc("/restore", server.RestoreHandler)
 	r.HandleFunc("/config", server.ConfigHandler).Methods("GET")
@@ -219,9 +262,14 @@ func main() {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
+	// Request contexts derive from ctx so that shutdown cancels in-flight
+	// Pi-hole calls made on behalf of HTTP handlers.
 	httpServer := &http.Server{
 		Addr:    ":8080",
 		Handler: r,
+		BaseContext: func(net.Listener) context.Context {
+			return ctx
+		},
 	}
 
 	// Start HTTP server in a separate goroutine
@@ -248,7 +296,7 @@ func main() {
 		watcher.Close()
 	}
 
-	// Cancel context to stop metrics collection
+	// Cancel context to stop metrics collection and abort in-flight syncs
 	cancel()
 
 	// Shutdown HTTP server
@@ -261,20 +309,72 @@ func main() {
 
 	// Wait for all goroutines to finish
 	wg.Wait()
+
+	// Release the Pi-hole API sessions held by the pool
+	logoutCtx, logoutCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer logoutCancel()
+	if err := pool.Close(logoutCtx); err != nil {
+		logger.Logger.Warn("Failed to logout Pi-hole sessions", zap.Error(err))
+	}
 	logger.Logger.Info("Server shutdown completed")
 }
 
-// startMetricsCollection starts the metrics collection service
-func startMetricsCollection(cfg *config.Config, wg *sync.WaitGroup, ctx context.Context) {
-	if cfg.Metrics.Enabled {
-		go func() {
+// syncOnFileChange syncs the named cluster after the watched Pi-hole files
+// changed.
+func syncOnFileChange(ctx context.Context, server *api.Server, name string) {
+	cluster, ok := server.GetCluster(name)
+	if !ok {
+		return
+	}
+	result, _, err := cluster.Coordinator().Submit(ctx, sync.SyncOptions{Trigger: sync.TriggerFileWatch})
+	if err != nil {
+		logger.Logger.Error("Pi-hole file change sync error", zap.String("cluster", name), zap.Error(err))
+		return
+	}
+	if result.Success {
+		logger.Logger.Info("Pi-hole file change sync completed", zap.String("cluster", name), zap.String("message", result.Message))
+	} else {
+		logger.Logger.Warn("Pi-hole file change sync failed", zap.String("cluster", name), zap.String("message", result.Message))
+	}
+}
+
+// startMetricsCollection starts one metrics collector per cluster. The role
+// label follows the cluster's current sync source.
+func startMetricsCollection(server *api.Server, wg *stdSync.WaitGroup, ctx context.Context) {
+	for _, cluster := range server.GetClusters() {
+		cfg := cluster.Config()
+		if !cfg.Metrics.Enabled {
+			continue
+		}
+		wg.Add(1)
+		go func(cluster *api.Cluster) {
 			defer wg.Done()
-			collector := metrics.NewCollector(cfg, logger.Logger)
-			if err := collector.Start(ctx); err != nil {
-				logger.Logger.Error("メトリクス収集エラー", zap.Error(err))
+			collector := metrics.NewCollector(cfg, server.GetPool(), logger.Logger)
+			collector.SetActiveMaster(func() string {
+				return cluster.Syncer().ActiveMaster()
+			})
+			if err := collector.Start(ctx); err != nil && err != context.Canceled {
+				logger.Logger.Error("メトリクス収集エラー", zap.String("cluster", cluster.Name()), zap.Error(err))
 			}
-		}()
+		}(cluster)
+	}
+}
+
+// startDriftDetection runs the drift detector of every cluster that enabled
+// it until ctx is done
+func startDriftDetection(server *api.Server, wg *stdSync.WaitGroup, ctx context.Context) {
+	for _, cluster := range server.GetClusters() {
+		if !cluster.Config().Drift.Enabled {
+			continue
+		}
+		detector := cluster.DriftDetector()
 		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			if err := detector.Start(ctx); err != nil && err != context.Canceled {
+				logger.Logger.Error("ドリフト検出エラー", zap.String("cluster", name), zap.Error(err))
+			}
+		}(cluster.Name())
 	}
 }
 
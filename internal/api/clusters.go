@@ -0,0 +1,204 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/arimakouyou/pihole-sync/internal/config"
+	"github.com/arimakouyou/pihole-sync/internal/logger"
+	"github.com/arimakouyou/pihole-sync/internal/metrics"
+	"github.com/arimakouyou/pihole-sync/internal/notifications"
+	"github.com/arimakouyou/pihole-sync/internal/sync"
+)
+
+// Cluster is one independent sync cluster of the server: a master, its
+// slaves and everything running syncs between them. The coordinator and
+// its jobs outlive config reloads so runs stay serialized across syncer
+// replacements; the rest is replaced on reload, with the new syncer
+// inheriting the old one's run state, and guarded by the server's
+// configMutex.
+type Cluster struct {
+	name        string
+	server      *Server
+	coordinator *sync.Coordinator
+	jobs        *sync.JobManager
+
+	config   *config.Config
+	syncer   *sync.Syncer
+	drift    *sync.DriftDetector
+	notifier *notifications.SlackNotifier
+}
+
+// newCluster creates the cluster cfg configures.
+func (s *Server) newCluster(cfg *config.Config) *Cluster {
+	c := &Cluster{name: cfg.ClusterName(), server: s}
+	c.coordinator = sync.NewCoordinatorWithEvents(s.ctx, c.Syncer, s.events)
+	c.jobs = sync.NewJobManager(c.coordinator)
+	c.configure(cfg)
+	return c
+}
+
+// configure replaces the cluster's config and the components built from it.
+// The caller holds s.configMutex or has not published the cluster yet.
+func (c *Cluster) configure(cfg *config.Config) {
+	prev := c.syncer
+	c.config = cfg
+	c.syncer = sync.NewSyncer(cfg, c.server.pool)
+	if c.server.history != nil {
+		c.syncer.SetRecorder(c.server.history.Cluster(c.name))
+	}
+	c.syncer.Inherit(prev)
+	c.syncer.SetAlert(c.alert)
+	c.notifier = notifications.NewSlackNotifier(cfg.Slack.WebhookURL, cfg.Slack.NotifyOnError)
+	// main restarts the drift detector on the reload signal
+	c.drift = sync.NewDriftDetector(cfg.Drift, c.coordinator, c.alert)
+}
+
+// Name returns the cluster's name.
+func (c *Cluster) Name() string {
+	return c.name
+}
+
+// Config returns the cluster's configuration, with its overrides merged
+// over the top-level settings.
+func (c *Cluster) Config() *config.Config {
+	c.server.configMutex.RLock()
+	defer c.server.configMutex.RUnlock()
+	return c.config
+}
+
+// Syncer returns the cluster's current syncer.
+func (c *Cluster) Syncer() *sync.Syncer {
+	c.server.configMutex.RLock()
+	defer c.server.configMutex.RUnlock()
+	return c.syncer
+}
+
+// Coordinator returns the coordinator every sync trigger of the cluster
+// should go through.
+func (c *Cluster) Coordinator() *sync.Coordinator {
+	return c.coordinator
+}
+
+// DriftDetector returns the cluster's drift detector. It is replaced on
+// config reload.
+func (c *Cluster) DriftDetector() *sync.DriftDetector {
+	c.server.configMutex.RLock()
+	defer c.server.configMutex.RUnlock()
+	return c.drift
+}
+
+// alert notifies through the cluster's current notifier. With several
+// clusters configured the title names the cluster.
+func (c *Cluster) alert(title, details string) {
+	c.server.configMutex.RLock()
+	notifier := c.notifier
+	title = c.title(title)
+	c.server.configMutex.RUnlock()
+	if err := notifier.NotifyError(title, details); err != nil {
+		logger.Logger.Warn("Failed to send alert", zap.String("title", title), zap.Error(err))
+	}
+}
+
+// title prefixes title with the cluster's name when the configuration has
+// clusters. The caller holds s.configMutex.
+func (c *Cluster) title(title string) string {
+	if len(c.server.config.Clusters) == 0 {
+		return title
+	}
+	return "[" + c.name + "] " + title
+}
+
+// GetClusters returns the configured clusters in configuration order.
+func (s *Server) GetClusters() []*Cluster {
+	s.configMutex.RLock()
+	defer s.configMutex.RUnlock()
+	return append([]*Cluster(nil), s.clusters...)
+}
+
+// GetCluster returns the cluster called name.
+func (s *Server) GetCluster(name string) (*Cluster, bool) {
+	s.configMutex.RLock()
+	defer s.configMutex.RUnlock()
+	for _, cluster := range s.clusters {
+		if cluster.name == name {
+			return cluster, true
+		}
+	}
+	return nil, false
+}
+
+// defaultCluster returns the first cluster, which serves requests that do
+// not name one.
+func (s *Server) defaultCluster() *Cluster {
+	s.configMutex.RLock()
+	defer s.configMutex.RUnlock()
+	return s.clusters[0]
+}
+
+// requestCluster returns the cluster named by the request's cluster query
+// parameter, or the first cluster if there is none. For an unknown name it
+// answers 404 and returns nil.
+func (s *Server) requestCluster(w http.ResponseWriter, r *http.Request) *Cluster {
+	name := r.URL.Query().Get("cluster")
+	if name == "" {
+		return s.defaultCluster()
+	}
+	cluster, ok := s.GetCluster(name)
+	if !ok {
+		http.Error(w, "Cluster not found", http.StatusNotFound)
+		return nil
+	}
+	return cluster
+}
+
+// ClusterSummary describes one cluster in the cluster list.
+type ClusterSummary struct {
+	Name        string     `json:"name"`
+	Master      string     `json:"master"`
+	Slaves      []string   `json:"slaves"`
+	MultiMaster bool       `json:"multi_master"`
+	Failover    bool       `json:"failover"`
+	Drift       bool       `json:"drift_detection"`
+	Schedule    string     `json:"schedule,omitempty"`
+	Running     bool       `json:"running"`
+	LastSync    *time.Time `json:"last_sync,omitempty"`
+}
+
+// ClustersHandler lists the configured clusters.
+func (s *Server) ClustersHandler(w http.ResponseWriter, r *http.Request) {
+	metrics.IncrementAPICall()
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	clusters := []ClusterSummary{}
+	for _, cluster := range s.GetClusters() {
+		cfg := cluster.Config()
+		summary := ClusterSummary{
+			Name:        cluster.name,
+			Master:      cluster.Syncer().ActiveMaster(),
+			Slaves:      []string{},
+			MultiMaster: cfg.MultiMaster.Enabled,
+			Failover:    cfg.Failover.Enabled,
+			Drift:       cfg.Drift.Enabled,
+			Schedule:    cfg.SyncTrigger.Schedule,
+			Running:     cluster.coordinator.Running(),
+		}
+		for _, slave := range cfg.Slaves {
+			summary.Slaves = append(summary.Slaves, slave.Host)
+		}
+		if last := cluster.Syncer().GetLastSync(); !last.IsZero() {
+			summary.LastSync = &last
+		}
+		clusters = append(clusters, summary)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"clusters": clusters})
+}
@@ -1,28 +1,38 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	stdSync "sync"
 	"time"
 
+	"github.com/gorilla/mux"
 	"go.uber.org/zap"
 
 	"github.com/arimakouyou/pihole-sync/internal/config"
+	"github.com/arimakouyou/pihole-sync/internal/history"
 	"github.com/arimakouyou/pihole-sync/internal/logger"
 	"github.com/arimakouyou/pihole-sync/internal/metrics"
-	"github.com/arimakouyou/pihole-sync/internal/notifications"
+	"github.com/arimakouyou/pihole-sync/internal/pihole"
 	"github.com/arimakouyou/pihole-sync/internal/sync"
 )
 
 type Server struct {
-	config        *config.Config
-	syncer        *sync.Syncer
-	notifier      *notifications.SlackNotifier
+	ctx    context.Context
+	config *config.Config
+	pool   *pihole.Pool
+	// clusters holds one entry per configured cluster, in configuration
+	// order; their coordinators all publish to events
+	clusters      []*Cluster
+	events        *sync.EventBus
+	history       *history.Store
 	gravity       []string
 	configMutex   stdSync.RWMutex
 	reloadChannel chan bool
@@ -33,23 +43,43 @@ type BackupData struct {
 	Gravity []string       `json:"gravity"`
 }
 
-func NewServer(cfg *config.Config) *Server {
-	syncer := sync.NewSyncer(cfg)
-	notifier := notifications.NewSlackNotifier(cfg.Slack.WebhookURL, cfg.Slack.NotifyOnError)
-
-	return &Server{
+// NewServer creates the HTTP server. store may be nil, in which case sync
+// runs are not recorded. Queued sync runs are cancelled with ctx.
+func NewServer(ctx context.Context, cfg *config.Config, pool *pihole.Pool, store *history.Store) *Server {
+	s := &Server{
+		ctx:           ctx,
 		config:        cfg,
-		syncer:        syncer,
-		notifier:      notifier,
+		pool:          pool,
+		events:        sync.NewEventBus(),
+		history:       store,
 		gravity:       cfg.Gravity,
 		reloadChannel: make(chan bool, 1),
 	}
+	for _, clusterConfig := range cfg.ClusterConfigs() {
+		s.clusters = append(s.clusters, s.newCluster(clusterConfig))
+	}
+	return s
 }
 
+// GetSyncer returns the syncer of the first cluster.
 func (s *Server) GetSyncer() *sync.Syncer {
-	s.configMutex.RLock()
-	defer s.configMutex.RUnlock()
-	return s.syncer
+	return s.defaultCluster().Syncer()
+}
+
+// GetCoordinator returns the coordinator of the first cluster.
+func (s *Server) GetCoordinator() *sync.Coordinator {
+	return s.defaultCluster().Coordinator()
+}
+
+// GetDriftDetector returns the drift detector of the first cluster. It is
+// replaced on config reload.
+func (s *Server) GetDriftDetector() *sync.DriftDetector {
+	return s.defaultCluster().DriftDetector()
+}
+
+// GetPool returns the shared Pi-hole client pool
+func (s *Server) GetPool() *pihole.Pool {
+	return s.pool
 }
 
 // GetConfig returns the current configuration (thread-safe)
@@ -80,11 +110,31 @@ func (s *Server) ReloadConfig() error {
 	s.config = newConfig
 	s.gravity = newConfig.Gravity
 
-	// Recreate syncer with new configuration
-	s.syncer = sync.NewSyncer(newConfig)
-
-	// Recreate notifier with new configuration
-	s.notifier = notifications.NewSlackNotifier(newConfig.Slack.WebhookURL, newConfig.Slack.NotifyOnError)
+	// Reconfigure the clusters. A cluster keeps its coordinator and jobs
+	// while its name stays configured. Sessions for hosts that are still
+	// configured are reused from the pool; removed hosts are logged out.
+	existing := make(map[string]*Cluster)
+	for _, cluster := range s.clusters {
+		existing[cluster.name] = cluster
+	}
+	var clusters []*Cluster
+	for _, clusterConfig := range newConfig.ClusterConfigs() {
+		cluster, ok := existing[clusterConfig.ClusterName()]
+		if ok {
+			cluster.configure(clusterConfig)
+		} else {
+			cluster = s.newCluster(clusterConfig)
+		}
+		clusters = append(clusters, cluster)
+	}
+	s.clusters = clusters
+	go func(hosts []string) {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := s.pool.Retain(ctx, hosts); err != nil {
+			logger.Logger.Warn("Failed to logout removed Pi-hole sessions", zap.Error(err))
+		}
+	}(newConfig.Hosts())
 
 	logger.Logger.Info("Configuration reloaded successfully")
 
@@ -111,53 +161,361 @@ func (s *Server) SyncHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !s.syncer.CanSync() {
-		response := map[string]interface{}{
-			"status":         "error",
-			"message":        "10秒以内に呼び出し済みのため、処理は実行されませんでした",
-			"last_synced_at": time.Now().Format(time.RFC3339),
-		}
+	cluster := s.requestCluster(w, r)
+	if cluster == nil {
+		return
+	}
 
+	if dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run")); dryRun {
+		s.dryRun(w, r, cluster)
+		return
+	}
+
+	force, _ := strconv.ParseBool(r.URL.Query().Get("force"))
+	job := cluster.jobs.Start(sync.SyncOptions{Trigger: sync.TriggerAPI, Force: force})
+	go cluster.reportJob(job)
+
+	// wait=true keeps the blocking behaviour of earlier versions
+	if wait, _ := strconv.ParseBool(r.URL.Query().Get("wait")); !wait {
+		status := job.Status()
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", "/api/sync/jobs/"+status.ID)
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":  "accepted",
+			"message": "同期ジョブを開始しました",
+			"cluster": cluster.name,
+			"job_id":  status.ID,
+			"job":     status,
+		})
+		return
+	}
+
+	select {
+	case <-job.Done():
+	case <-r.Context().Done():
+		job.Cancel()
+	}
+	status := job.Status()
+
+	if status.State == sync.JobCanceled || status.Error != "" {
+		message := status.Error
+		if message == "" {
+			message = "同期はキャンセルされました"
+		}
 		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		response := map[string]interface{}{
+			"status":      "error",
+			"message":     message,
+			"job_id":      status.ID,
+			"disposition": status.Disposition,
+		}
 		json.NewEncoder(w).Encode(response)
 		return
 	}
 
-	result, err := s.syncer.Sync()
+	details := map[string]interface{}{
+		"slaves": status.Result.Details,
+	}
+	if len(status.Result.Conflicts) > 0 {
+		details["conflicts"] = status.Result.Conflicts
+	}
+
+	response := map[string]interface{}{
+		"status":      "success",
+		"message":     status.Result.Message,
+		"cluster":     cluster.name,
+		"job_id":      status.ID,
+		"disposition": status.Disposition,
+		"synced_at":   status.Result.SyncedAt.Format(time.RFC3339),
+		"details":     details,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// reportJob updates metrics and notifies about a finished API sync job of
+// the cluster. Merged jobs share a run that was already reported, and
+// cancelled jobs have no outcome of their own.
+func (c *Cluster) reportJob(job *sync.Job) {
+	<-job.Done()
+	status := job.Status()
+	if status.Disposition == sync.DispositionMerged || status.State == sync.JobCanceled {
+		return
+	}
+
+	c.server.configMutex.RLock()
+	notifier := c.notifier
+	errorTitle, failureTitle := c.title("同期エラー"), c.title("同期失敗")
+	c.server.configMutex.RUnlock()
+
+	switch {
+	case status.Error != "":
+		metrics.IncrementError()
+		notifier.NotifyError(errorTitle, status.Error)
+	case status.Result.Success:
+		metrics.IncrementSyncSuccess(c.name)
+	default:
+		metrics.IncrementSyncFailure(c.name)
+		notifier.NotifyError(failureTitle, status.Result.Message)
+	}
+}
+
+// SyncJobHandler shows (GET) or cancels (DELETE) the sync job
+// /api/sync/jobs/{id} of any cluster.
+func (s *Server) SyncJobHandler(w http.ResponseWriter, r *http.Request) {
+	metrics.IncrementAPICall()
+
+	var job *sync.Job
+	ok := false
+	for _, cluster := range s.GetClusters() {
+		if job, ok = cluster.jobs.Get(mux.Vars(r)["id"]); ok {
+			break
+		}
+	}
+	if !ok {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodDelete:
+		if err := job.Cancel(); errors.Is(err, sync.ErrJobFinished) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"status":  "error",
+				"message": "同期ジョブはすでに終了しています",
+				"job":     job.Status(),
+			})
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job.Status())
+}
+
+// sseKeepAlive is how often an idle event stream sends a comment so that
+// proxies do not close it
+const sseKeepAlive = 15 * time.Second
+
+// SyncEventsHandler streams the lifecycle events of every sync run as
+// Server-Sent Events until the client disconnects. The cluster query
+// parameter limits the stream to one cluster's runs.
+func (s *Server) SyncEventsHandler(w http.ResponseWriter, r *http.Request) {
+	metrics.IncrementAPICall()
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	filter := r.URL.Query().Get("cluster")
+	if filter != "" {
+		if _, ok := s.GetCluster(filter); !ok {
+			http.Error(w, "Cluster not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	events, unsubscribe := s.events.Subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case event := <-events:
+			if filter != "" && event.Cluster != filter {
+				continue
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				logger.Logger.Warn("Failed to encode sync event", zap.Error(err))
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+			flusher.Flush()
+		}
+	}
+}
+
+// dryRun answers POST /sync?dry_run=true with the changes a sync of cluster
+// would make on every slave. No Pi-hole is modified.
+func (s *Server) dryRun(w http.ResponseWriter, r *http.Request, cluster *Cluster) {
+	result, err := cluster.Syncer().DryRun(r.Context())
 	if err != nil {
 		metrics.IncrementError()
-		s.notifier.NotifyError("同期エラー", err.Error())
 
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusInternalServerError)
 		response := map[string]interface{}{
 			"status":  "error",
+			"dry_run": true,
 			"message": err.Error(),
 		}
 		json.NewEncoder(w).Encode(response)
 		return
 	}
 
-	if result.Success {
-		metrics.IncrementSyncSuccess()
-	} else {
-		metrics.IncrementSyncFailure()
-		s.notifier.NotifyError("同期失敗", result.Message)
+	status := "success"
+	if !result.Success {
+		status = "error"
+	}
+
+	details := map[string]interface{}{
+		"slaves": result.Details,
+	}
+	if len(result.Conflicts) > 0 {
+		details["conflicts"] = result.Conflicts
 	}
 
 	response := map[string]interface{}{
-		"status":    "success",
-		"message":   result.Message,
-		"synced_at": result.SyncedAt.Format(time.RFC3339),
-		"details": map[string]interface{}{
-			"slaves": result.Details,
-		},
+		"status":     status,
+		"dry_run":    true,
+		"message":    result.Message,
+		"cluster":    cluster.name,
+		"planned_at": result.PlannedAt.Format(time.RFC3339),
+		"details":    details,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
+// DriftHandler returns the result of the latest drift check.
+func (s *Server) DriftHandler(w http.ResponseWriter, r *http.Request) {
+	metrics.IncrementAPICall()
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	cluster := s.requestCluster(w, r)
+	if cluster == nil {
+		return
+	}
+
+	response := map[string]interface{}{
+		"cluster": cluster.name,
+		"enabled": cluster.Config().Drift.Enabled,
+		"drift":   cluster.DriftDetector().Status(),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// MasterHandler shows the master candidates and which one is the current
+// sync source.
+func (s *Server) MasterHandler(w http.ResponseWriter, r *http.Request) {
+	metrics.IncrementAPICall()
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	cluster := s.requestCluster(w, r)
+	if cluster == nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cluster.Syncer().MasterStatus())
+}
+
+// SyncHistoryHandler returns recorded sync runs, newest first. Use limit
+// (default 20, max 100) and offset to page through them, and cluster to
+// only list the runs of one cluster.
+func (s *Server) SyncHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	metrics.IncrementAPICall()
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit := 20
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(parsed, 100)
+	}
+	offset := 0
+	if value := r.URL.Query().Get("offset"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			http.Error(w, "Invalid offset", http.StatusBadRequest)
+			return
+		}
+		offset = parsed
+	}
+
+	name := r.URL.Query().Get("cluster")
+	if name != "" {
+		if _, ok := s.GetCluster(name); !ok {
+			http.Error(w, "Cluster not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	entries, total := []history.Entry{}, 0
+	switch {
+	case s.history == nil:
+	case name != "":
+		entries, total = s.history.Cluster(name).List(offset, limit)
+	default:
+		entries, total = s.history.List(offset, limit)
+	}
+
+	response := map[string]interface{}{
+		"total":   total,
+		"offset":  offset,
+		"limit":   limit,
+		"entries": entries,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// HistoryHandler serves the sync history page.
+func (s *Server) HistoryHandler(w http.ResponseWriter, r *http.Request) {
+	http.ServeFile(w, r, "web/templates/history.html")
+}
+
 func (s *Server) GravityGetHandler(w http.ResponseWriter, r *http.Request) {
 	metrics.IncrementAPICall()
 
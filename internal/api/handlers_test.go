@@ -1,7 +1,9 @@
 package api
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
@@ -10,10 +12,14 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/gorilla/mux"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
 	"github.com/arimakouyou/pihole-sync/internal/config"
+	"github.com/arimakouyou/pihole-sync/internal/history"
+	"github.com/arimakouyou/pihole-sync/internal/pihole"
+	"github.com/arimakouyou/pihole-sync/internal/sync"
 )
 
 func createTestServer() *Server {
@@ -37,7 +43,7 @@ func createTestServer() *Server {
 			Count:   3,
 		},
 	}
-	return NewServer(cfg)
+	return NewServer(context.Background(), cfg, pihole.NewPool(), nil)
 }
 
 func TestSyncHandler(t *testing.T) {
@@ -49,16 +55,75 @@ func TestSyncHandler(t *testing.T) {
 	rr := httptest.NewRecorder()
 	server.SyncHandler(rr, req)
 
+	// The sync runs as a job; the response only carries its id
+	require.Equal(t, http.StatusAccepted, rr.Code)
+	var response map[string]interface{}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+	assert.Equal(t, "accepted", response["status"])
+	id, _ := response["job_id"].(string)
+	require.NotEmpty(t, id)
+	assert.Equal(t, "/api/sync/jobs/"+id, rr.Header().Get("Location"))
+
+	job, ok := server.clusters[0].jobs.Get(id)
+	require.True(t, ok)
+	<-job.Done()
+}
+
+func TestSyncHandlerWait(t *testing.T) {
+	server := createTestServer()
+
+	req, err := http.NewRequest("POST", "/sync?wait=true", nil)
+	require.NoError(t, err)
+
+	rr := httptest.NewRecorder()
+	server.SyncHandler(rr, req)
+
+	// The test hosts are unreachable, so the sync fails; the response is
+	// only sent once it did
+	var response map[string]interface{}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+	assert.Contains(t, response, "job_id")
+	assert.Equal(t, "ran", response["disposition"])
 	if rr.Code == http.StatusOK {
-		var response map[string]interface{}
-		err = json.Unmarshal(rr.Body.Bytes(), &response)
-		require.NoError(t, err)
-		assert.Contains(t, response, "status")
-		t.Logf("Sync response: %v", response)
+		assert.Contains(t, response, "details")
 	} else {
-		t.Logf("Sync failed with status %d, body: %s", rr.Code, rr.Body.String())
-		assert.True(t, rr.Code >= 400, "Expected error status code")
+		assert.Equal(t, http.StatusInternalServerError, rr.Code)
+		assert.Equal(t, "error", response["status"])
+	}
+}
+
+func TestSyncJobHandler(t *testing.T) {
+	server := createTestServer()
+
+	get := func(id string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", "/api/sync/jobs/"+id, nil)
+		require.NoError(t, err)
+		req = mux.SetURLVars(req, map[string]string{"id": id})
+		rr := httptest.NewRecorder()
+		server.SyncJobHandler(rr, req)
+		return rr
 	}
+
+	assert.Equal(t, http.StatusNotFound, get("unknown").Code)
+
+	job := server.clusters[0].jobs.Start(sync.SyncOptions{Trigger: sync.TriggerAPI})
+	<-job.Done()
+	id := job.Status().ID
+
+	rr := get(id)
+	require.Equal(t, http.StatusOK, rr.Code)
+	var status sync.JobStatus
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &status))
+	assert.Equal(t, id, status.ID)
+	assert.Equal(t, sync.JobFailed, status.State)
+	assert.NotEmpty(t, status.Error)
+
+	req, err := http.NewRequest("DELETE", "/api/sync/jobs/"+id, nil)
+	require.NoError(t, err)
+	req = mux.SetURLVars(req, map[string]string{"id": id})
+	rr = httptest.NewRecorder()
+	server.SyncJobHandler(rr, req)
+	assert.Equal(t, http.StatusConflict, rr.Code, "a finished job cannot be cancelled")
 }
 
 func TestSyncHandlerMethodNotAllowed(t *testing.T) {
@@ -251,3 +316,217 @@ func TestIndexHandler(t *testing.T) {
 	assert.Equal(t, "text/html; charset=utf-8", rr.Header().Get("Content-Type"))
 	assert.Contains(t, rr.Body.String(), "Pi-hole Sync 管理画面")
 }
+
+func TestSyncHandlerDryRun(t *testing.T) {
+	var writes int
+	fake := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/auth" {
+			json.NewEncoder(w).Encode(map[string]interface{}{"session": map[string]string{"sid": "sid", "csrf": "csrf"}})
+			return
+		}
+		if r.Method != http.MethodGet {
+			writes++
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer fake.Close()
+
+	server := createTestServer()
+	cluster := server.clusters[0]
+	cluster.config.Master.Host = fake.URL
+	cluster.config.Slaves[0].Host = fake.URL
+	cluster.syncer = sync.NewSyncer(cluster.config, server.pool)
+
+	req, err := http.NewRequest("POST", "/sync?dry_run=true", nil)
+	require.NoError(t, err)
+
+	rr := httptest.NewRecorder()
+	server.SyncHandler(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var response struct {
+		Status  string `json:"status"`
+		DryRun  bool   `json:"dry_run"`
+		Details struct {
+			Slaves []sync.SlavePlan `json:"slaves"`
+		} `json:"details"`
+	}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+	assert.Equal(t, "success", response.Status)
+	assert.True(t, response.DryRun)
+	require.Len(t, response.Details.Slaves, 1)
+	assert.Empty(t, response.Details.Slaves[0].Plan.Changes)
+	assert.Zero(t, writes)
+}
+
+func TestDriftHandler(t *testing.T) {
+	server := createTestServer()
+
+	req, err := http.NewRequest("GET", "/api/drift", nil)
+	require.NoError(t, err)
+
+	rr := httptest.NewRecorder()
+	server.DriftHandler(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var response struct {
+		Enabled bool             `json:"enabled"`
+		Drift   sync.DriftStatus `json:"drift"`
+	}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+	assert.False(t, response.Enabled)
+	assert.Empty(t, response.Drift.Slaves)
+}
+
+func TestMasterHandler(t *testing.T) {
+	server := createTestServer()
+
+	req, err := http.NewRequest("GET", "/api/master", nil)
+	require.NoError(t, err)
+
+	rr := httptest.NewRecorder()
+	server.MasterHandler(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var response sync.MasterStatus
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+	assert.Equal(t, server.GetConfig().Master.Host, response.Active)
+	assert.False(t, response.Failover)
+	require.Len(t, response.Candidates, 1)
+	assert.True(t, response.Candidates[0].Active)
+	assert.Equal(t, sync.MasterUnchecked, response.Candidates[0].Health)
+}
+
+func TestSyncHistoryHandler(t *testing.T) {
+	store, err := history.Open(filepath.Join(t.TempDir(), "history.jsonl"), 10)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, store.Record(sync.SyncResult{Success: true, Trigger: sync.TriggerAPI}))
+	}
+
+	server := createTestServer()
+	server.history = store
+
+	req, err := http.NewRequest("GET", "/api/sync/history?limit=2&offset=1", nil)
+	require.NoError(t, err)
+
+	rr := httptest.NewRecorder()
+	server.SyncHistoryHandler(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var response struct {
+		Total   int             `json:"total"`
+		Entries []history.Entry `json:"entries"`
+	}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+	assert.Equal(t, 3, response.Total)
+	require.Len(t, response.Entries, 2)
+	assert.Equal(t, int64(2), response.Entries[0].ID)
+	assert.Equal(t, sync.TriggerAPI, response.Entries[0].Trigger)
+
+	req, err = http.NewRequest("GET", "/api/sync/history?limit=abc", nil)
+	require.NoError(t, err)
+	rr = httptest.NewRecorder()
+	server.SyncHistoryHandler(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestSyncEventsHandler(t *testing.T) {
+	server := createTestServer()
+	ts := httptest.NewServer(http.HandlerFunc(server.SyncEventsHandler))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	reader := bufio.NewReader(resp.Body)
+	line, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, ": connected\n", line, "the stream is subscribed once the comment arrives")
+
+	go server.GetCoordinator().Submit(context.Background(), sync.SyncOptions{Trigger: sync.TriggerAPI})
+
+	var types []string
+	for {
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		if eventType, ok := strings.CutPrefix(line, "event: "); ok {
+			types = append(types, strings.TrimSpace(eventType))
+			continue
+		}
+		if data, ok := strings.CutPrefix(line, "data: "); ok {
+			var event sync.Event
+			require.NoError(t, json.Unmarshal([]byte(data), &event))
+			assert.Equal(t, types[len(types)-1], event.Type)
+			if event.Type == sync.EventSyncFinished {
+				assert.NotEmpty(t, event.Error, "the test hosts are unreachable")
+				break
+			}
+		}
+	}
+	assert.Equal(t, sync.EventSyncStarted, types[0])
+}
+
+func TestClusters(t *testing.T) {
+	cfg := &config.Config{
+		Clusters: []config.ClusterConfig{
+			{Name: "home", Master: config.MasterConfig{Host: "http://home-master.local"},
+				Slaves: []config.SlaveConfig{{Host: "http://home-slave.local"}}},
+			{Name: "office", Master: config.MasterConfig{Host: "http://office-master.local"},
+				Slaves: []config.SlaveConfig{{Host: "http://office-slave.local"}}},
+		},
+	}
+	server := NewServer(context.Background(), cfg, pihole.NewPool(), nil)
+
+	req, err := http.NewRequest("GET", "/api/clusters", nil)
+	require.NoError(t, err)
+	rr := httptest.NewRecorder()
+	server.ClustersHandler(rr, req)
+
+	require.Equal(t, http.StatusOK, rr.Code)
+	var response struct {
+		Clusters []ClusterSummary `json:"clusters"`
+	}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+	require.Len(t, response.Clusters, 2)
+	assert.Equal(t, "home", response.Clusters[0].Name)
+	assert.Equal(t, "office", response.Clusters[1].Name)
+	assert.Equal(t, []string{"http://office-slave.local"}, response.Clusters[1].Slaves)
+
+	master := func(query string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", "/api/master"+query, nil)
+		require.NoError(t, err)
+		rr := httptest.NewRecorder()
+		server.MasterHandler(rr, req)
+		return rr
+	}
+
+	// Requests without a cluster go to the first one
+	var status sync.MasterStatus
+	rr = master("")
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &status))
+	assert.Equal(t, "http://home-master.local", status.Active)
+
+	rr = master("?cluster=office")
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &status))
+	assert.Equal(t, "http://office-master.local", status.Active)
+
+	assert.Equal(t, http.StatusNotFound, master("?cluster=unknown").Code)
+
+	// Every cluster publishes to the shared bus, tagged with its name
+	events, unsubscribe := server.events.Subscribe()
+	defer unsubscribe()
+	_, _, err = server.clusters[1].Coordinator().Submit(context.Background(), sync.SyncOptions{Trigger: sync.TriggerAPI})
+	assert.Error(t, err, "the test hosts are unreachable")
+	event := <-events
+	assert.Equal(t, sync.EventSyncStarted, event.Type)
+	assert.Equal(t, "office", event.Cluster)
+}
@@ -3,9 +3,14 @@ package config
 import (
 	"fmt"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"time"
 
 	"gopkg.in/yaml.v3"
+
+	"github.com/arimakouyou/pihole-sync/internal/pihole"
 )
 
 type Config struct {
@@ -17,17 +22,334 @@ type Config struct {
 	SyncRetry   SyncRetry     `yaml:"sync_retry"`
 	Gravity     []string      `yaml:"gravity"`
 	Metrics     MetricsConfig `yaml:"metrics"`
+	Drift       DriftConfig   `yaml:"drift_detection"`
+	History     HistoryConfig `yaml:"history"`
+	// SyncParallelism controls how slaves are synced concurrently
+	SyncParallelism SyncParallelism `yaml:"sync_parallelism"`
+	// CircuitBreaker skips slaves that keep failing
+	CircuitBreaker CircuitBreakerConfig `yaml:"circuit_breaker"`
+	// Failover promotes a standby master when Master is down
+	Failover FailoverConfig `yaml:"failover"`
+	// MultiMaster merges changes made on any instance instead of copying
+	// the master
+	MultiMaster MultiMasterConfig `yaml:"multi_master"`
+	// Rollout syncs a canary slave first and the others in waves, each
+	// gated on health checks
+	Rollout RolloutConfig `yaml:"rollout"`
+	// Clusters, if set, run several independent clusters in this process
+	// instead of the top-level Master and Slaves
+	Clusters []ClusterConfig `yaml:"clusters,omitempty"`
+
+	// Cluster names the cluster of a config returned by ClusterConfigs
+	Cluster string `yaml:"-"`
+	// dir is the absolute directory of the file the config was loaded
+	// from, where files without a configured path are kept
+	dir string
 }
 
 type MasterConfig struct {
-	Host     string `yaml:"host"`
-	Password string `yaml:"password"`
+	Host       string        `yaml:"host"`
+	Password   string        `yaml:"password"`
+	TOTPSecret string        `yaml:"totp_secret,omitempty"`
+	Timeout    time.Duration `yaml:"timeout,omitempty"`
+	TLS        TLSConfig     `yaml:"tls,omitempty"`
 }
 
 type SlaveConfig struct {
-	Host      string    `yaml:"host"`
-	Password  string    `yaml:"password"`
+	Host       string        `yaml:"host"`
+	Password   string        `yaml:"password"`
+	TOTPSecret string        `yaml:"totp_secret,omitempty"`
+	Timeout    time.Duration `yaml:"timeout,omitempty"`
+	TLS        TLSConfig     `yaml:"tls,omitempty"`
+	// Strategy selects how this slave is synced: "teleporter" (default)
+	// restores the master's backup, "api" applies only the differences.
+	Strategy string `yaml:"strategy,omitempty"`
+	// SyncItems selects what this slave receives from its upstream
 	SyncItems SyncItems `yaml:"sync_items"`
+	// Upstream, if set, is the host of another slave this slave is synced
+	// from instead of the master, which makes that slave a relay
+	Upstream string `yaml:"upstream,omitempty"`
+}
+
+// Sync strategies for SlaveConfig.Strategy
+const (
+	StrategyTeleporter = "teleporter"
+	StrategyAPI        = "api"
+)
+
+// SyncStrategy returns the configured strategy, defaulting to Teleporter.
+func (s SlaveConfig) SyncStrategy() string {
+	if s.Strategy == "" {
+		return StrategyTeleporter
+	}
+	return s.Strategy
+}
+
+// TLSConfig holds the HTTPS settings for connecting to a Pi-hole
+type TLSConfig struct {
+	CAFile             string `yaml:"ca_file,omitempty"`
+	Fingerprint        string `yaml:"fingerprint,omitempty"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify,omitempty"`
+	CertFile           string `yaml:"cert_file,omitempty"`
+	KeyFile            string `yaml:"key_file,omitempty"`
+}
+
+func (t TLSConfig) options() pihole.TLSOptions {
+	return pihole.TLSOptions{
+		CAFile:             t.CAFile,
+		Fingerprint:        t.Fingerprint,
+		InsecureSkipVerify: t.InsecureSkipVerify,
+		CertFile:           t.CertFile,
+		KeyFile:            t.KeyFile,
+	}
+}
+
+// ClientOptions returns the Pi-hole client settings for the master.
+func (m MasterConfig) ClientOptions() pihole.ClientOptions {
+	return pihole.ClientOptions{
+		Password:   m.Password,
+		TOTPSecret: m.TOTPSecret,
+		Timeout:    m.Timeout,
+		TLS:        m.TLS.options(),
+	}
+}
+
+// ClientOptions returns the Pi-hole client settings for the slave.
+func (s SlaveConfig) ClientOptions() pihole.ClientOptions {
+	return pihole.ClientOptions{
+		Password:   s.Password,
+		TOTPSecret: s.TOTPSecret,
+		Timeout:    s.Timeout,
+		TLS:        s.TLS.options(),
+	}
+}
+
+// Hosts returns the master, failover candidate and slave hosts of every
+// cluster in configuration order.
+func (c *Config) Hosts() []string {
+	var hosts []string
+	for _, cluster := range c.ClusterConfigs() {
+		for _, candidate := range cluster.MasterCandidates() {
+			hosts = append(hosts, candidate.Host)
+		}
+		for _, slave := range cluster.Slaves {
+			hosts = append(hosts, slave.Host)
+		}
+	}
+	return hosts
+}
+
+// DefaultClusterName names the single cluster of a config without Clusters
+const DefaultClusterName = "default"
+
+// ClusterConfig is one independent sync cluster. The optional sections
+// override the top-level settings of the same name for this cluster; the
+// others (logging, metrics, history, parallelism, ...) are shared.
+type ClusterConfig struct {
+	Name           string                `yaml:"name"`
+	Master         MasterConfig          `yaml:"master"`
+	Slaves         []SlaveConfig         `yaml:"slaves"`
+	SyncTrigger    *SyncTrigger          `yaml:"sync_trigger,omitempty"`
+	SyncRetry      *SyncRetry            `yaml:"sync_retry,omitempty"`
+	Slack          *Slack                `yaml:"slack,omitempty"`
+	CircuitBreaker *CircuitBreakerConfig `yaml:"circuit_breaker,omitempty"`
+	Failover       *FailoverConfig       `yaml:"failover,omitempty"`
+	MultiMaster    *MultiMasterConfig    `yaml:"multi_master,omitempty"`
+	Drift          *DriftConfig          `yaml:"drift_detection,omitempty"`
+	Rollout        *RolloutConfig        `yaml:"rollout,omitempty"`
+}
+
+// ClusterName returns the name of the cluster c configures.
+func (c *Config) ClusterName() string {
+	if c.Cluster == "" {
+		return DefaultClusterName
+	}
+	return c.Cluster
+}
+
+// ClusterConfigs returns one config per cluster, in configuration order,
+// with the cluster's settings merged over the top-level ones. Without
+// Clusters it is a copy of c named DefaultClusterName. Unless its own
+// multi_master section sets state_path, each cluster keeps its multi-master
+// state next to the top-level state file, with "-<name>" added to its name.
+func (c *Config) ClusterConfigs() []*Config {
+	if len(c.Clusters) == 0 {
+		cluster := *c
+		cluster.Cluster = DefaultClusterName
+		return []*Config{&cluster}
+	}
+
+	clusters := make([]*Config, 0, len(c.Clusters))
+	for _, override := range c.Clusters {
+		cluster := *c
+		cluster.Clusters = nil
+		cluster.Cluster = override.Name
+		cluster.Master = override.Master
+		cluster.Slaves = override.Slaves
+		if override.SyncTrigger != nil {
+			cluster.SyncTrigger = *override.SyncTrigger
+		}
+		if override.SyncRetry != nil {
+			cluster.SyncRetry = *override.SyncRetry
+		}
+		if override.Slack != nil {
+			cluster.Slack = *override.Slack
+		}
+		if override.CircuitBreaker != nil {
+			cluster.CircuitBreaker = *override.CircuitBreaker
+		}
+		if override.Failover != nil {
+			cluster.Failover = *override.Failover
+		}
+		if override.MultiMaster != nil {
+			cluster.MultiMaster = *override.MultiMaster
+		}
+		if override.Drift != nil {
+			cluster.Drift = *override.Drift
+		}
+		if override.Rollout != nil {
+			cluster.Rollout = *override.Rollout
+		}
+		if override.MultiMaster == nil || override.MultiMaster.StatePath == "" {
+			cluster.MultiMaster.StatePath = clusterStatePath(c.MultiMasterStatePath(), override.Name)
+		}
+		clusters = append(clusters, &cluster)
+	}
+	return clusters
+}
+
+// clusterStatePath derives the state file of cluster name from the shared
+// path, e.g. /data/state.json becomes /data/state-home.json.
+func clusterStatePath(path, name string) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "-" + name + ext
+}
+
+// SlaveTiers groups the indexes of the slaves by their distance from the
+// master: the first tier is synced from the master, every further tier from
+// relays in the tier before it. An upstream naming the master counts as
+// none. It fails if an upstream is not a slave or the upstreams form a
+// cycle.
+func (c *Config) SlaveTiers() ([][]int, error) {
+	index := make(map[string]int)
+	for i, slave := range c.Slaves {
+		if _, ok := index[slave.Host]; !ok {
+			index[slave.Host] = i
+		}
+	}
+
+	// depth[i] is the tier of slave i, -1 while it is being resolved
+	depth := make([]int, len(c.Slaves))
+	resolved := make([]bool, len(c.Slaves))
+	var resolve func(i int, path []string) error
+	resolve = func(i int, path []string) error {
+		if resolved[i] {
+			if depth[i] < 0 {
+				// Leave out the slaves leading into the cycle
+				cycle := path[slices.Index(path, c.Slaves[i].Host):]
+				return fmt.Errorf("relay cycle: %s", strings.Join(append(cycle, c.Slaves[i].Host), " -> "))
+			}
+			return nil
+		}
+		resolved[i] = true
+		depth[i] = -1
+
+		upstream := c.Slaves[i].Upstream
+		if upstream == "" || upstream == c.Master.Host {
+			depth[i] = 0
+			return nil
+		}
+		parent, ok := index[upstream]
+		if !ok {
+			return fmt.Errorf("upstream %q of slave %s is not a slave", upstream, c.Slaves[i].Host)
+		}
+		if err := resolve(parent, append(path, c.Slaves[i].Host)); err != nil {
+			return err
+		}
+		depth[i] = depth[parent] + 1
+		return nil
+	}
+
+	var tiers [][]int
+	for i := range c.Slaves {
+		if err := resolve(i, nil); err != nil {
+			return nil, err
+		}
+		for len(tiers) <= depth[i] {
+			tiers = append(tiers, nil)
+		}
+		tiers[depth[i]] = append(tiers[depth[i]], i)
+	}
+	return tiers, nil
+}
+
+// validateTopology checks the relay topology and the rollout canary of
+// every cluster.
+func (c *Config) validateTopology() error {
+	for _, cluster := range c.ClusterConfigs() {
+		err := cluster.validateRollout()
+		if err == nil {
+			err = cluster.validateStrategies()
+		}
+		if err == nil {
+			err = cluster.MultiMaster.validate()
+		}
+		if err == nil {
+			_, err = cluster.SlaveTiers()
+		}
+		if err != nil {
+			if len(c.Clusters) == 0 {
+				return err
+			}
+			return fmt.Errorf("cluster %q: %w", cluster.ClusterName(), err)
+		}
+	}
+	return nil
+}
+
+// validateRollout checks that the rollout canary is a slave synced from the
+// master.
+func (c *Config) validateRollout() error {
+	if !c.Rollout.Enabled || c.Rollout.Canary == "" {
+		return nil
+	}
+	for _, slave := range c.Slaves {
+		if slave.Host != c.Rollout.Canary {
+			continue
+		}
+		if slave.Upstream != "" && slave.Upstream != c.Master.Host {
+			return fmt.Errorf("rollout canary %s is synced from a relay, not the master", slave.Host)
+		}
+		return nil
+	}
+	return fmt.Errorf("rollout canary %s is not a slave", c.Rollout.Canary)
+}
+
+// validateStrategies checks that every slave names a known sync strategy.
+func (c *Config) validateStrategies() error {
+	for _, slave := range c.Slaves {
+		switch slave.Strategy {
+		case "", StrategyTeleporter, StrategyAPI:
+		default:
+			return fmt.Errorf("slave %s has unknown strategy %q", slave.Host, slave.Strategy)
+		}
+	}
+	return nil
+}
+
+// validateClusters checks that every cluster has a unique name.
+func (c *Config) validateClusters() error {
+	names := make(map[string]bool)
+	for i, cluster := range c.Clusters {
+		if cluster.Name == "" {
+			return fmt.Errorf("cluster %d has no name", i+1)
+		}
+		if names[cluster.Name] {
+			return fmt.Errorf("duplicate cluster name %q", cluster.Name)
+		}
+		names[cluster.Name] = true
+	}
+	return nil
 }
 
 type SyncItems struct {
@@ -40,6 +362,14 @@ type SyncItems struct {
 	DHCP       bool `yaml:"dhcp"`
 	Clients    bool `yaml:"clients"`
 	Settings   bool `yaml:"settings"`
+
+	// Teleporter-only tables that follow the item they belong to unless set:
+	// the group assignments of adlists, domains (blacklist, whitelist and
+	// regex) and clients, and the active DHCP leases.
+	AdlistByGroup     *bool `yaml:"adlist_by_group,omitempty"`
+	DomainlistByGroup *bool `yaml:"domainlist_by_group,omitempty"`
+	ClientByGroup     *bool `yaml:"client_by_group,omitempty"`
+	DHCPLeases        *bool `yaml:"dhcp_leases,omitempty"`
 }
 
 type SyncTrigger struct {
@@ -59,9 +389,160 @@ type Slack struct {
 	NotifyOnError bool   `yaml:"notify_on_error"`
 }
 
+// Defaults for the SyncRetry backoff fields
+const (
+	DefaultInitialBackoff    = time.Second
+	DefaultMaxBackoff        = 30 * time.Second
+	DefaultBackoffMultiplier = 2.0
+	DefaultBackoffJitter     = 0.2
+)
+
+// SyncRetry controls retries of transient slave errors. The wait before the
+// n-th retry is InitialBackoff * Multiplier^(n-1), capped at MaxBackoff and
+// randomized by ±Jitter (a fraction of the wait). Jitter defaults to
+// DefaultBackoffJitter when unset; 0 turns the randomization off.
 type SyncRetry struct {
+	Enabled        bool          `yaml:"enabled"`
+	Count          int           `yaml:"count"`
+	InitialBackoff time.Duration `yaml:"initial_backoff"`
+	MaxBackoff     time.Duration `yaml:"max_backoff"`
+	Multiplier     float64       `yaml:"multiplier"`
+	Jitter         *float64      `yaml:"jitter,omitempty"`
+}
+
+// Defaults for CircuitBreakerConfig
+const (
+	DefaultBreakerFailureThreshold = 3
+	DefaultBreakerCooldown         = 5 * time.Minute
+)
+
+// CircuitBreakerConfig skips slaves that keep failing. After FailureThreshold
+// consecutive failed syncs a slave is skipped for Cooldown; the first sync
+// after that is a trial that either closes the breaker or reopens it.
+type CircuitBreakerConfig struct {
+	Enabled          bool          `yaml:"enabled"`
+	FailureThreshold int           `yaml:"failure_threshold"`
+	Cooldown         time.Duration `yaml:"cooldown"`
+}
+
+// DefaultFailoverMaxStaleness is used when FailoverConfig.MaxStaleness is unset
+const DefaultFailoverMaxStaleness = 24 * time.Hour
+
+// FailoverConfig lists standby masters that take over, in priority order,
+// when Master fails its health check. A standby is only promoted if it
+// matched the active master within MaxStaleness, which it does when it is
+// also configured as a slave, so an instance with outdated data never
+// becomes the sync source.
+type FailoverConfig struct {
+	Enabled      bool           `yaml:"enabled"`
+	Candidates   []MasterConfig `yaml:"candidates"`
+	MaxStaleness time.Duration  `yaml:"max_staleness"`
+}
+
+// MasterCandidates returns Master followed by the failover candidates, in
+// priority order. Without failover only Master is returned.
+func (c *Config) MasterCandidates() []MasterConfig {
+	candidates := []MasterConfig{c.Master}
+	if c.Failover.Enabled {
+		candidates = append(candidates, c.Failover.Candidates...)
+	}
+	return candidates
+}
+
+// Conflict policies for MultiMasterConfig.ConflictPolicy
+const (
+	ConflictLastWriterWins = "last_writer_wins"
+	ConflictMasterWins     = "master_wins"
+	ConflictUnion          = "union"
+)
+
+// DefaultMultiMasterStatePath is used, next to the configuration file, when
+// MultiMasterConfig.StatePath is unset
+const DefaultMultiMasterStatePath = "multi-master-state.json"
+
+// MultiMasterConfig turns on bidirectional sync: the changes made on the
+// master and on every slave since the last sync are merged, and the merged
+// state is written to all of them. Only the items the API can write are
+// merged (adlists, blacklist, whitelist, regex, groups and clients); the
+// slaves' own sync_items and strategy are not used in this mode. The last
+// merged state is kept at StatePath so that deletions are recognized after
+// a restart.
+type MultiMasterConfig struct {
 	Enabled bool `yaml:"enabled"`
-	Count   int  `yaml:"count"`
+	// ConflictPolicy resolves entries changed differently on several
+	// instances: last_writer_wins (default), master_wins or union
+	ConflictPolicy string    `yaml:"conflict_policy"`
+	SyncItems      SyncItems `yaml:"sync_items"`
+	StatePath      string    `yaml:"state_path"`
+}
+
+// validate checks that the conflict policy is a known one.
+func (m MultiMasterConfig) validate() error {
+	switch m.ConflictPolicy {
+	case "", ConflictLastWriterWins, ConflictMasterWins, ConflictUnion:
+		return nil
+	default:
+		return fmt.Errorf("unknown multi_master conflict_policy %q", m.ConflictPolicy)
+	}
+}
+
+// MultiMasterStatePath returns where the last merged state is kept: the
+// configured state_path, or DefaultMultiMasterStatePath in the directory of
+// the configuration file so that it does not depend on the working
+// directory.
+func (c *Config) MultiMasterStatePath() string {
+	if c.MultiMaster.StatePath != "" {
+		return c.MultiMaster.StatePath
+	}
+	return filepath.Join(c.dir, DefaultMultiMasterStatePath)
+}
+
+// Policy returns the configured conflict policy, defaulting to
+// last-writer-wins.
+func (m MultiMasterConfig) Policy() string {
+	if m.ConflictPolicy == "" {
+		return ConflictLastWriterWins
+	}
+	return m.ConflictPolicy
+}
+
+// Defaults for RolloutHealthCheck
+const (
+	DefaultRolloutTestDomain = "pi.hole"
+	DefaultRolloutDNSPort    = 53
+	DefaultRolloutTimeout    = 5 * time.Second
+)
+
+// RolloutConfig stages every sync of the slaves synced from the master: the
+// canary slave is synced first, then the others in waves of WaveSize (all
+// at once if zero), waiting WaveInterval between waves. After each wave the
+// synced slaves are health checked; a wave that fails halts the rollout.
+// Canary defaults to the first slave.
+type RolloutConfig struct {
+	Enabled      bool               `yaml:"enabled"`
+	Canary       string             `yaml:"canary,omitempty"`
+	WaveSize     int                `yaml:"wave_size"`
+	WaveInterval time.Duration      `yaml:"wave_interval"`
+	HealthCheck  RolloutHealthCheck `yaml:"health_check"`
+}
+
+// RolloutHealthCheck is what a slave must pass after a rollout sync: its API
+// answers, blocking is enabled and its DNS server on DNSPort resolves
+// TestDomain, each within Timeout.
+type RolloutHealthCheck struct {
+	TestDomain string        `yaml:"test_domain"`
+	DNSPort    int           `yaml:"dns_port"`
+	Timeout    time.Duration `yaml:"timeout"`
+}
+
+// DefaultMaxConcurrentSlaves is used when SyncParallelism.MaxConcurrent is unset
+const DefaultMaxConcurrentSlaves = 4
+
+// SyncParallelism bounds concurrent slave syncs. SlaveTimeout limits the time
+// spent on one slave, retries included; zero means no limit.
+type SyncParallelism struct {
+	MaxConcurrent int           `yaml:"max_concurrent"`
+	SlaveTimeout  time.Duration `yaml:"slave_timeout"`
 }
 
 type MetricsConfig struct {
@@ -74,6 +555,24 @@ type MetricsConfig struct {
 	TopItemsLimit      int           `yaml:"top_items_limit"`
 }
 
+// DriftConfig controls the background comparison of master and slaves.
+type DriftConfig struct {
+	Enabled  bool          `yaml:"enabled"`
+	Interval time.Duration `yaml:"interval"`
+	// PersistChecks is how many consecutive checks must find a slave drifted
+	// before AutoSync or Alert fire.
+	PersistChecks int  `yaml:"persist_checks"`
+	AutoSync      bool `yaml:"auto_sync"`
+	Alert         bool `yaml:"alert"`
+}
+
+// HistoryConfig controls where sync runs are persisted. It is read once at
+// startup.
+type HistoryConfig struct {
+	Path       string `yaml:"path"`
+	MaxEntries int    `yaml:"max_entries"`
+}
+
 func LoadConfig(path string) (*Config, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
@@ -84,6 +583,15 @@ func LoadConfig(path string) (*Config, error) {
 	if err := yaml.Unmarshal(data, &config); err != nil {
 		return nil, fmt.Errorf("failed to parse config file: %w", err)
 	}
+	if err := config.validateClusters(); err != nil {
+		return nil, fmt.Errorf("invalid config file: %w", err)
+	}
+	if err := config.validateTopology(); err != nil {
+		return nil, fmt.Errorf("invalid config file: %w", err)
+	}
+	if dir, err := filepath.Abs(filepath.Dir(path)); err == nil {
+		config.dir = dir
+	}
 
 	return &config, nil
 }
@@ -3,7 +3,9 @@ package config
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -259,6 +261,117 @@ sync_retry:
 	}
 }
 
+func TestSyncRetryBackoffAndCircuitBreaker(t *testing.T) {
+	configData := `
+master:
+  host: "http://test-master.local"
+  password: "test-master-password"
+sync_retry:
+  enabled: true
+  count: 5
+  initial_backoff: "500ms"
+  max_backoff: "1m"
+  multiplier: 1.5
+  jitter: 0.3
+circuit_breaker:
+  enabled: true
+  failure_threshold: 4
+  cooldown: "10m"
+`
+	tmpFile, err := os.CreateTemp("", "config-test-*.yaml")
+	require.NoError(t, err)
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.WriteString(configData)
+	require.NoError(t, err)
+	tmpFile.Close()
+
+	config, err := LoadConfig(tmpFile.Name())
+	require.NoError(t, err)
+
+	jitter := 0.3
+	assert.Equal(t, SyncRetry{
+		Enabled:        true,
+		Count:          5,
+		InitialBackoff: 500 * time.Millisecond,
+		MaxBackoff:     time.Minute,
+		Multiplier:     1.5,
+		Jitter:         &jitter,
+	}, config.SyncRetry)
+	assert.Equal(t, CircuitBreakerConfig{Enabled: true, FailureThreshold: 4, Cooldown: 10 * time.Minute}, config.CircuitBreaker)
+}
+
+func TestFailoverCandidates(t *testing.T) {
+	configData := `
+master:
+  host: "http://test-master.local"
+  password: "test-master-password"
+slaves:
+  - host: "http://test-slave.local"
+    password: "test-slave-password"
+failover:
+  enabled: true
+  max_staleness: "2h"
+  candidates:
+    - host: "http://test-standby.local"
+      password: "test-standby-password"
+`
+	tmpFile, err := os.CreateTemp("", "config-test-*.yaml")
+	require.NoError(t, err)
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.WriteString(configData)
+	require.NoError(t, err)
+	tmpFile.Close()
+
+	config, err := LoadConfig(tmpFile.Name())
+	require.NoError(t, err)
+
+	assert.Equal(t, 2*time.Hour, config.Failover.MaxStaleness)
+	candidates := config.MasterCandidates()
+	require.Len(t, candidates, 2)
+	assert.Equal(t, "http://test-master.local", candidates[0].Host)
+	assert.Equal(t, "test-standby-password", candidates[1].Password)
+	assert.Equal(t, []string{"http://test-master.local", "http://test-standby.local", "http://test-slave.local"}, config.Hosts())
+
+	config.Failover.Enabled = false
+	assert.Len(t, config.MasterCandidates(), 1, "candidates are ignored without failover")
+}
+
+func TestSyncItemsTeleporterOverrides(t *testing.T) {
+	configData := `
+master:
+  host: "http://test-master.local"
+  password: "test-master-password"
+slaves:
+  - host: "http://test-slave.local"
+    password: "test-slave-password"
+    sync_items:
+      adlists: true
+      clients: true
+      adlist_by_group: false
+      dhcp_leases: true
+`
+	tmpFile, err := os.CreateTemp("", "config-test-*.yaml")
+	require.NoError(t, err)
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.WriteString(configData)
+	require.NoError(t, err)
+	tmpFile.Close()
+
+	config, err := LoadConfig(tmpFile.Name())
+	require.NoError(t, err)
+
+	items := config.Slaves[0].SyncItems
+	require.NotNil(t, items.AdlistByGroup)
+	assert.False(t, *items.AdlistByGroup)
+	require.NotNil(t, items.DHCPLeases)
+	assert.True(t, *items.DHCPLeases)
+	assert.Nil(t, items.ClientByGroup, "unset overrides follow their item")
+	assert.Nil(t, items.DomainlistByGroup)
+}
+
 func TestEmptyMasterFields(t *testing.T) {
 	configData := `
 master:
@@ -455,3 +568,303 @@ func TestSaveConfigFilePermissions(t *testing.T) {
 	assert.True(t, actualPerms&0644 == 0644 || actualPerms == 0600,
 		"File permissions should be 0644 or 0600, got %o", actualPerms)
 }
+
+func TestLoadConfigClientOptions(t *testing.T) {
+	configData := `
+master:
+  host: "http://test-master.local"
+  password: "master-password"
+  totp_secret: "JBSWY3DPEHPK3PXP"
+  timeout: "5s"
+slaves:
+  - host: "http://test-slave.local"
+    password: "slave-password"
+`
+	tmpFile, err := os.CreateTemp("", "config-test-*.yaml")
+	require.NoError(t, err)
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.WriteString(configData)
+	require.NoError(t, err)
+	tmpFile.Close()
+
+	config, err := LoadConfig(tmpFile.Name())
+	require.NoError(t, err)
+
+	masterOpts := config.Master.ClientOptions()
+	assert.Equal(t, "master-password", masterOpts.Password)
+	assert.Equal(t, "JBSWY3DPEHPK3PXP", masterOpts.TOTPSecret)
+	assert.Equal(t, 5*time.Second, masterOpts.Timeout)
+
+	slaveOpts := config.Slaves[0].ClientOptions()
+	assert.Equal(t, "slave-password", slaveOpts.Password)
+	assert.Empty(t, slaveOpts.TOTPSecret)
+	assert.Zero(t, slaveOpts.Timeout)
+}
+
+func TestMultiMasterConfig(t *testing.T) {
+	configData := `
+master:
+  host: "http://test-master.local"
+  password: "test-master-password"
+multi_master:
+  enabled: true
+  conflict_policy: "union"
+  state_path: "/tmp/merged.json"
+  sync_items:
+    blacklist: true
+    groups: true
+`
+	tmpFile, err := os.CreateTemp("", "config-test-*.yaml")
+	require.NoError(t, err)
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.WriteString(configData)
+	require.NoError(t, err)
+	tmpFile.Close()
+
+	config, err := LoadConfig(tmpFile.Name())
+	require.NoError(t, err)
+
+	assert.True(t, config.MultiMaster.Enabled)
+	assert.Equal(t, ConflictUnion, config.MultiMaster.Policy())
+	assert.Equal(t, "/tmp/merged.json", config.MultiMaster.StatePath)
+	assert.True(t, config.MultiMaster.SyncItems.Groups)
+	assert.False(t, config.MultiMaster.SyncItems.Whitelist)
+
+	assert.Equal(t, ConflictLastWriterWins, MultiMasterConfig{}.Policy())
+}
+
+func TestMultiMasterStatePathDefault(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("multi_master:\n  enabled: true\n"), 0644))
+
+	config, err := LoadConfig(path)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, DefaultMultiMasterStatePath), config.MultiMasterStatePath(), "the state is kept next to the config file")
+	assert.Empty(t, config.MultiMaster.StatePath, "the default is not written back to the config")
+
+	config.MultiMaster.StatePath = "/var/lib/pihole-sync/state.json"
+	assert.Equal(t, "/var/lib/pihole-sync/state.json", config.MultiMasterStatePath())
+}
+
+func TestClusterConfigs(t *testing.T) {
+	configData := `
+sync_trigger:
+  schedule: "0 * * * *"
+slack:
+  webhook_url: "https://hooks.slack.com/shared"
+clusters:
+  - name: "home"
+    master:
+      host: "http://home-master.local"
+    slaves:
+      - host: "http://home-slave.local"
+  - name: "office"
+    master:
+      host: "http://office-master.local"
+    slaves:
+      - host: "http://office-slave.local"
+    sync_trigger:
+      schedule: "*/5 * * * *"
+    slack:
+      webhook_url: "https://hooks.slack.com/office"
+    multi_master:
+      enabled: true
+`
+	tmpFile, err := os.CreateTemp("", "config-test-*.yaml")
+	require.NoError(t, err)
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.WriteString(configData)
+	require.NoError(t, err)
+	tmpFile.Close()
+
+	config, err := LoadConfig(tmpFile.Name())
+	require.NoError(t, err)
+
+	clusters := config.ClusterConfigs()
+	require.Len(t, clusters, 2)
+
+	home, office := clusters[0], clusters[1]
+	assert.Equal(t, "home", home.ClusterName())
+	assert.Equal(t, "http://home-master.local", home.Master.Host)
+	assert.Equal(t, "0 * * * *", home.SyncTrigger.Schedule)
+	assert.Equal(t, "https://hooks.slack.com/shared", home.Slack.WebhookURL)
+	assert.Equal(t, filepath.Join(filepath.Dir(tmpFile.Name()), "multi-master-state-home.json"), home.MultiMaster.StatePath)
+	assert.Empty(t, home.Clusters)
+
+	assert.Equal(t, "office", office.ClusterName())
+	assert.Equal(t, "*/5 * * * *", office.SyncTrigger.Schedule)
+	assert.Equal(t, "https://hooks.slack.com/office", office.Slack.WebhookURL)
+	assert.True(t, office.MultiMaster.Enabled)
+	assert.Equal(t, filepath.Join(filepath.Dir(tmpFile.Name()), "multi-master-state-office.json"), office.MultiMaster.StatePath)
+
+	// A top-level state_path is shared out per cluster
+	config.MultiMaster.StatePath = "/var/lib/pihole-sync/state.json"
+	clusters = config.ClusterConfigs()
+	assert.Equal(t, "/var/lib/pihole-sync/state-home.json", clusters[0].MultiMaster.StatePath)
+	assert.Equal(t, "/var/lib/pihole-sync/state-office.json", clusters[1].MultiMaster.StatePath)
+	config.Clusters[1].MultiMaster.StatePath = "/data/office.json"
+	assert.Equal(t, "/data/office.json", config.ClusterConfigs()[1].MultiMaster.StatePath)
+
+	assert.Equal(t, []string{"http://home-master.local", "http://home-slave.local",
+		"http://office-master.local", "http://office-slave.local"}, config.Hosts())
+
+	// Without clusters the top-level settings form the default cluster
+	single := &Config{Master: MasterConfig{Host: "http://master.local"}}
+	clusters = single.ClusterConfigs()
+	require.Len(t, clusters, 1)
+	assert.Equal(t, DefaultClusterName, clusters[0].ClusterName())
+	assert.Equal(t, "http://master.local", clusters[0].Master.Host)
+	assert.Empty(t, clusters[0].MultiMaster.StatePath)
+}
+
+func TestClusterConfigValidation(t *testing.T) {
+	tests := []struct {
+		name     string
+		clusters []ClusterConfig
+		err      string
+	}{
+		{"missing name", []ClusterConfig{{Name: "home"}, {}}, "cluster 2 has no name"},
+		{"duplicate name", []ClusterConfig{{Name: "home"}, {Name: "home"}}, `duplicate cluster name "home"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{Clusters: tt.clusters}
+			assert.EqualError(t, config.validateClusters(), tt.err)
+		})
+	}
+}
+
+func TestSlaveTiers(t *testing.T) {
+	config := &Config{
+		Master: MasterConfig{Host: "http://a-master"},
+		Slaves: []SlaveConfig{
+			{Host: "http://b-slave1", Upstream: "http://b-relay"},
+			{Host: "http://b-relay"},
+			{Host: "http://a-slave", Upstream: "http://a-master"},
+			{Host: "http://c-slave", Upstream: "http://b-slave1"},
+		},
+	}
+	tiers, err := config.SlaveTiers()
+	require.NoError(t, err)
+	assert.Equal(t, [][]int{{1, 2}, {0}, {3}}, tiers)
+
+	tests := []struct {
+		name   string
+		slaves []SlaveConfig
+		err    string
+	}{
+		{
+			"unknown upstream",
+			[]SlaveConfig{{Host: "http://b-slave", Upstream: "http://b-relay"}},
+			`upstream "http://b-relay" of slave http://b-slave is not a slave`,
+		},
+		{
+			"self",
+			[]SlaveConfig{{Host: "http://b-relay", Upstream: "http://b-relay"}},
+			"relay cycle: http://b-relay -> http://b-relay",
+		},
+		{
+			"cycle",
+			[]SlaveConfig{
+				{Host: "http://b-slave", Upstream: "http://b-relay"},
+				{Host: "http://b-relay", Upstream: "http://c-relay"},
+				{Host: "http://c-relay", Upstream: "http://b-relay"},
+			},
+			"relay cycle: http://b-relay -> http://c-relay -> http://b-relay",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{Master: MasterConfig{Host: "http://a-master"}, Slaves: tt.slaves}
+			_, err := config.SlaveTiers()
+			assert.EqualError(t, err, tt.err)
+		})
+	}
+}
+
+func TestLoadConfigRejectsRelayCycle(t *testing.T) {
+	configData := `
+master:
+  host: "http://a-master"
+clusters:
+  - name: "office"
+    master:
+      host: "http://b-master"
+    slaves:
+      - host: "http://b-relay"
+        upstream: "http://b-slave"
+      - host: "http://b-slave"
+        upstream: "http://b-relay"
+`
+	tmpFile, err := os.CreateTemp("", "config-test-*.yaml")
+	require.NoError(t, err)
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.WriteString(configData)
+	require.NoError(t, err)
+	tmpFile.Close()
+
+	_, err = LoadConfig(tmpFile.Name())
+	assert.EqualError(t, err, `invalid config file: cluster "office": relay cycle: http://b-relay -> http://b-slave -> http://b-relay`)
+}
+
+func TestRolloutCanaryValidation(t *testing.T) {
+	config := &Config{
+		Master: MasterConfig{Host: "http://a-master"},
+		Slaves: []SlaveConfig{
+			{Host: "http://a-slave", Upstream: "http://a-master"},
+			{Host: "http://b-slave", Upstream: "http://a-slave"},
+		},
+		Rollout: RolloutConfig{Enabled: true, Canary: "http://a-slave"},
+	}
+	assert.NoError(t, config.validateTopology())
+
+	config.Rollout.Canary = "http://b-slave"
+	assert.EqualError(t, config.validateTopology(), "rollout canary http://b-slave is synced from a relay, not the master")
+
+	config.Rollout.Canary = "http://c-slave"
+	assert.EqualError(t, config.validateTopology(), "rollout canary http://c-slave is not a slave")
+}
+
+func TestStrategyValidation(t *testing.T) {
+	config := &Config{
+		Master: MasterConfig{Host: "http://a-master"},
+		Slaves: []SlaveConfig{
+			{Host: "http://a-slave"},
+			{Host: "http://b-slave", Strategy: StrategyAPI},
+		},
+	}
+	assert.NoError(t, config.validateTopology())
+
+	config.Slaves[0].Strategy = "diff"
+	assert.EqualError(t, config.validateTopology(), `slave http://a-slave has unknown strategy "diff"`)
+}
+
+func TestLoadConfigRejectsUnknownConflictPolicy(t *testing.T) {
+	configData := `
+master:
+  host: "http://a-master"
+clusters:
+  - name: "office"
+    master:
+      host: "http://b-master"
+    multi_master:
+      enabled: true
+      conflict_policy: "newest"
+`
+	tmpFile, err := os.CreateTemp("", "config-test-*.yaml")
+	require.NoError(t, err)
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.WriteString(configData)
+	require.NoError(t, err)
+	tmpFile.Close()
+
+	_, err = LoadConfig(tmpFile.Name())
+	assert.EqualError(t, err, `invalid config file: cluster "office": unknown multi_master conflict_policy "newest"`)
+}
@@ -0,0 +1,319 @@
+package history
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	stdSync "sync"
+	"time"
+
+	"github.com/arimakouyou/pihole-sync/internal/config"
+	"github.com/arimakouyou/pihole-sync/internal/sync"
+)
+
+const (
+	// DefaultPath is used when no history path is configured
+	DefaultPath = "sync-history.jsonl"
+	// DefaultMaxEntries is used when no history size is configured
+	DefaultMaxEntries = 1000
+)
+
+// Entry is one recorded sync run.
+type Entry struct {
+	ID int64 `json:"id"`
+	sync.SyncResult
+}
+
+// Store keeps the sync history in a JSON Lines file, one run per line, and
+// in memory for queries. Only the newest maxEntries runs are kept. Runs are
+// appended to the file, which is only rewritten without the older runs once
+// it holds twice as many.
+type Store struct {
+	mu         stdSync.RWMutex
+	path       string
+	maxEntries int
+	entries    []Entry
+	nextID     int64
+	// fileLines counts the lines in the file, including trimmed runs
+	fileLines int
+}
+
+// Open loads the history at path, creating the file on the first Record.
+// Lines that cannot be parsed are skipped.
+func Open(path string, maxEntries int) (*Store, error) {
+	if path == "" {
+		path = DefaultPath
+	}
+	if maxEntries <= 0 {
+		maxEntries = DefaultMaxEntries
+	}
+
+	store := &Store{
+		path:       path,
+		maxEntries: maxEntries,
+		nextID:     1,
+	}
+
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sync history: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		store.fileLines++
+		var entry Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		store.entries = append(store.entries, entry)
+		if entry.ID >= store.nextID {
+			store.nextID = entry.ID + 1
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read sync history: %w", err)
+	}
+
+	if len(store.entries) > maxEntries {
+		store.entries = store.entries[len(store.entries)-maxEntries:]
+	}
+	if store.fileLines > 2*maxEntries {
+		if err := store.rewrite(); err != nil {
+			return nil, err
+		}
+	}
+
+	return store, nil
+}
+
+// Record appends a sync run to the history.
+func (s *Store) Record(result sync.SyncResult) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry := Entry{ID: s.nextID, SyncResult: result}
+	s.nextID++
+	s.entries = append(s.entries, entry)
+
+	if len(s.entries) > s.maxEntries {
+		s.entries = s.entries[len(s.entries)-s.maxEntries:]
+	}
+	if s.fileLines >= 2*s.maxEntries {
+		return s.rewrite()
+	}
+	return s.append(entry)
+}
+
+// LastSyncedAt returns the end time of the newest run, or the zero time.
+func (s *Store) LastSyncedAt() time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.entries) == 0 {
+		return time.Time{}
+	}
+	return s.entries[len(s.entries)-1].SyncedAt
+}
+
+// LastInSync returns the end time of the newest run that host matched the
+// master in, as master or as slave, or the zero time.
+func (s *Store) LastInSync(host string) time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.lastInSync(host, nil)
+}
+
+// lastInSync implements LastInSync over the entries include accepts, or all
+// entries if include is nil. s.mu must be held.
+func (s *Store) lastInSync(host string, include func(Entry) bool) time.Time {
+	for i := len(s.entries) - 1; i >= 0; i-- {
+		entry := s.entries[i]
+		if include != nil && !include(entry) {
+			continue
+		}
+		if entry.Master == host {
+			return entry.SyncedAt
+		}
+		for _, detail := range entry.Details {
+			if detail.Host == host && detail.InSync() {
+				return entry.SyncedAt
+			}
+		}
+	}
+	return time.Time{}
+}
+
+// LastMaster returns the master of the newest run that recorded one and
+// when the runs began syncing from it: the start of the oldest run of the
+// unbroken series from that master. host is "" if no run recorded a master.
+func (s *Store) LastMaster() (host string, since time.Time) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.lastMaster(nil)
+}
+
+// lastMaster implements LastMaster over the entries include accepts, or all
+// entries if include is nil. s.mu must be held.
+func (s *Store) lastMaster(include func(Entry) bool) (host string, since time.Time) {
+	for i := len(s.entries) - 1; i >= 0; i-- {
+		entry := s.entries[i]
+		if (include != nil && !include(entry)) || entry.Master == "" {
+			continue
+		}
+		if host == "" {
+			host = entry.Master
+		} else if entry.Master != host {
+			break
+		}
+		since = entry.StartedAt
+		if since.IsZero() {
+			since = entry.SyncedAt
+		}
+	}
+	return host, since
+}
+
+// List returns up to limit runs, newest first, skipping the newest offset
+// runs, together with the total number of runs.
+func (s *Store) List(offset, limit int) ([]Entry, int) {
+	return s.list(offset, limit, nil)
+}
+
+// list implements List over the entries include accepts, or all entries if
+// include is nil.
+func (s *Store) list(offset, limit int, include func(Entry) bool) ([]Entry, int) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	total := 0
+	entries := []Entry{}
+	for i := len(s.entries) - 1; i >= 0; i-- {
+		if include != nil && !include(s.entries[i]) {
+			continue
+		}
+		if total >= offset && len(entries) < limit {
+			entries = append(entries, s.entries[i])
+		}
+		total++
+	}
+	return entries, total
+}
+
+// Cluster returns a view of the store limited to the runs of the named
+// cluster. Runs recorded before clusters existed belong to the default
+// cluster.
+func (s *Store) Cluster(name string) *ClusterStore {
+	return &ClusterStore{store: s, name: name}
+}
+
+// ClusterStore records the runs of one cluster into a shared Store and
+// answers queries about them only.
+type ClusterStore struct {
+	store *Store
+	name  string
+}
+
+// Record appends a run of the cluster to the history.
+func (c *ClusterStore) Record(result sync.SyncResult) error {
+	result.Cluster = c.name
+	return c.store.Record(result)
+}
+
+// LastSyncedAt returns the end time of the cluster's newest run, or the zero
+// time.
+func (c *ClusterStore) LastSyncedAt() time.Time {
+	c.store.mu.RLock()
+	defer c.store.mu.RUnlock()
+	for i := len(c.store.entries) - 1; i >= 0; i-- {
+		if c.contains(c.store.entries[i]) {
+			return c.store.entries[i].SyncedAt
+		}
+	}
+	return time.Time{}
+}
+
+// LastInSync is Store.LastInSync limited to the cluster's runs.
+func (c *ClusterStore) LastInSync(host string) time.Time {
+	c.store.mu.RLock()
+	defer c.store.mu.RUnlock()
+	return c.store.lastInSync(host, c.contains)
+}
+
+// LastMaster is Store.LastMaster limited to the cluster's runs.
+func (c *ClusterStore) LastMaster() (host string, since time.Time) {
+	c.store.mu.RLock()
+	defer c.store.mu.RUnlock()
+	return c.store.lastMaster(c.contains)
+}
+
+// List is Store.List limited to the cluster's runs.
+func (c *ClusterStore) List(offset, limit int) ([]Entry, int) {
+	return c.store.list(offset, limit, c.contains)
+}
+
+func (c *ClusterStore) contains(entry Entry) bool {
+	cluster := entry.Cluster
+	if cluster == "" {
+		cluster = config.DefaultClusterName
+	}
+	return cluster == c.name
+}
+
+func (s *Store) append(entry Entry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal sync history entry: %w", err)
+	}
+
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open sync history: %w", err)
+	}
+	defer file.Close()
+
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write sync history: %w", err)
+	}
+	s.fileLines++
+	return nil
+}
+
+// rewrite replaces the file with the entries kept in memory. The new file is
+// written next to the old one and renamed so a crash never truncates it.
+func (s *Store) rewrite() error {
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed to rewrite sync history: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	writer := bufio.NewWriter(tmp)
+	for _, entry := range s.entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			tmp.Close()
+			return fmt.Errorf("failed to marshal sync history entry: %w", err)
+		}
+		writer.Write(append(line, '\n'))
+	}
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to rewrite sync history: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to rewrite sync history: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("failed to rewrite sync history: %w", err)
+	}
+	s.fileLines = len(s.entries)
+	return nil
+}
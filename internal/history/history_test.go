@@ -0,0 +1,196 @@
+package history
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/arimakouyou/pihole-sync/internal/sync"
+)
+
+func TestStoreRecordAndList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+
+	store, err := Open(path, 10)
+	require.NoError(t, err)
+	assert.True(t, store.LastSyncedAt().IsZero())
+
+	base := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, store.Record(sync.SyncResult{
+			Success:  i != 1,
+			Trigger:  sync.TriggerSchedule,
+			SyncedAt: base.Add(time.Duration(i) * time.Minute),
+			Details:  []sync.SlaveResult{{Host: "http://slave", Result: "ok", Retries: i}},
+		}))
+	}
+
+	entries, total := store.List(0, 2)
+	assert.Equal(t, 3, total)
+	require.Len(t, entries, 2)
+	assert.Equal(t, int64(3), entries[0].ID, "newest first")
+	assert.Equal(t, int64(2), entries[1].ID)
+	assert.False(t, entries[1].Success)
+
+	entries, _ = store.List(2, 2)
+	require.Len(t, entries, 1)
+	assert.Equal(t, int64(1), entries[0].ID)
+
+	entries, _ = store.List(5, 2)
+	assert.Empty(t, entries)
+
+	// The history survives a restart
+	reopened, err := Open(path, 10)
+	require.NoError(t, err)
+	entries, total = reopened.List(0, 10)
+	assert.Equal(t, 3, total)
+	assert.Equal(t, 2, entries[0].Details[0].Retries)
+	assert.True(t, reopened.LastSyncedAt().Equal(base.Add(2*time.Minute)))
+
+	require.NoError(t, reopened.Record(sync.SyncResult{}))
+	entries, _ = reopened.List(0, 1)
+	assert.Equal(t, int64(4), entries[0].ID)
+}
+
+func TestStoreKeepsMaxEntries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+
+	store, err := Open(path, 2)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		require.NoError(t, store.Record(sync.SyncResult{Message: "run"}))
+	}
+
+	entries, total := store.List(0, 10)
+	assert.Equal(t, 2, total)
+	assert.Equal(t, int64(5), entries[0].ID)
+	assert.Equal(t, int64(4), entries[1].ID)
+
+	reopened, err := Open(path, 2)
+	require.NoError(t, err)
+	_, total = reopened.List(0, 10)
+	assert.Equal(t, 2, total)
+}
+
+func TestStoreRewritesOnlyAtTwiceMaxEntries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	lines := func() int {
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		return strings.Count(string(data), "\n")
+	}
+
+	store, err := Open(path, 2)
+	require.NoError(t, err)
+	// Past maxEntries the runs are still only appended
+	for i := 1; i <= 4; i++ {
+		require.NoError(t, store.Record(sync.SyncResult{Message: "run"}))
+		assert.Equal(t, i, lines(), "run %d", i)
+	}
+	_, total := store.List(0, 10)
+	assert.Equal(t, 2, total)
+
+	require.NoError(t, store.Record(sync.SyncResult{Message: "run"}))
+	assert.Equal(t, 2, lines())
+
+	reopened, err := Open(path, 2)
+	require.NoError(t, err)
+	entries, total := reopened.List(0, 10)
+	assert.Equal(t, 2, total)
+	assert.Equal(t, int64(5), entries[0].ID)
+	require.NoError(t, reopened.Record(sync.SyncResult{Message: "run"}))
+	assert.Equal(t, 3, lines())
+}
+
+func TestStoreLastInSync(t *testing.T) {
+	store, err := Open(filepath.Join(t.TempDir(), "history.jsonl"), 10)
+	require.NoError(t, err)
+	assert.True(t, store.LastInSync("http://standby").IsZero())
+
+	base := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	require.NoError(t, store.Record(sync.SyncResult{
+		Master:   "http://master",
+		SyncedAt: base,
+		Details:  []sync.SlaveResult{{Host: "http://standby", Result: "ok"}},
+	}))
+	require.NoError(t, store.Record(sync.SyncResult{
+		Master:   "http://master",
+		SyncedAt: base.Add(time.Minute),
+		Details:  []sync.SlaveResult{{Host: "http://standby", Result: "error"}},
+	}))
+
+	assert.True(t, store.LastInSync("http://standby").Equal(base), "failed syncs do not count")
+	assert.True(t, store.LastInSync("http://master").Equal(base.Add(time.Minute)))
+}
+
+func TestStoreLastMaster(t *testing.T) {
+	store, err := Open(filepath.Join(t.TempDir(), "history.jsonl"), 10)
+	require.NoError(t, err)
+	host, _ := store.LastMaster()
+	assert.Empty(t, host)
+
+	base := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	for i, master := range []string{"http://master", "http://standby", "", "http://standby"} {
+		require.NoError(t, store.Record(sync.SyncResult{
+			Master:    master,
+			StartedAt: base.Add(time.Duration(i) * time.Minute),
+			SyncedAt:  base.Add(time.Duration(i)*time.Minute + time.Second),
+		}))
+	}
+
+	host, since := store.LastMaster()
+	assert.Equal(t, "http://standby", host)
+	assert.Equal(t, base.Add(time.Minute), since, "runs without a master do not break the series")
+	host, _ = store.Cluster("other").LastMaster()
+	assert.Empty(t, host)
+}
+
+func TestOpenSkipsCorruptLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	require.NoError(t, os.WriteFile(path, []byte("{\"id\":1,\"success\":true}\nnot json\n{\"id\":2}\n"), 0644))
+
+	store, err := Open(path, 10)
+	require.NoError(t, err)
+	entries, total := store.List(0, 10)
+	assert.Equal(t, 2, total)
+	assert.Equal(t, int64(2), entries[0].ID)
+}
+
+func TestClusterStore(t *testing.T) {
+	store, err := Open(filepath.Join(t.TempDir(), "history.jsonl"), 10)
+	require.NoError(t, err)
+
+	base := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	home, office := store.Cluster("home"), store.Cluster("office")
+	// A run recorded before clusters existed belongs to the default cluster
+	require.NoError(t, store.Record(sync.SyncResult{SyncedAt: base}))
+	require.NoError(t, home.Record(sync.SyncResult{SyncedAt: base.Add(time.Minute),
+		Details: []sync.SlaveResult{{Host: "http://slave", Result: "ok"}}}))
+	require.NoError(t, office.Record(sync.SyncResult{SyncedAt: base.Add(2 * time.Minute),
+		Details: []sync.SlaveResult{{Host: "http://slave", Result: "error"}}}))
+
+	entries, total := home.List(0, 10)
+	assert.Equal(t, 1, total)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "home", entries[0].Cluster)
+
+	entries, total = store.Cluster("default").List(0, 10)
+	assert.Equal(t, 1, total)
+	require.Len(t, entries, 1)
+	assert.Equal(t, int64(1), entries[0].ID)
+
+	_, total = store.List(0, 10)
+	assert.Equal(t, 3, total)
+
+	assert.Equal(t, base.Add(time.Minute), home.LastSyncedAt())
+	assert.Equal(t, base.Add(2*time.Minute), office.LastSyncedAt())
+	assert.True(t, store.Cluster("other").LastSyncedAt().IsZero())
+
+	assert.Equal(t, base.Add(time.Minute), home.LastInSync("http://slave"))
+	assert.True(t, office.LastInSync("http://slave").IsZero(), "the slave is out of sync in office")
+}
@@ -14,42 +14,120 @@ import (
 type PiholeInstance struct {
 	Client *pihole.Client
 	Host   string
-	Role   string // "master" or "slave"
+	Role   string // RoleMaster, RoleStandby or RoleSlave
 }
 
-// Collector is responsible for collecting Pi-hole metrics from multiple instances
+// Roles reported in the role label
+const (
+	RoleMaster  = "master"
+	RoleStandby = "standby"
+	RoleSlave   = "slave"
+)
+
+// Collector is responsible for collecting Pi-hole metrics from the
+// instances of one cluster
 type Collector struct {
+	// cluster is reported in the cluster label
+	cluster   string
 	instances []PiholeInstance
 	config    *config.MetricsConfig
 	logger    *zap.Logger
+	// activeMaster, if set, returns the host currently used as the sync
+	// source, which is then reported with the master role
+	activeMaster func() string
+	// roles holds the role each instance was last reported with
+	roles map[string]string
 }
 
-// NewCollector creates a new metrics collector for multiple Pi-hole instances
-func NewCollector(cfg *config.Config, logger *zap.Logger) *Collector {
+// NewCollector creates a new metrics collector for multiple Pi-hole instances.
+// Clients are taken from pool so that metrics collection reuses the sessions
+// already opened by the syncer.
+func NewCollector(cfg *config.Config, pool *pihole.Pool, logger *zap.Logger) *Collector {
 	var instances []PiholeInstance
 
 	// Add master instance
-	masterClient := pihole.NewClient(cfg.Master.Host, cfg.Master.Password)
-	instances = append(instances, PiholeInstance{
-		Client: masterClient,
-		Host:   cfg.Master.Host,
-		Role:   "master",
-	})
+	if masterClient, err := pool.Get(cfg.Master.Host, cfg.Master.ClientOptions()); err != nil {
+		logger.Error("Skipping master with invalid client configuration",
+			zap.String("host", cfg.Master.Host),
+			zap.Error(err))
+	} else {
+		instances = append(instances, PiholeInstance{
+			Client: masterClient,
+			Host:   cfg.Master.Host,
+			Role:   RoleMaster,
+		})
+	}
+
+	// Add failover candidates that are not also synced as slaves
+	slaveHosts := make(map[string]bool)
+	for _, slave := range cfg.Slaves {
+		slaveHosts[slave.Host] = true
+	}
+	for _, candidate := range cfg.MasterCandidates()[1:] {
+		if slaveHosts[candidate.Host] {
+			continue
+		}
+		candidateClient, err := pool.Get(candidate.Host, candidate.ClientOptions())
+		if err != nil {
+			logger.Error("Skipping master candidate with invalid client configuration",
+				zap.String("host", candidate.Host),
+				zap.Error(err))
+			continue
+		}
+		instances = append(instances, PiholeInstance{
+			Client: candidateClient,
+			Host:   candidate.Host,
+			Role:   RoleStandby,
+		})
+	}
 
 	// Add slave instances
 	for _, slave := range cfg.Slaves {
-		slaveClient := pihole.NewClient(slave.Host, slave.Password)
+		slaveClient, err := pool.Get(slave.Host, slave.ClientOptions())
+		if err != nil {
+			logger.Error("Skipping slave with invalid client configuration",
+				zap.String("host", slave.Host),
+				zap.Error(err))
+			continue
+		}
 		instances = append(instances, PiholeInstance{
 			Client: slaveClient,
 			Host:   slave.Host,
-			Role:   "slave",
+			Role:   RoleSlave,
 		})
 	}
 
 	return &Collector{
+		cluster:   cfg.ClusterName(),
 		instances: instances,
 		config:    &cfg.Metrics,
 		logger:    logger,
+		roles:     make(map[string]string),
+	}
+}
+
+// SetActiveMaster makes the collector follow master failover: the instance
+// activeMaster returns is reported as master and a demoted master as
+// standby.
+func (c *Collector) SetActiveMaster(activeMaster func() string) {
+	c.activeMaster = activeMaster
+}
+
+// role returns the role to report instance with.
+func (c *Collector) role(instance PiholeInstance) string {
+	if c.activeMaster == nil {
+		return instance.Role
+	}
+	active := c.activeMaster()
+	switch {
+	case active == "":
+		return instance.Role
+	case instance.Host == active:
+		return RoleMaster
+	case instance.Role == RoleMaster:
+		return RoleStandby
+	default:
+		return instance.Role
 	}
 }
 
@@ -60,13 +138,15 @@ func (c *Collector) Start(ctx context.Context) error {
 		return nil
 	}
 
-	c.logger.Info("Starting Pi-hole metrics collector", zap.Duration("interval", c.config.CollectionInterval))
+	c.logger.Info("Starting Pi-hole metrics collector",
+		zap.String("cluster", c.cluster),
+		zap.Duration("interval", c.config.CollectionInterval))
 
 	ticker := time.NewTicker(c.config.CollectionInterval)
 	defer ticker.Stop()
 
 	// Collect metrics immediately on start
-	c.collectMetrics()
+	c.collectMetrics(ctx)
 
 	for {
 		select {
@@ -74,18 +154,31 @@ func (c *Collector) Start(ctx context.Context) error {
 			c.logger.Info("Stopping metrics collector")
 			return ctx.Err()
 		case <-ticker.C:
-			c.collectMetrics()
+			c.collectMetrics(ctx)
 		}
 	}
 }
 
 // collectMetrics collects all enabled metrics from all Pi-hole instances
-func (c *Collector) collectMetrics() {
+func (c *Collector) collectMetrics(ctx context.Context) {
 	startTime := time.Now()
 	c.logger.Debug("Starting metrics collection", zap.Int("instances", len(c.instances)))
 
 	for _, instance := range c.instances {
-		c.collectInstanceMetrics(instance)
+		if ctx.Err() != nil {
+			return
+		}
+		// A role change would leave the old series behind
+		instance.Role = c.role(instance)
+		if previous, ok := c.roles[instance.Host]; ok && previous != instance.Role {
+			c.logger.Info("Instance role changed",
+				zap.String("host", instance.Host),
+				zap.String("from", previous),
+				zap.String("to", instance.Role))
+			DeleteInstanceMetrics(c.cluster, instance.Host)
+		}
+		c.roles[instance.Host] = instance.Role
+		c.collectInstanceMetrics(ctx, instance)
 	}
 
 	duration := time.Since(startTime)
@@ -93,126 +186,126 @@ func (c *Collector) collectMetrics() {
 }
 
 // collectInstanceMetrics collects metrics from a single Pi-hole instance
-func (c *Collector) collectInstanceMetrics(instance PiholeInstance) {
+func (c *Collector) collectInstanceMetrics(ctx context.Context, instance PiholeInstance) {
 	instanceName := instance.Host
 	role := instance.Role
 
 	// Collect summary statistics
-	if err := c.collectSummaryStats(instance); err != nil {
+	if err := c.collectSummaryStats(ctx, instance); err != nil {
 		c.logger.Error("Failed to collect summary stats",
 			zap.String("host", instanceName),
 			zap.String("role", role),
 			zap.Error(err))
-		RecordAPIError(instanceName, role, "stats/summary")
+		RecordAPIError(c.cluster, instanceName, role, "stats/summary")
 	}
 
 	// Collect query types
-	if err := c.collectQueryTypes(instance); err != nil {
+	if err := c.collectQueryTypes(ctx, instance); err != nil {
 		c.logger.Error("Failed to collect query types",
 			zap.String("host", instanceName),
 			zap.String("role", role),
 			zap.Error(err))
-		RecordAPIError(instanceName, role, "stats/query_types")
+		RecordAPIError(c.cluster, instanceName, role, "stats/query_types")
 	}
 
 	// Collect upstreams if enabled
 	if c.config.EnableUpstreams {
-		if err := c.collectUpstreams(instance); err != nil {
+		if err := c.collectUpstreams(ctx, instance); err != nil {
 			c.logger.Error("Failed to collect upstreams",
 				zap.String("host", instanceName),
 				zap.String("role", role),
 				zap.Error(err))
-			RecordAPIError(instanceName, role, "stats/upstreams")
+			RecordAPIError(c.cluster, instanceName, role, "stats/upstreams")
 		}
 	}
 
 	// Collect top domains if enabled
 	if c.config.EnableTopDomains {
-		if err := c.collectTopDomains(instance); err != nil {
+		if err := c.collectTopDomains(ctx, instance); err != nil {
 			c.logger.Error("Failed to collect top domains",
 				zap.String("host", instanceName),
 				zap.String("role", role),
 				zap.Error(err))
-			RecordAPIError(instanceName, role, "stats/top_domains")
+			RecordAPIError(c.cluster, instanceName, role, "stats/top_domains")
 		}
 	}
 
 	// Collect top clients if enabled
 	if c.config.EnableTopClients {
-		if err := c.collectTopClients(instance); err != nil {
+		if err := c.collectTopClients(ctx, instance); err != nil {
 			c.logger.Error("Failed to collect top clients",
 				zap.String("host", instanceName),
 				zap.String("role", role),
 				zap.Error(err))
-			RecordAPIError(instanceName, role, "stats/top_clients")
+			RecordAPIError(c.cluster, instanceName, role, "stats/top_clients")
 		}
 	}
 
 	// Record successful collection
-	RecordSuccessfulCollection(instanceName, role)
+	RecordSuccessfulCollection(c.cluster, instanceName, role)
 }
 
 // collectSummaryStats collects and updates summary statistics for an instance
-func (c *Collector) collectSummaryStats(instance PiholeInstance) error {
+func (c *Collector) collectSummaryStats(ctx context.Context, instance PiholeInstance) error {
 	startTime := time.Now()
-	stats, err := instance.Client.GetSummaryStats()
+	stats, err := instance.Client.GetSummaryStats(ctx)
 	if err != nil {
 		return err
 	}
 
-	UpdateSummaryStats(stats, instance.Host, instance.Role)
-	RecordAPIResponseTime(instance.Host, instance.Role, "stats/summary", time.Since(startTime).Seconds())
+	UpdateSummaryStats(stats, c.cluster, instance.Host, instance.Role)
+	RecordAPIResponseTime(c.cluster, instance.Host, instance.Role, "stats/summary", time.Since(startTime).Seconds())
 	return nil
 }
 
 // collectQueryTypes collects and updates query type statistics for an instance
-func (c *Collector) collectQueryTypes(instance PiholeInstance) error {
+func (c *Collector) collectQueryTypes(ctx context.Context, instance PiholeInstance) error {
 	startTime := time.Now()
-	queryTypes, err := instance.Client.GetQueryTypes()
+	queryTypes, err := instance.Client.GetQueryTypes(ctx)
 	if err != nil {
 		return err
 	}
 
-	UpdateQueryTypes(queryTypes, instance.Host, instance.Role)
-	RecordAPIResponseTime(instance.Host, instance.Role, "stats/query_types", time.Since(startTime).Seconds())
+	UpdateQueryTypes(queryTypes, c.cluster, instance.Host, instance.Role)
+	RecordAPIResponseTime(c.cluster, instance.Host, instance.Role, "stats/query_types", time.Since(startTime).Seconds())
 	return nil
 }
 
 // collectUpstreams collects and updates upstream server statistics for an instance
-func (c *Collector) collectUpstreams(instance PiholeInstance) error {
+func (c *Collector) collectUpstreams(ctx context.Context, instance PiholeInstance) error {
 	startTime := time.Now()
-	upstreams, err := instance.Client.GetUpstreams()
+	upstreams, err := instance.Client.GetUpstreams(ctx)
 	if err != nil {
 		return err
 	}
 
-	UpdateUpstreams(upstreams, instance.Host, instance.Role)
-	RecordAPIResponseTime(instance.Host, instance.Role, "stats/upstreams", time.Since(startTime).Seconds())
+	UpdateUpstreams(upstreams, c.cluster, instance.Host, instance.Role)
+	RecordAPIResponseTime(c.cluster, instance.Host, instance.Role, "stats/upstreams", time.Since(startTime).Seconds())
 	return nil
 }
 
 // collectTopDomains collects and updates top domains statistics for an instance
-func (c *Collector) collectTopDomains(instance PiholeInstance) error {
+func (c *Collector) collectTopDomains(ctx context.Context, instance PiholeInstance) error {
 	startTime := time.Now()
-	topDomains, err := instance.Client.GetTopDomains()
+	topDomains, err := instance.Client.GetTopDomains(ctx)
 	if err != nil {
 		return err
 	}
 
-	UpdateTopDomains(topDomains, instance.Host, instance.Role, c.config.TopItemsLimit)
-	RecordAPIResponseTime(instance.Host, instance.Role, "stats/top_domains", time.Since(startTime).Seconds())
+	UpdateTopDomains(topDomains, c.cluster, instance.Host, instance.Role, c.config.TopItemsLimit)
+	RecordAPIResponseTime(c.cluster, instance.Host, instance.Role, "stats/top_domains", time.Since(startTime).Seconds())
 	return nil
 }
 
 // collectTopClients collects and updates top clients statistics for an instance
-func (c *Collector) collectTopClients(instance PiholeInstance) error {
+func (c *Collector) collectTopClients(ctx context.Context, instance PiholeInstance) error {
 	startTime := time.Now()
-	topClients, err := instance.Client.GetTopClients()
+	topClients, err := instance.Client.GetTopClients(ctx)
 	if err != nil {
 		return err
 	}
 
-	UpdateTopClients(topClients, instance.Host, instance.Role, c.config.TopItemsLimit)
-	RecordAPIResponseTime(instance.Host, instance.Role, "stats/top_clients", time.Since(startTime).Seconds())
+	UpdateTopClients(topClients, c.cluster, instance.Host, instance.Role, c.config.TopItemsLimit)
+	RecordAPIResponseTime(c.cluster, instance.Host, instance.Role, "stats/top_clients", time.Since(startTime).Seconds())
 	return nil
 }
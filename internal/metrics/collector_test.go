@@ -2,12 +2,14 @@ package metrics
 
 import (
 	"context"
+	"fmt"
 	"testing"
 	"time"
 
 	"go.uber.org/zap"
 
 	"github.com/arimakouyou/pihole-sync/internal/config"
+	"github.com/arimakouyou/pihole-sync/internal/pihole"
 )
 
 func TestNewCollector(t *testing.T) {
@@ -34,7 +36,7 @@ func TestNewCollector(t *testing.T) {
 	}
 	logger := zap.NewNop() // No-op logger for testing
 
-	collector := NewCollector(cfg, logger)
+	collector := NewCollector(cfg, pihole.NewPool(), logger)
 
 	if collector == nil {
 		t.Fatal("Expected collector to be created, got nil")
@@ -81,7 +83,7 @@ func TestCollectorStart_Disabled(t *testing.T) {
 	}
 	logger := zap.NewNop() // No-op logger for testing
 
-	collector := NewCollector(cfg, logger)
+	collector := NewCollector(cfg, pihole.NewPool(), logger)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
 	defer cancel()
@@ -106,7 +108,7 @@ func TestCollectorStart_WithContext(t *testing.T) {
 	}
 	logger := zap.NewNop() // No-op logger for testing
 
-	collector := NewCollector(cfg, logger)
+	collector := NewCollector(cfg, pihole.NewPool(), logger)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
 	defer cancel()
@@ -116,3 +118,51 @@ func TestCollectorStart_WithContext(t *testing.T) {
 		t.Errorf("Expected context deadline exceeded, got: %v", err)
 	}
 }
+
+func TestCollectorRoleFollowsActiveMaster(t *testing.T) {
+	cfg := &config.Config{
+		Master: config.MasterConfig{Host: "http://master.localhost", Password: "password"},
+		Slaves: []config.SlaveConfig{
+			{Host: "http://standby1.localhost", Password: "password"},
+			{Host: "http://slave.localhost", Password: "password"},
+		},
+		Failover: config.FailoverConfig{
+			Enabled: true,
+			Candidates: []config.MasterConfig{
+				{Host: "http://standby1.localhost", Password: "password"},
+				{Host: "http://standby2.localhost", Password: "password"},
+			},
+		},
+	}
+
+	collector := NewCollector(cfg, pihole.NewPool(), zap.NewNop())
+
+	// standby1 is synced as a slave, so it is not added twice
+	if len(collector.instances) != 4 {
+		t.Fatalf("Expected 4 instances, got %d", len(collector.instances))
+	}
+	if collector.instances[1].Host != "http://standby2.localhost" || collector.instances[1].Role != RoleStandby {
+		t.Errorf("Expected standby2 as standby, got %+v", collector.instances[1])
+	}
+
+	active := "http://master.localhost"
+	collector.SetActiveMaster(func() string { return active })
+	roles := func() []string {
+		var roles []string
+		for _, instance := range collector.instances {
+			roles = append(roles, collector.role(instance))
+		}
+		return roles
+	}
+
+	expected := []string{RoleMaster, RoleStandby, RoleSlave, RoleSlave}
+	if got := roles(); fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("Expected roles %v, got %v", expected, got)
+	}
+
+	active = "http://standby1.localhost"
+	expected = []string{RoleStandby, RoleStandby, RoleMaster, RoleSlave}
+	if got := roles(); fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("Expected roles %v after failover, got %v", expected, got)
+	}
+}
@@ -6,16 +6,18 @@ import (
 )
 
 var (
-	SyncSuccessTotal = promauto.NewCounter(prometheus.CounterOpts{
+	SyncSuccessTotal = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "pihole_sync_success_total",
 		Help: "The total number of successful synchronizations",
-	})
+	}, []string{"cluster"})
 
-	SyncFailureTotal = promauto.NewCounter(prometheus.CounterOpts{
+	SyncFailureTotal = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "pihole_sync_failure_total",
 		Help: "The total number of failed synchronizations",
-	})
+	}, []string{"cluster"})
 
+	// GravityEditTotal, APICallTotal and ErrorTotal count events of the
+	// whole process and are therefore not labeled with a cluster
 	GravityEditTotal = promauto.NewCounter(prometheus.CounterOpts{
 		Name: "pihole_gravity_edit_total",
 		Help: "The total number of gravity list edits",
@@ -30,14 +32,56 @@ var (
 		Name: "pihole_error_total",
 		Help: "The total number of errors",
 	})
+
+	DriftEntries = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pihole_sync_drift_entries",
+		Help: "Number of entries a sync would add, update or delete on a slave, per sync item",
+	}, []string{"cluster", "instance", "item"})
+
+	SlaveDrifted = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pihole_sync_slave_drifted",
+		Help: "Whether a slave differs from the master (1) or not (0)",
+	}, []string{"cluster", "instance"})
+
+	SlaveCircuitBreakerState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pihole_sync_slave_circuit_breaker_state",
+		Help: "Circuit breaker state of a slave: 0 closed, 1 half-open, 2 open",
+	}, []string{"cluster", "instance"})
+
+	SlaveCircuitBreakerTrips = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pihole_sync_slave_circuit_breaker_trips_total",
+		Help: "The total number of times a slave's circuit breaker opened",
+	}, []string{"cluster", "instance"})
+
+	MasterActive = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pihole_sync_master_active",
+		Help: "Whether a master candidate is the current sync source (1) or not (0)",
+	}, []string{"cluster", "instance"})
+
+	MasterFailovers = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pihole_sync_master_failovers_total",
+		Help: "The total number of times the sync source moved to another master candidate",
+	}, []string{"cluster", "from", "to"})
+
+	MergeConflicts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pihole_sync_merge_conflicts_total",
+		Help: "The total number of entries changed differently on several instances in multi-master sync",
+	}, []string{"cluster", "item", "policy"})
+)
+
+// Values of SlaveCircuitBreakerState
+const (
+	CircuitBreakerClosed   = 0
+	CircuitBreakerHalfOpen = 1
+	CircuitBreakerOpen     = 2
 )
 
-func IncrementSyncSuccess() {
-	SyncSuccessTotal.Inc()
+func IncrementSyncSuccess(cluster string) {
+	SyncSuccessTotal.WithLabelValues(cluster).Inc()
 }
 
-func IncrementSyncFailure() {
-	SyncFailureTotal.Inc()
+func IncrementSyncFailure(cluster string) {
+	SyncFailureTotal.WithLabelValues(cluster).Inc()
 }
 
 func IncrementGravityEdit() {
@@ -51,3 +95,58 @@ func IncrementAPICall() {
 func IncrementError() {
 	ErrorTotal.Inc()
 }
+
+// SetSlaveDrift records the drift of one slave of cluster; entries maps
+// each checked sync item to its number of differing entries.
+func SetSlaveDrift(cluster, instance string, entries map[string]int) {
+	drifted := 0.0
+	for item, count := range entries {
+		DriftEntries.WithLabelValues(cluster, instance, item).Set(float64(count))
+		if count > 0 {
+			drifted = 1
+		}
+	}
+	SlaveDrifted.WithLabelValues(cluster, instance).Set(drifted)
+}
+
+// ResetDrift removes the drift series of all slaves of cluster, e.g. before
+// a check after slaves were removed from the configuration.
+func ResetDrift(cluster string) {
+	DriftEntries.DeletePartialMatch(prometheus.Labels{"cluster": cluster})
+	SlaveDrifted.DeletePartialMatch(prometheus.Labels{"cluster": cluster})
+}
+
+// SetCircuitBreakerState records the circuit breaker state of a slave, one
+// of CircuitBreakerClosed, CircuitBreakerHalfOpen or CircuitBreakerOpen.
+func SetCircuitBreakerState(cluster, instance string, state int) {
+	SlaveCircuitBreakerState.WithLabelValues(cluster, instance).Set(float64(state))
+}
+
+// IncrementCircuitBreakerTrips counts a slave's circuit breaker opening.
+func IncrementCircuitBreakerTrips(cluster, instance string) {
+	SlaveCircuitBreakerTrips.WithLabelValues(cluster, instance).Inc()
+}
+
+// SetActiveMaster marks active as the sync source among the master
+// candidates of cluster.
+func SetActiveMaster(cluster string, candidates []string, active string) {
+	for _, candidate := range candidates {
+		value := 0.0
+		if candidate == active {
+			value = 1
+		}
+		MasterActive.WithLabelValues(cluster, candidate).Set(value)
+	}
+}
+
+// IncrementMasterFailovers counts the sync source of cluster moving from
+// one master candidate to another.
+func IncrementMasterFailovers(cluster, from, to string) {
+	MasterFailovers.WithLabelValues(cluster, from, to).Inc()
+}
+
+// IncrementMergeConflicts counts a multi-master conflict on an entry of item
+// resolved by policy.
+func IncrementMergeConflicts(cluster, item, policy string) {
+	MergeConflicts.WithLabelValues(cluster, item, policy).Inc()
+}
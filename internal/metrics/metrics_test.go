@@ -11,23 +11,23 @@ import (
 func TestMetricsIncrement(t *testing.T) {
 	prometheus.DefaultRegisterer = prometheus.NewRegistry()
 	
-	SyncSuccessTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	SyncSuccessTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "pihole_sync_success_total",
 		Help: "The total number of successful synchronizations",
-	})
+	}, []string{"cluster"})
 	prometheus.MustRegister(SyncSuccessTotal)
 
-	initialValue := testutil.ToFloat64(SyncSuccessTotal)
+	initialValue := testutil.ToFloat64(SyncSuccessTotal.WithLabelValues("default"))
 	
-	IncrementSyncSuccess()
+	IncrementSyncSuccess("default")
 	
-	newValue := testutil.ToFloat64(SyncSuccessTotal)
+	newValue := testutil.ToFloat64(SyncSuccessTotal.WithLabelValues("default"))
 	assert.Equal(t, initialValue+1, newValue)
 }
 
 func TestAllMetricsIncrement(t *testing.T) {
-	IncrementSyncSuccess()
-	IncrementSyncFailure()
+	IncrementSyncSuccess("default")
+	IncrementSyncFailure("default")
 	IncrementGravityEdit()
 	IncrementAPICall()
 	IncrementError()
@@ -28,11 +28,11 @@ func TestUpdateSummaryStats(t *testing.T) {
 	}
 
 	// This should not panic
-	UpdateSummaryStats(stats, "test.localhost", "master")
+	UpdateSummaryStats(stats, "default", "test.localhost", "master")
 
 	// Test with disabled status
 	stats.Status = "disabled"
-	UpdateSummaryStats(stats, "test.localhost", "master")
+	UpdateSummaryStats(stats, "default", "test.localhost", "master")
 }
 
 func TestUpdateQueryTypes(t *testing.T) {
@@ -46,7 +46,7 @@ func TestUpdateQueryTypes(t *testing.T) {
 	}
 
 	// This should not panic
-	UpdateQueryTypes(queryTypes, "test.localhost", "master")
+	UpdateQueryTypes(queryTypes, "default", "test.localhost", "master")
 }
 
 func TestUpdateUpstreams(t *testing.T) {
@@ -85,7 +85,7 @@ func TestUpdateUpstreams(t *testing.T) {
 	}
 
 	// This should not panic
-	UpdateUpstreams(upstreams, "test.localhost", "master")
+	UpdateUpstreams(upstreams, "default", "test.localhost", "master")
 }
 
 func TestUpdateTopDomains(t *testing.T) {
@@ -105,10 +105,10 @@ func TestUpdateTopDomains(t *testing.T) {
 	}
 
 	// Test with limit
-	UpdateTopDomains(topDomains, "test.localhost", "master", 3)
+	UpdateTopDomains(topDomains, "default", "test.localhost", "master", 3)
 
 	// Test with higher limit than available domains
-	UpdateTopDomains(topDomains, "test.localhost", "master", 10)
+	UpdateTopDomains(topDomains, "default", "test.localhost", "master", 10)
 }
 
 func TestUpdateTopClients(t *testing.T) {
@@ -123,25 +123,25 @@ func TestUpdateTopClients(t *testing.T) {
 	}
 
 	// Test with limit
-	UpdateTopClients(topClients, "test.localhost", "master", 3)
+	UpdateTopClients(topClients, "default", "test.localhost", "master", 3)
 
 	// Test with higher limit than available clients
-	UpdateTopClients(topClients, "test.localhost", "master", 10)
+	UpdateTopClients(topClients, "default", "test.localhost", "master", 10)
 }
 
 func TestRecordAPIError(t *testing.T) {
 	// This should not panic
-	RecordAPIError("test.localhost", "master", "stats/summary")
-	RecordAPIError("test.localhost", "slave", "stats/query_types")
+	RecordAPIError("default", "test.localhost", "master", "stats/summary")
+	RecordAPIError("default", "test.localhost", "slave", "stats/query_types")
 }
 
 func TestRecordAPIResponseTime(t *testing.T) {
 	// This should not panic
-	RecordAPIResponseTime("test.localhost", "master", "stats/summary", 0.5)
-	RecordAPIResponseTime("test.localhost", "slave", "stats/query_types", 1.2)
+	RecordAPIResponseTime("default", "test.localhost", "master", "stats/summary", 0.5)
+	RecordAPIResponseTime("default", "test.localhost", "slave", "stats/query_types", 1.2)
 }
 
 func TestRecordSuccessfulCollection(t *testing.T) {
 	// This should not panic
-	RecordSuccessfulCollection("test.localhost", "master")
+	RecordSuccessfulCollection("default", "test.localhost", "master")
 }
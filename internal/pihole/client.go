@@ -2,33 +2,66 @@ package pihole
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"mime/multipart"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/arimakouyou/pihole-sync/internal/types"
 )
 
 type Client struct {
-	BaseURL   string
-	Password  string
-	SID       string
-	CSRFToken string
-	client    *http.Client
+	BaseURL  string
+	Password string
+	// TOTPSecret is the base32 two-factor secret; empty if 2FA is not used.
+	TOTPSecret string
+	SID        string
+	CSRFToken  string
+	// Timeout is the per-call deadline applied on top of the caller's context.
+	// Zero means only the caller's context (and the transport timeout) apply.
+	Timeout time.Duration
+	client  *http.Client
+
+	// settingsMu guards Password, TOTPSecret, Timeout and client, which a
+	// Pool updates in place when the options of a shared client change.
+	settingsMu sync.RWMutex
+	// sessionMu guards SID, CSRFToken and lastTOTPStep once the client is
+	// shared between goroutines (see Pool).
+	sessionMu sync.Mutex
+	// lastTOTPStep is the time step of the last TOTP code that logged in.
+	// Pi-hole accepts each code only once.
+	lastTOTPStep int64
+	// now returns the current time; time.Now unless a test replaces it
+	now func() time.Time
 }
 
+// PiholeData is the flattened list state of a Pi-hole. Exact and regex
+// domains are kept apart so that an entry is only ever matched against one
+// of the same kind.
 type PiholeData struct {
-	Adlists    []string `json:"adlists"`
-	Blacklist  []string `json:"blacklist"`
-	Whitelist  []string `json:"whitelist"`
-	Groups     []string `json:"groups"`
-	DNSRecords []string `json:"dns_records"`
-	DHCP       []string `json:"dhcp"`
+	Adlists        []string `json:"adlists"`
+	Blacklist      []string `json:"blacklist"`
+	RegexBlacklist []string `json:"regex_blacklist"`
+	Whitelist      []string `json:"whitelist"`
+	RegexWhitelist []string `json:"regex_whitelist"`
+	Groups         []string `json:"groups"`
+	DNSRecords     []string `json:"dns_records"`
+	DHCP           []string `json:"dhcp"`
+}
+
+// ClientOptions holds the per-instance settings used to build a Client.
+type ClientOptions struct {
+	Password   string
+	TOTPSecret string
+	Timeout    time.Duration
+	TLS        TLSOptions
 }
 
 func NewClient(baseURL, password string) *Client {
@@ -41,40 +74,98 @@ func NewClient(baseURL, password string) *Client {
 	}
 }
 
-func (c *Client) GetData() (*PiholeData, error) {
+// NewClientWithOptions creates a client for baseURL configured from opts. It
+// fails if the TLS settings cannot be loaded.
+func NewClientWithOptions(baseURL string, opts ClientOptions) (*Client, error) {
+	transport, err := newTransport(opts.TLS)
+	if err != nil {
+		return nil, err
+	}
+
+	client := NewClient(baseURL, opts.Password)
+	client.TOTPSecret = opts.TOTPSecret
+	client.Timeout = opts.Timeout
+	client.client.Transport = transport
+	return client, nil
+}
+
+// withTimeout derives the context for a single API call, applying the
+// client's per-call deadline if one is configured.
+func (c *Client) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	c.settingsMu.RLock()
+	timeout := c.Timeout
+	c.settingsMu.RUnlock()
+
+	if timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// httpClient returns the HTTP client requests are sent with.
+func (c *Client) httpClient() *http.Client {
+	c.settingsMu.RLock()
+	defer c.settingsMu.RUnlock()
+	return c.client
+}
+
+// reconfigure applies opts to the client in place, so that every component
+// holding it follows the change. The current session was opened with the old
+// credentials: it is detached and its sid/csrf pair returned for the caller
+// to log out, and the next call logs in with the new settings. Nothing is
+// changed if the TLS settings cannot be loaded.
+func (c *Client) reconfigure(opts ClientOptions) (string, string, error) {
+	transport, err := newTransport(opts.TLS)
+	if err != nil {
+		return "", "", err
+	}
+
+	c.settingsMu.Lock()
+	c.Password = opts.Password
+	c.TOTPSecret = opts.TOTPSecret
+	c.Timeout = opts.Timeout
+	c.client = &http.Client{Timeout: 30 * time.Second, Transport: transport}
+	c.settingsMu.Unlock()
+
+	c.sessionMu.Lock()
+	defer c.sessionMu.Unlock()
+	sid, csrf := c.SID, c.CSRFToken
+	c.SID = ""
+	c.CSRFToken = ""
+	return sid, csrf, nil
+}
+
+func (c *Client) GetData(ctx context.Context) (*PiholeData, error) {
 	data := &PiholeData{}
 
-	adlists, err := c.getAdlists()
+	adlists, err := c.getAdlists(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get adlists: %w", err)
 	}
 	data.Adlists = adlists
 
-	blacklist, err := c.getBlacklist()
+	domains, err := c.GetDomains(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get blacklist: %w", err)
+		return nil, fmt.Errorf("failed to get domains: %w", err)
 	}
-	data.Blacklist = blacklist
+	data.Blacklist = filterDomains(domains, DomainDeny, DomainExact)
+	data.RegexBlacklist = filterDomains(domains, DomainDeny, DomainRegex)
+	data.Whitelist = filterDomains(domains, DomainAllow, DomainExact)
+	data.RegexWhitelist = filterDomains(domains, DomainAllow, DomainRegex)
 
-	whitelist, err := c.getWhitelist()
-	if err != nil {
-		return nil, fmt.Errorf("failed to get whitelist: %w", err)
-	}
-	data.Whitelist = whitelist
-
-	groups, err := c.getGroups()
+	groups, err := c.getGroups(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get groups: %w", err)
 	}
 	data.Groups = groups
 
-	dnsRecords, err := c.getDNSRecords()
+	dnsRecords, err := c.getDNSRecords(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get DNS records: %w", err)
 	}
 	data.DNSRecords = dnsRecords
 
-	dhcp, err := c.getDHCP()
+	dhcp, err := c.getDHCP(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get DHCP: %w", err)
 	}
@@ -83,25 +174,47 @@ func (c *Client) GetData() (*PiholeData, error) {
 	return data, nil
 }
 
-func (c *Client) authenticate() error {
+func (c *Client) authenticate(ctx context.Context) error {
 	authURL := fmt.Sprintf("%s/api/auth", c.BaseURL)
 
+	c.settingsMu.RLock()
+	password, totpSecret, httpClient := c.Password, c.TOTPSecret, c.client
+	c.settingsMu.RUnlock()
+
 	// JSONペイロードを作成
-	payload := map[string]string{
-		"password": c.Password,
+	payload := map[string]interface{}{
+		"password": password,
+	}
+	var totpStepUsed int64
+	if totpSecret != "" {
+		now, err := c.nextTOTPTime(ctx)
+		if err != nil {
+			return err
+		}
+		totpStepUsed = totpStep(now)
+		code, err := GenerateTOTP(totpSecret, now)
+		if err != nil {
+			return fmt.Errorf("failed to generate TOTP code: %w", err)
+		}
+		// FTL expects the code as a JSON number
+		totp, err := strconv.Atoi(code)
+		if err != nil {
+			return fmt.Errorf("failed to generate TOTP code: %w", err)
+		}
+		payload["totp"] = totp
 	}
 	jsonPayload, err := json.Marshal(payload)
 	if err != nil {
 		return fmt.Errorf("failed to marshal auth payload: %w", err)
 	}
 
-	req, err := http.NewRequest("POST", authURL, bytes.NewBuffer(jsonPayload))
+	req, err := http.NewRequestWithContext(ctx, "POST", authURL, bytes.NewBuffer(jsonPayload))
 	if err != nil {
 		return fmt.Errorf("failed to create auth request: %w", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := c.client.Do(req)
+	resp, err := httpClient.Do(req)
 	if err != nil {
 		return fmt.Errorf("failed to authenticate: %w", err)
 	}
@@ -113,7 +226,13 @@ func (c *Client) authenticate() error {
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("authentication failed with status %d: %s", resp.StatusCode, string(body))
+		if requiresTOTP(body) {
+			if totpSecret == "" {
+				return ErrTOTPRequired
+			}
+			return fmt.Errorf("%w (status %d): %s", ErrTOTPRejected, resp.StatusCode, string(body))
+		}
+		return &StatusError{Op: "authentication", StatusCode: resp.StatusCode, Body: string(body)}
 	}
 
 	var authResp map[string]interface{}
@@ -138,94 +257,254 @@ func (c *Client) authenticate() error {
 		return fmt.Errorf("session object not found in auth response")
 	}
 
+	if totpStepUsed != 0 {
+		c.lastTOTPStep = totpStepUsed
+	}
 	return nil
 }
 
-func (c *Client) UpdateData(data *PiholeData) error {
-	if err := c.updateAdlists(data.Adlists); err != nil {
+// nextTOTPTime returns the time to generate the next TOTP code for. A code
+// that already logged in is rejected by Pi-hole, so if the current time step
+// was used it waits for the next one.
+func (c *Client) nextTOTPTime(ctx context.Context) (time.Time, error) {
+	now := time.Now
+	if c.now != nil {
+		now = c.now
+	}
+	t := now()
+	if totpStep(t) > c.lastTOTPStep {
+		return t, nil
+	}
+
+	next := time.Unix((c.lastTOTPStep+1)*int64(totpPeriod/time.Second), 0)
+	timer := time.NewTimer(next.Sub(t))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return time.Time{}, fmt.Errorf("waiting for the next TOTP code: %w", ctx.Err())
+	case <-timer.C:
+	}
+	if t = now(); totpStep(t) <= c.lastTOTPStep {
+		t = next
+	}
+	return t, nil
+}
+
+// requiresTOTP reports whether a failed /api/auth response says that the
+// instance has two-factor authentication enabled (session.totp == true).
+func requiresTOTP(body []byte) bool {
+	var authResp struct {
+		Session struct {
+			TOTP bool `json:"totp"`
+		} `json:"session"`
+	}
+	if err := json.Unmarshal(body, &authResp); err != nil {
+		return false
+	}
+	return authResp.Session.TOTP
+}
+
+// Logout ends the current API session (DELETE /api/auth) so that it no longer
+// occupies one of the Pi-hole's limited API seats. It is a no-op if the client
+// has no session.
+func (c *Client) Logout(ctx context.Context) error {
+	c.sessionMu.Lock()
+	defer c.sessionMu.Unlock()
+
+	if c.SID == "" {
+		return nil
+	}
+
+	reached, err := c.endSession(ctx, c.SID, c.CSRFToken)
+	if reached {
+		c.SID = ""
+		c.CSRFToken = ""
+	}
+	return err
+}
+
+// endSession sends DELETE /api/auth for the given session. reached reports
+// whether the Pi-hole answered at all; the session is unusable afterwards
+// even if the answer was an error.
+func (c *Client) endSession(ctx context.Context, sid, csrf string) (bool, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "DELETE", fmt.Sprintf("%s/api/auth", c.BaseURL), nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to create logout request: %w", err)
+	}
+	req.Header.Set("sid", sid)
+	req.Header.Set("X-FTL-CSRF", csrf)
+
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return false, fmt.Errorf("failed to logout: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// 401/404/410 mean the session is already gone, which is what we want
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusUnauthorized, http.StatusNotFound, http.StatusGone:
+		return true, nil
+	default:
+		body, _ := io.ReadAll(resp.Body)
+		return true, fmt.Errorf("logout failed with status %d: %s", resp.StatusCode, string(body))
+	}
+}
+
+func (c *Client) UpdateData(ctx context.Context, data *PiholeData) error {
+	if err := c.updateAdlists(ctx, data.Adlists); err != nil {
 		return fmt.Errorf("failed to update adlists: %w", err)
 	}
 
-	if err := c.updateBlacklist(data.Blacklist); err != nil {
+	if err := c.convergeDomains(ctx, DomainDeny, DomainExact, data.Blacklist); err != nil {
 		return fmt.Errorf("failed to update blacklist: %w", err)
 	}
 
-	if err := c.updateWhitelist(data.Whitelist); err != nil {
+	if err := c.convergeDomains(ctx, DomainDeny, DomainRegex, data.RegexBlacklist); err != nil {
+		return fmt.Errorf("failed to update regex blacklist: %w", err)
+	}
+
+	if err := c.convergeDomains(ctx, DomainAllow, DomainExact, data.Whitelist); err != nil {
 		return fmt.Errorf("failed to update whitelist: %w", err)
 	}
 
-	if err := c.updateGroups(data.Groups); err != nil {
+	if err := c.convergeDomains(ctx, DomainAllow, DomainRegex, data.RegexWhitelist); err != nil {
+		return fmt.Errorf("failed to update regex whitelist: %w", err)
+	}
+
+	if err := c.updateGroups(ctx, data.Groups); err != nil {
 		return fmt.Errorf("failed to update groups: %w", err)
 	}
 
-	if err := c.updateDNSRecords(data.DNSRecords); err != nil {
+	if err := c.updateDNSRecords(ctx, data.DNSRecords); err != nil {
 		return fmt.Errorf("failed to update DNS records: %w", err)
 	}
 
-	if err := c.updateDHCP(data.DHCP); err != nil {
+	if err := c.updateDHCP(ctx, data.DHCP); err != nil {
 		return fmt.Errorf("failed to update DHCP: %w", err)
 	}
 
 	return nil
 }
 
-func (c *Client) makeRequest(method, endpoint string, params url.Values) ([]byte, error) {
+// session returns the current sid/csrf pair, logging in first if there is
+// no session yet.
+func (c *Client) session(ctx context.Context) (string, string, error) {
+	c.sessionMu.Lock()
+	defer c.sessionMu.Unlock()
+
 	if c.SID == "" {
-		if err := c.authenticate(); err != nil {
-			return nil, fmt.Errorf("authentication failed: %w", err)
+		if err := c.authenticate(ctx); err != nil {
+			return "", "", fmt.Errorf("authentication failed: %w", err)
 		}
 	}
+	return c.SID, c.CSRFToken, nil
+}
+
+// renewSession replaces an expired session. If another goroutine already
+// renewed it (the current sid differs from staleSID) that session is reused.
+func (c *Client) renewSession(ctx context.Context, staleSID string) (string, string, error) {
+	c.sessionMu.Lock()
+	defer c.sessionMu.Unlock()
+
+	if c.SID == "" || c.SID == staleSID {
+		c.SID = ""
+		c.CSRFToken = ""
+		if err := c.authenticate(ctx); err != nil {
+			return "", "", fmt.Errorf("authentication failed: %w", err)
+		}
+	}
+	return c.SID, c.CSRFToken, nil
+}
+
+// doAuthenticated sends the request produced by newRequest with the current
+// session, logging in first if there is none. If the Pi-hole answers 401
+// (the session expired or FTL restarted) the client re-authenticates and
+// replays the request once, so newRequest must produce a fresh body on every
+// call.
+func (c *Client) doAuthenticated(ctx context.Context, newRequest func(sid, csrf string) (*http.Request, error)) (*http.Response, error) {
+	sid, csrf, err := c.session(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := newRequest(sid, csrf)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusUnauthorized {
+		return resp, nil
+	}
 
-	reqURL := fmt.Sprintf("%s/api/%s", c.BaseURL, endpoint)
+	// セッション切れ: 再認証して1回だけリトライする
+	resp.Body.Close()
+	sid, csrf, err = c.renewSession(ctx, sid)
+	if err != nil {
+		return nil, err
+	}
 
-	if params == nil {
-		params = url.Values{}
+	req, err = newRequest(sid, csrf)
+	if err != nil {
+		return nil, err
 	}
 
-	var req *http.Request
-	var err error
+	return c.httpClient().Do(req)
+}
+
+func (c *Client) makeRequest(ctx context.Context, method, endpoint string, params url.Values) ([]byte, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
 
-	if method == "GET" {
-		params.Set("sid", c.SID)
-		if len(params) > 0 {
-			reqURL += "?" + params.Encode()
+	newRequest := func(sid, csrf string) (*http.Request, error) {
+		reqURL := fmt.Sprintf("%s/api/%s", c.BaseURL, endpoint)
+
+		query := url.Values{}
+		for key, values := range params {
+			query[key] = values
 		}
-		req, err = http.NewRequest(method, reqURL, nil)
-	} else {
-		// POSTリクエストの場合はJSONで送信
-		var body []byte
-		if len(params) > 0 {
-			data := make(map[string]string)
-			data["sid"] = c.SID
-			for key, values := range params {
+
+		var req *http.Request
+		var err error
+
+		if method == "GET" {
+			query.Set("sid", sid)
+			reqURL += "?" + query.Encode()
+			req, err = http.NewRequestWithContext(ctx, method, reqURL, nil)
+		} else {
+			// POSTリクエストの場合はJSONで送信
+			data := map[string]string{"sid": sid}
+			for key, values := range query {
 				if len(values) > 0 {
 					data[key] = values[0]
 				}
 			}
-			body, err = json.Marshal(data)
+			body, err := json.Marshal(data)
 			if err != nil {
 				return nil, fmt.Errorf("failed to marshal request data: %w", err)
 			}
-		} else {
-			data := map[string]string{"sid": c.SID}
-			body, err = json.Marshal(data)
-			if err != nil {
-				return nil, fmt.Errorf("failed to marshal request data: %w", err)
+
+			req, err = http.NewRequestWithContext(ctx, method, reqURL, bytes.NewBuffer(body))
+			if err == nil {
+				req.Header.Set("Content-Type", "application/json")
+				req.Header.Set("X-FTL-CSRF", csrf)
 			}
 		}
 
-		req, err = http.NewRequest(method, reqURL, bytes.NewBuffer(body))
-		if err == nil {
-			req.Header.Set("Content-Type", "application/json")
-			req.Header.Set("X-FTL-CSRF", c.CSRFToken)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create request: %w", err)
 		}
+		return req, nil
 	}
 
-	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
-	}
-
-	resp, err := c.client.Do(req)
+	resp, err := c.doAuthenticated(ctx, newRequest)
 	if err != nil {
 		return nil, fmt.Errorf("failed to make request: %w", err)
 	}
@@ -237,183 +516,282 @@ func (c *Client) makeRequest(method, endpoint string, params url.Values) ([]byte
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("API request failed with status %d: %s", resp.StatusCode, string(body))
+		return nil, &StatusError{Op: "API request", StatusCode: resp.StatusCode, Body: string(body)}
 	}
 
 	return body, nil
 }
 
-func (c *Client) getAdlists() ([]string, error) {
-	body, err := c.makeRequest("GET", "lists", nil)
+// getJSON performs an authenticated GET and decodes the JSON response into v.
+func (c *Client) getJSON(ctx context.Context, endpoint string, v interface{}) error {
+	body, err := c.makeRequest(ctx, "GET", endpoint, nil)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	var result map[string]interface{}
-	if err := json.Unmarshal(body, &result); err != nil {
-		return nil, fmt.Errorf("failed to parse response: %w", err)
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("failed to parse response: %w", err)
 	}
+	return nil
+}
 
-	var adlists []string
-	if lists, ok := result["lists"].([]interface{}); ok {
-		for _, item := range lists {
-			if itemMap, ok := item.(map[string]interface{}); ok {
-				if listType, ok := itemMap["type"].(string); ok && listType == "block" {
-					if address, ok := itemMap["address"].(string); ok {
-						adlists = append(adlists, address)
-					}
-				}
-			}
-		}
+// Ping checks that the Pi-hole is up and accepts our credentials, using the
+// lightweight /api/info/version.
+func (c *Client) Ping(ctx context.Context) error {
+	_, err := c.makeRequest(ctx, "GET", "info/version", nil)
+	return err
+}
+
+// Blocking states reported by GetBlocking
+const (
+	BlockingEnabled  = "enabled"
+	BlockingDisabled = "disabled"
+)
+
+// GetBlocking returns the DNS blocking state from /api/dns/blocking:
+// "enabled", "disabled", "failed" or "unknown".
+func (c *Client) GetBlocking(ctx context.Context) (string, error) {
+	var resp struct {
+		Blocking string `json:"blocking"`
+	}
+	if err := c.getJSON(ctx, "dns/blocking", &resp); err != nil {
+		return "", err
 	}
+	return resp.Blocking, nil
+}
 
-	return adlists, nil
+// GetDomains returns every allow/deny entry, exact and regex, from /api/domains
+func (c *Client) GetDomains(ctx context.Context) ([]Domain, error) {
+	var resp domainsResponse
+	if err := c.getJSON(ctx, "domains", &resp); err != nil {
+		return nil, err
+	}
+	return resp.Domains, nil
 }
 
-func (c *Client) getBlacklist() ([]string, error) {
-	body, err := c.makeRequest("GET", "domains", nil)
-	if err != nil {
+// GetAdlists returns every subscribed list, block and allow, from /api/lists
+func (c *Client) GetAdlists(ctx context.Context) ([]Adlist, error) {
+	var resp listsResponse
+	if err := c.getJSON(ctx, "lists", &resp); err != nil {
 		return nil, err
 	}
+	return resp.Lists, nil
+}
 
-	var result map[string]interface{}
-	if err := json.Unmarshal(body, &result); err != nil {
-		return nil, fmt.Errorf("failed to parse response: %w", err)
+// GetGroups returns every group from /api/groups
+func (c *Client) GetGroups(ctx context.Context) ([]Group, error) {
+	var resp groupsResponse
+	if err := c.getJSON(ctx, "groups", &resp); err != nil {
+		return nil, err
 	}
+	return resp.Groups, nil
+}
 
-	var blacklist []string
-	if domains, ok := result["domains"].([]interface{}); ok {
-		for _, item := range domains {
-			if itemMap, ok := item.(map[string]interface{}); ok {
-				if domainType, ok := itemMap["type"].(string); ok && domainType == "block" {
-					if domain, ok := itemMap["domain"].(string); ok {
-						blacklist = append(blacklist, domain)
-					}
-				}
-			}
-		}
+// GetClients returns every configured client from /api/clients
+func (c *Client) GetClients(ctx context.Context) ([]ClientEntry, error) {
+	var resp clientsResponse
+	if err := c.getJSON(ctx, "clients", &resp); err != nil {
+		return nil, err
 	}
+	return resp.Clients, nil
+}
 
-	return blacklist, nil
+// GetConfig returns the Pi-hole configuration (pihole.toml) from /api/config
+// as a tree of sections, e.g. config["dns"].(map[string]interface{})["hosts"].
+func (c *Client) GetConfig(ctx context.Context) (map[string]interface{}, error) {
+	var resp struct {
+		Config map[string]interface{} `json:"config"`
+	}
+	if err := c.getJSON(ctx, "config", &resp); err != nil {
+		return nil, err
+	}
+	return resp.Config, nil
 }
 
-func (c *Client) getWhitelist() ([]string, error) {
-	body, err := c.makeRequest("GET", "domains", nil)
+func (c *Client) getAdlists(ctx context.Context) ([]string, error) {
+	lists, err := c.GetAdlists(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	var result map[string]interface{}
-	if err := json.Unmarshal(body, &result); err != nil {
-		return nil, fmt.Errorf("failed to parse response: %w", err)
+	var adlists []string
+	for _, list := range lists {
+		if list.Type == ListBlock {
+			adlists = append(adlists, list.Address)
+		}
 	}
 
-	var whitelist []string
-	if domains, ok := result["domains"].([]interface{}); ok {
-		for _, item := range domains {
-			if itemMap, ok := item.(map[string]interface{}); ok {
-				if domainType, ok := itemMap["type"].(string); ok && domainType == "allow" {
-					if domain, ok := itemMap["domain"].(string); ok {
-						whitelist = append(whitelist, domain)
-					}
-				}
-			}
+	return adlists, nil
+}
+
+// filterDomains returns the names of the domains of the given type and kind.
+func filterDomains(domains []Domain, domainType DomainType, kind DomainKind) []string {
+	var names []string
+	for _, domain := range domains {
+		if domainMatches(domain, domainType, kind) {
+			names = append(names, domain.Domain)
 		}
 	}
+	return names
+}
 
-	return whitelist, nil
+// domainMatches reports whether domain is of the given type and kind. An
+// entry without a kind counts as exact.
+func domainMatches(domain Domain, domainType DomainType, kind DomainKind) bool {
+	if domain.IsRegex() != (kind == DomainRegex) {
+		return false
+	}
+	if domainType == DomainDeny {
+		return domain.IsDeny()
+	}
+	return domain.IsAllow()
 }
 
-func (c *Client) getGroups() ([]string, error) {
-	body, err := c.makeRequest("GET", "groups", nil)
+func (c *Client) getGroups(ctx context.Context) ([]string, error) {
+	groupList, err := c.GetGroups(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	var result map[string]interface{}
-	if err := json.Unmarshal(body, &result); err != nil {
-		return nil, fmt.Errorf("failed to parse response: %w", err)
-	}
-
 	var groups []string
-	if groupsData, ok := result["groups"].([]interface{}); ok {
-		for _, item := range groupsData {
-			if itemMap, ok := item.(map[string]interface{}); ok {
-				if name, ok := itemMap["name"].(string); ok {
-					groups = append(groups, name)
-				}
-			}
-		}
+	for _, group := range groupList {
+		groups = append(groups, group.Name)
 	}
 
 	return groups, nil
 }
 
-func (c *Client) getDNSRecords() ([]string, error) {
+func (c *Client) getDNSRecords(ctx context.Context) ([]string, error) {
 	// Teleporter APIを使用するため、空のリストを返す
 	// 実際のデータはGetBackup/RestoreBackupメソッドで処理
 	return []string{}, nil
 }
 
-func (c *Client) getDHCP() ([]string, error) {
+func (c *Client) getDHCP(ctx context.Context) ([]string, error) {
 	return []string{}, nil
 }
 
-func (c *Client) updateAdlists(adlists []string) error {
-	for _, adlist := range adlists {
-		params := url.Values{}
-		params.Set("address", adlist)
+// updateAdlists makes the block lists on the Pi-hole equal to adlists: missing
+// addresses are added and addresses not in adlists are removed. A nil slice
+// leaves the Pi-hole untouched.
+func (c *Client) updateAdlists(ctx context.Context, adlists []string) error {
+	if adlists == nil {
+		return nil
+	}
 
-		_, err := c.makeRequest("POST", "lists", params)
-		if err != nil {
+	current, err := c.GetAdlists(ctx)
+	if err != nil {
+		return err
+	}
+
+	wanted := stringSet(adlists)
+	existing := make(map[string]bool)
+	for _, list := range current {
+		if list.Type != ListBlock {
+			continue
+		}
+		existing[list.Address] = true
+		if !wanted[list.Address] {
+			if _, err := c.DeleteAdlist(ctx, ListBlock, list.Address); err != nil {
+				return fmt.Errorf("failed to delete adlist %s: %w", list.Address, err)
+			}
+		}
+	}
+
+	for _, adlist := range adlists {
+		if existing[adlist] {
+			continue
+		}
+		if _, err := c.AddAdlist(ctx, Adlist{Address: adlist, Type: ListBlock, Enabled: true}); err != nil {
 			return fmt.Errorf("failed to add adlist %s: %w", adlist, err)
 		}
 	}
 	return nil
 }
 
-func (c *Client) updateBlacklist(blacklist []string) error {
-	for _, domain := range blacklist {
-		params := url.Values{}
-		params.Set("domain", domain)
-		params.Set("type", "block")
+// convergeDomains makes the entries of the given type and kind equal to
+// domains. Entries are matched on the type/kind pair, so an exact and a
+// regex entry with the same text are never mistaken for one another. A nil
+// slice leaves the Pi-hole untouched.
+func (c *Client) convergeDomains(ctx context.Context, domainType DomainType, kind DomainKind, domains []string) error {
+	if domains == nil {
+		return nil
+	}
 
-		_, err := c.makeRequest("POST", "domains", params)
-		if err != nil {
-			return fmt.Errorf("failed to add blacklist domain %s: %w", domain, err)
+	current, err := c.GetDomains(ctx)
+	if err != nil {
+		return err
+	}
+
+	wanted := stringSet(domains)
+	existing := make(map[string]bool)
+	for _, domain := range current {
+		if !domainMatches(domain, domainType, kind) {
+			continue
+		}
+		existing[domain.Domain] = true
+		if !wanted[domain.Domain] {
+			if _, err := c.DeleteDomain(ctx, domainType, kind, domain.Domain); err != nil {
+				return fmt.Errorf("failed to delete %s/%s domain %s: %w", domainType, kind, domain.Domain, err)
+			}
+		}
+	}
+
+	for _, domain := range domains {
+		if existing[domain] {
+			continue
+		}
+		if _, err := c.AddDomain(ctx, Domain{Domain: domain, Type: domainType, Kind: kind, Enabled: true}); err != nil {
+			return fmt.Errorf("failed to add %s/%s domain %s: %w", domainType, kind, domain, err)
 		}
 	}
 	return nil
 }
 
-func (c *Client) updateWhitelist(whitelist []string) error {
-	for _, domain := range whitelist {
-		params := url.Values{}
-		params.Set("domain", domain)
-		params.Set("type", "allow")
+// updateGroups makes the groups on the Pi-hole equal to groups. The Default
+// group (id 0) cannot be removed and is always kept. A nil slice leaves the
+// Pi-hole untouched.
+func (c *Client) updateGroups(ctx context.Context, groups []string) error {
+	if groups == nil {
+		return nil
+	}
 
-		_, err := c.makeRequest("POST", "domains", params)
-		if err != nil {
-			return fmt.Errorf("failed to add whitelist domain %s: %w", domain, err)
+	current, err := c.GetGroups(ctx)
+	if err != nil {
+		return err
+	}
+
+	wanted := stringSet(groups)
+	existing := make(map[string]bool)
+	for _, group := range current {
+		existing[group.Name] = true
+		if group.ID != 0 && !wanted[group.Name] {
+			if _, err := c.DeleteGroup(ctx, group.Name); err != nil {
+				return fmt.Errorf("failed to delete group %s: %w", group.Name, err)
+			}
 		}
 	}
-	return nil
-}
 
-func (c *Client) updateGroups(groups []string) error {
 	for _, group := range groups {
-		params := url.Values{}
-		params.Set("name", group)
-
-		_, err := c.makeRequest("POST", "groups", params)
-		if err != nil {
+		if existing[group] {
+			continue
+		}
+		if _, err := c.AddGroup(ctx, Group{Name: group, Enabled: true}); err != nil {
 			return fmt.Errorf("failed to add group %s: %w", group, err)
 		}
 	}
 	return nil
 }
 
-func (c *Client) updateDNSRecords(dnsRecords []string) error {
+func stringSet(values []string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, value := range values {
+		set[value] = true
+	}
+	return set
+}
+
+func (c *Client) updateDNSRecords(ctx context.Context, dnsRecords []string) error {
 	for _, record := range dnsRecords {
 		parts := strings.Split(record, "=")
 		if len(parts) != 2 {
@@ -424,7 +802,7 @@ func (c *Client) updateDNSRecords(dnsRecords []string) error {
 		params.Set("domain", parts[0])
 		params.Set("ip", parts[1])
 
-		_, err := c.makeRequest("POST", "dns", params)
+		_, err := c.makeRequest(ctx, "POST", "dns", params)
 		if err != nil {
 			return fmt.Errorf("failed to add DNS record %s: %w", record, err)
 		}
@@ -432,28 +810,25 @@ func (c *Client) updateDNSRecords(dnsRecords []string) error {
 	return nil
 }
 
-func (c *Client) updateDHCP(dhcp []string) error {
+func (c *Client) updateDHCP(ctx context.Context, dhcp []string) error {
 	return nil
 }
 
 // GetBackup downloads a backup from Pi-hole using the Teleporter API
-func (c *Client) GetBackup() ([]byte, error) {
-	if c.SID == "" {
-		if err := c.authenticate(); err != nil {
-			return nil, fmt.Errorf("authentication failed: %w", err)
-		}
-	}
+func (c *Client) GetBackup(ctx context.Context) ([]byte, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
 
 	reqURL := fmt.Sprintf("%s/api/teleporter", c.BaseURL)
 
-	req, err := http.NewRequest("GET", reqURL, nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create backup request: %w", err)
-	}
-
-	req.Header.Set("sid", c.SID)
-
-	resp, err := c.client.Do(req)
+	resp, err := c.doAuthenticated(ctx, func(sid, csrf string) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "GET", reqURL, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create backup request: %w", err)
+		}
+		req.Header.Set("sid", sid)
+		return req, nil
+	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to download backup: %w", err)
 	}
@@ -461,24 +836,47 @@ func (c *Client) GetBackup() ([]byte, error) {
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("backup download failed with status %d: %s", resp.StatusCode, string(body))
+		return nil, &StatusError{Op: "backup download", StatusCode: resp.StatusCode, Body: string(body)}
 	}
 
 	return io.ReadAll(resp.Body)
 }
 
 // RestoreBackup uploads a backup to Pi-hole using the Teleporter API
-func (c *Client) RestoreBackup(backupData []byte) error {
-	return c.RestoreBackupWithOptions(backupData, nil)
+func (c *Client) RestoreBackup(ctx context.Context, backupData []byte) error {
+	return c.RestoreBackupWithOptions(ctx, backupData, nil)
 }
 
-// RestoreBackupWithOptions uploads a backup to Pi-hole using the Teleporter API with specific import options
-func (c *Client) RestoreBackupWithOptions(backupData []byte, importOptions map[string]bool) error {
-	if c.SID == "" {
-		if err := c.authenticate(); err != nil {
-			return fmt.Errorf("authentication failed: %w", err)
-		}
-	}
+// ImportOptions selects what a Teleporter restore imports, in the schema of
+// the Pi-hole v6 /api/teleporter "import" field. Each option replaces the
+// whole file or gravity table it names.
+type ImportOptions struct {
+	// Config imports pihole.toml: settings, local DNS records and CNAMEs,
+	// and the DHCP configuration including static leases
+	Config bool `json:"config"`
+	// DHCPLeases imports the active DHCP leases
+	DHCPLeases bool                 `json:"dhcp_leases"`
+	Gravity    GravityImportOptions `json:"gravity"`
+}
+
+// GravityImportOptions selects the gravity database tables to import. The
+// *_by_group tables hold the group assignments of adlists, domains and
+// clients.
+type GravityImportOptions struct {
+	Group             bool `json:"group"`
+	Adlist            bool `json:"adlist"`
+	AdlistByGroup     bool `json:"adlist_by_group"`
+	Domainlist        bool `json:"domainlist"`
+	DomainlistByGroup bool `json:"domainlist_by_group"`
+	Client            bool `json:"client"`
+	ClientByGroup     bool `json:"client_by_group"`
+}
+
+// RestoreBackupWithOptions uploads a backup to Pi-hole using the Teleporter
+// API, importing only what importOptions selects; nil imports everything.
+func (c *Client) RestoreBackupWithOptions(ctx context.Context, backupData []byte, importOptions *ImportOptions) error {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
 
 	reqURL := fmt.Sprintf("%s/api/teleporter", c.BaseURL)
 
@@ -515,16 +913,16 @@ func (c *Client) RestoreBackupWithOptions(backupData []byte, importOptions map[s
 
 	writer.Close()
 
-	req, err := http.NewRequest("POST", reqURL, &buf)
-	if err != nil {
-		return fmt.Errorf("failed to create restore request: %w", err)
-	}
-
-	req.Header.Set("Content-Type", writer.FormDataContentType())
-	req.Header.Set("sid", c.SID)
-	req.Header.Set("X-FTL-CSRF", c.CSRFToken)
-
-	resp, err := c.client.Do(req)
+	resp, err := c.doAuthenticated(ctx, func(sid, csrf string) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "POST", reqURL, bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create restore request: %w", err)
+		}
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		req.Header.Set("sid", sid)
+		req.Header.Set("X-FTL-CSRF", csrf)
+		return req, nil
+	})
 	if err != nil {
 		return fmt.Errorf("failed to upload backup: %w", err)
 	}
@@ -532,15 +930,15 @@ func (c *Client) RestoreBackupWithOptions(backupData []byte, importOptions map[s
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("backup restore failed with status %d: %s", resp.StatusCode, string(body))
+		return &StatusError{Op: "backup restore", StatusCode: resp.StatusCode, Body: string(body)}
 	}
 
 	return nil
 }
 
 // GetSummaryStats retrieves summary statistics from Pi-hole FTL API
-func (c *Client) GetSummaryStats() (*types.SummaryStats, error) {
-	body, err := c.makeRequest("GET", "stats/summary", nil)
+func (c *Client) GetSummaryStats(ctx context.Context) (*types.SummaryStats, error) {
+	body, err := c.makeRequest(ctx, "GET", "stats/summary", nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get summary stats: %w", err)
 	}
@@ -554,8 +952,8 @@ func (c *Client) GetSummaryStats() (*types.SummaryStats, error) {
 }
 
 // GetQueryTypes retrieves query types statistics from Pi-hole FTL API
-func (c *Client) GetQueryTypes() (*types.QueryTypes, error) {
-	body, err := c.makeRequest("GET", "stats/query_types", nil)
+func (c *Client) GetQueryTypes(ctx context.Context) (*types.QueryTypes, error) {
+	body, err := c.makeRequest(ctx, "GET", "stats/query_types", nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get query types: %w", err)
 	}
@@ -569,8 +967,8 @@ func (c *Client) GetQueryTypes() (*types.QueryTypes, error) {
 }
 
 // GetUpstreams retrieves upstream server statistics from Pi-hole FTL API
-func (c *Client) GetUpstreams() (*types.Upstreams, error) {
-	body, err := c.makeRequest("GET", "stats/upstreams", nil)
+func (c *Client) GetUpstreams(ctx context.Context) (*types.Upstreams, error) {
+	body, err := c.makeRequest(ctx, "GET", "stats/upstreams", nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get upstreams: %w", err)
 	}
@@ -584,8 +982,8 @@ func (c *Client) GetUpstreams() (*types.Upstreams, error) {
 }
 
 // GetTopDomains retrieves top domains statistics from Pi-hole FTL API
-func (c *Client) GetTopDomains() (*types.TopDomains, error) {
-	body, err := c.makeRequest("GET", "stats/top_domains", nil)
+func (c *Client) GetTopDomains(ctx context.Context) (*types.TopDomains, error) {
+	body, err := c.makeRequest(ctx, "GET", "stats/top_domains", nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get top domains: %w", err)
 	}
@@ -599,8 +997,8 @@ func (c *Client) GetTopDomains() (*types.TopDomains, error) {
 }
 
 // GetTopClients retrieves top clients statistics from Pi-hole FTL API
-func (c *Client) GetTopClients() (*types.TopClients, error) {
-	body, err := c.makeRequest("GET", "stats/top_clients", nil)
+func (c *Client) GetTopClients(ctx context.Context) (*types.TopClients, error) {
+	body, err := c.makeRequest(ctx, "GET", "stats/top_clients", nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get top clients: %w", err)
 	}
@@ -614,8 +1012,8 @@ func (c *Client) GetTopClients() (*types.TopClients, error) {
 }
 
 // GetRecentBlocked retrieves recently blocked domains from Pi-hole FTL API
-func (c *Client) GetRecentBlocked() (*types.RecentBlocked, error) {
-	body, err := c.makeRequest("GET", "stats/recent_blocked", nil)
+func (c *Client) GetRecentBlocked(ctx context.Context) (*types.RecentBlocked, error) {
+	body, err := c.makeRequest(ctx, "GET", "stats/recent_blocked", nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get recent blocked: %w", err)
 	}
@@ -1,6 +1,9 @@
 package pihole
 
 import (
+	"context"
+	"encoding/json"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -35,7 +38,7 @@ func TestMakeRequest(t *testing.T) {
 
 	client := NewClient(server.URL, "test-password")
 
-	body, err := client.makeRequest("GET", "", nil)
+	body, err := client.makeRequest(context.Background(), "GET", "", nil)
 	require.NoError(t, err)
 
 	assert.True(t, authCalled)
@@ -58,7 +61,7 @@ func TestMakeRequestError(t *testing.T) {
 
 	client := NewClient(server.URL, "test-password")
 
-	_, err := client.makeRequest("GET", "", nil)
+	_, err := client.makeRequest(context.Background(), "GET", "", nil)
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "authentication failed")
 }
@@ -88,7 +91,7 @@ func TestGetData(t *testing.T) {
 
 	client := NewClient(server.URL, "test-password")
 
-	data, err := client.GetData()
+	data, err := client.GetData(context.Background())
 	require.NoError(t, err)
 
 	assert.NotNil(t, data)
@@ -130,7 +133,7 @@ func TestUpdateData(t *testing.T) {
 		Blacklist: []string{"bad.com"},
 	}
 
-	err := client.UpdateData(data)
+	err := client.UpdateData(context.Background(), data)
 	assert.NoError(t, err)
 }
 
@@ -153,7 +156,7 @@ func TestUpdateDataAlwaysErrors(t *testing.T) {
 		Blacklist: []string{"bad.com"},
 	}
 
-	err := client.UpdateData(data)
+	err := client.UpdateData(context.Background(), data)
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "authentication failed")
 }
@@ -172,7 +175,7 @@ func TestGetDataInvalidJSON(t *testing.T) {
 
 	client := NewClient(server.URL, "test-password")
 
-	_, err := client.GetData()
+	_, err := client.GetData(context.Background())
 	assert.Error(t, err)
 }
 
@@ -201,7 +204,7 @@ func TestGetDataEmptyResponse(t *testing.T) {
 
 	client := NewClient(server.URL, "test-password")
 
-	data, err := client.GetData()
+	data, err := client.GetData(context.Background())
 	require.NoError(t, err)
 
 	assert.Empty(t, data.Adlists)
@@ -223,7 +226,7 @@ func TestMakeRequestTimeout(t *testing.T) {
 	client := NewClient(server.URL, "test-password")
 	client.client.Timeout = 10 * time.Millisecond
 
-	_, err := client.makeRequest("GET", "", nil)
+	_, err := client.makeRequest(context.Background(), "GET", "", nil)
 	assert.Error(t, err)
 }
 
@@ -234,21 +237,21 @@ func TestUpdateDataNetworkError(t *testing.T) {
 		Adlists: []string{"example.com"},
 	}
 
-	err := client.UpdateData(data)
+	err := client.UpdateData(context.Background(), data)
 	assert.Error(t, err)
 }
 
 func TestGetDataNetworkError(t *testing.T) {
 	client := NewClient("http://invalid-host-that-does-not-exist.local", "test-password")
 
-	_, err := client.GetData()
+	_, err := client.GetData(context.Background())
 	assert.Error(t, err)
 }
 
 func TestMakeRequestInvalidURL(t *testing.T) {
 	client := NewClient("invalid-url", "test-password")
 
-	_, err := client.makeRequest("GET", "", nil)
+	_, err := client.makeRequest(context.Background(), "GET", "", nil)
 	assert.Error(t, err)
 }
 
@@ -264,7 +267,7 @@ func TestAuthenticate(t *testing.T) {
 
 	client := NewClient(server.URL, "test-password")
 
-	err := client.authenticate()
+	err := client.authenticate(context.Background())
 	assert.NoError(t, err)
 	assert.Equal(t, "test-sid", client.SID)
 	assert.Equal(t, "test-csrf", client.CSRFToken)
@@ -282,7 +285,7 @@ func TestAuthenticateFailure(t *testing.T) {
 
 	client := NewClient(server.URL, "wrong-password")
 
-	err := client.authenticate()
+	err := client.authenticate(context.Background())
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "authentication failed")
 }
@@ -299,7 +302,7 @@ func TestAuthenticateInvalidResponse(t *testing.T) {
 
 	client := NewClient(server.URL, "test-password")
 
-	err := client.authenticate()
+	err := client.authenticate(context.Background())
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "session object not found")
 }
@@ -316,7 +319,7 @@ func TestAuthenticateInvalidJSON(t *testing.T) {
 
 	client := NewClient(server.URL, "test-password")
 
-	err := client.authenticate()
+	err := client.authenticate(context.Background())
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "failed to parse auth response")
 }
@@ -333,7 +336,7 @@ func TestAuthenticateMissingCSRFToken(t *testing.T) {
 
 	client := NewClient(server.URL, "test-password")
 
-	err := client.authenticate()
+	err := client.authenticate(context.Background())
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "session.csrf not found")
 }
@@ -357,12 +360,29 @@ func TestMakeRequestWithExistingSession(t *testing.T) {
 	client.SID = "test-sid"
 	client.CSRFToken = "test-csrf"
 
-	_, err := client.makeRequest("GET", "", nil)
+	_, err := client.makeRequest(context.Background(), "GET", "", nil)
 	require.NoError(t, err)
 
 	assert.Equal(t, 0, authCallCount, "Should not authenticate when session already exists")
 }
 
+func TestGetBlocking(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/auth" {
+			w.Write([]byte(`{"session": {"sid": "test-sid", "csrf": "test-csrf"}}`))
+			return
+		}
+		assert.Equal(t, "/api/dns/blocking", r.URL.Path)
+		w.Write([]byte(`{"blocking": "disabled", "timer": 30.5, "took": 0.001}`))
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, "test-password")
+	blocking, err := client.GetBlocking(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, BlockingDisabled, blocking)
+}
+
 func TestMakeRequestPOSTWithCSRF(t *testing.T) {
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path == "/api/auth" {
@@ -382,7 +402,7 @@ func TestMakeRequestPOSTWithCSRF(t *testing.T) {
 
 	client := NewClient(server.URL, "test-password")
 
-	_, err := client.makeRequest("POST", "", nil)
+	_, err := client.makeRequest(context.Background(), "POST", "", nil)
 	require.NoError(t, err)
 }
 
@@ -409,6 +429,366 @@ func TestUpdateDataWithEmptyData(t *testing.T) {
 
 	data := &PiholeData{}
 
-	err := client.UpdateData(data)
+	err := client.UpdateData(context.Background(), data)
 	assert.NoError(t, err)
 }
+
+func TestMakeRequestContextCanceled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, "test-password")
+	client.SID = "test-sid"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+
+	start := time.Now()
+	_, err := client.makeRequest(ctx, "GET", "", nil)
+	assert.Error(t, err)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestGetBackupPerCallTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, "test-password")
+	client.SID = "test-sid"
+	client.Timeout = 20 * time.Millisecond
+
+	_, err := client.GetBackup(context.Background())
+	assert.Error(t, err)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+// expiringSessionServer accepts only the sid issued by the most recent login,
+// so a client holding "stale-sid" sees 401 until it re-authenticates.
+func expiringSessionServer(authCalls *int, handler http.HandlerFunc) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/auth" {
+			*authCalls++
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{"session": {"sid": "fresh-sid", "csrf": "fresh-csrf"}}`))
+			return
+		}
+		if r.URL.Query().Get("sid") != "fresh-sid" && r.Header.Get("sid") != "fresh-sid" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error": {"key": "unauthorized", "message": "Unauthorized"}}`))
+			return
+		}
+		handler(w, r)
+	}))
+}
+
+func TestMakeRequestReauthenticatesOnExpiredSession(t *testing.T) {
+	authCalls := 0
+	server := expiringSessionServer(&authCalls, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"status": "enabled"}`))
+	})
+	defer server.Close()
+
+	client := NewClient(server.URL, "test-password")
+	client.SID = "stale-sid"
+	client.CSRFToken = "stale-csrf"
+
+	body, err := client.makeRequest(context.Background(), "GET", "stats/summary", nil)
+	require.NoError(t, err)
+
+	assert.Contains(t, string(body), "enabled")
+	assert.Equal(t, 1, authCalls)
+	assert.Equal(t, "fresh-sid", client.SID)
+	assert.Equal(t, "fresh-csrf", client.CSRFToken)
+}
+
+func TestMakeRequestReauthenticatesOnlyOnce(t *testing.T) {
+	authCalls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/auth" {
+			authCalls++
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{"session": {"sid": "test-sid", "csrf": "test-csrf"}}`))
+			return
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("Unauthorized"))
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, "test-password")
+	client.SID = "stale-sid"
+
+	_, err := client.makeRequest(context.Background(), "GET", "stats/summary", nil)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "status 401")
+	assert.Equal(t, 1, authCalls)
+}
+
+func TestGetBackupReauthenticatesOnExpiredSession(t *testing.T) {
+	authCalls := 0
+	server := expiringSessionServer(&authCalls, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("zip-data"))
+	})
+	defer server.Close()
+
+	client := NewClient(server.URL, "test-password")
+	client.SID = "stale-sid"
+
+	data, err := client.GetBackup(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "zip-data", string(data))
+	assert.Equal(t, 1, authCalls)
+}
+
+func TestRestoreBackupReauthenticatesOnExpiredSession(t *testing.T) {
+	authCalls := 0
+	var uploads, imports []string
+	server := expiringSessionServer(&authCalls, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "fresh-csrf", r.Header.Get("X-FTL-CSRF"))
+		file, _, err := r.FormFile("file")
+		require.NoError(t, err)
+		defer file.Close()
+		content, _ := io.ReadAll(file)
+		uploads = append(uploads, string(content))
+		imports = append(imports, r.FormValue("import"))
+		w.WriteHeader(http.StatusOK)
+	})
+	defer server.Close()
+
+	client := NewClient(server.URL, "test-password")
+	client.SID = "stale-sid"
+
+	err := client.RestoreBackupWithOptions(context.Background(), []byte("zip-data"), &ImportOptions{
+		Gravity: GravityImportOptions{Adlist: true, AdlistByGroup: true},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 1, authCalls)
+	assert.Equal(t, []string{"zip-data"}, uploads)
+	require.Len(t, imports, 1)
+	assert.JSONEq(t, `{
+		"config": false,
+		"dhcp_leases": false,
+		"gravity": {
+			"group": false,
+			"adlist": true,
+			"adlist_by_group": true,
+			"domainlist": false,
+			"domainlist_by_group": false,
+			"client": false,
+			"client_by_group": false
+		}
+	}`, imports[0])
+}
+
+func TestLogout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "DELETE", r.Method)
+		assert.Equal(t, "/api/auth", r.URL.Path)
+		assert.Equal(t, "test-sid", r.Header.Get("sid"))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, "test-password")
+	client.SID = "test-sid"
+	client.CSRFToken = "test-csrf"
+
+	err := client.Logout(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, client.SID)
+	assert.Empty(t, client.CSRFToken)
+}
+
+func TestAuthenticateSendsTOTP(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]interface{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&payload))
+		assert.Equal(t, "test-password", payload["password"])
+		assert.IsType(t, float64(0), payload["totp"])
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"session": {"sid": "test-sid", "csrf": "test-csrf"}}`))
+	}))
+	defer server.Close()
+
+	client, err := NewClientWithOptions(server.URL, ClientOptions{
+		Password:   "test-password",
+		TOTPSecret: "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ",
+	})
+	require.NoError(t, err)
+
+	err = client.authenticate(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "test-sid", client.SID)
+}
+
+func TestAuthenticateWaitsForUnusedTOTPCode(t *testing.T) {
+	var codes []float64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]interface{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&payload))
+		codes = append(codes, payload["totp"].(float64))
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"session": {"sid": "test-sid", "csrf": "test-csrf"}}`))
+	}))
+	defer server.Close()
+
+	client, err := NewClientWithOptions(server.URL, ClientOptions{
+		Password:   "test-password",
+		TOTPSecret: "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ",
+	})
+	require.NoError(t, err)
+
+	// Start 100ms before the end of a time step
+	wall := time.Now()
+	boundary := wall.Truncate(totpPeriod).Add(totpPeriod)
+	offset := boundary.Add(-100 * time.Millisecond).Sub(wall)
+	client.now = func() time.Time { return time.Now().Add(offset) }
+
+	require.NoError(t, client.authenticate(context.Background()))
+	started := time.Now()
+	require.NoError(t, client.authenticate(context.Background()))
+
+	require.Len(t, codes, 2)
+	assert.NotEqual(t, codes[0], codes[1], "a used code must not be sent again")
+	assert.Less(t, time.Since(started), 5*time.Second)
+
+	// Waiting for the next code honors the context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = client.authenticate(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Len(t, codes, 2)
+}
+
+func TestAuthenticateTOTPRequiredButNotConfigured(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"session": {"valid": false, "totp": true, "sid": null, "validity": -1, "message": "no 2FA token found"}}`))
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, "test-password")
+
+	err := client.authenticate(context.Background())
+	assert.ErrorIs(t, err, ErrTOTPRequired)
+
+	_, err = client.makeRequest(context.Background(), "GET", "stats/summary", nil)
+	assert.ErrorIs(t, err, ErrTOTPRequired)
+}
+
+func TestAuthenticateTOTPRejected(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"session": {"valid": false, "totp": true, "sid": null, "validity": -1, "message": "2FA token invalid"}}`))
+	}))
+	defer server.Close()
+
+	client, err := NewClientWithOptions(server.URL, ClientOptions{
+		Password:   "test-password",
+		TOTPSecret: "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ",
+	})
+	require.NoError(t, err)
+
+	err = client.authenticate(context.Background())
+	assert.ErrorIs(t, err, ErrTOTPRejected)
+	assert.NotErrorIs(t, err, ErrTOTPRequired)
+}
+
+func TestTypedGetters(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/auth" {
+			w.Write([]byte(`{"session": {"sid": "test-sid", "csrf": "test-csrf"}}`))
+			return
+		}
+
+		switch r.URL.Path {
+		case "/api/domains":
+			w.Write([]byte(`{"domains": [
+				{"domain": "ads.example.com", "unicode": "ads.example.com", "type": "deny", "kind": "exact", "comment": "tracker", "groups": [0, 2], "enabled": true, "id": 7, "date_added": 1700000000, "date_modified": 1700000100},
+				{"domain": "(^|\\.)doubleclick\\.net$", "type": "deny", "kind": "regex", "comment": null, "groups": [0], "enabled": false, "id": 8, "date_added": 1700000000, "date_modified": 1700000000},
+				{"domain": "good.example.com", "type": "allow", "kind": "exact", "comment": null, "groups": [0], "enabled": true, "id": 9, "date_added": 1700000000, "date_modified": 1700000000}
+			], "took": 0.001}`))
+		case "/api/lists":
+			w.Write([]byte(`{"lists": [
+				{"address": "https://example.com/hosts", "type": "block", "comment": "main", "groups": [0], "enabled": true, "id": 1, "date_added": 1700000000, "date_modified": 1700000000, "date_updated": 1700000500, "number": 1234, "invalid_domains": 2, "abp_entries": 0, "status": 2}
+			]}`))
+		case "/api/groups":
+			w.Write([]byte(`{"groups": [
+				{"name": "Default", "comment": "The default group", "enabled": true, "id": 0, "date_added": 1700000000, "date_modified": 1700000000},
+				{"name": "kids", "comment": null, "enabled": false, "id": 2, "date_added": 1700000000, "date_modified": 1700000000}
+			]}`))
+		case "/api/clients":
+			w.Write([]byte(`{"clients": [
+				{"client": "192.168.1.0/24", "name": null, "comment": "lan", "groups": [0, 2], "id": 3, "date_added": 1700000000, "date_modified": 1700000000}
+			]}`))
+		case "/api/config":
+			w.Write([]byte(`{"config": {"dns": {"hosts": ["192.168.1.2 nas.lan"]}, "dhcp": {"active": false}}, "took": 0.001}`))
+		}
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, "test-password")
+	ctx := context.Background()
+
+	domains, err := client.GetDomains(ctx)
+	require.NoError(t, err)
+	require.Len(t, domains, 3)
+	assert.Equal(t, 7, domains[0].ID)
+	assert.Equal(t, "tracker", domains[0].Comment)
+	assert.Equal(t, []int{0, 2}, domains[0].Groups)
+	assert.Equal(t, int64(1700000100), domains[0].DateModified)
+	assert.True(t, domains[0].IsDeny())
+	assert.False(t, domains[0].IsRegex())
+	assert.True(t, domains[1].IsRegex())
+	assert.False(t, domains[1].Enabled)
+	assert.Empty(t, domains[1].Comment)
+	assert.True(t, domains[2].IsAllow())
+
+	lists, err := client.GetAdlists(ctx)
+	require.NoError(t, err)
+	require.Len(t, lists, 1)
+	assert.Equal(t, ListBlock, lists[0].Type)
+	assert.Equal(t, "https://example.com/hosts", lists[0].Address)
+	assert.Equal(t, 1234, lists[0].Number)
+
+	groups, err := client.GetGroups(ctx)
+	require.NoError(t, err)
+	require.Len(t, groups, 2)
+	assert.Equal(t, "Default", groups[0].Name)
+	assert.Equal(t, 2, groups[1].ID)
+	assert.False(t, groups[1].Enabled)
+
+	clients, err := client.GetClients(ctx)
+	require.NoError(t, err)
+	require.Len(t, clients, 1)
+	assert.Equal(t, "192.168.1.0/24", clients[0].Client)
+	assert.Equal(t, []int{0, 2}, clients[0].Groups)
+
+	cfg, err := client.GetConfig(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{"192.168.1.2 nas.lan"}, cfg["dns"].(map[string]interface{})["hosts"])
+
+	// The legacy flattened view is derived from the typed data
+	data, err := client.GetData(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"ads.example.com"}, data.Blacklist)
+	assert.Equal(t, []string{"(^|\\.)doubleclick\\.net$"}, data.RegexBlacklist)
+	assert.Equal(t, []string{"good.example.com"}, data.Whitelist)
+	assert.Empty(t, data.RegexWhitelist)
+	assert.Equal(t, []string{"Default", "kids"}, data.Groups)
+}
@@ -0,0 +1,293 @@
+package pihole
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Outcome describes what a create, update or delete call did on the Pi-hole.
+// "Already exists" and, for deletes, "not found" are reported as outcomes
+// rather than errors so that callers can apply the same change repeatedly.
+type Outcome string
+
+const (
+	OutcomeApplied  Outcome = "applied"
+	OutcomeExists   Outcome = "exists"
+	OutcomeNotFound Outcome = "not_found"
+)
+
+// domainPayload is the body of POST/PUT /api/domains
+type domainPayload struct {
+	Domain  string     `json:"domain,omitempty"`
+	Type    DomainType `json:"type,omitempty"`
+	Kind    DomainKind `json:"kind,omitempty"`
+	Comment string     `json:"comment"`
+	Groups  []int      `json:"groups"`
+	Enabled bool       `json:"enabled"`
+}
+
+// listPayload is the body of POST/PUT /api/lists
+type listPayload struct {
+	Address string   `json:"address,omitempty"`
+	Type    ListType `json:"type,omitempty"`
+	Comment string   `json:"comment"`
+	Groups  []int    `json:"groups"`
+	Enabled bool     `json:"enabled"`
+}
+
+// groupPayload is the body of POST/PUT /api/groups
+type groupPayload struct {
+	Name    string `json:"name"`
+	Comment string `json:"comment"`
+	Enabled bool   `json:"enabled"`
+}
+
+// clientPayload is the body of POST/PUT /api/clients
+type clientPayload struct {
+	Client  string `json:"client,omitempty"`
+	Comment string `json:"comment"`
+	Groups  []int  `json:"groups"`
+}
+
+// mutationResponse is the part of a POST/PUT response that reports per-item
+// failures. FTL answers 201 even if some items were rejected.
+type mutationResponse struct {
+	Processed struct {
+		Errors []struct {
+			Item  string `json:"item"`
+			Error string `json:"error"`
+		} `json:"errors"`
+	} `json:"processed"`
+}
+
+func groupsOrDefault(groups []int) []int {
+	if len(groups) == 0 {
+		return []int{0}
+	}
+	return groups
+}
+
+// AddDomain creates an allow/deny entry. An existing entry is not an error.
+func (c *Client) AddDomain(ctx context.Context, domain Domain) (Outcome, error) {
+	endpoint := fmt.Sprintf("domains/%s/%s", domain.Type, domainKindOrExact(domain.Kind))
+	return c.mutate(ctx, "POST", endpoint, nil, domainPayload{
+		Domain:  domain.Domain,
+		Comment: domain.Comment,
+		Groups:  groupsOrDefault(domain.Groups),
+		Enabled: domain.Enabled,
+	})
+}
+
+// UpdateDomain replaces comment, groups and enabled state of the entry
+// identified by domain's Domain, Type and Kind.
+func (c *Client) UpdateDomain(ctx context.Context, domain Domain) (Outcome, error) {
+	kind := domainKindOrExact(domain.Kind)
+	endpoint := fmt.Sprintf("domains/%s/%s/%s", domain.Type, kind, url.PathEscape(domain.Domain))
+	return c.mutate(ctx, "PUT", endpoint, nil, domainPayload{
+		Type:    domain.Type,
+		Kind:    kind,
+		Comment: domain.Comment,
+		Groups:  groupsOrDefault(domain.Groups),
+		Enabled: domain.Enabled,
+	})
+}
+
+// DeleteDomain removes an allow/deny entry. A missing entry is not an error.
+func (c *Client) DeleteDomain(ctx context.Context, domainType DomainType, kind DomainKind, domain string) (Outcome, error) {
+	endpoint := fmt.Sprintf("domains/%s/%s/%s", domainType, domainKindOrExact(kind), url.PathEscape(domain))
+	return c.mutate(ctx, "DELETE", endpoint, nil, nil)
+}
+
+func domainKindOrExact(kind DomainKind) DomainKind {
+	if kind == "" {
+		return DomainExact
+	}
+	return kind
+}
+
+// AddAdlist subscribes to a list. An existing subscription is not an error.
+func (c *Client) AddAdlist(ctx context.Context, list Adlist) (Outcome, error) {
+	query := url.Values{"type": {string(listTypeOrBlock(list.Type))}}
+	return c.mutate(ctx, "POST", "lists", query, listPayload{
+		Address: list.Address,
+		Comment: list.Comment,
+		Groups:  groupsOrDefault(list.Groups),
+		Enabled: list.Enabled,
+	})
+}
+
+// UpdateAdlist replaces comment, groups and enabled state of the list
+// identified by its Address and Type.
+func (c *Client) UpdateAdlist(ctx context.Context, list Adlist) (Outcome, error) {
+	listType := listTypeOrBlock(list.Type)
+	query := url.Values{"type": {string(listType)}}
+	return c.mutate(ctx, "PUT", "lists/"+url.PathEscape(list.Address), query, listPayload{
+		Type:    listType,
+		Comment: list.Comment,
+		Groups:  groupsOrDefault(list.Groups),
+		Enabled: list.Enabled,
+	})
+}
+
+// DeleteAdlist unsubscribes from a list. A missing list is not an error.
+func (c *Client) DeleteAdlist(ctx context.Context, listType ListType, address string) (Outcome, error) {
+	query := url.Values{"type": {string(listTypeOrBlock(listType))}}
+	return c.mutate(ctx, "DELETE", "lists/"+url.PathEscape(address), query, nil)
+}
+
+func listTypeOrBlock(listType ListType) ListType {
+	if listType == "" {
+		return ListBlock
+	}
+	return listType
+}
+
+// AddGroup creates a group. An existing group is not an error.
+func (c *Client) AddGroup(ctx context.Context, group Group) (Outcome, error) {
+	return c.mutate(ctx, "POST", "groups", nil, groupPayload{
+		Name:    group.Name,
+		Comment: group.Comment,
+		Enabled: group.Enabled,
+	})
+}
+
+// UpdateGroup replaces the group called name with group, which may carry a
+// new name to rename it.
+func (c *Client) UpdateGroup(ctx context.Context, name string, group Group) (Outcome, error) {
+	if group.Name == "" {
+		group.Name = name
+	}
+	return c.mutate(ctx, "PUT", "groups/"+url.PathEscape(name), nil, groupPayload{
+		Name:    group.Name,
+		Comment: group.Comment,
+		Enabled: group.Enabled,
+	})
+}
+
+// DeleteGroup removes a group. A missing group is not an error.
+func (c *Client) DeleteGroup(ctx context.Context, name string) (Outcome, error) {
+	return c.mutate(ctx, "DELETE", "groups/"+url.PathEscape(name), nil, nil)
+}
+
+// AddClient creates a client entry. An existing client is not an error.
+func (c *Client) AddClient(ctx context.Context, client ClientEntry) (Outcome, error) {
+	return c.mutate(ctx, "POST", "clients", nil, clientPayload{
+		Client:  client.Client,
+		Comment: client.Comment,
+		Groups:  groupsOrDefault(client.Groups),
+	})
+}
+
+// UpdateClient replaces comment and groups of the client entry.
+func (c *Client) UpdateClient(ctx context.Context, client ClientEntry) (Outcome, error) {
+	return c.mutate(ctx, "PUT", "clients/"+url.PathEscape(client.Client), nil, clientPayload{
+		Comment: client.Comment,
+		Groups:  groupsOrDefault(client.Groups),
+	})
+}
+
+// DeleteClient removes a client entry. A missing client is not an error.
+func (c *Client) DeleteClient(ctx context.Context, client string) (Outcome, error) {
+	return c.mutate(ctx, "DELETE", "clients/"+url.PathEscape(client), nil, nil)
+}
+
+// mutate sends a JSON create/update/delete request and classifies the
+// response into an Outcome.
+func (c *Client) mutate(ctx context.Context, method, endpoint string, query url.Values, payload interface{}) (Outcome, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	var payloadJSON []byte
+	if payload != nil {
+		var err error
+		payloadJSON, err = json.Marshal(payload)
+		if err != nil {
+			return "", fmt.Errorf("failed to marshal request data: %w", err)
+		}
+	}
+
+	resp, err := c.doAuthenticated(ctx, func(sid, csrf string) (*http.Request, error) {
+		params := url.Values{}
+		for key, values := range query {
+			params[key] = values
+		}
+		params.Set("sid", sid)
+		reqURL := fmt.Sprintf("%s/api/%s?%s", c.BaseURL, endpoint, params.Encode())
+
+		var body io.Reader
+		if payloadJSON != nil {
+			body = bytes.NewReader(payloadJSON)
+		}
+		req, err := http.NewRequestWithContext(ctx, method, reqURL, body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create request: %w", err)
+		}
+		if payloadJSON != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		req.Header.Set("X-FTL-CSRF", csrf)
+		return req, nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to make request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read response: %w", err)
+	}
+
+	switch {
+	// Only a delete of a missing item already has the wanted result; an
+	// update of one did not happen
+	case resp.StatusCode == http.StatusNotFound && method == "DELETE":
+		return OutcomeNotFound, nil
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return processedOutcome(body)
+	case isAlreadyExists(string(body)):
+		return OutcomeExists, nil
+	default:
+		return "", &StatusError{Op: method + " " + endpoint, StatusCode: resp.StatusCode, Body: string(body)}
+	}
+}
+
+// processedOutcome inspects processed.errors of a successful response. Items
+// rejected only because they already exist count as OutcomeExists.
+func processedOutcome(body []byte) (Outcome, error) {
+	if len(body) == 0 {
+		return OutcomeApplied, nil
+	}
+
+	var resp mutationResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		// Bodies without a processed section (e.g. 204) are plain successes
+		return OutcomeApplied, nil
+	}
+
+	if len(resp.Processed.Errors) == 0 {
+		return OutcomeApplied, nil
+	}
+
+	var failures []string
+	for _, itemErr := range resp.Processed.Errors {
+		if !isAlreadyExists(itemErr.Error) {
+			failures = append(failures, fmt.Sprintf("%s: %s", itemErr.Item, itemErr.Error))
+		}
+	}
+	if len(failures) > 0 {
+		return "", fmt.Errorf("rejected by Pi-hole: %s", strings.Join(failures, "; "))
+	}
+	return OutcomeExists, nil
+}
+
+func isAlreadyExists(message string) bool {
+	lower := strings.ToLower(message)
+	return strings.Contains(lower, "unique constraint failed") || strings.Contains(lower, "already exists")
+}
@@ -0,0 +1,292 @@
+package pihole
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type recordedRequest struct {
+	Method string
+	Path   string
+	Type   string
+	Body   map[string]interface{}
+}
+
+// newCRUDServer records every non-auth request and answers with respond.
+func newCRUDServer(t *testing.T, requests *[]recordedRequest, respond func(w http.ResponseWriter, r *http.Request)) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/auth" {
+			w.Write([]byte(`{"session": {"sid": "test-sid", "csrf": "test-csrf"}}`))
+			return
+		}
+
+		assert.Equal(t, "test-sid", r.URL.Query().Get("sid"))
+		rec := recordedRequest{Method: r.Method, Path: r.URL.EscapedPath(), Type: r.URL.Query().Get("type")}
+		if raw, _ := io.ReadAll(r.Body); len(raw) > 0 {
+			require.NoError(t, json.Unmarshal(raw, &rec.Body))
+		}
+		*requests = append(*requests, rec)
+		respond(w, r)
+	}))
+}
+
+func created(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "DELETE" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(`{"processed": {"success": [{"item": "x"}], "errors": []}}`))
+}
+
+func TestDomainCRUD(t *testing.T) {
+	var requests []recordedRequest
+	server := newCRUDServer(t, &requests, created)
+	defer server.Close()
+
+	client := NewClient(server.URL, "test-password")
+	ctx := context.Background()
+
+	outcome, err := client.AddDomain(ctx, Domain{Domain: "ads.example.com", Type: DomainDeny, Kind: DomainExact, Comment: "c", Groups: []int{0, 3}, Enabled: true})
+	require.NoError(t, err)
+	assert.Equal(t, OutcomeApplied, outcome)
+
+	outcome, err = client.UpdateDomain(ctx, Domain{Domain: `(^|\.)ads\.net$`, Type: DomainDeny, Kind: DomainRegex, Enabled: false})
+	require.NoError(t, err)
+	assert.Equal(t, OutcomeApplied, outcome)
+
+	outcome, err = client.DeleteDomain(ctx, DomainAllow, DomainExact, "good.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, OutcomeApplied, outcome)
+
+	require.Len(t, requests, 3)
+	assert.Equal(t, "POST", requests[0].Method)
+	assert.Equal(t, "/api/domains/deny/exact", requests[0].Path)
+	assert.Equal(t, "ads.example.com", requests[0].Body["domain"])
+	assert.Equal(t, []interface{}{float64(0), float64(3)}, requests[0].Body["groups"])
+
+	assert.Equal(t, "PUT", requests[1].Method)
+	assert.Equal(t, "/api/domains/deny/regex/%28%5E%7C%5C.%29ads%5C.net$", requests[1].Path)
+	assert.Equal(t, false, requests[1].Body["enabled"])
+	assert.Equal(t, []interface{}{float64(0)}, requests[1].Body["groups"], "empty groups default to the Default group")
+
+	assert.Equal(t, "DELETE", requests[2].Method)
+	assert.Equal(t, "/api/domains/allow/exact/good.example.com", requests[2].Path)
+	assert.Nil(t, requests[2].Body)
+}
+
+func TestAdlistGroupClientCRUD(t *testing.T) {
+	var requests []recordedRequest
+	server := newCRUDServer(t, &requests, created)
+	defer server.Close()
+
+	client := NewClient(server.URL, "test-password")
+	ctx := context.Background()
+
+	_, err := client.AddAdlist(ctx, Adlist{Address: "https://example.com/hosts", Enabled: true})
+	require.NoError(t, err)
+	_, err = client.UpdateAdlist(ctx, Adlist{Address: "https://example.com/hosts", Type: ListAllow, Comment: "allow"})
+	require.NoError(t, err)
+	_, err = client.DeleteAdlist(ctx, ListBlock, "https://example.com/hosts")
+	require.NoError(t, err)
+
+	_, err = client.AddGroup(ctx, Group{Name: "kids", Enabled: true})
+	require.NoError(t, err)
+	_, err = client.UpdateGroup(ctx, "kids", Group{Name: "children", Enabled: false})
+	require.NoError(t, err)
+	_, err = client.DeleteGroup(ctx, "children")
+	require.NoError(t, err)
+
+	_, err = client.AddClient(ctx, ClientEntry{Client: "192.168.1.0/24", Groups: []int{2}})
+	require.NoError(t, err)
+	_, err = client.UpdateClient(ctx, ClientEntry{Client: "192.168.1.0/24", Comment: "lan"})
+	require.NoError(t, err)
+	_, err = client.DeleteClient(ctx, "192.168.1.0/24")
+	require.NoError(t, err)
+
+	expected := []struct{ method, path, listType string }{
+		{"POST", "/api/lists", "block"},
+		{"PUT", "/api/lists/https:%2F%2Fexample.com%2Fhosts", "allow"},
+		{"DELETE", "/api/lists/https:%2F%2Fexample.com%2Fhosts", "block"},
+		{"POST", "/api/groups", ""},
+		{"PUT", "/api/groups/kids", ""},
+		{"DELETE", "/api/groups/children", ""},
+		{"POST", "/api/clients", ""},
+		{"PUT", "/api/clients/192.168.1.0%2F24", ""},
+		{"DELETE", "/api/clients/192.168.1.0%2F24", ""},
+	}
+	require.Len(t, requests, len(expected))
+	for i, want := range expected {
+		assert.Equal(t, want.method, requests[i].Method, "request %d", i)
+		assert.Equal(t, want.path, requests[i].Path, "request %d", i)
+		assert.Equal(t, want.listType, requests[i].Type, "request %d", i)
+	}
+
+	assert.Equal(t, "https://example.com/hosts", requests[0].Body["address"])
+	assert.Equal(t, "children", requests[4].Body["name"])
+	assert.Equal(t, "192.168.1.0/24", requests[6].Body["client"])
+}
+
+func TestMutationIdempotentOutcomes(t *testing.T) {
+	var requests []recordedRequest
+	server := newCRUDServer(t, &requests, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"processed": {"success": [], "errors": [{"item": "ads.example.com", "error": "UNIQUE constraint failed: domainlist.domain, domainlist.type"}]}}`))
+		case "PUT":
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": {"key": "database_error", "message": "Could not add to gravity database", "hint": "UNIQUE constraint failed: group.name"}}`))
+		case "DELETE":
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error": {"key": "not_found", "message": "Item not found"}}`))
+		}
+	})
+	defer server.Close()
+
+	client := NewClient(server.URL, "test-password")
+	ctx := context.Background()
+
+	outcome, err := client.AddDomain(ctx, Domain{Domain: "ads.example.com", Type: DomainDeny})
+	require.NoError(t, err)
+	assert.Equal(t, OutcomeExists, outcome)
+
+	outcome, err = client.UpdateGroup(ctx, "kids", Group{Name: "Default"})
+	require.NoError(t, err)
+	assert.Equal(t, OutcomeExists, outcome)
+
+	outcome, err = client.DeleteClient(ctx, "10.0.0.1")
+	require.NoError(t, err)
+	assert.Equal(t, OutcomeNotFound, outcome)
+}
+
+func TestMutationRejectedItem(t *testing.T) {
+	var requests []recordedRequest
+	server := newCRUDServer(t, &requests, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"processed": {"success": [], "errors": [{"item": "[invalid", "error": "Invalid regex"}]}}`))
+	})
+	defer server.Close()
+
+	client := NewClient(server.URL, "test-password")
+
+	_, err := client.AddDomain(context.Background(), Domain{Domain: "[invalid", Type: DomainDeny, Kind: DomainRegex})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Invalid regex")
+}
+
+func TestMutationServerError(t *testing.T) {
+	var requests []recordedRequest
+	server := newCRUDServer(t, &requests, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("boom"))
+	})
+	defer server.Close()
+
+	client := NewClient(server.URL, "test-password")
+
+	_, err := client.DeleteGroup(context.Background(), "kids")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "status 500")
+}
+
+func TestMutationUpdateOfMissingItemFails(t *testing.T) {
+	var requests []recordedRequest
+	server := newCRUDServer(t, &requests, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error": {"key": "not_found", "message": "Item not found"}}`))
+	})
+	defer server.Close()
+
+	client := NewClient(server.URL, "test-password")
+
+	_, err := client.UpdateGroup(context.Background(), "kids", Group{Name: "kids"})
+	var statusErr *StatusError
+	require.ErrorAs(t, err, &statusErr)
+	assert.Equal(t, http.StatusNotFound, statusErr.StatusCode)
+
+	outcome, err := client.DeleteGroup(context.Background(), "kids")
+	require.NoError(t, err)
+	assert.Equal(t, OutcomeNotFound, outcome)
+}
+
+func TestUpdateDataConverges(t *testing.T) {
+	var requests []recordedRequest
+	server := newCRUDServer(t, &requests, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			switch r.URL.Path {
+			case "/api/lists":
+				w.Write([]byte(`{"lists": [{"address": "https://keep.example/hosts", "type": "block"}, {"address": "https://stale.example/hosts", "type": "block"}, {"address": "https://allow.example/list", "type": "allow"}]}`))
+			case "/api/domains":
+				w.Write([]byte(`{"domains": [{"domain": "old.example.com", "type": "deny", "kind": "exact"}, {"domain": "keep.example.com", "type": "deny", "kind": "exact"}, {"domain": "stale-regex", "type": "deny", "kind": "regex"}]}`))
+			}
+			return
+		}
+		created(w, r)
+	})
+	defer server.Close()
+
+	client := NewClient(server.URL, "test-password")
+
+	err := client.UpdateData(context.Background(), &PiholeData{
+		Adlists:        []string{"https://keep.example/hosts", "https://new.example/hosts"},
+		Blacklist:      []string{"keep.example.com", "new.example.com"},
+		RegexBlacklist: []string{},
+	})
+	require.NoError(t, err)
+
+	var mutations []string
+	for _, req := range requests {
+		if req.Method != "GET" {
+			mutations = append(mutations, req.Method+" "+req.Path)
+		}
+	}
+	assert.Equal(t, []string{
+		"DELETE /api/lists/https:%2F%2Fstale.example%2Fhosts",
+		"POST /api/lists",
+		"DELETE /api/domains/deny/exact/old.example.com",
+		"POST /api/domains/deny/exact",
+		"DELETE /api/domains/deny/regex/stale-regex",
+	}, mutations)
+}
+
+func TestUpdateDataMatchesDomainKind(t *testing.T) {
+	var requests []recordedRequest
+	server := newCRUDServer(t, &requests, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			w.Write([]byte(`{"domains": [{"domain": "example.com", "type": "deny", "kind": "exact"}, {"domain": "tracker", "type": "allow", "kind": "regex"}]}`))
+			return
+		}
+		created(w, r)
+	})
+	defer server.Close()
+
+	client := NewClient(server.URL, "test-password")
+
+	// The same text is wanted as both kinds on the deny list, and only as an
+	// exact domain on the allow list
+	err := client.UpdateData(context.Background(), &PiholeData{
+		Blacklist:      []string{"example.com"},
+		RegexBlacklist: []string{"example.com"},
+		Whitelist:      []string{"tracker"},
+	})
+	require.NoError(t, err)
+
+	var mutations []string
+	for _, req := range requests {
+		if req.Method != "GET" {
+			mutations = append(mutations, req.Method+" "+req.Path+" "+req.Body["domain"].(string))
+		}
+	}
+	assert.Equal(t, []string{
+		"POST /api/domains/deny/regex example.com",
+		"POST /api/domains/allow/exact tracker",
+	}, mutations, "an entry of the other kind neither satisfies nor blocks the wanted one")
+}
@@ -0,0 +1,46 @@
+package pihole
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+)
+
+// StatusError is returned when a Pi-hole answers with an unexpected HTTP
+// status.
+type StatusError struct {
+	// Op describes the failed request, e.g. "backup restore"
+	Op         string
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s failed with status %d: %s", e.Op, e.StatusCode, e.Body)
+}
+
+// IsTransient reports whether err is worth retrying: network failures,
+// timeouts of a single request, 5xx answers and 429 Too Many Requests.
+// Rejected credentials, bad requests and malformed responses are not.
+func IsTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, ErrTOTPRequired) || errors.Is(err, ErrTOTPRejected) || errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500 || statusErr.StatusCode == http.StatusTooManyRequests
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	return errors.Is(err, context.DeadlineExceeded) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
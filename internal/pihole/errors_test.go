@@ -0,0 +1,61 @@
+package pihole
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		transient bool
+	}{
+		{"nil", nil, false},
+		{"server error", &StatusError{Op: "backup restore", StatusCode: http.StatusBadGateway}, true},
+		{"rate limited", fmt.Errorf("failed to add adlist: %w", &StatusError{StatusCode: http.StatusTooManyRequests}), true},
+		{"bad request", &StatusError{StatusCode: http.StatusBadRequest}, false},
+		{"unauthorized", fmt.Errorf("authentication failed: %w", &StatusError{Op: "authentication", StatusCode: http.StatusUnauthorized}), false},
+		{"network", fmt.Errorf("failed to make request: %w", &net.OpError{Op: "dial", Err: errors.New("connection refused")}), true},
+		{"request timeout", fmt.Errorf("failed to download backup: %w", context.DeadlineExceeded), true},
+		{"canceled", context.Canceled, false},
+		{"totp rejected", fmt.Errorf("authentication failed: %w", ErrTOTPRejected), false},
+		{"malformed response", errors.New("failed to parse response: unexpected end of JSON input"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.transient, IsTransient(tt.err))
+		})
+	}
+}
+
+func TestStatusErrorFromClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/auth" {
+			w.Write([]byte(`{"session":{"valid":true,"sid":"sid","csrf":"csrf"}}`))
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("FTL is starting"))
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, "password")
+	_, err := client.GetBackup(context.Background())
+	require.Error(t, err)
+	assert.Equal(t, "backup download failed with status 503: FTL is starting", err.Error())
+
+	var statusErr *StatusError
+	require.ErrorAs(t, err, &statusErr)
+	assert.Equal(t, http.StatusServiceUnavailable, statusErr.StatusCode)
+	assert.True(t, IsTransient(err))
+}
@@ -0,0 +1,106 @@
+package pihole
+
+// DomainType is the list a domain entry belongs to.
+type DomainType string
+
+// DomainKind distinguishes exact domains from regular expressions.
+type DomainKind string
+
+// ListType is the kind of subscribed list (adlist or allowlist).
+type ListType string
+
+const (
+	DomainAllow DomainType = "allow"
+	DomainDeny  DomainType = "deny"
+
+	DomainExact DomainKind = "exact"
+	DomainRegex DomainKind = "regex"
+
+	ListBlock ListType = "block"
+	ListAllow ListType = "allow"
+)
+
+// Domain is an entry of the v6 /api/domains endpoint.
+type Domain struct {
+	ID           int        `json:"id"`
+	Domain       string     `json:"domain"`
+	Unicode      string     `json:"unicode,omitempty"`
+	Type         DomainType `json:"type"`
+	Kind         DomainKind `json:"kind"`
+	Comment      string     `json:"comment"`
+	Groups       []int      `json:"groups"`
+	Enabled      bool       `json:"enabled"`
+	DateAdded    int64      `json:"date_added"`
+	DateModified int64      `json:"date_modified"`
+}
+
+// IsDeny reports whether the domain is on the deny list. "block" is accepted
+// as an alias so that domains and adlists share the same vocabulary.
+func (d Domain) IsDeny() bool {
+	return d.Type == DomainDeny || d.Type == DomainType(ListBlock)
+}
+
+// IsAllow reports whether the domain is on the allow list.
+func (d Domain) IsAllow() bool {
+	return d.Type == DomainAllow
+}
+
+// IsRegex reports whether the entry is a regular expression.
+func (d Domain) IsRegex() bool {
+	return d.Kind == DomainRegex
+}
+
+// Adlist is an entry of the v6 /api/lists endpoint.
+type Adlist struct {
+	ID             int      `json:"id"`
+	Address        string   `json:"address"`
+	Type           ListType `json:"type"`
+	Comment        string   `json:"comment"`
+	Groups         []int    `json:"groups"`
+	Enabled        bool     `json:"enabled"`
+	DateAdded      int64    `json:"date_added"`
+	DateModified   int64    `json:"date_modified"`
+	DateUpdated    int64    `json:"date_updated"`
+	Number         int      `json:"number"`
+	InvalidDomains int      `json:"invalid_domains"`
+	ABPEntries     int      `json:"abp_entries"`
+	Status         int      `json:"status"`
+}
+
+// Group is an entry of the v6 /api/groups endpoint.
+type Group struct {
+	ID           int    `json:"id"`
+	Name         string `json:"name"`
+	Comment      string `json:"comment"`
+	Enabled      bool   `json:"enabled"`
+	DateAdded    int64  `json:"date_added"`
+	DateModified int64  `json:"date_modified"`
+}
+
+// ClientEntry is an entry of the v6 /api/clients endpoint, i.e. a client
+// (IP, subnet, MAC, hostname or interface) with explicit group assignments.
+type ClientEntry struct {
+	ID           int    `json:"id"`
+	Client       string `json:"client"`
+	Name         string `json:"name,omitempty"`
+	Comment      string `json:"comment"`
+	Groups       []int  `json:"groups"`
+	DateAdded    int64  `json:"date_added"`
+	DateModified int64  `json:"date_modified"`
+}
+
+type domainsResponse struct {
+	Domains []Domain `json:"domains"`
+}
+
+type listsResponse struct {
+	Lists []Adlist `json:"lists"`
+}
+
+type groupsResponse struct {
+	Groups []Group `json:"groups"`
+}
+
+type clientsResponse struct {
+	Clients []ClientEntry `json:"clients"`
+}
@@ -0,0 +1,139 @@
+package pihole
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DefaultLogoutTimeout bounds the background logout of a session dropped
+// by Get, so that a hung host does not keep the goroutine around
+const DefaultLogoutTimeout = 10 * time.Second
+
+// Pool shares one authenticated Client per Pi-hole host across the syncer,
+// the metrics collector and configuration reloads. Pi-hole v6 only has a
+// limited number of API seats, so every component must go through the pool
+// instead of logging in on its own.
+type Pool struct {
+	mu      sync.Mutex
+	entries map[string]*poolEntry
+	// logoutErr is told about failed logouts of replaced sessions
+	logoutErr     func(host string, err error)
+	logoutTimeout time.Duration
+}
+
+type poolEntry struct {
+	opts   ClientOptions
+	client *Client
+}
+
+// NewPool creates an empty client pool.
+func NewPool() *Pool {
+	return &Pool{
+		entries:       make(map[string]*poolEntry),
+		logoutTimeout: DefaultLogoutTimeout,
+	}
+}
+
+// Get returns the shared client for baseURL. If the host is already pooled
+// with different options (e.g. the password changed on reload) the client
+// is updated in place, so that components still holding it log in with the
+// new settings instead of opening a session the pool does not know about;
+// the old session is logged out. An error is returned if opts cannot be
+// applied, for example because of a broken TLS setting.
+func (p *Pool) Get(baseURL string, opts ClientOptions) (*Client, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if entry, ok := p.entries[baseURL]; ok {
+		if entry.opts == opts {
+			return entry.client, nil
+		}
+		sid, csrf, err := entry.client.reconfigure(opts)
+		if err != nil {
+			return nil, err
+		}
+		entry.opts = opts
+		if sid != "" {
+			go logoutReplaced(entry.client, sid, csrf, p.logoutTimeout, p.logoutErr)
+		}
+		return entry.client, nil
+	}
+
+	client, err := NewClientWithOptions(baseURL, opts)
+	if err != nil {
+		return nil, err
+	}
+	p.entries[baseURL] = &poolEntry{opts: opts, client: client}
+	return client, nil
+}
+
+// SetLogoutErrorHandler makes the pool call handler when the session a
+// client had before Get changed its options cannot be logged out. That logout runs in the
+// background, so it has no caller to return the error to.
+func (p *Pool) SetLogoutErrorHandler(handler func(host string, err error)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.logoutErr = handler
+}
+
+// Hosts returns the hosts currently held by the pool.
+func (p *Pool) Hosts() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	hosts := make([]string, 0, len(p.entries))
+	for host := range p.entries {
+		hosts = append(hosts, host)
+	}
+	return hosts
+}
+
+// Retain logs out and drops every pooled client whose host is not in keep.
+// It is called after a configuration reload so that instances removed from
+// the config do not keep their API sessions open.
+func (p *Pool) Retain(ctx context.Context, keep []string) error {
+	wanted := make(map[string]bool, len(keep))
+	for _, host := range keep {
+		wanted[host] = true
+	}
+
+	p.mu.Lock()
+	var removed []*Client
+	for host, entry := range p.entries {
+		if !wanted[host] {
+			removed = append(removed, entry.client)
+			delete(p.entries, host)
+		}
+	}
+	p.mu.Unlock()
+
+	return logoutAll(ctx, removed)
+}
+
+// Close logs out every pooled session. The pool is empty afterwards.
+func (p *Pool) Close(ctx context.Context) error {
+	return p.Retain(ctx, nil)
+}
+
+// logoutReplaced logs out the session a client had before Get changed its
+// options and reports a failure to handler, if set.
+func logoutReplaced(client *Client, sid, csrf string, timeout time.Duration, handler func(host string, err error)) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if _, err := client.endSession(ctx, sid, csrf); err != nil && handler != nil {
+		handler(client.BaseURL, err)
+	}
+}
+
+func logoutAll(ctx context.Context, clients []*Client) error {
+	var errs []error
+	for _, client := range clients {
+		if err := client.Logout(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", client.BaseURL, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,189 @@
+package pihole
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func mustGet(t *testing.T, pool *Pool, baseURL string, opts ClientOptions) *Client {
+	t.Helper()
+	client, err := pool.Get(baseURL, opts)
+	require.NoError(t, err)
+	return client
+}
+
+func TestPoolGetSharesClientPerHost(t *testing.T) {
+	pool := NewPool()
+
+	opts := ClientOptions{Password: "test-password", Timeout: 5 * time.Second}
+	first := mustGet(t, pool, "http://test.local", opts)
+	second := mustGet(t, pool, "http://test.local", opts)
+	other := mustGet(t, pool, "http://other.local", opts)
+
+	assert.Same(t, first, second)
+	assert.NotSame(t, first, other)
+	assert.Equal(t, 5*time.Second, first.Timeout)
+	assert.ElementsMatch(t, []string{"http://test.local", "http://other.local"}, pool.Hosts())
+}
+
+func TestPoolGetUpdatesClientWhenOptionsChange(t *testing.T) {
+	var mu sync.Mutex
+	var logins, logouts []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case r.URL.Path == "/api/auth" && r.Method == "POST":
+			var payload struct {
+				Password string `json:"password"`
+			}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&payload))
+			logins = append(logins, payload.Password)
+			fmt.Fprintf(w, `{"session":{"sid":"sid-%d","csrf":"csrf"}}`, len(logins))
+		case r.URL.Path == "/api/auth" && r.Method == "DELETE":
+			logouts = append(logouts, r.Header.Get("sid"))
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			fmt.Fprint(w, `{}`)
+		}
+	}))
+	defer server.Close()
+
+	pool := NewPool()
+	held := mustGet(t, pool, server.URL, ClientOptions{Password: "old-password"})
+	_, err := held.makeRequest(context.Background(), "GET", "groups", nil)
+	require.NoError(t, err)
+
+	updated := mustGet(t, pool, server.URL, ClientOptions{Password: "new-password", Timeout: time.Second})
+	assert.Same(t, held, updated)
+	assert.Equal(t, time.Second, held.Timeout)
+
+	// A component still holding the client must not log in again with the
+	// old password into a session the pool does not know about
+	_, err = held.makeRequest(context.Background(), "GET", "groups", nil)
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(logouts) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"old-password", "new-password"}, logins)
+	assert.Equal(t, []string{"sid-1"}, logouts)
+	assert.Equal(t, "sid-2", held.SID)
+}
+
+func TestPoolGetLogsOutReplacedClientWithTimeout(t *testing.T) {
+	// The host hangs on logout until the request is abandoned
+	abandoned := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/auth" && r.Method == "DELETE" {
+			<-r.Context().Done()
+			close(abandoned)
+		}
+	}))
+	defer server.Close()
+
+	failed := make(chan error, 1)
+	pool := NewPool()
+	pool.logoutTimeout = 50 * time.Millisecond
+	pool.SetLogoutErrorHandler(func(host string, err error) {
+		assert.Equal(t, server.URL, host)
+		failed <- err
+	})
+	first := mustGet(t, pool, server.URL, ClientOptions{Password: "old-password"})
+	first.SID = "old-sid"
+	mustGet(t, pool, server.URL, ClientOptions{Password: "new-password"})
+
+	select {
+	case err := <-failed:
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	case <-time.After(5 * time.Second):
+		t.Fatal("logout of the replaced session was not bounded by a timeout")
+	}
+	<-abandoned
+}
+
+func TestPoolRetainLogsOutRemovedHosts(t *testing.T) {
+	var logouts []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/auth" && r.Method == "DELETE" {
+			logouts = append(logouts, r.Header.Get("sid"))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	pool := NewPool()
+	removed := mustGet(t, pool, server.URL, ClientOptions{Password: "test-password"})
+	removed.SID = "removed-sid"
+	kept := mustGet(t, pool, "http://kept.local", ClientOptions{Password: "test-password"})
+
+	err := pool.Retain(context.Background(), []string{"http://kept.local"})
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"removed-sid"}, logouts)
+	assert.Empty(t, removed.SID)
+	assert.Equal(t, []string{"http://kept.local"}, pool.Hosts())
+	assert.Same(t, kept, mustGet(t, pool, "http://kept.local", ClientOptions{Password: "test-password"}))
+}
+
+func TestPoolClose(t *testing.T) {
+	logouts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/auth" && r.Method == "DELETE" {
+			logouts++
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer server.Close()
+
+	pool := NewPool()
+	client := mustGet(t, pool, server.URL, ClientOptions{Password: "test-password"})
+	client.SID = "test-sid"
+	// Clients without a session must not trigger a logout call
+	mustGet(t, pool, "http://never-used.local", ClientOptions{})
+
+	err := pool.Close(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 1, logouts)
+	assert.Empty(t, pool.Hosts())
+}
+
+func TestPoolGetInvalidTLS(t *testing.T) {
+	pool := NewPool()
+
+	_, err := pool.Get("https://test.local", ClientOptions{
+		TLS: TLSOptions{CAFile: "/nonexistent/ca.pem"},
+	})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid TLS configuration")
+	assert.Empty(t, pool.Hosts())
+}
+
+func TestPoolGetKeepsClientOnInvalidTLSUpdate(t *testing.T) {
+	pool := NewPool()
+	opts := ClientOptions{Password: "test-password"}
+	client := mustGet(t, pool, "https://test.local", opts)
+
+	_, err := pool.Get("https://test.local", ClientOptions{
+		Password: "new-password",
+		TLS:      TLSOptions{CAFile: "/nonexistent/ca.pem"},
+	})
+	assert.Error(t, err)
+	assert.Equal(t, "test-password", client.Password)
+	assert.Same(t, client, mustGet(t, pool, "https://test.local", opts))
+}
@@ -0,0 +1,122 @@
+package pihole
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// TLSOptions configures how a client verifies and authenticates to a Pi-hole
+// that serves its API over HTTPS.
+type TLSOptions struct {
+	// CAFile is a PEM bundle used instead of the system roots.
+	CAFile string
+	// Fingerprint pins the SHA-256 fingerprint of the server's leaf
+	// certificate (hex, colons optional). When set without CAFile the chain
+	// itself is not verified, which allows pinning self-signed certificates.
+	Fingerprint string
+	// InsecureSkipVerify disables all certificate verification.
+	InsecureSkipVerify bool
+	// CertFile and KeyFile are a PEM client certificate and key for mTLS.
+	CertFile string
+	KeyFile  string
+}
+
+// IsZero reports whether no TLS option is set.
+func (o TLSOptions) IsZero() bool {
+	return o == TLSOptions{}
+}
+
+// newTransport builds the HTTP transport for opts. It returns an error that
+// names the offending setting if the TLS configuration cannot be loaded.
+func newTransport(opts TLSOptions) (http.RoundTripper, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if opts.IsZero() {
+		return transport, nil
+	}
+
+	tlsConfig, err := buildTLSConfig(opts)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TLS configuration: %w", err)
+	}
+	transport.TLSClientConfig = tlsConfig
+	return transport, nil
+}
+
+func buildTLSConfig(opts TLSOptions) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: opts.InsecureSkipVerify,
+	}
+
+	if opts.CAFile != "" {
+		pem, err := os.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ca_file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("ca_file %s contains no PEM certificates", opts.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if opts.CertFile != "" || opts.KeyFile != "" {
+		if opts.CertFile == "" || opts.KeyFile == "" {
+			return nil, fmt.Errorf("cert_file and key_file must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if opts.Fingerprint != "" {
+		want, err := parseFingerprint(opts.Fingerprint)
+		if err != nil {
+			return nil, err
+		}
+
+		// Without a CA the pin is the only check, so skip chain verification
+		// and rely on VerifyConnection below.
+		if opts.CAFile == "" {
+			tlsConfig.InsecureSkipVerify = true
+		}
+		tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return fmt.Errorf("server presented no certificate")
+			}
+			got := sha256.Sum256(state.PeerCertificates[0].Raw)
+			if !bytes.Equal(got[:], want) {
+				return fmt.Errorf("certificate fingerprint mismatch: expected %s, got %s",
+					hex.EncodeToString(want), hex.EncodeToString(got[:]))
+			}
+			return nil
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// parseFingerprint decodes a SHA-256 fingerprint written as hex with or
+// without colon separators (e.g. the output of `openssl x509 -fingerprint`).
+func parseFingerprint(fingerprint string) ([]byte, error) {
+	normalized := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(fingerprint), ":", ""))
+	normalized = strings.TrimPrefix(normalized, "sha256/")
+
+	decoded, err := hex.DecodeString(normalized)
+	if err != nil {
+		return nil, fmt.Errorf("invalid fingerprint: %w", err)
+	}
+	if len(decoded) != sha256.Size {
+		return nil, fmt.Errorf("invalid fingerprint: expected %d bytes of SHA-256, got %d", sha256.Size, len(decoded))
+	}
+	return decoded, nil
+}
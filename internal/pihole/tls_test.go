@@ -0,0 +1,131 @@
+package pihole
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTLSTestServer() *httptest.Server {
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"status": "enabled"}`))
+	}))
+}
+
+func serverFingerprint(server *httptest.Server) string {
+	sum := sha256.Sum256(server.Certificate().Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+func newTLSClient(t *testing.T, baseURL string, opts TLSOptions) *Client {
+	t.Helper()
+	client, err := NewClientWithOptions(baseURL, ClientOptions{Password: "test-password", TLS: opts})
+	require.NoError(t, err)
+	client.SID = "test-sid"
+	return client
+}
+
+func TestTLSDefaultRejectsUnknownCA(t *testing.T) {
+	server := newTLSTestServer()
+	defer server.Close()
+
+	client := newTLSClient(t, server.URL, TLSOptions{})
+
+	_, err := client.makeRequest(context.Background(), "GET", "stats/summary", nil)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "certificate")
+}
+
+func TestTLSCustomCAFile(t *testing.T) {
+	server := newTLSTestServer()
+	defer server.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	require.NoError(t, os.WriteFile(caFile, caPEM, 0600))
+
+	client := newTLSClient(t, server.URL, TLSOptions{CAFile: caFile})
+
+	_, err := client.makeRequest(context.Background(), "GET", "stats/summary", nil)
+	assert.NoError(t, err)
+}
+
+func TestTLSPinnedFingerprint(t *testing.T) {
+	server := newTLSTestServer()
+	defer server.Close()
+
+	// Colon-separated upper case, as printed by openssl
+	fingerprint := serverFingerprint(server)
+	var parts []string
+	for i := 0; i < len(fingerprint); i += 2 {
+		parts = append(parts, strings.ToUpper(fingerprint[i:i+2]))
+	}
+
+	client := newTLSClient(t, server.URL, TLSOptions{Fingerprint: strings.Join(parts, ":")})
+
+	_, err := client.makeRequest(context.Background(), "GET", "stats/summary", nil)
+	assert.NoError(t, err)
+}
+
+func TestTLSPinnedFingerprintMismatch(t *testing.T) {
+	server := newTLSTestServer()
+	defer server.Close()
+
+	client := newTLSClient(t, server.URL, TLSOptions{Fingerprint: strings.Repeat("00", sha256.Size)})
+
+	_, err := client.makeRequest(context.Background(), "GET", "stats/summary", nil)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "certificate fingerprint mismatch")
+}
+
+func TestTLSInsecureSkipVerify(t *testing.T) {
+	server := newTLSTestServer()
+	defer server.Close()
+
+	client := newTLSClient(t, server.URL, TLSOptions{InsecureSkipVerify: true})
+
+	_, err := client.makeRequest(context.Background(), "GET", "stats/summary", nil)
+	assert.NoError(t, err)
+}
+
+func TestTLSInvalidOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    TLSOptions
+		message string
+	}{
+		{"missing ca file", TLSOptions{CAFile: "/nonexistent/ca.pem"}, "failed to read ca_file"},
+		{"cert without key", TLSOptions{CertFile: "/tmp/cert.pem"}, "cert_file and key_file must be set together"},
+		{"non-hex fingerprint", TLSOptions{Fingerprint: "zz"}, "invalid fingerprint"},
+		{"short fingerprint", TLSOptions{Fingerprint: "abcd"}, "expected 32 bytes"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewClientWithOptions("https://test.local", ClientOptions{TLS: tt.opts})
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), "invalid TLS configuration")
+			assert.Contains(t, err.Error(), tt.message)
+		})
+	}
+}
+
+func TestTLSCAFileWithoutCertificates(t *testing.T) {
+	caFile := filepath.Join(t.TempDir(), "empty.pem")
+	require.NoError(t, os.WriteFile(caFile, []byte("not a certificate"), 0600))
+
+	_, err := NewClientWithOptions("https://test.local", ClientOptions{TLS: TLSOptions{CAFile: caFile}})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "contains no PEM certificates")
+}
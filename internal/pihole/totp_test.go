@@ -0,0 +1,48 @@
+package pihole
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerateTOTP(t *testing.T) {
+	// RFC 6238 Appendix B test vectors (SHA1), truncated to 6 digits.
+	// The secret is the ASCII string "12345678901234567890" in base32.
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+
+	for _, tt := range tests {
+		code, err := GenerateTOTP(secret, time.Unix(tt.unix, 0))
+		require.NoError(t, err)
+		assert.Equal(t, tt.code, code, "time %d", tt.unix)
+	}
+}
+
+func TestGenerateTOTPNormalizesSecret(t *testing.T) {
+	at := time.Unix(59, 0)
+
+	code, err := GenerateTOTP("gezd gnbv gy3t qojq gezd gnbv gy3t qojq", at)
+	require.NoError(t, err)
+	assert.Equal(t, "287082", code)
+}
+
+func TestGenerateTOTPInvalidSecret(t *testing.T) {
+	_, err := GenerateTOTP("not-base32!", time.Now())
+	assert.Error(t, err)
+
+	_, err = GenerateTOTP("", time.Now())
+	assert.Error(t, err)
+}
@@ -0,0 +1,138 @@
+package sync
+
+import (
+	gosync "sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/arimakouyou/pihole-sync/internal/config"
+	"github.com/arimakouyou/pihole-sync/internal/logger"
+	"github.com/arimakouyou/pihole-sync/internal/metrics"
+)
+
+// Circuit breaker states reported in SlaveResult.Breaker
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half_open"
+)
+
+// slaveBreaker is the circuit breaker state of one slave.
+type slaveBreaker struct {
+	state     string
+	failures  int
+	openUntil time.Time
+}
+
+// breakers keeps a circuit breaker per slave host. A slave whose syncs fail
+// FailureThreshold times in a row is skipped until Cooldown passed; the next
+// sync is a trial that closes the breaker on success and reopens it on
+// failure.
+type breakers struct {
+	// cluster is reported in the breaker metrics
+	cluster string
+	config  config.CircuitBreakerConfig
+	now     func() time.Time
+
+	mu     gosync.Mutex
+	slaves map[string]*slaveBreaker
+}
+
+func newBreakers(cluster string, cfg config.CircuitBreakerConfig) *breakers {
+	if cfg.FailureThreshold <= 0 {
+		cfg.FailureThreshold = config.DefaultBreakerFailureThreshold
+	}
+	if cfg.Cooldown <= 0 {
+		cfg.Cooldown = config.DefaultBreakerCooldown
+	}
+	return &breakers{
+		cluster: cluster,
+		config:  cfg,
+		now:     time.Now,
+		slaves:  make(map[string]*slaveBreaker),
+	}
+}
+
+func (b *breakers) get(host string) *slaveBreaker {
+	breaker, ok := b.slaves[host]
+	if !ok {
+		breaker = &slaveBreaker{state: BreakerClosed}
+		b.slaves[host] = breaker
+	}
+	return breaker
+}
+
+// inherit copies the breakers of hosts from prev, the breakers of the
+// syncer replaced on a configuration reload. b must not be in use yet.
+func (b *breakers) inherit(prev *breakers, hosts []string) {
+	prev.mu.Lock()
+	defer prev.mu.Unlock()
+	for _, host := range hosts {
+		if breaker, ok := prev.slaves[host]; ok {
+			copied := *breaker
+			b.slaves[host] = &copied
+		}
+	}
+}
+
+// allow reports whether host may be synced now. If not, it also returns
+// when the breaker lets the next trial through.
+func (b *breakers) allow(host string) (bool, time.Time) {
+	if !b.config.Enabled {
+		return true, time.Time{}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	breaker := b.get(host)
+	if breaker.state != BreakerOpen {
+		return true, time.Time{}
+	}
+	if b.now().Before(breaker.openUntil) {
+		return false, breaker.openUntil
+	}
+
+	breaker.state = BreakerHalfOpen
+	metrics.SetCircuitBreakerState(b.cluster, host, metrics.CircuitBreakerHalfOpen)
+	if logger.Logger != nil {
+		logger.Logger.Info("Circuit breaker cool-down over, trying slave again",
+			zap.String("host", host))
+	}
+	return true, time.Time{}
+}
+
+// record updates host's breaker with the outcome of a sync and returns the
+// resulting state, or "" if breakers are disabled.
+func (b *breakers) record(host string, failed bool) string {
+	if !b.config.Enabled {
+		return ""
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	breaker := b.get(host)
+	if !failed {
+		breaker.state = BreakerClosed
+		breaker.failures = 0
+		metrics.SetCircuitBreakerState(b.cluster, host, metrics.CircuitBreakerClosed)
+		return breaker.state
+	}
+
+	breaker.failures++
+	if breaker.state == BreakerHalfOpen || breaker.failures >= b.config.FailureThreshold {
+		breaker.state = BreakerOpen
+		breaker.openUntil = b.now().Add(b.config.Cooldown)
+		metrics.SetCircuitBreakerState(b.cluster, host, metrics.CircuitBreakerOpen)
+		metrics.IncrementCircuitBreakerTrips(b.cluster, host)
+		if logger.Logger != nil {
+			logger.Logger.Warn("Circuit breaker opened, skipping slave during cool-down",
+				zap.String("host", host),
+				zap.Int("consecutive_failures", breaker.failures),
+				zap.Time("until", breaker.openUntil))
+		}
+	}
+	return breaker.state
+}
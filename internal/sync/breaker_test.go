@@ -0,0 +1,194 @@
+package sync
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/arimakouyou/pihole-sync/internal/config"
+	"github.com/arimakouyou/pihole-sync/internal/pihole"
+)
+
+func TestBreakers(t *testing.T) {
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	b := newBreakers(config.DefaultClusterName, config.CircuitBreakerConfig{Enabled: true, FailureThreshold: 2, Cooldown: time.Minute})
+	b.now = func() time.Time { return now }
+
+	ok, _ := b.allow("slave")
+	assert.True(t, ok)
+	assert.Equal(t, BreakerClosed, b.record("slave", true))
+	assert.Equal(t, BreakerClosed, b.record("slave", false), "a success resets the failure count")
+	assert.Equal(t, BreakerClosed, b.record("slave", true))
+	assert.Equal(t, BreakerOpen, b.record("slave", true))
+
+	ok, until := b.allow("slave")
+	assert.False(t, ok)
+	assert.Equal(t, now.Add(time.Minute), until)
+	ok, _ = b.allow("other")
+	assert.True(t, ok, "breakers are per slave")
+
+	// After the cool-down one trial goes through; failing it reopens the
+	// breaker right away
+	now = now.Add(time.Minute)
+	ok, _ = b.allow("slave")
+	assert.True(t, ok)
+	assert.Equal(t, BreakerOpen, b.record("slave", true))
+	ok, _ = b.allow("slave")
+	assert.False(t, ok)
+
+	now = now.Add(time.Minute)
+	ok, _ = b.allow("slave")
+	assert.True(t, ok)
+	assert.Equal(t, BreakerClosed, b.record("slave", false))
+}
+
+func TestBreakersDisabled(t *testing.T) {
+	b := newBreakers(config.DefaultClusterName, config.CircuitBreakerConfig{})
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, "", b.record("slave", true))
+	}
+	ok, _ := b.allow("slave")
+	assert.True(t, ok)
+}
+
+func TestSyncSkipsSlaveWithOpenBreaker(t *testing.T) {
+	master := newFakePihole()
+	defer master.Close()
+	slave := newFakePihole()
+	defer slave.Close()
+	slave.failRestore = 1000
+
+	cfg := &config.Config{
+		Master:         config.MasterConfig{Host: master.URL(), Password: "test-password"},
+		Slaves:         []config.SlaveConfig{{Host: slave.URL(), Password: "test-password", SyncItems: config.SyncItems{Blacklist: true}}},
+		CircuitBreaker: config.CircuitBreakerConfig{Enabled: true, FailureThreshold: 2, Cooldown: time.Hour},
+	}
+	syncer := NewSyncer(cfg, pihole.NewPool())
+
+	syncOnce := func() SlaveResult {
+		result, err := syncer.syncNow(context.Background(), SyncOptions{})
+		require.NoError(t, err)
+		require.Len(t, result.Details, 1)
+		return result.Details[0]
+	}
+
+	assert.Equal(t, BreakerClosed, syncOnce().Breaker)
+	assert.Equal(t, BreakerOpen, syncOnce().Breaker)
+	attempts := slave.restoreAttempts
+
+	skipped := syncOnce()
+	assert.Equal(t, "error", skipped.Result)
+	assert.Equal(t, BreakerOpen, skipped.Breaker)
+	assert.Contains(t, skipped.Error, "circuit breaker open")
+	assert.Equal(t, attempts, slave.restoreAttempts, "an open breaker keeps the slave untouched")
+}
+
+func TestInheritKeepsOpenBreakers(t *testing.T) {
+	master := newFakePihole()
+	defer master.Close()
+	slave := newFakePihole()
+	defer slave.Close()
+	slave.failRestore = 1000
+
+	cfg := &config.Config{
+		Master:         config.MasterConfig{Host: master.URL(), Password: "test-password"},
+		Slaves:         []config.SlaveConfig{{Host: slave.URL(), Password: "test-password", SyncItems: config.SyncItems{Blacklist: true}}},
+		CircuitBreaker: config.CircuitBreakerConfig{Enabled: true, FailureThreshold: 1, Cooldown: time.Hour},
+	}
+	pool := pihole.NewPool()
+	prev := NewSyncer(cfg, pool)
+	result, err := prev.syncNow(context.Background(), SyncOptions{})
+	require.NoError(t, err)
+	require.Equal(t, BreakerOpen, result.Details[0].Breaker)
+	attempts := slave.restoreAttempts
+
+	syncer := NewSyncer(cfg, pool)
+	syncer.Inherit(prev)
+	result, err = syncer.syncNow(context.Background(), SyncOptions{})
+	require.NoError(t, err)
+	assert.Contains(t, result.Details[0].Error, "circuit breaker open")
+	assert.Equal(t, attempts, slave.restoreAttempts, "the reload does not close the breaker")
+}
+
+func TestRetryOnlyTransientErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		attempts int
+	}{
+		{"server error is retried", http.StatusServiceUnavailable, 3},
+		{"rate limit is retried", http.StatusTooManyRequests, 3},
+		{"bad request is not retried", http.StatusBadRequest, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			master := newFakePihole()
+			defer master.Close()
+			slave := newFakePihole()
+			defer slave.Close()
+			slave.failRestore = 2
+			slave.failStatus = tt.status
+
+			cfg := &config.Config{
+				Master: config.MasterConfig{Host: master.URL(), Password: "test-password"},
+				Slaves: []config.SlaveConfig{{Host: slave.URL(), Password: "test-password", SyncItems: config.SyncItems{Blacklist: true}}},
+				SyncRetry: config.SyncRetry{
+					Enabled:        true,
+					Count:          3,
+					InitialBackoff: 10 * time.Millisecond,
+				},
+			}
+
+			result, err := NewSyncer(cfg, pihole.NewPool()).syncNow(context.Background(), SyncOptions{})
+			require.NoError(t, err)
+			// A failed restore is rolled back with one more POST
+			attempts := slave.restoreAttempts
+			if result.Details[0].Rollback != "" {
+				attempts--
+			}
+			assert.Equal(t, tt.attempts, attempts)
+			assert.Equal(t, tt.attempts-1, result.Details[0].Retries)
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	jitter := 0.1
+	syncer := NewSyncer(&config.Config{SyncRetry: config.SyncRetry{
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     time.Second,
+		Multiplier:     3,
+		Jitter:         &jitter,
+	}}, pihole.NewPool())
+
+	expected := []time.Duration{100 * time.Millisecond, 300 * time.Millisecond, 900 * time.Millisecond, time.Second, time.Second}
+	for i, base := range expected {
+		for j := 0; j < 20; j++ {
+			wait := syncer.backoff(i + 1)
+			assert.GreaterOrEqual(t, wait, base*9/10, "retry %d", i+1)
+			assert.LessOrEqual(t, wait, base*11/10, "retry %d", i+1)
+		}
+	}
+
+	defaults := NewSyncer(&config.Config{}, pihole.NewPool())
+	assert.InDelta(t, float64(config.DefaultInitialBackoff), float64(defaults.backoff(1)), float64(config.DefaultInitialBackoff)*config.DefaultBackoffJitter)
+}
+
+func TestBackoffWithoutJitter(t *testing.T) {
+	jitter := 0.0
+	syncer := NewSyncer(&config.Config{SyncRetry: config.SyncRetry{
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     time.Minute,
+		Multiplier:     3,
+		Jitter:         &jitter,
+	}}, pihole.NewPool())
+
+	for n, want := range []time.Duration{100 * time.Millisecond, 300 * time.Millisecond, 900 * time.Millisecond, 2700 * time.Millisecond} {
+		assert.Equal(t, want, syncer.backoff(n+1), "retry %d", n+1)
+	}
+}
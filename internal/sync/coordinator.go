@@ -0,0 +1,216 @@
+package sync
+
+import (
+	"context"
+	gosync "sync"
+
+	"go.uber.org/zap"
+
+	"github.com/arimakouyou/pihole-sync/internal/logger"
+)
+
+// Disposition tells a caller of Coordinator.Submit what happened to its
+// request.
+type Disposition string
+
+const (
+	// DispositionRan: no sync was running, the request ran immediately
+	DispositionRan Disposition = "ran"
+	// DispositionQueued: a sync was running, the request became the
+	// follow-up run
+	DispositionQueued Disposition = "queued"
+	// DispositionMerged: a follow-up run was already queued and the request
+	// was merged into it
+	DispositionMerged Disposition = "merged"
+)
+
+// Coordinator serializes sync runs across all triggers. Requests arriving
+// while a sync runs are coalesced into a single follow-up run.
+type Coordinator struct {
+	// ctx bounds every run; a run is additionally cancelled once all of its
+	// requesters stopped waiting for it
+	ctx    context.Context
+	syncer func() *Syncer
+	events *EventBus
+
+	mu      gosync.Mutex
+	running bool
+	pending *coordinatedRun
+	lastRun int64
+}
+
+// coordinatedRun is one sync run and everyone waiting for it.
+type coordinatedRun struct {
+	id      int64
+	opts    SyncOptions
+	ctx     context.Context
+	cancel  context.CancelFunc
+	waiters int
+	events  []func(Event)
+	started []func()
+	done    chan struct{}
+	result  *SyncResult
+	err     error
+}
+
+// runHooks let a requester follow the run covering its request.
+type runHooks struct {
+	// accepted is called once the request is placed, before any wait
+	accepted func(Disposition)
+	// started is called when the covering run starts
+	started func()
+}
+
+// NewCoordinator creates a coordinator running syncs on the syncer returned
+// by syncer, which is looked up per run so that config reloads are followed.
+// Runs are cancelled with ctx.
+func NewCoordinator(ctx context.Context, syncer func() *Syncer) *Coordinator {
+	return NewCoordinatorWithEvents(ctx, syncer, NewEventBus())
+}
+
+// NewCoordinatorWithEvents is like NewCoordinator but publishes to events,
+// so that several coordinators can share one bus. Events carry the cluster
+// of their run to tell them apart.
+func NewCoordinatorWithEvents(ctx context.Context, syncer func() *Syncer, events *EventBus) *Coordinator {
+	return &Coordinator{ctx: ctx, syncer: syncer, events: events}
+}
+
+// Events returns the bus publishing the events of every run.
+func (c *Coordinator) Events() *EventBus {
+	return c.events
+}
+
+// Syncer returns the syncer the next run would use.
+func (c *Coordinator) Syncer() *Syncer {
+	return c.syncer()
+}
+
+// Running reports whether a sync is in progress.
+func (c *Coordinator) Running() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.running
+}
+
+// Submit requests a sync and waits for the run that covers it. If no sync is
+// running it starts immediately. Otherwise it is queued as, or merged into,
+// the follow-up run started when the current one ends; merged requests force
+// the follow-up if any of them did, and receive the events of the shared
+// run. Cancelling ctx stops waiting; a run nobody waits for any more is
+// cancelled, or dropped if it has not started.
+func (c *Coordinator) Submit(ctx context.Context, opts SyncOptions) (*SyncResult, Disposition, error) {
+	return c.submit(ctx, opts, runHooks{})
+}
+
+func (c *Coordinator) submit(ctx context.Context, opts SyncOptions, hooks runHooks) (*SyncResult, Disposition, error) {
+	c.mu.Lock()
+	var run *coordinatedRun
+	var disposition Disposition
+	switch {
+	case !c.running:
+		c.running = true
+		run = c.newRun(opts)
+		disposition = DispositionRan
+	case c.pending == nil:
+		c.pending = c.newRun(opts)
+		run = c.pending
+		disposition = DispositionQueued
+	default:
+		run = c.pending
+		run.opts.Force = run.opts.Force || opts.Force
+		disposition = DispositionMerged
+	}
+	run.waiters++
+	if opts.Events != nil {
+		run.events = append(run.events, opts.Events)
+	}
+	if hooks.started != nil {
+		run.started = append(run.started, hooks.started)
+	}
+	c.mu.Unlock()
+
+	if hooks.accepted != nil {
+		hooks.accepted(disposition)
+	}
+	if disposition == DispositionRan {
+		go c.execute(run)
+	} else if logger.Logger != nil {
+		logger.Logger.Info("Sync already running, request deferred",
+			zap.String("trigger", opts.Trigger),
+			zap.String("disposition", string(disposition)))
+	}
+
+	select {
+	case <-run.done:
+		return run.result, disposition, run.err
+	case <-ctx.Done():
+		c.abandon(run)
+		return nil, disposition, ctx.Err()
+	}
+}
+
+// newRun creates a run; c.mu must be held.
+func (c *Coordinator) newRun(opts SyncOptions) *coordinatedRun {
+	ctx, cancel := context.WithCancel(c.ctx)
+	c.lastRun++
+	opts.Events = nil
+	return &coordinatedRun{id: c.lastRun, opts: opts, ctx: ctx, cancel: cancel, done: make(chan struct{})}
+}
+
+// abandon removes a waiter from run. The last waiter to leave cancels the
+// run, or drops it if it is still queued.
+func (c *Coordinator) abandon(run *coordinatedRun) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	run.waiters--
+	if run.waiters > 0 {
+		return
+	}
+	if c.pending == run {
+		c.pending = nil
+		run.cancel()
+		if logger.Logger != nil {
+			logger.Logger.Info("Queued sync dropped, no requester is waiting for it")
+		}
+		return
+	}
+	run.cancel()
+}
+
+// execute runs run, then hands over to the queued follow-up, if any.
+func (c *Coordinator) execute(run *coordinatedRun) {
+	// A running run is no longer pending, so nothing is added to it any more
+	c.mu.Lock()
+	opts := run.opts
+	observers := run.events
+	started := run.started
+	c.mu.Unlock()
+
+	for _, hook := range started {
+		hook()
+	}
+	opts.Events = func(event Event) {
+		event.Run = run.id
+		c.events.Publish(event)
+		for _, observe := range observers {
+			observe(event)
+		}
+	}
+
+	run.result, run.err = c.syncer().syncNow(run.ctx, opts)
+	run.cancel()
+	close(run.done)
+
+	c.mu.Lock()
+	next := c.pending
+	c.pending = nil
+	if next == nil {
+		c.running = false
+	}
+	c.mu.Unlock()
+
+	if next != nil {
+		go c.execute(next)
+	}
+}
@@ -0,0 +1,144 @@
+package sync
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/arimakouyou/pihole-sync/internal/config"
+	"github.com/arimakouyou/pihole-sync/internal/pihole"
+)
+
+type submission struct {
+	result      *SyncResult
+	disposition Disposition
+	err         error
+}
+
+func submitAsync(coordinator *Coordinator, opts SyncOptions) <-chan submission {
+	done := make(chan submission, 1)
+	go func() {
+		result, disposition, err := coordinator.Submit(context.Background(), opts)
+		done <- submission{result, disposition, err}
+	}()
+	return done
+}
+
+func TestCoordinatorCoalescesConcurrentTriggers(t *testing.T) {
+	master := newFakePihole()
+	defer master.Close()
+	slave := newFakePihole()
+	defer slave.Close()
+	slave.restoreDelay = 300 * time.Millisecond
+
+	cfg := &config.Config{
+		Master: config.MasterConfig{Host: master.URL(), Password: "test-password"},
+		Slaves: []config.SlaveConfig{{Host: slave.URL(), Password: "test-password", SyncItems: config.SyncItems{Blacklist: true}}},
+	}
+	syncer := NewSyncer(cfg, pihole.NewPool())
+	coordinator := NewCoordinator(context.Background(), func() *Syncer { return syncer })
+
+	first := submitAsync(coordinator, SyncOptions{Trigger: TriggerSchedule})
+	require.Eventually(t, coordinator.Running, time.Second, 5*time.Millisecond)
+
+	queued := submitAsync(coordinator, SyncOptions{Trigger: TriggerFileWatch})
+	require.Eventually(t, func() bool {
+		coordinator.mu.Lock()
+		defer coordinator.mu.Unlock()
+		return coordinator.pending != nil
+	}, time.Second, 5*time.Millisecond)
+	merged := submitAsync(coordinator, SyncOptions{Trigger: TriggerAPI, Force: true})
+
+	ran := <-first
+	require.NoError(t, ran.err)
+	assert.Equal(t, DispositionRan, ran.disposition)
+	assert.True(t, ran.result.Success)
+
+	q := <-queued
+	m := <-merged
+	require.NoError(t, q.err)
+	require.NoError(t, m.err)
+	assert.Equal(t, DispositionQueued, q.disposition)
+	assert.Equal(t, DispositionMerged, m.disposition)
+	assert.Same(t, q.result, m.result, "merged requests share the follow-up run")
+	assert.Equal(t, TriggerFileWatch, q.result.Trigger)
+
+	// Nothing changed on the master, so only the merged force makes the
+	// follow-up restore again
+	require.Len(t, q.result.Details, 1)
+	assert.Equal(t, "ok", q.result.Details[0].Result)
+	assert.Len(t, slave.restores, 2)
+
+	assert.Eventually(t, func() bool { return !coordinator.Running() }, time.Second, 5*time.Millisecond)
+}
+
+func TestCoordinatorSubmitIgnoresRateLimit(t *testing.T) {
+	syncer := NewSyncer(&config.Config{}, pihole.NewPool())
+	coordinator := NewCoordinator(context.Background(), func() *Syncer { return syncer })
+
+	for i := 0; i < 2; i++ {
+		_, disposition, err := coordinator.Submit(context.Background(), SyncOptions{})
+		assert.Error(t, err, "no master configured")
+		assert.Equal(t, DispositionRan, disposition)
+	}
+	assert.False(t, coordinator.Running())
+}
+
+func TestCoordinatorWaitIsCancellable(t *testing.T) {
+	master := newFakePihole()
+	defer master.Close()
+	slave := newFakePihole()
+	defer slave.Close()
+	slave.restoreDelay = 300 * time.Millisecond
+
+	cfg := &config.Config{
+		Master: config.MasterConfig{Host: master.URL(), Password: "test-password"},
+		Slaves: []config.SlaveConfig{{Host: slave.URL(), Password: "test-password", SyncItems: config.SyncItems{Blacklist: true}}},
+	}
+	syncer := NewSyncer(cfg, pihole.NewPool())
+	coordinator := NewCoordinator(context.Background(), func() *Syncer { return syncer })
+
+	first := submitAsync(coordinator, SyncOptions{})
+	require.Eventually(t, coordinator.Running, time.Second, 5*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, disposition, err := coordinator.Submit(ctx, SyncOptions{})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, DispositionQueued, disposition)
+
+	require.NoError(t, (<-first).err)
+	// Nobody waits for the queued run any more, so it is dropped
+	assert.Eventually(t, func() bool { return !coordinator.Running() }, 2*time.Second, 5*time.Millisecond)
+	assert.Len(t, slave.restores, 1)
+}
+
+func TestCoordinatorCancelsAbandonedRun(t *testing.T) {
+	master := newFakePihole()
+	defer master.Close()
+	slave := newFakePihole()
+	defer slave.Close()
+	slave.restoreDelay = 300 * time.Millisecond
+
+	cfg := &config.Config{
+		Master: config.MasterConfig{Host: master.URL(), Password: "test-password"},
+		Slaves: []config.SlaveConfig{{Host: slave.URL(), Password: "test-password", SyncItems: config.SyncItems{Blacklist: true}}},
+	}
+	syncer := NewSyncer(cfg, pihole.NewPool())
+	recorder := &memoryRecorder{}
+	syncer.SetRecorder(recorder)
+	coordinator := NewCoordinator(context.Background(), func() *Syncer { return syncer })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, disposition, err := coordinator.Submit(ctx, SyncOptions{})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, DispositionRan, disposition)
+
+	require.Eventually(t, func() bool { return !coordinator.Running() }, 2*time.Second, 5*time.Millisecond)
+	require.Len(t, recorder.results, 1)
+	assert.False(t, recorder.results[0].Success, "the run is cancelled once its only requester left")
+}
@@ -0,0 +1,421 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/arimakouyou/pihole-sync/internal/config"
+	"github.com/arimakouyou/pihole-sync/internal/pihole"
+)
+
+// Sync item names used in plans. They match the SyncItems yaml keys.
+const (
+	ItemAdlists   = "adlists"
+	ItemBlacklist = "blacklist"
+	ItemWhitelist = "whitelist"
+	ItemRegex     = "regex"
+	ItemGroups    = "groups"
+	ItemClients   = "clients"
+)
+
+// ChangeAction is what a plan entry does to the slave.
+type ChangeAction string
+
+const (
+	ActionAdd    ChangeAction = "add"
+	ActionUpdate ChangeAction = "update"
+	ActionDelete ChangeAction = "delete"
+)
+
+// Change is a single add/update/delete of one entry on a slave.
+type Change struct {
+	Item   string       `json:"item"`
+	Action ChangeAction `json:"action"`
+	Key    string       `json:"key"`
+
+	// Exactly one of these holds the desired (add/update) or current
+	// (delete) entry. Group memberships are resolved by name when applied
+	// because group ids differ between instances.
+	domain     *pihole.Domain
+	adlist     *pihole.Adlist
+	group      *pihole.Group
+	client     *pihole.ClientEntry
+	groupNames []string
+}
+
+// Plan is the ordered list of changes that converges a slave to the master.
+type Plan struct {
+	Changes []Change `json:"changes"`
+}
+
+// Empty reports whether the slave already matches the master.
+func (p *Plan) Empty() bool {
+	return len(p.Changes) == 0
+}
+
+// State is the list/group data of one Pi-hole as read through the API.
+type State struct {
+	Domains []pihole.Domain      `json:"domains"`
+	Adlists []pihole.Adlist      `json:"adlists"`
+	Groups  []pihole.Group       `json:"groups"`
+	Clients []pihole.ClientEntry `json:"clients"`
+}
+
+// ReadState reads the domains, lists, groups and clients of a Pi-hole.
+func ReadState(ctx context.Context, client *pihole.Client) (*State, error) {
+	domains, err := client.GetDomains(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get domains: %w", err)
+	}
+	adlists, err := client.GetAdlists(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get adlists: %w", err)
+	}
+	groups, err := client.GetGroups(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get groups: %w", err)
+	}
+	clients, err := client.GetClients(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get clients: %w", err)
+	}
+
+	return &State{
+		Domains: domains,
+		Adlists: adlists,
+		Groups:  groups,
+		Clients: clients,
+	}, nil
+}
+
+// groupNames maps group ids to names for this state.
+func (st *State) groupNames() map[int]string {
+	names := make(map[int]string, len(st.Groups))
+	for _, group := range st.Groups {
+		names[group.ID] = group.Name
+	}
+	return names
+}
+
+// resolveGroupNames translates group ids to sorted group names. Unknown ids
+// are kept as "#<id>" so that they still compare unequal.
+func resolveGroupNames(ids []int, names map[int]string) []string {
+	if len(ids) == 0 {
+		ids = []int{0}
+	}
+	resolved := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if name, ok := names[id]; ok {
+			resolved = append(resolved, name)
+		} else {
+			resolved = append(resolved, fmt.Sprintf("#%d", id))
+		}
+	}
+	sort.Strings(resolved)
+	return resolved
+}
+
+// domainItem returns the sync item a domain entry belongs to.
+func domainItem(domain pihole.Domain) string {
+	switch {
+	case domain.IsRegex():
+		return ItemRegex
+	case domain.IsAllow():
+		return ItemWhitelist
+	default:
+		return ItemBlacklist
+	}
+}
+
+func domainKey(domain pihole.Domain) string {
+	return fmt.Sprintf("%s/%s/%s", domain.Type, domain.Kind, domain.Domain)
+}
+
+func adlistKey(list pihole.Adlist) string {
+	return fmt.Sprintf("%s/%s", list.Type, list.Address)
+}
+
+// itemEnabled reports whether item is selected in items.
+func itemEnabled(items config.SyncItems, item string) bool {
+	switch item {
+	case ItemAdlists:
+		return items.Adlists
+	case ItemBlacklist:
+		return items.Blacklist
+	case ItemWhitelist:
+		return items.Whitelist
+	case ItemRegex:
+		return items.Regex
+	case ItemGroups:
+		return items.Groups
+	case ItemClients:
+		return items.Clients
+	case ItemDNSRecords:
+		return items.DNSRecords
+	case ItemDHCP:
+		return items.DHCP
+	case ItemSettings:
+		return items.Settings
+	}
+	return false
+}
+
+// ComputePlan compares master and slave and returns the changes needed to
+// make the slave match the master for the categories enabled in items.
+// Groups are added/updated first and deleted last so that memberships of the
+// other entries can always be resolved.
+func ComputePlan(master, slave *State, items config.SyncItems) *Plan {
+	masterGroups := master.groupNames()
+	slaveGroups := slave.groupNames()
+
+	var adds, deletes []Change
+	var groupDeletes []Change
+
+	if items.Groups {
+		current := make(map[string]pihole.Group)
+		for _, group := range slave.Groups {
+			current[group.Name] = group
+		}
+		wanted := make(map[string]bool)
+		for _, group := range master.Groups {
+			group := group
+			wanted[group.Name] = true
+			existing, ok := current[group.Name]
+			switch {
+			case !ok:
+				adds = append(adds, Change{Item: ItemGroups, Action: ActionAdd, Key: group.Name, group: &group})
+			case existing.Comment != group.Comment || existing.Enabled != group.Enabled:
+				adds = append(adds, Change{Item: ItemGroups, Action: ActionUpdate, Key: group.Name, group: &group})
+			}
+		}
+		for _, group := range slave.Groups {
+			group := group
+			// The Default group (id 0) always exists and cannot be removed
+			if group.ID != 0 && !wanted[group.Name] {
+				groupDeletes = append(groupDeletes, Change{Item: ItemGroups, Action: ActionDelete, Key: group.Name, group: &group})
+			}
+		}
+	}
+
+	// Domains
+	current := make(map[string]pihole.Domain)
+	for _, domain := range slave.Domains {
+		if itemEnabled(items, domainItem(domain)) {
+			current[domainKey(domain)] = domain
+		}
+	}
+	wanted := make(map[string]bool)
+	for _, domain := range master.Domains {
+		domain := domain
+		item := domainItem(domain)
+		if !itemEnabled(items, item) {
+			continue
+		}
+		key := domainKey(domain)
+		wanted[key] = true
+		names := resolveGroupNames(domain.Groups, masterGroups)
+		existing, ok := current[key]
+		switch {
+		case !ok:
+			adds = append(adds, Change{Item: item, Action: ActionAdd, Key: domain.Domain, domain: &domain, groupNames: names})
+		case existing.Comment != domain.Comment || existing.Enabled != domain.Enabled ||
+			!equalStrings(resolveGroupNames(existing.Groups, slaveGroups), names):
+			adds = append(adds, Change{Item: item, Action: ActionUpdate, Key: domain.Domain, domain: &domain, groupNames: names})
+		}
+	}
+	for key, domain := range current {
+		domain := domain
+		if !wanted[key] {
+			deletes = append(deletes, Change{Item: domainItem(domain), Action: ActionDelete, Key: domain.Domain, domain: &domain})
+		}
+	}
+
+	if items.Adlists {
+		current := make(map[string]pihole.Adlist)
+		for _, list := range slave.Adlists {
+			current[adlistKey(list)] = list
+		}
+		wanted := make(map[string]bool)
+		for _, list := range master.Adlists {
+			list := list
+			key := adlistKey(list)
+			wanted[key] = true
+			names := resolveGroupNames(list.Groups, masterGroups)
+			existing, ok := current[key]
+			switch {
+			case !ok:
+				adds = append(adds, Change{Item: ItemAdlists, Action: ActionAdd, Key: list.Address, adlist: &list, groupNames: names})
+			case existing.Comment != list.Comment || existing.Enabled != list.Enabled ||
+				!equalStrings(resolveGroupNames(existing.Groups, slaveGroups), names):
+				adds = append(adds, Change{Item: ItemAdlists, Action: ActionUpdate, Key: list.Address, adlist: &list, groupNames: names})
+			}
+		}
+		for key, list := range current {
+			list := list
+			if !wanted[key] {
+				deletes = append(deletes, Change{Item: ItemAdlists, Action: ActionDelete, Key: list.Address, adlist: &list})
+			}
+		}
+	}
+
+	if items.Clients {
+		current := make(map[string]pihole.ClientEntry)
+		for _, client := range slave.Clients {
+			current[client.Client] = client
+		}
+		wanted := make(map[string]bool)
+		for _, client := range master.Clients {
+			client := client
+			wanted[client.Client] = true
+			names := resolveGroupNames(client.Groups, masterGroups)
+			existing, ok := current[client.Client]
+			switch {
+			case !ok:
+				adds = append(adds, Change{Item: ItemClients, Action: ActionAdd, Key: client.Client, client: &client, groupNames: names})
+			case existing.Comment != client.Comment ||
+				!equalStrings(resolveGroupNames(existing.Groups, slaveGroups), names):
+				adds = append(adds, Change{Item: ItemClients, Action: ActionUpdate, Key: client.Client, client: &client, groupNames: names})
+			}
+		}
+		for key, client := range current {
+			client := client
+			if !wanted[key] {
+				deletes = append(deletes, Change{Item: ItemClients, Action: ActionDelete, Key: client.Client, client: &client})
+			}
+		}
+	}
+
+	// Map iteration is random; keep plans deterministic for display/tests
+	sortChanges(deletes)
+	sortChanges(groupDeletes)
+
+	changes := append(adds, deletes...)
+	changes = append(changes, groupDeletes...)
+	return &Plan{Changes: changes}
+}
+
+func sortChanges(changes []Change) {
+	sort.SliceStable(changes, func(i, j int) bool {
+		if changes[i].Item != changes[j].Item {
+			return changes[i].Item < changes[j].Item
+		}
+		return changes[i].Key < changes[j].Key
+	})
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// ApplyPlan executes plan against client. Group ids on the slave are looked
+// up by name after the group changes have been applied.
+func ApplyPlan(ctx context.Context, client *pihole.Client, plan *Plan) error {
+	var groupIDs map[string]int
+	resolveGroups := func(names []string) ([]int, error) {
+		if groupIDs == nil {
+			groups, err := client.GetGroups(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get groups: %w", err)
+			}
+			groupIDs = make(map[string]int, len(groups))
+			for _, group := range groups {
+				groupIDs[group.Name] = group.ID
+			}
+		}
+		ids := make([]int, 0, len(names))
+		var missing []string
+		for _, name := range names {
+			if id, ok := groupIDs[name]; ok {
+				ids = append(ids, id)
+			} else {
+				missing = append(missing, name)
+			}
+		}
+		if len(missing) > 0 {
+			return nil, fmt.Errorf("groups not found on slave: %s", strings.Join(missing, ", "))
+		}
+		return ids, nil
+	}
+
+	for _, change := range plan.Changes {
+		if err := applyChange(ctx, client, change, resolveGroups); err != nil {
+			return fmt.Errorf("failed to %s %s %s: %w", change.Action, change.Item, change.Key, err)
+		}
+		if change.group != nil {
+			// Group ids changed; resolve again on next use
+			groupIDs = nil
+		}
+	}
+	return nil
+}
+
+func applyChange(ctx context.Context, client *pihole.Client, change Change, resolveGroups func([]string) ([]int, error)) error {
+	var err error
+	switch {
+	case change.group != nil:
+		switch change.Action {
+		case ActionAdd:
+			_, err = client.AddGroup(ctx, *change.group)
+		case ActionUpdate:
+			_, err = client.UpdateGroup(ctx, change.group.Name, *change.group)
+		case ActionDelete:
+			_, err = client.DeleteGroup(ctx, change.group.Name)
+		}
+
+	case change.domain != nil:
+		domain := *change.domain
+		if change.Action == ActionDelete {
+			_, err = client.DeleteDomain(ctx, domain.Type, domain.Kind, domain.Domain)
+			break
+		}
+		if domain.Groups, err = resolveGroups(change.groupNames); err != nil {
+			return err
+		}
+		if change.Action == ActionAdd {
+			_, err = client.AddDomain(ctx, domain)
+		} else {
+			_, err = client.UpdateDomain(ctx, domain)
+		}
+
+	case change.adlist != nil:
+		list := *change.adlist
+		if change.Action == ActionDelete {
+			_, err = client.DeleteAdlist(ctx, list.Type, list.Address)
+			break
+		}
+		if list.Groups, err = resolveGroups(change.groupNames); err != nil {
+			return err
+		}
+		if change.Action == ActionAdd {
+			_, err = client.AddAdlist(ctx, list)
+		} else {
+			_, err = client.UpdateAdlist(ctx, list)
+		}
+
+	case change.client != nil:
+		entry := *change.client
+		if change.Action == ActionDelete {
+			_, err = client.DeleteClient(ctx, entry.Client)
+			break
+		}
+		if entry.Groups, err = resolveGroups(change.groupNames); err != nil {
+			return err
+		}
+		if change.Action == ActionAdd {
+			_, err = client.AddClient(ctx, entry)
+		} else {
+			_, err = client.UpdateClient(ctx, entry)
+		}
+	}
+	return err
+}
@@ -0,0 +1,118 @@
+package sync
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/arimakouyou/pihole-sync/internal/config"
+	"github.com/arimakouyou/pihole-sync/internal/pihole"
+)
+
+func changeSummary(plan *Plan) []string {
+	var out []string
+	for _, change := range plan.Changes {
+		out = append(out, string(change.Action)+" "+change.Item+" "+change.Key)
+	}
+	return out
+}
+
+func TestComputePlan(t *testing.T) {
+	master := &State{
+		Groups: []pihole.Group{
+			{ID: 0, Name: "Default", Enabled: true},
+			{ID: 1, Name: "kids", Enabled: true},
+		},
+		Domains: []pihole.Domain{
+			{Domain: "ads.example.com", Type: pihole.DomainDeny, Kind: pihole.DomainExact, Groups: []int{0, 1}, Enabled: true},
+			{Domain: "same.example.com", Type: pihole.DomainDeny, Kind: pihole.DomainExact, Groups: []int{1}, Enabled: true},
+			{Domain: "good.example.com", Type: pihole.DomainAllow, Kind: pihole.DomainExact, Enabled: true},
+			{Domain: "^ad", Type: pihole.DomainDeny, Kind: pihole.DomainRegex, Enabled: true},
+		},
+		Adlists: []pihole.Adlist{
+			{Address: "https://lists.example/hosts", Type: pihole.ListBlock, Groups: []int{0}, Enabled: true, Comment: "new comment"},
+		},
+	}
+	slave := &State{
+		// Same group names as the master, different ids
+		Groups: []pihole.Group{
+			{ID: 0, Name: "Default", Enabled: true},
+			{ID: 5, Name: "kids", Enabled: true},
+			{ID: 6, Name: "stale", Enabled: true},
+		},
+		Domains: []pihole.Domain{
+			{Domain: "same.example.com", Type: pihole.DomainDeny, Kind: pihole.DomainExact, Groups: []int{5}, Enabled: true},
+			{Domain: "old.example.com", Type: pihole.DomainDeny, Kind: pihole.DomainExact, Groups: []int{0}, Enabled: true},
+			{Domain: "local-allow.example.com", Type: pihole.DomainAllow, Kind: pihole.DomainExact, Enabled: true},
+		},
+		Adlists: []pihole.Adlist{
+			{Address: "https://lists.example/hosts", Type: pihole.ListBlock, Groups: []int{0}, Enabled: true, Comment: "old comment"},
+		},
+	}
+
+	// Whitelist is not synced: the slave's local allow entry must survive
+	// and the master's allow entry must not be copied.
+	items := config.SyncItems{Adlists: true, Blacklist: true, Regex: true, Groups: true}
+
+	plan := ComputePlan(master, slave, items)
+
+	assert.Equal(t, []string{
+		"add blacklist ads.example.com",
+		"add regex ^ad",
+		"update adlists https://lists.example/hosts",
+		"delete blacklist old.example.com",
+		"delete groups stale",
+	}, changeSummary(plan))
+	assert.Equal(t, []string{"Default", "kids"}, plan.Changes[0].groupNames)
+}
+
+func TestComputePlanNoChanges(t *testing.T) {
+	state := &State{
+		Groups:  []pihole.Group{{ID: 0, Name: "Default", Enabled: true}},
+		Domains: []pihole.Domain{{Domain: "ads.example.com", Type: pihole.DomainDeny, Kind: pihole.DomainExact, Groups: []int{0}, Enabled: true}},
+	}
+
+	plan := ComputePlan(state, state, config.SyncItems{Blacklist: true, Groups: true})
+	assert.True(t, plan.Empty())
+}
+
+func TestApplyPlanResolvesGroupsByName(t *testing.T) {
+	slave := newFakePihole()
+	defer slave.Close()
+
+	master := &State{
+		Groups: []pihole.Group{
+			{ID: 0, Name: "Default", Enabled: true},
+			{ID: 1, Name: "kids", Enabled: true},
+		},
+		Domains: []pihole.Domain{
+			{Domain: "ads.example.com", Type: pihole.DomainDeny, Kind: pihole.DomainExact, Groups: []int{1}, Enabled: true},
+		},
+		Clients: []pihole.ClientEntry{
+			{Client: "192.168.1.10", Groups: []int{0, 1}},
+		},
+	}
+
+	client := pihole.NewClient(slave.URL(), "test-password")
+	ctx := context.Background()
+	items := config.SyncItems{Blacklist: true, Groups: true, Clients: true}
+
+	slaveState, err := ReadState(ctx, client)
+	require.NoError(t, err)
+	plan := ComputePlan(master, slaveState, items)
+	require.NoError(t, ApplyPlan(ctx, client, plan))
+
+	kidsID := slave.groupID("kids")
+	require.NotEqual(t, -1, kidsID)
+	require.Len(t, slave.domains, 1)
+	assert.Equal(t, []int{kidsID}, slave.domains[0].Groups)
+	require.Len(t, slave.clients, 1)
+	assert.ElementsMatch(t, []int{0, kidsID}, slave.clients[0].Groups)
+
+	// Converged: a second plan is empty
+	slaveState, err = ReadState(ctx, client)
+	require.NoError(t, err)
+	assert.True(t, ComputePlan(master, slaveState, items).Empty())
+}
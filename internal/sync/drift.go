@@ -0,0 +1,237 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	gosync "sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/arimakouyou/pihole-sync/internal/config"
+	"github.com/arimakouyou/pihole-sync/internal/logger"
+	"github.com/arimakouyou/pihole-sync/internal/metrics"
+)
+
+const (
+	defaultDriftInterval      = 5 * time.Minute
+	defaultDriftPersistChecks = 3
+)
+
+// DriftStatus is the outcome of the latest drift check.
+type DriftStatus struct {
+	CheckedAt time.Time    `json:"checked_at"`
+	Error     string       `json:"error,omitempty"`
+	Slaves    []SlaveDrift `json:"slaves"`
+}
+
+// SlaveDrift describes how far one slave has drifted from the master.
+type SlaveDrift struct {
+	Host    string `json:"host"`
+	Drifted bool   `json:"drifted"`
+	// Items maps each checked sync item to its number of differing entries
+	Items map[string]int `json:"items,omitempty"`
+	Error string         `json:"error,omitempty"`
+	// ConsecutiveChecks is the number of checks in a row that found drift
+	ConsecutiveChecks int `json:"consecutive_checks"`
+}
+
+// DriftDetector periodically compares every slave with the master without
+// writing anything. Drift is exported to Prometheus and, once it persisted
+// for the configured number of checks, can trigger a sync or an alert.
+type DriftDetector struct {
+	config      config.DriftConfig
+	coordinator *Coordinator
+	alert       func(title, details string)
+
+	mu          gosync.RWMutex
+	status      DriftStatus
+	consecutive map[string]int
+}
+
+// NewDriftDetector creates a detector comparing on the coordinator's current
+// syncer and syncing through the coordinator. alert may be nil.
+func NewDriftDetector(cfg config.DriftConfig, coordinator *Coordinator, alert func(title, details string)) *DriftDetector {
+	if cfg.Interval <= 0 {
+		cfg.Interval = defaultDriftInterval
+	}
+	if cfg.PersistChecks <= 0 {
+		cfg.PersistChecks = defaultDriftPersistChecks
+	}
+	return &DriftDetector{
+		config:      cfg,
+		coordinator: coordinator,
+		alert:       alert,
+		consecutive: make(map[string]int),
+	}
+}
+
+// Start runs a check immediately and then every interval until ctx is done.
+func (d *DriftDetector) Start(ctx context.Context) error {
+	if !d.config.Enabled {
+		return nil
+	}
+
+	if logger.Logger != nil {
+		logger.Logger.Info("Starting drift detection",
+			zap.Duration("interval", d.config.Interval),
+			zap.Int("persist_checks", d.config.PersistChecks))
+	}
+
+	ticker := time.NewTicker(d.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		d.Check(ctx)
+
+		select {
+		case <-ctx.Done():
+			if logger.Logger != nil {
+				logger.Logger.Info("Drift detection stopped")
+			}
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Status returns the result of the latest check.
+func (d *DriftDetector) Status() DriftStatus {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.status
+}
+
+// Check compares every slave with the master once, updates the status and
+// the drift gauges and fires the configured actions. While a sync is running
+// slaves are mid-update, so the check is skipped and the previous status kept.
+func (d *DriftDetector) Check(ctx context.Context) DriftStatus {
+	if d.coordinator.Running() {
+		if logger.Logger != nil {
+			logger.Logger.Debug("Sync in progress, skipping drift check")
+		}
+		return d.Status()
+	}
+
+	syncer := d.coordinator.Syncer()
+	status := DriftStatus{CheckedAt: time.Now()}
+
+	plans, err := syncer.DryRun(ctx)
+	if err != nil {
+		status.Error = err.Error()
+		if logger.Logger != nil {
+			logger.Logger.Warn("Drift check failed", zap.Error(err))
+		}
+		d.mu.Lock()
+		d.status = status
+		d.mu.Unlock()
+		return status
+	}
+
+	metrics.ResetDrift(syncer.config.ClusterName())
+
+	d.mu.Lock()
+	seen := make(map[string]bool)
+	var persistent []SlaveDrift
+	for i, plan := range plans.Details {
+		drift := SlaveDrift{Host: plan.Host, Error: plan.Error}
+		seen[plan.Host] = true
+
+		if plan.Plan != nil {
+			drift.Items = make(map[string]int)
+			for _, item := range verifiableItems {
+				if itemEnabled(syncer.plannedItems(i), item) {
+					drift.Items[item] = 0
+				}
+			}
+			for _, change := range plan.Plan.Changes {
+				drift.Items[change.Item]++
+			}
+			drift.Drifted = !plan.Plan.Empty()
+			metrics.SetSlaveDrift(syncer.config.ClusterName(), plan.Host, drift.Items)
+		}
+
+		if drift.Drifted {
+			d.consecutive[plan.Host]++
+		} else if drift.Error == "" {
+			d.consecutive[plan.Host] = 0
+		}
+		drift.ConsecutiveChecks = d.consecutive[plan.Host]
+		if drift.Drifted && drift.ConsecutiveChecks%d.config.PersistChecks == 0 {
+			persistent = append(persistent, drift)
+		}
+
+		status.Slaves = append(status.Slaves, drift)
+	}
+	for host := range d.consecutive {
+		if !seen[host] {
+			delete(d.consecutive, host)
+		}
+	}
+	d.status = status
+	d.mu.Unlock()
+
+	if len(persistent) > 0 {
+		d.handlePersistentDrift(ctx, persistent)
+	}
+	return status
+}
+
+// handlePersistentDrift alerts once when a slave first reaches the persist
+// threshold and syncs the drifted slaves every time the threshold is reached
+// again.
+func (d *DriftDetector) handlePersistentDrift(ctx context.Context, drifts []SlaveDrift) {
+	var lines []string
+	alert := false
+	for _, drift := range drifts {
+		lines = append(lines, fmt.Sprintf("%s: %s", drift.Host, formatDriftItems(drift.Items)))
+		if drift.ConsecutiveChecks == d.config.PersistChecks {
+			alert = true
+		}
+		if logger.Logger != nil {
+			logger.Logger.Warn("Slave drift persists",
+				zap.String("host", drift.Host),
+				zap.Int("consecutive_checks", drift.ConsecutiveChecks),
+				zap.Any("items", drift.Items))
+		}
+	}
+
+	if d.config.Alert && alert && d.alert != nil {
+		d.alert("ドリフト検出", "マスターと一致しないスレーブがあります\n"+strings.Join(lines, "\n"))
+	}
+
+	if d.config.AutoSync {
+		// The drift may be a change made on the slave alone. The master's
+		// fingerprint did not move then, so the run would skip the slave
+		// unless it is forgotten what it received.
+		syncer := d.coordinator.Syncer()
+		for _, drift := range drifts {
+			syncer.forgetReceived(drift.Host)
+		}
+		result, _, err := d.coordinator.Submit(ctx, SyncOptions{Trigger: TriggerDrift})
+		if err != nil {
+			if logger.Logger != nil {
+				logger.Logger.Error("Drift sync error", zap.Error(err))
+			}
+			return
+		}
+		if logger.Logger != nil {
+			logger.Logger.Info("Drift sync finished",
+				zap.Bool("success", result.Success),
+				zap.String("message", result.Message))
+		}
+	}
+}
+
+func formatDriftItems(items map[string]int) string {
+	var parts []string
+	for item, count := range items {
+		if count > 0 {
+			parts = append(parts, fmt.Sprintf("%s=%d", item, count))
+		}
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,145 @@
+package sync
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/arimakouyou/pihole-sync/internal/config"
+	"github.com/arimakouyou/pihole-sync/internal/metrics"
+	"github.com/arimakouyou/pihole-sync/internal/pihole"
+)
+
+func TestDriftDetector(t *testing.T) {
+	master := newFakePihole()
+	defer master.Close()
+	master.domains = []pihole.Domain{
+		{ID: 1, Domain: "ads.example.com", Type: pihole.DomainDeny, Kind: pihole.DomainExact, Groups: []int{0}, Enabled: true},
+	}
+
+	slave := newFakePihole()
+	defer slave.Close()
+
+	cfg := &config.Config{
+		Master: config.MasterConfig{Host: master.URL(), Password: "test-password"},
+		Slaves: []config.SlaveConfig{
+			{Host: slave.URL(), Password: "test-password", SyncItems: config.SyncItems{Blacklist: true, Adlists: true}},
+		},
+	}
+	syncer := NewSyncer(cfg, pihole.NewPool())
+
+	var alerts []string
+	detector := NewDriftDetector(
+		config.DriftConfig{Enabled: true, PersistChecks: 2, AutoSync: true, Alert: true},
+		NewCoordinator(context.Background(), func() *Syncer { return syncer }),
+		func(title, details string) { alerts = append(alerts, details) },
+	)
+	ctx := context.Background()
+
+	// First check: drift found but not yet persistent
+	status := detector.Check(ctx)
+	require.Empty(t, status.Error)
+	require.Len(t, status.Slaves, 1)
+	assert.True(t, status.Slaves[0].Drifted)
+	assert.Equal(t, map[string]int{ItemBlacklist: 1, ItemAdlists: 0}, status.Slaves[0].Items)
+	assert.Equal(t, 1, status.Slaves[0].ConsecutiveChecks)
+	assert.Empty(t, alerts)
+	assert.Empty(t, slave.restores, "drift detection must not write")
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.SlaveDrifted.WithLabelValues(config.DefaultClusterName, slave.URL())))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.DriftEntries.WithLabelValues(config.DefaultClusterName, slave.URL(), ItemBlacklist)))
+
+	// Second check: drift persisted, alert and sync fire
+	status = detector.Check(ctx)
+	assert.Equal(t, 2, status.Slaves[0].ConsecutiveChecks)
+	require.Len(t, alerts, 1)
+	assert.Contains(t, alerts[0], "blacklist=1")
+	assert.Len(t, slave.restores, 1)
+
+	// Third check: the slave was synced, drift cleared
+	status = detector.Check(ctx)
+	assert.False(t, status.Slaves[0].Drifted)
+	assert.Equal(t, 0, status.Slaves[0].ConsecutiveChecks)
+	assert.Equal(t, 0.0, testutil.ToFloat64(metrics.SlaveDrifted.WithLabelValues(config.DefaultClusterName, slave.URL())))
+	assert.Equal(t, status, detector.Status())
+}
+
+func TestDriftDetectorMasterUnreachable(t *testing.T) {
+	cfg := &config.Config{
+		Master: config.MasterConfig{Host: "http://127.0.0.1:1", Password: "test-password"},
+	}
+	syncer := NewSyncer(cfg, pihole.NewPool())
+	detector := NewDriftDetector(config.DriftConfig{Enabled: true}, NewCoordinator(context.Background(), func() *Syncer { return syncer }), nil)
+
+	status := detector.Check(context.Background())
+	assert.Contains(t, status.Error, "failed to read master state")
+}
+
+func TestDriftDetectorMultiMaster(t *testing.T) {
+	master := newFakePihole()
+	defer master.Close()
+	master.domains = []pihole.Domain{denyDomain("ads.example.com", "", 1)}
+	slave := newFakePihole()
+	defer slave.Close()
+
+	cfg := &config.Config{
+		Master: config.MasterConfig{Host: master.URL(), Password: "test-password"},
+		Slaves: []config.SlaveConfig{{Host: slave.URL(), Password: "test-password"}},
+		MultiMaster: config.MultiMasterConfig{
+			Enabled:   true,
+			SyncItems: config.SyncItems{Blacklist: true},
+			StatePath: t.TempDir() + "/state.json",
+		},
+	}
+	syncer := NewSyncer(cfg, pihole.NewPool())
+	detector := NewDriftDetector(config.DriftConfig{Enabled: true, PersistChecks: 1}, NewCoordinator(context.Background(), func() *Syncer { return syncer }), nil)
+
+	// Every instance is compared with the merged state
+	status := detector.Check(context.Background())
+	require.Empty(t, status.Error)
+	require.Len(t, status.Slaves, 2)
+	assert.False(t, status.Slaves[0].Drifted)
+	assert.Equal(t, map[string]int{ItemBlacklist: 1}, status.Slaves[1].Items)
+}
+
+func TestDriftDetectorSyncsSlaveEditedByHand(t *testing.T) {
+	master := newFakePihole()
+	defer master.Close()
+	master.domains = []pihole.Domain{denyDomain("ads.example.com", "", 0)}
+	slave := newFakePihole()
+	defer slave.Close()
+
+	cfg := &config.Config{
+		Master: config.MasterConfig{Host: master.URL(), Password: "test-password"},
+		Slaves: []config.SlaveConfig{
+			{Host: slave.URL(), Password: "test-password", SyncItems: config.SyncItems{Blacklist: true}},
+		},
+	}
+	syncer := NewSyncer(cfg, pihole.NewPool())
+	detector := NewDriftDetector(
+		config.DriftConfig{Enabled: true, PersistChecks: 2, AutoSync: true},
+		NewCoordinator(context.Background(), func() *Syncer { return syncer }),
+		nil,
+	)
+	ctx := context.Background()
+
+	result := syncNowForTest(t, syncer, SyncOptions{})
+	require.True(t, result.Success)
+	require.Len(t, slave.restores, 1)
+
+	// Only the slave changes; the master's fingerprint stays the same
+	slave.domains = append(slave.domains, denyDomain("local.example.com", "", 0))
+
+	status := detector.Check(ctx)
+	assert.True(t, status.Slaves[0].Drifted)
+	status = detector.Check(ctx)
+	assert.Equal(t, 2, status.Slaves[0].ConsecutiveChecks)
+	assert.Len(t, slave.restores, 2, "the drifted slave is synced although the master did not change")
+
+	status = detector.Check(ctx)
+	assert.False(t, status.Slaves[0].Drifted)
+	require.Len(t, slave.domains, 1)
+	assert.Equal(t, "ads.example.com", slave.domains[0].Domain)
+}
@@ -0,0 +1,129 @@
+package sync
+
+import (
+	"context"
+	gosync "sync"
+	"time"
+)
+
+// Sync lifecycle event types
+const (
+	EventSyncStarted    = "sync_started"
+	EventMasterFailover = "master_failover"
+	EventMasterBackup   = "master_backup"
+	EventSlaveStarted   = "slave_started"
+	EventSlaveRetry     = "slave_retry"
+	EventSlaveVerified  = "slave_verified"
+	// EventSlaveHealthChecked follows the rollout health checks of a slave
+	EventSlaveHealthChecked = "slave_health_checked"
+	EventSlaveDone          = "slave_done"
+	EventSlaveFailed        = "slave_failed"
+	EventSyncFinished       = "sync_finished"
+)
+
+// Event is one step of a sync run. Slave events carry the slave's index in
+// the configuration and its host.
+type Event struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	// Run numbers the coordinator's runs so subscribers can group events
+	Run int64 `json:"run,omitempty"`
+	// Cluster is the name of the cluster the run syncs
+	Cluster string `json:"cluster,omitempty"`
+	Trigger string `json:"trigger,omitempty"`
+	// Hosts lists the slaves of the run, on sync_started
+	Hosts []string `json:"hosts,omitempty"`
+	// Master and FormerMaster are the new and the previous sync source, on
+	// master_failover
+	Master       string         `json:"master,omitempty"`
+	FormerMaster string         `json:"former_master,omitempty"`
+	Index        *int           `json:"index,omitempty"`
+	Host         string         `json:"host,omitempty"`
+	Bytes        int64          `json:"bytes,omitempty"`
+	Attempt      int            `json:"attempt,omitempty"`
+	Error        string         `json:"error,omitempty"`
+	Verification string         `json:"verification,omitempty"`
+	Mismatches   []ItemMismatch `json:"mismatches,omitempty"`
+	// Health lists the rollout health checks, on slave_health_checked
+	Health      []HealthCheck `json:"health,omitempty"`
+	SlaveResult *SlaveResult  `json:"slave_result,omitempty"`
+	SyncResult  *SyncResult   `json:"sync_result,omitempty"`
+}
+
+func (o SyncOptions) emit(event Event) {
+	if o.Events != nil {
+		event.Time = time.Now()
+		o.Events(event)
+	}
+}
+
+type eventsKey struct{}
+
+// withSlaveEvents returns a context whose slave events are sent to opts'
+// Events, tagged with the slave's index and host. Retries and verification
+// happen deep in the slave flow, so the context carries the sink there.
+func withSlaveEvents(ctx context.Context, opts SyncOptions, index int, host string) context.Context {
+	if opts.Events == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, eventsKey{}, func(event Event) {
+		event.Index = &index
+		event.Host = host
+		opts.emit(event)
+	})
+}
+
+// emitSlaveEvent sends event to the sink set by withSlaveEvents, if any.
+func emitSlaveEvent(ctx context.Context, event Event) {
+	if emit, ok := ctx.Value(eventsKey{}).(func(Event)); ok {
+		emit(event)
+	}
+}
+
+// subscriberBuffer is how many events a subscriber may lag behind before
+// further events are dropped for it
+const subscriberBuffer = 64
+
+// EventBus fans sync events out to subscribers, e.g. Server-Sent Events
+// clients. Publishing never blocks; a subscriber that does not keep up
+// misses events.
+type EventBus struct {
+	mu          gosync.Mutex
+	subscribers map[chan Event]struct{}
+}
+
+// NewEventBus creates an event bus without subscribers.
+func NewEventBus() *EventBus {
+	return &EventBus{subscribers: make(map[chan Event]struct{})}
+}
+
+// Publish sends event to every subscriber.
+func (b *EventBus) Publish(event Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// Subscribe returns a channel receiving every published event and a
+// function ending the subscription, which closes the channel.
+func (b *EventBus) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, subscriberBuffer)
+	b.mu.Lock()
+	b.subscribers[ch] = struct{}{}
+	b.mu.Unlock()
+
+	var once gosync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subscribers, ch)
+			b.mu.Unlock()
+			close(ch)
+		})
+	}
+}
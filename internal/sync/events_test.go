@@ -0,0 +1,134 @@
+package sync
+
+import (
+	"context"
+	gosync "sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/arimakouyou/pihole-sync/internal/config"
+	"github.com/arimakouyou/pihole-sync/internal/pihole"
+)
+
+type eventLog struct {
+	mu     gosync.Mutex
+	events []Event
+}
+
+func (l *eventLog) add(event Event) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, event)
+}
+
+func (l *eventLog) types() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var types []string
+	for _, event := range l.events {
+		types = append(types, event.Type)
+	}
+	return types
+}
+
+func TestSyncEmitsLifecycleEvents(t *testing.T) {
+	master := newFakePihole()
+	defer master.Close()
+	slave := newFakePihole()
+	defer slave.Close()
+	slave.failRestore = 1
+
+	cfg := &config.Config{
+		Master:    config.MasterConfig{Host: master.URL(), Password: "test-password"},
+		Slaves:    []config.SlaveConfig{{Host: slave.URL(), Password: "test-password", SyncItems: config.SyncItems{Blacklist: true}}},
+		SyncRetry: config.SyncRetry{Enabled: true, Count: 1},
+	}
+
+	log := &eventLog{}
+	result, err := NewSyncer(cfg, pihole.NewPool()).syncNow(context.Background(), SyncOptions{Trigger: TriggerAPI, Events: log.add})
+	require.NoError(t, err)
+	require.True(t, result.Success)
+
+	assert.Equal(t, []string{
+		EventSyncStarted,
+		EventMasterBackup,
+		EventSlaveStarted,
+		EventSlaveRetry,
+		EventSlaveVerified,
+		EventSlaveDone,
+		EventSyncFinished,
+	}, log.types())
+
+	events := log.events
+	assert.Equal(t, []string{slave.URL()}, events[0].Hosts)
+	assert.Equal(t, TriggerAPI, events[0].Trigger)
+	assert.Positive(t, events[1].Bytes)
+	for _, event := range events[2:6] {
+		require.NotNil(t, event.Index)
+		assert.Equal(t, 0, *event.Index)
+		assert.Equal(t, slave.URL(), event.Host)
+	}
+	assert.Equal(t, 1, events[3].Attempt)
+	assert.NotEmpty(t, events[3].Error)
+	assert.Equal(t, VerificationVerified, events[4].Verification)
+	require.NotNil(t, events[5].SlaveResult)
+	assert.Equal(t, "ok", events[5].SlaveResult.Result)
+	assert.Same(t, result, events[6].SyncResult)
+}
+
+func TestSyncEmitsSlaveFailed(t *testing.T) {
+	master := newFakePihole()
+	defer master.Close()
+	slave := newFakePihole()
+	defer slave.Close()
+	slave.failRestore = 1
+
+	cfg := &config.Config{
+		Master: config.MasterConfig{Host: master.URL(), Password: "test-password"},
+		Slaves: []config.SlaveConfig{{Host: slave.URL(), Password: "test-password", SyncItems: config.SyncItems{Blacklist: true}}},
+	}
+
+	log := &eventLog{}
+	_, err := NewSyncer(cfg, pihole.NewPool()).syncNow(context.Background(), SyncOptions{Events: log.add})
+	require.NoError(t, err)
+
+	types := log.types()
+	assert.Contains(t, types, EventSlaveFailed)
+	assert.NotContains(t, types, EventSlaveDone)
+	assert.NotContains(t, types, EventSlaveVerified, "a failed restore is not verified")
+}
+
+func TestCoordinatorPublishesEvents(t *testing.T) {
+	syncer := NewSyncer(&config.Config{}, pihole.NewPool())
+	coordinator := NewCoordinator(context.Background(), func() *Syncer { return syncer })
+
+	events, unsubscribe := coordinator.Events().Subscribe()
+	_, _, err := coordinator.Submit(context.Background(), SyncOptions{Trigger: TriggerSchedule})
+	assert.Error(t, err)
+
+	started := <-events
+	assert.Equal(t, EventSyncStarted, started.Type)
+	assert.Equal(t, int64(1), started.Run)
+	finished := <-events
+	assert.Equal(t, EventSyncFinished, finished.Type)
+	assert.NotEmpty(t, finished.Error)
+
+	unsubscribe()
+	_, open := <-events
+	assert.False(t, open)
+	unsubscribe()
+}
+
+func TestEventBusDropsForSlowSubscribers(t *testing.T) {
+	bus := NewEventBus()
+	events, unsubscribe := bus.Subscribe()
+	defer unsubscribe()
+
+	for i := 0; i < subscriberBuffer+10; i++ {
+		bus.Publish(Event{Type: EventSlaveRetry, Attempt: i})
+	}
+	assert.Len(t, events, subscriberBuffer)
+	assert.Equal(t, 0, (<-events).Attempt, "the oldest events are kept")
+}
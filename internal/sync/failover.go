@@ -0,0 +1,360 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/arimakouyou/pihole-sync/internal/config"
+	"github.com/arimakouyou/pihole-sync/internal/logger"
+	"github.com/arimakouyou/pihole-sync/internal/metrics"
+	"github.com/arimakouyou/pihole-sync/internal/pihole"
+)
+
+// Health of a master candidate reported in MasterStatus
+const (
+	MasterUnchecked = "unchecked"
+	MasterHealthy   = "healthy"
+	MasterUnhealthy = "unhealthy"
+	// MasterStale candidates are not checked: they did not match the active
+	// master recently enough to be promoted
+	MasterStale = "stale"
+)
+
+// masterCandidate is one entry of the master priority list.
+type masterCandidate struct {
+	config config.MasterConfig
+	client *pihole.Client
+	// err is set when building the client failed
+	err error
+
+	health    string
+	error     string
+	checkedAt time.Time
+}
+
+// MasterCandidateStatus is the state of one master candidate.
+type MasterCandidateStatus struct {
+	Host     string `json:"host"`
+	Priority int    `json:"priority"`
+	Active   bool   `json:"active"`
+	Health   string `json:"health"`
+	Error    string `json:"error,omitempty"`
+	// CheckedAt is the time of the latest health check
+	CheckedAt *time.Time `json:"checked_at,omitempty"`
+	// LastInSync is when the candidate last matched the active master
+	LastInSync *time.Time `json:"last_in_sync,omitempty"`
+}
+
+// MasterStatus shows which master candidate is the sync source.
+type MasterStatus struct {
+	Active     string                  `json:"active"`
+	Failover   bool                    `json:"failover"`
+	Candidates []MasterCandidateStatus `json:"candidates"`
+}
+
+// inSyncRecorder is implemented by recorders that know when a host last
+// matched the master, so the staleness safeguard survives restarts.
+type inSyncRecorder interface {
+	LastInSync(host string) time.Time
+}
+
+// masterRecorder is implemented by recorders that know which master the
+// recorded runs synced from, so that a failover survives restarts.
+type masterRecorder interface {
+	LastMaster() (host string, since time.Time)
+}
+
+// SetAlert makes the syncer call alert whenever the sync source moves to
+// another master candidate or a staged rollout halts.
+func (s *Syncer) SetAlert(alert func(title, details string)) {
+	s.mastersMu.Lock()
+	defer s.mastersMu.Unlock()
+	s.alert = alert
+}
+
+// currentAlert returns the function set by SetAlert, if any.
+func (s *Syncer) currentAlert() func(title, details string) {
+	s.mastersMu.Lock()
+	defer s.mastersMu.Unlock()
+	return s.alert
+}
+
+// ActiveMaster returns the host currently used as the sync source.
+func (s *Syncer) ActiveMaster() string {
+	s.mastersMu.Lock()
+	defer s.mastersMu.Unlock()
+	return s.masters[s.active].config.Host
+}
+
+// MasterStatus returns the master priority list with the latest health of
+// every candidate.
+func (s *Syncer) MasterStatus() MasterStatus {
+	s.mastersMu.Lock()
+	defer s.mastersMu.Unlock()
+
+	status := MasterStatus{
+		Active:     s.masters[s.active].config.Host,
+		Failover:   s.config.Failover.Enabled,
+		Candidates: make([]MasterCandidateStatus, len(s.masters)),
+	}
+	for i, candidate := range s.masters {
+		candidateStatus := MasterCandidateStatus{
+			Host:     candidate.config.Host,
+			Priority: i,
+			Active:   i == s.active,
+			Health:   candidate.health,
+			Error:    candidate.error,
+		}
+		if !candidate.checkedAt.IsZero() {
+			checkedAt := candidate.checkedAt
+			candidateStatus.CheckedAt = &checkedAt
+		}
+		if last := s.lastInSync(candidate.config.Host); !last.IsZero() {
+			candidateStatus.LastInSync = &last
+		}
+		status.Candidates[i] = candidateStatus
+	}
+	return status
+}
+
+// currentMaster returns the active master candidate without checking it.
+func (s *Syncer) currentMaster() (*masterCandidate, error) {
+	s.mastersMu.Lock()
+	master := s.masters[s.active]
+	s.mastersMu.Unlock()
+	if master.err != nil {
+		return nil, fmt.Errorf("failed to create master client: %w", master.err)
+	}
+	return master, nil
+}
+
+// selectMaster returns the master to sync from. Without failover that is
+// the configured master. With failover every candidate is considered in
+// priority order and the first healthy one that is not stale is promoted;
+// the active master is never considered stale.
+func (s *Syncer) selectMaster(ctx context.Context, opts SyncOptions) (*masterCandidate, error) {
+	if !s.config.Failover.Enabled {
+		return s.currentMaster()
+	}
+
+	s.mastersMu.Lock()
+	active := s.active
+	promotedAt := s.promotedAt
+	s.mastersMu.Unlock()
+
+	var reasons []string
+	for i, candidate := range s.masters {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		health, err := s.checkCandidate(ctx, candidate, i == active, promotedAt)
+
+		s.mastersMu.Lock()
+		candidate.health = health
+		candidate.error = ""
+		if err != nil {
+			candidate.error = err.Error()
+		}
+		if health != MasterStale {
+			candidate.checkedAt = time.Now()
+		}
+		s.mastersMu.Unlock()
+
+		if health != MasterHealthy {
+			if logger.Logger != nil {
+				logger.Logger.Warn("Master candidate not usable",
+					zap.String("host", candidate.config.Host),
+					zap.String("health", health),
+					zap.Error(err))
+			}
+			reasons = append(reasons, fmt.Sprintf("%s: %v", candidate.config.Host, err))
+			continue
+		}
+
+		if i != active {
+			s.promote(opts, active, i, reasons)
+		}
+		return candidate, nil
+	}
+	return nil, fmt.Errorf("no usable master candidate: %s", strings.Join(reasons, "; "))
+}
+
+// checkCandidate returns the health of candidate and, unless it is healthy,
+// why not. A candidate other than the active master is stale unless it
+// matched the active master since that one took over at promotedAt, and
+// within the configured staleness.
+func (s *Syncer) checkCandidate(ctx context.Context, candidate *masterCandidate, active bool, promotedAt time.Time) (string, error) {
+	if candidate.err != nil {
+		return MasterUnhealthy, fmt.Errorf("failed to create client: %w", candidate.err)
+	}
+
+	if !active {
+		if s.partialSlave(candidate.config.Host) {
+			return MasterStale, fmt.Errorf("syncs only part of the items the master hands out")
+		}
+		maxStaleness := s.config.Failover.MaxStaleness
+		if maxStaleness <= 0 {
+			maxStaleness = config.DefaultFailoverMaxStaleness
+		}
+		last := s.lastInSync(candidate.config.Host)
+		if last.IsZero() {
+			return MasterStale, fmt.Errorf("never matched the active master")
+		}
+		if !last.After(promotedAt) {
+			return MasterStale, fmt.Errorf("has not matched the active master since it took over")
+		}
+		if time.Since(last) > maxStaleness {
+			return MasterStale, fmt.Errorf("last matched the active master at %s", last.Format(time.RFC3339))
+		}
+	}
+
+	if err := candidate.client.Ping(ctx); err != nil {
+		return MasterUnhealthy, fmt.Errorf("health check failed: %w", err)
+	}
+	return MasterHealthy, nil
+}
+
+// promote makes the to-th candidate the sync source and reports the
+// failover. reasons says why the candidates before it were passed over.
+func (s *Syncer) promote(opts SyncOptions, from, to int, reasons []string) {
+	s.mastersMu.Lock()
+	s.active = to
+	s.promotedAt = time.Now()
+	alert := s.alert
+	s.mastersMu.Unlock()
+
+	fromHost := s.masters[from].config.Host
+	toHost := s.masters[to].config.Host
+	metrics.SetActiveMaster(s.config.ClusterName(), s.masterHosts(), toHost)
+	metrics.IncrementMasterFailovers(s.config.ClusterName(), fromHost, toHost)
+	if logger.Logger != nil {
+		logger.Logger.Warn("Master failover, syncing from another master candidate",
+			zap.String("from", fromHost),
+			zap.String("to", toHost),
+			zap.Strings("reasons", reasons))
+	}
+
+	event := Event{Type: EventMasterFailover, Master: toHost, FormerMaster: fromHost}
+	if len(reasons) > 0 {
+		event.Error = strings.Join(reasons, "; ")
+	}
+	opts.emit(event)
+
+	if alert != nil {
+		details := fmt.Sprintf("同期元のマスターを %s から %s に切り替えました", fromHost, toHost)
+		if len(reasons) > 0 {
+			details += "\n" + strings.Join(reasons, "\n")
+		}
+		alert("マスターフェイルオーバー", details)
+	}
+}
+
+// restoreActiveMaster makes the master the recorded runs last synced from
+// the active one, as if it had been promoted when those runs began. A
+// restart would otherwise go back to the first candidate, which may have
+// missed every change made since the failover.
+func (s *Syncer) restoreActiveMaster(recorder masterRecorder) {
+	if !s.config.Failover.Enabled {
+		return
+	}
+	host, since := recorder.LastMaster()
+	s.setActiveMaster(host, since)
+}
+
+// inheritFailover takes over when the hosts last matched the master and,
+// with failover, the active master from prev, the syncer replaced on a
+// configuration reload.
+func (s *Syncer) inheritFailover(prev *Syncer, hosts []string) {
+	prev.receivedMu.Lock()
+	for _, host := range hosts {
+		if last, ok := prev.inSync[host]; ok {
+			s.inSync[host] = last
+		}
+	}
+	prev.receivedMu.Unlock()
+
+	if !s.config.Failover.Enabled {
+		return
+	}
+	prev.mastersMu.Lock()
+	host := prev.masters[prev.active].config.Host
+	promotedAt := prev.promotedAt
+	prev.mastersMu.Unlock()
+	s.setActiveMaster(host, promotedAt)
+}
+
+// setActiveMaster makes the candidate at host the active master, which took
+// over at promotedAt. A host that is no candidate is ignored.
+func (s *Syncer) setActiveMaster(host string, promotedAt time.Time) {
+	i := slices.IndexFunc(s.masters, func(candidate *masterCandidate) bool { return candidate.config.Host == host })
+	if i < 0 {
+		return
+	}
+	s.mastersMu.Lock()
+	s.active = i
+	s.promotedAt = promotedAt
+	s.mastersMu.Unlock()
+	metrics.SetActiveMaster(s.config.ClusterName(), s.masterHosts(), host)
+}
+
+// masterHosts returns the hosts of the master priority list.
+func (s *Syncer) masterHosts() []string {
+	hosts := make([]string, len(s.masters))
+	for i, candidate := range s.masters {
+		hosts[i] = candidate.config.Host
+	}
+	return hosts
+}
+
+// lastInSync returns when host last matched the master, from this process
+// or, if the recorder keeps it, from the recorded history.
+func (s *Syncer) lastInSync(host string) time.Time {
+	s.receivedMu.Lock()
+	last := s.inSync[host]
+	s.receivedMu.Unlock()
+
+	if recorder, ok := s.recorder.(inSyncRecorder); ok {
+		if recorded := recorder.LastInSync(host); recorded.After(last) {
+			last = recorded
+		}
+	}
+	return last
+}
+
+// markInSync records the hosts that matched the master at syncedAt: the
+// master itself and every slave that ended up in sync and receives all of
+// the master's items.
+func (s *Syncer) markInSync(master string, details []SlaveResult, syncedAt time.Time) {
+	s.receivedMu.Lock()
+	defer s.receivedMu.Unlock()
+	s.inSync[master] = syncedAt
+	for _, result := range details {
+		if result.InSync() && !s.partialSlave(result.Host) {
+			s.inSync[result.Host] = syncedAt
+		}
+	}
+}
+
+// partialSlave reports whether host is a slave whose SyncItems leave out
+// items the master hands out to other slaves. Matching the master says
+// nothing about the items it does not receive, so such a slave never counts
+// as in sync and cannot be promoted.
+func (s *Syncer) partialSlave(host string) bool {
+	var handedOut, own config.SyncItems
+	found := false
+	for _, slave := range s.config.Slaves {
+		for _, item := range enabledItems(slave.SyncItems) {
+			setItem(&handedOut, item)
+		}
+		if slave.Host == host {
+			own = slave.SyncItems
+			found = true
+		}
+	}
+	return found && len(enabledItems(own)) < len(enabledItems(handedOut))
+}
@@ -0,0 +1,238 @@
+package sync
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/arimakouyou/pihole-sync/internal/config"
+	"github.com/arimakouyou/pihole-sync/internal/pihole"
+)
+
+type alertLog struct {
+	titles  []string
+	details []string
+}
+
+func (l *alertLog) add(title, details string) {
+	l.titles = append(l.titles, title)
+	l.details = append(l.details, details)
+}
+
+// failoverSetup has a primary master, a standby that is also synced as a
+// slave, and a plain slave.
+func failoverSetup(t *testing.T) (primary, standby, slave *fakePihole, cfg *config.Config) {
+	primary = newFakePihole()
+	t.Cleanup(primary.Close)
+	primary.domains = []pihole.Domain{
+		{ID: 1, Domain: "ads.example.com", Type: pihole.DomainDeny, Kind: pihole.DomainExact, Groups: []int{0}, Enabled: true},
+	}
+	standby = newFakePihole()
+	t.Cleanup(standby.Close)
+	slave = newFakePihole()
+	t.Cleanup(slave.Close)
+
+	items := config.SyncItems{Blacklist: true}
+	cfg = &config.Config{
+		Master: config.MasterConfig{Host: primary.URL(), Password: "test-password"},
+		Slaves: []config.SlaveConfig{
+			{Host: standby.URL(), Password: "test-password", SyncItems: items},
+			{Host: slave.URL(), Password: "test-password", SyncItems: items},
+		},
+		Failover: config.FailoverConfig{
+			Enabled:    true,
+			Candidates: []config.MasterConfig{{Host: standby.URL(), Password: "test-password"}},
+		},
+	}
+	return primary, standby, slave, cfg
+}
+
+func syncNowForTest(t *testing.T, syncer *Syncer, opts SyncOptions) *SyncResult {
+	t.Helper()
+	result, err := syncer.syncNow(context.Background(), opts)
+	require.NoError(t, err)
+	return result
+}
+
+func TestFailoverPromotesInSyncStandby(t *testing.T) {
+	primary, standby, slave, cfg := failoverSetup(t)
+	syncer := NewSyncer(cfg, pihole.NewPool())
+	alerts := &alertLog{}
+	syncer.SetAlert(alerts.add)
+
+	result := syncNowForTest(t, syncer, SyncOptions{})
+	require.True(t, result.Success)
+	assert.Equal(t, primary.URL(), result.Master)
+	assert.Empty(t, alerts.titles)
+
+	// The standby keeps the primary's data when it goes down
+	primary.setDown(true)
+	primary.domains = append(primary.domains, pihole.Domain{ID: 2, Domain: "lost.example.com", Type: pihole.DomainDeny, Kind: pihole.DomainExact, Groups: []int{0}, Enabled: true})
+	standby.domains = append(standby.domains, pihole.Domain{ID: 3, Domain: "new.example.com", Type: pihole.DomainDeny, Kind: pihole.DomainExact, Groups: []int{0}, Enabled: true})
+
+	log := &eventLog{}
+	result = syncNowForTest(t, syncer, SyncOptions{Events: log.add})
+	require.True(t, result.Success, "%+v", result.Details)
+	assert.Equal(t, standby.URL(), result.Master)
+	assert.Equal(t, standby.URL(), syncer.ActiveMaster())
+
+	assert.True(t, result.Details[0].ActingMaster, "the promoted standby is not synced onto itself")
+	assert.Equal(t, "skipped", result.Details[0].Result)
+	assert.Equal(t, "ok", result.Details[1].Result)
+	assert.Len(t, slave.domains, 2)
+
+	require.Len(t, alerts.titles, 1)
+	assert.Contains(t, alerts.details[0], standby.URL())
+	assert.Equal(t, EventMasterFailover, log.events[1].Type)
+	assert.Equal(t, standby.URL(), log.events[1].Master)
+	assert.Equal(t, primary.URL(), log.events[1].FormerMaster)
+	assert.Contains(t, log.events[1].Error, "health check failed")
+
+	status := syncer.MasterStatus()
+	assert.Equal(t, standby.URL(), status.Active)
+	require.Len(t, status.Candidates, 2)
+	assert.Equal(t, MasterUnhealthy, status.Candidates[0].Health)
+	assert.Equal(t, MasterHealthy, status.Candidates[1].Health)
+	assert.True(t, status.Candidates[1].Active)
+
+	// Back up, the primary has not matched the standby since, so it stays
+	// passed over and the standby remains the source
+	primary.setDown(false)
+	result = syncNowForTest(t, syncer, SyncOptions{})
+	require.True(t, result.Success)
+	assert.Equal(t, standby.URL(), result.Master)
+	assert.Equal(t, MasterStale, syncer.MasterStatus().Candidates[0].Health)
+	assert.Len(t, alerts.titles, 1)
+}
+
+func TestFailoverRefusesStaleStandby(t *testing.T) {
+	primary, _, _, cfg := failoverSetup(t)
+	primary.setDown(true)
+	syncer := NewSyncer(cfg, pihole.NewPool())
+	alerts := &alertLog{}
+	syncer.SetAlert(alerts.add)
+
+	// The standby never matched the primary
+	_, err := syncer.syncNow(context.Background(), SyncOptions{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no usable master candidate")
+	assert.Contains(t, err.Error(), "never matched the active master")
+	assert.Empty(t, alerts.titles)
+
+	// Nor recently enough
+	syncer.inSync[cfg.Failover.Candidates[0].Host] = time.Now().Add(-config.DefaultFailoverMaxStaleness - time.Minute)
+	_, err = syncer.syncNow(context.Background(), SyncOptions{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "last matched the active master")
+	assert.Equal(t, primary.URL(), syncer.ActiveMaster())
+}
+
+func TestFailoverRefusesStandbyWithNarrowerItems(t *testing.T) {
+	primary, standby, _, cfg := failoverSetup(t)
+	// The other slave also receives the whitelist, which the standby lacks
+	cfg.Slaves[1].SyncItems.Whitelist = true
+	syncer := NewSyncer(cfg, pihole.NewPool())
+
+	result := syncNowForTest(t, syncer, SyncOptions{})
+	require.True(t, result.Success)
+	assert.True(t, syncer.lastInSync(standby.URL()).IsZero())
+
+	primary.setDown(true)
+	_, err := syncer.syncNow(context.Background(), SyncOptions{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "syncs only part of the items")
+	assert.Equal(t, primary.URL(), syncer.ActiveMaster())
+}
+
+func TestFailbackToPrimaryOnceInSync(t *testing.T) {
+	primary, standby, _, cfg := failoverSetup(t)
+	// Syncing the primary from the standby lets it take over again
+	cfg.Slaves = append(cfg.Slaves, config.SlaveConfig{Host: primary.URL(), Password: "test-password", SyncItems: config.SyncItems{Blacklist: true}})
+	syncer := NewSyncer(cfg, pihole.NewPool())
+	alerts := &alertLog{}
+	syncer.SetAlert(alerts.add)
+
+	syncNowForTest(t, syncer, SyncOptions{})
+	primary.setDown(true)
+	result := syncNowForTest(t, syncer, SyncOptions{})
+	assert.Equal(t, standby.URL(), result.Master)
+	assert.Equal(t, "error", result.Details[2].Result, "the primary is down")
+
+	primary.setDown(false)
+	result = syncNowForTest(t, syncer, SyncOptions{})
+	assert.Equal(t, standby.URL(), result.Master, "the primary missed the standby's changes")
+	assert.Equal(t, "ok", result.Details[2].Result)
+
+	result = syncNowForTest(t, syncer, SyncOptions{})
+	assert.Equal(t, primary.URL(), result.Master)
+	assert.True(t, result.Details[2].ActingMaster)
+	assert.Len(t, alerts.titles, 2)
+}
+
+func TestFailoverSurvivesReload(t *testing.T) {
+	primary, standby, _, cfg := failoverSetup(t)
+	pool := pihole.NewPool()
+	prev := NewSyncer(cfg, pool)
+	syncNowForTest(t, prev, SyncOptions{})
+	primary.setDown(true)
+	require.Equal(t, standby.URL(), syncNowForTest(t, prev, SyncOptions{}).Master)
+
+	// The primary missed the standby's changes; a reload does not trust it
+	primary.setDown(false)
+	syncer := NewSyncer(cfg, pool)
+	syncer.Inherit(prev)
+	assert.Equal(t, standby.URL(), syncer.ActiveMaster())
+	result := syncNowForTest(t, syncer, SyncOptions{})
+	assert.Equal(t, standby.URL(), result.Master)
+	assert.Equal(t, MasterStale, syncer.MasterStatus().Candidates[0].Health)
+}
+
+// lastMasterRecorder is a memoryRecorder that also reports the recorded
+// master.
+type lastMasterRecorder struct {
+	memoryRecorder
+	master string
+	since  time.Time
+}
+
+func (r *lastMasterRecorder) LastMaster() (string, time.Time) {
+	return r.master, r.since
+}
+
+func TestFailoverSurvivesRestart(t *testing.T) {
+	primary, standby, _, cfg := failoverSetup(t)
+	recorder := &lastMasterRecorder{master: standby.URL(), since: time.Now().Add(-time.Hour)}
+
+	// After a restart the primary is up again, but the recorded runs were
+	// synced from the standby
+	syncer := NewSyncer(cfg, pihole.NewPool())
+	syncer.SetRecorder(recorder)
+	assert.Equal(t, standby.URL(), syncer.ActiveMaster())
+	result := syncNowForTest(t, syncer, SyncOptions{})
+	require.True(t, result.Success, "%+v", result.Details)
+	assert.Equal(t, standby.URL(), result.Master)
+	assert.Equal(t, MasterStale, syncer.MasterStatus().Candidates[0].Health)
+	assert.Empty(t, primary.restores)
+
+	// Without failover the configured master is used as before
+	cfg.Failover.Enabled = false
+	syncer = NewSyncer(cfg, pihole.NewPool())
+	syncer.SetRecorder(recorder)
+	assert.Equal(t, primary.URL(), syncer.ActiveMaster())
+}
+
+func TestFailoverDisabledUsesConfiguredMaster(t *testing.T) {
+	primary, _, _, cfg := failoverSetup(t)
+	cfg.Failover.Enabled = false
+	syncer := NewSyncer(cfg, pihole.NewPool())
+	syncNowForTest(t, syncer, SyncOptions{})
+
+	primary.setDown(true)
+	_, err := syncer.syncNow(context.Background(), SyncOptions{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to get master backup")
+	assert.Len(t, syncer.MasterStatus().Candidates, 1)
+}
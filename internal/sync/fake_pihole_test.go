@@ -0,0 +1,332 @@
+package sync
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	gosync "sync"
+	"time"
+
+	"github.com/arimakouyou/pihole-sync/internal/pihole"
+)
+
+// fakePihole is an in-memory Pi-hole v6 API covering the endpoints used by
+// the syncer: auth, teleporter and CRUD on domains, lists, groups and clients.
+type fakePihole struct {
+	mu      gosync.Mutex
+	server  *httptest.Server
+	domains []pihole.Domain
+	lists   []pihole.Adlist
+	groups  []pihole.Group
+	clients []pihole.ClientEntry
+	nextID  int
+	// backup overrides the Teleporter archive; by default it is a JSON
+	// snapshot of the fake's state that a restore applies.
+	backup   []byte
+	restores [][]byte
+	imports  []string
+	// mutations counts POST/PUT/DELETE calls on list endpoints
+	mutations int
+	// failRestore makes POST /api/teleporter fail this many times, with
+	// failStatus (500 if unset)
+	failRestore int
+	failStatus  int
+	// restoreAttempts counts POST /api/teleporter calls, failed ones included
+	restoreAttempts int
+	// restoreDelay slows down POST /api/teleporter
+	restoreDelay time.Duration
+	// down makes every request fail with 503
+	down bool
+	// blocking is reported by GET /api/dns/blocking ("enabled" if unset)
+	blocking string
+}
+
+type fakeSnapshot struct {
+	Domains []pihole.Domain      `json:"domains"`
+	Lists   []pihole.Adlist      `json:"lists"`
+	Groups  []pihole.Group       `json:"groups"`
+	Clients []pihole.ClientEntry `json:"clients"`
+}
+
+func newFakePihole() *fakePihole {
+	f := &fakePihole{
+		groups: []pihole.Group{{ID: 0, Name: "Default", Enabled: true}},
+		nextID: 100,
+	}
+	f.server = httptest.NewServer(http.HandlerFunc(f.handle))
+	return f
+}
+
+func (f *fakePihole) URL() string {
+	return f.server.URL
+}
+
+func (f *fakePihole) Close() {
+	f.server.Close()
+}
+
+func (f *fakePihole) setDown(down bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.down = down
+}
+
+func (f *fakePihole) id() int {
+	f.nextID++
+	return f.nextID
+}
+
+func (f *fakePihole) groupID(name string) int {
+	for _, group := range f.groups {
+		if group.Name == name {
+			return group.ID
+		}
+	}
+	return -1
+}
+
+func (f *fakePihole) handle(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.down {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.EscapedPath(), "/api/")
+	parts := strings.Split(path, "/")
+	for i := range parts {
+		parts[i], _ = url.PathUnescape(parts[i])
+	}
+
+	var body map[string]interface{}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		raw, _ := io.ReadAll(r.Body)
+		json.Unmarshal(raw, &body)
+	}
+
+	writeJSON := func(status int, v interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(v)
+	}
+
+	switch {
+	case parts[0] == "auth" && r.Method == "POST":
+		writeJSON(http.StatusOK, map[string]interface{}{"session": map[string]string{"sid": "fake-sid", "csrf": "fake-csrf"}})
+		return
+	case parts[0] == "auth" && r.Method == "DELETE":
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case parts[0] == "teleporter" && r.Method == "GET":
+		if f.backup != nil {
+			w.Write(f.backup)
+			return
+		}
+		json.NewEncoder(w).Encode(fakeSnapshot{Domains: f.domains, Lists: f.lists, Groups: f.groups, Clients: f.clients})
+		return
+	case parts[0] == "teleporter" && r.Method == "POST":
+		time.Sleep(f.restoreDelay)
+		f.restoreAttempts++
+		if f.failRestore > 0 {
+			f.failRestore--
+			status := f.failStatus
+			if status == 0 {
+				status = http.StatusInternalServerError
+			}
+			w.WriteHeader(status)
+			w.Write([]byte("restore failed"))
+			return
+		}
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		data, _ := io.ReadAll(file)
+		f.restores = append(f.restores, data)
+		var snapshot fakeSnapshot
+		if json.Unmarshal(data, &snapshot) == nil {
+			f.domains, f.lists, f.groups, f.clients = snapshot.Domains, snapshot.Lists, snapshot.Groups, snapshot.Clients
+		}
+		f.imports = append(f.imports, r.FormValue("import"))
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method == "GET" {
+		switch parts[0] {
+		case "domains":
+			writeJSON(http.StatusOK, map[string]interface{}{"domains": f.domains})
+		case "lists":
+			writeJSON(http.StatusOK, map[string]interface{}{"lists": f.lists})
+		case "groups":
+			writeJSON(http.StatusOK, map[string]interface{}{"groups": f.groups})
+		case "clients":
+			writeJSON(http.StatusOK, map[string]interface{}{"clients": f.clients})
+		case "dns":
+			blocking := f.blocking
+			if blocking == "" {
+				blocking = pihole.BlockingEnabled
+			}
+			writeJSON(http.StatusOK, map[string]interface{}{"blocking": blocking})
+		default:
+			writeJSON(http.StatusOK, map[string]interface{}{})
+		}
+		return
+	}
+
+	f.mutations++
+	str := func(key string) string {
+		v, _ := body[key].(string)
+		return v
+	}
+	boolean := func(key string) bool {
+		v, _ := body[key].(bool)
+		return v
+	}
+	ints := func(key string) []int {
+		var out []int
+		values, _ := body[key].([]interface{})
+		for _, v := range values {
+			out = append(out, int(v.(float64)))
+		}
+		return out
+	}
+	created := func() {
+		writeJSON(http.StatusCreated, map[string]interface{}{"processed": map[string]interface{}{"errors": []interface{}{}}})
+	}
+
+	switch parts[0] {
+	case "domains":
+		domainType, kind := pihole.DomainType(parts[1]), pihole.DomainKind(parts[2])
+		index := -1
+		if len(parts) > 3 {
+			for i, d := range f.domains {
+				if d.Type == domainType && d.Kind == kind && d.Domain == parts[3] {
+					index = i
+				}
+			}
+		}
+		switch r.Method {
+		case "POST":
+			f.domains = append(f.domains, pihole.Domain{ID: f.id(), Domain: str("domain"), Type: domainType, Kind: kind,
+				Comment: str("comment"), Groups: ints("groups"), Enabled: boolean("enabled")})
+			created()
+		case "PUT":
+			if index < 0 {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			d := &f.domains[index]
+			d.Comment, d.Groups, d.Enabled = str("comment"), ints("groups"), boolean("enabled")
+			created()
+		case "DELETE":
+			if index < 0 {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			f.domains = append(f.domains[:index], f.domains[index+1:]...)
+			w.WriteHeader(http.StatusNoContent)
+		}
+
+	case "lists":
+		listType := pihole.ListType(r.URL.Query().Get("type"))
+		index := -1
+		if len(parts) > 1 {
+			for i, l := range f.lists {
+				if l.Type == listType && l.Address == parts[1] {
+					index = i
+				}
+			}
+		}
+		switch r.Method {
+		case "POST":
+			f.lists = append(f.lists, pihole.Adlist{ID: f.id(), Address: str("address"), Type: listType,
+				Comment: str("comment"), Groups: ints("groups"), Enabled: boolean("enabled")})
+			created()
+		case "PUT":
+			if index < 0 {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			l := &f.lists[index]
+			l.Comment, l.Groups, l.Enabled = str("comment"), ints("groups"), boolean("enabled")
+			created()
+		case "DELETE":
+			if index < 0 {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			f.lists = append(f.lists[:index], f.lists[index+1:]...)
+			w.WriteHeader(http.StatusNoContent)
+		}
+
+	case "groups":
+		index := -1
+		if len(parts) > 1 {
+			for i, g := range f.groups {
+				if g.Name == parts[1] {
+					index = i
+				}
+			}
+		}
+		switch r.Method {
+		case "POST":
+			f.groups = append(f.groups, pihole.Group{ID: f.id(), Name: str("name"), Comment: str("comment"), Enabled: boolean("enabled")})
+			created()
+		case "PUT":
+			if index < 0 {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			g := &f.groups[index]
+			g.Name, g.Comment, g.Enabled = str("name"), str("comment"), boolean("enabled")
+			created()
+		case "DELETE":
+			if index < 0 {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			f.groups = append(f.groups[:index], f.groups[index+1:]...)
+			w.WriteHeader(http.StatusNoContent)
+		}
+
+	case "clients":
+		index := -1
+		if len(parts) > 1 {
+			for i, c := range f.clients {
+				if c.Client == parts[1] {
+					index = i
+				}
+			}
+		}
+		switch r.Method {
+		case "POST":
+			f.clients = append(f.clients, pihole.ClientEntry{ID: f.id(), Client: str("client"), Comment: str("comment"), Groups: ints("groups")})
+			created()
+		case "PUT":
+			if index < 0 {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			c := &f.clients[index]
+			c.Comment, c.Groups = str("comment"), ints("groups")
+			created()
+		case "DELETE":
+			if index < 0 {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			f.clients = append(f.clients[:index], f.clients[index+1:]...)
+			w.WriteHeader(http.StatusNoContent)
+		}
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
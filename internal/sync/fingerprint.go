@@ -0,0 +1,132 @@
+package sync
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+
+	"go.uber.org/zap"
+
+	"github.com/arimakouyou/pihole-sync/internal/config"
+	"github.com/arimakouyou/pihole-sync/internal/logger"
+	"github.com/arimakouyou/pihole-sync/internal/pihole"
+)
+
+// Sync items that are only carried by Teleporter, fingerprinted from the
+// master's configuration.
+const (
+	ItemDNSRecords = "dns_records"
+	ItemDHCP       = "dhcp"
+	ItemSettings   = "settings"
+)
+
+// allItems lists every sync item in SyncItems order.
+var allItems = []string{ItemAdlists, ItemBlacklist, ItemWhitelist, ItemRegex, ItemGroups, ItemDNSRecords, ItemDHCP, ItemClients, ItemSettings}
+
+// Fingerprint maps each sync item to a hash of the master's content for it.
+// An item without a hash could not be fingerprinted and always counts as
+// changed.
+type Fingerprint map[string]string
+
+// readFingerprint reads the master's state and configuration and fingerprints
+// every sync item. The state is returned for reuse. A configuration that
+// cannot be read only leaves the Teleporter-only items unfingerprinted.
+func readFingerprint(ctx context.Context, client *pihole.Client) (Fingerprint, *State, error) {
+	state, err := ReadState(ctx, client)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fingerprint := make(Fingerprint)
+	for _, item := range verifiableItems {
+		fingerprint[item] = state.Digest(item).Hash
+	}
+
+	piholeConfig, err := client.GetConfig(ctx)
+	if err != nil {
+		if logger.Logger != nil {
+			logger.Logger.Warn("Could not read master configuration, dns_records, dhcp and settings will always be synced",
+				zap.Error(err))
+		}
+		return fingerprint, state, nil
+	}
+
+	dns, _ := piholeConfig["dns"].(map[string]interface{})
+	fingerprint[ItemDNSRecords] = hashJSON(map[string]interface{}{
+		"hosts":        dns["hosts"],
+		"cnameRecords": dns["cnameRecords"],
+	})
+	// Leases change constantly and are not part of the fingerprint; static
+	// leases live in dhcp.hosts
+	fingerprint[ItemDHCP] = hashJSON(piholeConfig["dhcp"])
+	fingerprint[ItemSettings] = hashJSON(piholeConfig)
+
+	return fingerprint, state, nil
+}
+
+// hashJSON hashes the JSON encoding of v; map keys are encoded sorted, so
+// equal content always hashes equally.
+func hashJSON(v interface{}) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// changedItems returns the items enabled in items whose master fingerprint
+// differs from what the slave last received. Table overrides are kept.
+func changedItems(items config.SyncItems, current, received Fingerprint) config.SyncItems {
+	changed := config.SyncItems{
+		AdlistByGroup:     items.AdlistByGroup,
+		DomainlistByGroup: items.DomainlistByGroup,
+		ClientByGroup:     items.ClientByGroup,
+		DHCPLeases:        items.DHCPLeases,
+	}
+	for _, item := range allItems {
+		if !itemEnabled(items, item) {
+			continue
+		}
+		hash := current[item]
+		if hash == "" || received[item] != hash {
+			setItem(&changed, item)
+		}
+	}
+	return changed
+}
+
+// enabledItems returns the names of the items enabled in items.
+func enabledItems(items config.SyncItems) []string {
+	var names []string
+	for _, item := range allItems {
+		if itemEnabled(items, item) {
+			names = append(names, item)
+		}
+	}
+	return names
+}
+
+func setItem(items *config.SyncItems, item string) {
+	switch item {
+	case ItemAdlists:
+		items.Adlists = true
+	case ItemBlacklist:
+		items.Blacklist = true
+	case ItemWhitelist:
+		items.Whitelist = true
+	case ItemRegex:
+		items.Regex = true
+	case ItemGroups:
+		items.Groups = true
+	case ItemDNSRecords:
+		items.DNSRecords = true
+	case ItemDHCP:
+		items.DHCP = true
+	case ItemClients:
+		items.Clients = true
+	case ItemSettings:
+		items.Settings = true
+	}
+}
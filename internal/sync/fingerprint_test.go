@@ -0,0 +1,119 @@
+package sync
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/arimakouyou/pihole-sync/internal/config"
+	"github.com/arimakouyou/pihole-sync/internal/pihole"
+)
+
+func TestChangedItems(t *testing.T) {
+	items := config.SyncItems{Adlists: true, Blacklist: true, Settings: true}
+	current := Fingerprint{ItemAdlists: "a1", ItemBlacklist: "b1", ItemWhitelist: "w1"}
+
+	// Nothing received yet: every enabled item is changed
+	assert.Equal(t, items, changedItems(items, current, nil))
+
+	// Only the blacklist changed; settings could not be fingerprinted
+	received := Fingerprint{ItemAdlists: "a1", ItemBlacklist: "b0", ItemSettings: ""}
+	assert.Equal(t, config.SyncItems{Blacklist: true, Settings: true}, changedItems(items, current, received))
+
+	assert.Equal(t, []string{ItemAdlists, ItemBlacklist, ItemSettings}, enabledItems(items))
+
+	// Teleporter table overrides survive the narrowing
+	off := false
+	items.DomainlistByGroup = &off
+	assert.Equal(t, config.SyncItems{Blacklist: true, Settings: true, DomainlistByGroup: &off}, changedItems(items, current, received))
+}
+
+func TestSyncSkipsUnchangedMaster(t *testing.T) {
+	master := newFakePihole()
+	defer master.Close()
+	master.domains = []pihole.Domain{
+		{ID: 1, Domain: "ads.example.com", Type: pihole.DomainDeny, Kind: pihole.DomainExact, Groups: []int{0}, Enabled: true},
+	}
+
+	slave := newFakePihole()
+	defer slave.Close()
+
+	cfg := &config.Config{
+		Master: config.MasterConfig{Host: master.URL(), Password: "test-password"},
+		Slaves: []config.SlaveConfig{
+			{Host: slave.URL(), Password: "test-password", SyncItems: config.SyncItems{Blacklist: true, Groups: true}},
+		},
+	}
+	syncer := NewSyncer(cfg, pihole.NewPool())
+	ctx := context.Background()
+	syncOnce := func(opts SyncOptions) *SyncResult {
+		result, err := syncer.syncNow(ctx, opts)
+		require.NoError(t, err)
+		require.True(t, result.Success, "%+v", result.Details)
+		return result
+	}
+
+	result := syncOnce(SyncOptions{})
+	assert.Equal(t, "ok", result.Details[0].Result)
+	assert.Equal(t, []string{ItemBlacklist, ItemGroups}, result.Details[0].SyncedItems)
+	require.Len(t, slave.restores, 1)
+
+	// Master unchanged: the slave is skipped
+	result = syncOnce(SyncOptions{})
+	assert.Equal(t, "skipped", result.Details[0].Result)
+	assert.Equal(t, "マスターに変更がないため同期をスキップしました", result.Message)
+	assert.Len(t, slave.restores, 1)
+
+	// Only the blacklist changed: the sync is narrowed to it
+	master.domains = append(master.domains, pihole.Domain{
+		ID: 2, Domain: "tracker.example.com", Type: pihole.DomainDeny, Kind: pihole.DomainExact, Groups: []int{0}, Enabled: true,
+	})
+	result = syncOnce(SyncOptions{})
+	assert.Equal(t, "ok", result.Details[0].Result)
+	assert.Equal(t, []string{ItemBlacklist}, result.Details[0].SyncedItems)
+	assert.Len(t, slave.restores, 2)
+	assert.Len(t, slave.domains, 2)
+
+	// Force syncs every enabled item again
+	result = syncOnce(SyncOptions{Force: true})
+	assert.Equal(t, "ok", result.Details[0].Result)
+	assert.Equal(t, []string{ItemBlacklist, ItemGroups}, result.Details[0].SyncedItems)
+	assert.Len(t, slave.restores, 3)
+}
+
+func TestInheritKeepsReceivedFingerprints(t *testing.T) {
+	master := newFakePihole()
+	defer master.Close()
+	master.domains = []pihole.Domain{denyDomain("ads.example.com", "", 0)}
+	slave := newFakePihole()
+	defer slave.Close()
+	removed := newFakePihole()
+	defer removed.Close()
+
+	cfg := &config.Config{
+		Master: config.MasterConfig{Host: master.URL(), Password: "test-password"},
+		Slaves: []config.SlaveConfig{
+			{Host: slave.URL(), Password: "test-password", SyncItems: config.SyncItems{Blacklist: true}},
+			{Host: removed.URL(), Password: "test-password", SyncItems: config.SyncItems{Blacklist: true}},
+		},
+	}
+	pool := pihole.NewPool()
+	prev := NewSyncer(cfg, pool)
+	result, err := prev.syncNow(context.Background(), SyncOptions{})
+	require.NoError(t, err)
+	require.True(t, result.Success, "%+v", result.Details)
+
+	// A reload that drops a slave builds a new syncer from the old one
+	reloaded := *cfg
+	reloaded.Slaves = cfg.Slaves[:1]
+	syncer := NewSyncer(&reloaded, pool)
+	syncer.Inherit(prev)
+	assert.NotContains(t, syncer.received, removed.URL())
+
+	result, err = syncer.syncNow(context.Background(), SyncOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "skipped", result.Details[0].Result, "the reload does not resync an up-to-date slave")
+	assert.Len(t, slave.restores, 1)
+}
@@ -0,0 +1,254 @@
+package sync
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	gosync "sync"
+	"time"
+)
+
+// Job states
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+	JobCanceled  = "canceled"
+)
+
+// Slave states shown in JobStatus
+const (
+	ProgressPending = "pending"
+	ProgressRunning = "running"
+	ProgressDone    = "done"
+)
+
+// SlaveProgress is the state of one slave of a job's run. Result is set once
+// the slave is done.
+type SlaveProgress struct {
+	Index  int          `json:"index"`
+	Host   string       `json:"host"`
+	State  string       `json:"state"`
+	Result *SlaveResult `json:"result,omitempty"`
+}
+
+// maxFinishedJobs is how many finished jobs are kept for lookup
+const maxFinishedJobs = 100
+
+// ErrJobFinished is returned when cancelling a job that already ended.
+var ErrJobFinished = errors.New("job already finished")
+
+// JobStatus is a snapshot of a sync job.
+type JobStatus struct {
+	ID          string          `json:"id"`
+	State       string          `json:"state"`
+	Trigger     string          `json:"trigger"`
+	Force       bool            `json:"force"`
+	Disposition Disposition     `json:"disposition,omitempty"`
+	CreatedAt   time.Time       `json:"created_at"`
+	StartedAt   *time.Time      `json:"started_at,omitempty"`
+	FinishedAt  *time.Time      `json:"finished_at,omitempty"`
+	Slaves      []SlaveProgress `json:"slaves"`
+	Result      *SyncResult     `json:"result,omitempty"`
+	Error       string          `json:"error,omitempty"`
+}
+
+// Finished reports whether the job reached a final state.
+func (s JobStatus) Finished() bool {
+	return s.State == JobSucceeded || s.State == JobFailed || s.State == JobCanceled
+}
+
+// Job is one sync request running in the background through a Coordinator.
+type Job struct {
+	mu     gosync.Mutex
+	status JobStatus
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Status returns a snapshot of the job.
+func (j *Job) Status() JobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	status := j.status
+	status.Slaves = append([]SlaveProgress(nil), j.status.Slaves...)
+	return status
+}
+
+// Done is closed when the job finished.
+func (j *Job) Done() <-chan struct{} {
+	return j.done
+}
+
+// Cancel stops waiting for the sync. The run itself is cancelled unless it
+// was merged with requests that still wait for it.
+func (j *Job) Cancel() error {
+	j.mu.Lock()
+	finished := j.status.Finished()
+	j.mu.Unlock()
+	if finished {
+		return ErrJobFinished
+	}
+	j.cancel()
+	<-j.done
+	return nil
+}
+
+func (j *Job) accepted(disposition Disposition) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.status.Disposition = disposition
+}
+
+func (j *Job) started() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := time.Now()
+	j.status.State = JobRunning
+	j.status.StartedAt = &now
+}
+
+// observe updates the per-slave progress from the run's events.
+func (j *Job) observe(event Event) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.status.Finished() {
+		return
+	}
+
+	switch event.Type {
+	case EventSyncStarted:
+		j.status.Slaves = make([]SlaveProgress, len(event.Hosts))
+		for i, host := range event.Hosts {
+			j.status.Slaves[i] = SlaveProgress{Index: i, Host: host, State: ProgressPending}
+		}
+	case EventSlaveStarted, EventSlaveDone, EventSlaveFailed:
+		if event.Index == nil || *event.Index >= len(j.status.Slaves) {
+			return
+		}
+		progress := &j.status.Slaves[*event.Index]
+		progress.State = ProgressRunning
+		if event.SlaveResult != nil {
+			progress.State = ProgressDone
+			progress.Result = event.SlaveResult
+		}
+	}
+}
+
+func (j *Job) finish(result *SyncResult, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := time.Now()
+	j.status.FinishedAt = &now
+	j.status.Result = result
+	switch {
+	case errors.Is(err, context.Canceled):
+		j.status.State = JobCanceled
+	case err != nil:
+		j.status.State = JobFailed
+		j.status.Error = err.Error()
+	case !result.Success:
+		j.status.State = JobFailed
+	default:
+		j.status.State = JobSucceeded
+	}
+	close(j.done)
+}
+
+// JobManager starts sync jobs and keeps them for lookup by id. Unfinished
+// jobs are always kept; of the finished ones only the newest are.
+type JobManager struct {
+	coordinator *Coordinator
+
+	mu    gosync.Mutex
+	jobs  map[string]*Job
+	order []string
+}
+
+// NewJobManager creates a job manager running syncs through coordinator.
+func NewJobManager(coordinator *Coordinator) *JobManager {
+	return &JobManager{
+		coordinator: coordinator,
+		jobs:        make(map[string]*Job),
+	}
+}
+
+// Start submits a sync in the background and returns its job immediately.
+func (m *JobManager) Start(opts SyncOptions) *Job {
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &Job{
+		status: JobStatus{
+			ID:        newJobID(),
+			State:     JobQueued,
+			Trigger:   opts.Trigger,
+			Force:     opts.Force,
+			CreatedAt: time.Now(),
+			Slaves:    []SlaveProgress{},
+		},
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	m.mu.Lock()
+	m.jobs[job.status.ID] = job
+	m.order = append(m.order, job.status.ID)
+	m.prune()
+	m.mu.Unlock()
+
+	opts.Events = job.observe
+	accepted := make(chan struct{})
+	go func() {
+		defer cancel()
+		result, _, err := m.coordinator.submit(ctx, opts, runHooks{
+			accepted: func(disposition Disposition) {
+				job.accepted(disposition)
+				close(accepted)
+			},
+			started: job.started,
+		})
+		job.finish(result, err)
+	}()
+	// Return once the job knows whether it runs now or later
+	<-accepted
+
+	return job
+}
+
+// Get returns the job with id.
+func (m *JobManager) Get(id string) (*Job, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job, ok := m.jobs[id]
+	return job, ok
+}
+
+// prune forgets the oldest finished jobs beyond maxFinishedJobs.
+func (m *JobManager) prune() {
+	finished := 0
+	for _, id := range m.order {
+		if m.jobs[id].Status().Finished() {
+			finished++
+		}
+	}
+
+	kept := m.order[:0]
+	for _, id := range m.order {
+		if finished > maxFinishedJobs && m.jobs[id].Status().Finished() {
+			delete(m.jobs, id)
+			finished--
+			continue
+		}
+		kept = append(kept, id)
+	}
+	m.order = kept
+}
+
+func newJobID() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return time.Now().Format("20060102150405.000000000")
+	}
+	return hex.EncodeToString(b[:])
+}
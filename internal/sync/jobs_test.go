@@ -0,0 +1,104 @@
+package sync
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/arimakouyou/pihole-sync/internal/config"
+	"github.com/arimakouyou/pihole-sync/internal/pihole"
+)
+
+func newJobTestManager(t *testing.T, delay time.Duration) (*JobManager, *fakePihole) {
+	master := newFakePihole()
+	t.Cleanup(master.Close)
+	slave := newFakePihole()
+	t.Cleanup(slave.Close)
+	slave.restoreDelay = delay
+
+	cfg := &config.Config{
+		Master: config.MasterConfig{Host: master.URL(), Password: "test-password"},
+		Slaves: []config.SlaveConfig{{Host: slave.URL(), Password: "test-password", SyncItems: config.SyncItems{Blacklist: true}}},
+	}
+	syncer := NewSyncer(cfg, pihole.NewPool())
+	return NewJobManager(NewCoordinator(context.Background(), func() *Syncer { return syncer })), slave
+}
+
+func TestJobReportsProgress(t *testing.T) {
+	jobs, slave := newJobTestManager(t, 300*time.Millisecond)
+
+	job := jobs.Start(SyncOptions{Trigger: TriggerAPI})
+	status := job.Status()
+	assert.NotEmpty(t, status.ID)
+	assert.Equal(t, DispositionRan, status.Disposition)
+	assert.Equal(t, TriggerAPI, status.Trigger)
+
+	found, ok := jobs.Get(status.ID)
+	require.True(t, ok)
+	assert.Same(t, job, found)
+
+	require.Eventually(t, func() bool {
+		slaves := job.Status().Slaves
+		return len(slaves) == 1 && slaves[0].State == ProgressRunning
+	}, time.Second, 5*time.Millisecond)
+	status = job.Status()
+	assert.Equal(t, JobRunning, status.State)
+	assert.Equal(t, slave.URL(), status.Slaves[0].Host)
+	assert.NotNil(t, status.StartedAt)
+
+	<-job.Done()
+	status = job.Status()
+	assert.Equal(t, JobSucceeded, status.State)
+	assert.NotNil(t, status.FinishedAt)
+	require.NotNil(t, status.Result)
+	assert.True(t, status.Result.Success)
+	require.Len(t, status.Slaves, 1)
+	assert.Equal(t, ProgressDone, status.Slaves[0].State)
+	require.NotNil(t, status.Slaves[0].Result)
+	assert.Equal(t, "ok", status.Slaves[0].Result.Result)
+
+	assert.ErrorIs(t, job.Cancel(), ErrJobFinished)
+
+	_, ok = jobs.Get("unknown")
+	assert.False(t, ok)
+}
+
+func TestJobCancel(t *testing.T) {
+	jobs, _ := newJobTestManager(t, 300*time.Millisecond)
+
+	job := jobs.Start(SyncOptions{})
+	require.Eventually(t, func() bool { return job.Status().State == JobRunning }, time.Second, 5*time.Millisecond)
+
+	require.NoError(t, job.Cancel())
+	status := job.Status()
+	assert.Equal(t, JobCanceled, status.State)
+	assert.Nil(t, status.Result)
+
+	// The run is cancelled as the job was its only requester
+	assert.Eventually(t, func() bool { return !jobs.coordinator.Running() }, 2*time.Second, 5*time.Millisecond)
+}
+
+func TestJobsShareCoalescedRun(t *testing.T) {
+	jobs, _ := newJobTestManager(t, 300*time.Millisecond)
+
+	first := jobs.Start(SyncOptions{})
+	queued := jobs.Start(SyncOptions{})
+	merged := jobs.Start(SyncOptions{Force: true})
+	assert.Equal(t, DispositionRan, first.Status().Disposition)
+	assert.Equal(t, DispositionQueued, queued.Status().Disposition)
+	assert.Equal(t, DispositionMerged, merged.Status().Disposition)
+	assert.Equal(t, JobQueued, merged.Status().State)
+
+	// Cancelling one of two waiting jobs leaves the follow-up run in place
+	require.NoError(t, queued.Cancel())
+	assert.Equal(t, JobCanceled, queued.Status().State)
+
+	<-merged.Done()
+	status := merged.Status()
+	assert.Equal(t, JobSucceeded, status.State)
+	require.Len(t, status.Slaves, 1)
+	assert.Equal(t, "ok", status.Slaves[0].Result.Result, "the merged force applies")
+}
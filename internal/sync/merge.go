@@ -0,0 +1,342 @@
+package sync
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/arimakouyou/pihole-sync/internal/config"
+	"github.com/arimakouyou/pihole-sync/internal/pihole"
+)
+
+// MergeConflict is an entry that several instances changed differently since
+// the last merge, and how the conflict policy resolved it.
+type MergeConflict struct {
+	Item string `json:"item"`
+	Key  string `json:"key"`
+	// Hosts lists the instances whose changes conflicted
+	Hosts []string `json:"hosts"`
+	// Winner is the host whose version was kept; it is empty when the union
+	// policy combined the versions
+	Winner string `json:"winner,omitempty"`
+	// Deleted reports that the kept change removes the entry
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+// MergeInput is the state of one instance taking part in a merge. Known
+// means the instance received the base state in the last merge, so an entry
+// missing on it was deleted there; otherwise its entries only add.
+type MergeInput struct {
+	Host  string
+	State *State
+	Known bool
+}
+
+// mergeEntry is a list entry in instance-independent form, with group
+// memberships resolved to names.
+type mergeEntry struct {
+	item     string
+	key      string
+	content  string
+	modified int64
+	groups   []string
+	enabled  bool
+
+	domain *pihole.Domain
+	adlist *pihole.Adlist
+	group  *pihole.Group
+	client *pihole.ClientEntry
+}
+
+// mergeEntries returns the entries of st for the merged items, keyed by item
+// and entry key.
+func mergeEntries(st *State, items config.SyncItems) map[string]mergeEntry {
+	entries := make(map[string]mergeEntry)
+	if st == nil {
+		return entries
+	}
+	names := st.groupNames()
+	add := func(entry mergeEntry) {
+		entries[entry.item+"|"+entry.key] = entry
+	}
+
+	if items.Groups {
+		for _, group := range st.Groups {
+			group := group
+			add(mergeEntry{item: ItemGroups, key: group.Name, modified: group.DateModified, enabled: group.Enabled,
+				content: fmt.Sprintf("%t|%s", group.Enabled, group.Comment), group: &group})
+		}
+	}
+	for _, domain := range st.Domains {
+		domain := domain
+		item := domainItem(domain)
+		if !itemEnabled(items, item) {
+			continue
+		}
+		groups := resolveGroupNames(domain.Groups, names)
+		add(mergeEntry{item: item, key: domainKey(domain), modified: domain.DateModified, groups: groups, enabled: domain.Enabled,
+			content: fmt.Sprintf("%t|%s|%s", domain.Enabled, domain.Comment, strings.Join(groups, ",")), domain: &domain})
+	}
+	if items.Adlists {
+		for _, list := range st.Adlists {
+			list := list
+			groups := resolveGroupNames(list.Groups, names)
+			add(mergeEntry{item: ItemAdlists, key: adlistKey(list), modified: list.DateModified, groups: groups, enabled: list.Enabled,
+				content: fmt.Sprintf("%t|%s|%s", list.Enabled, list.Comment, strings.Join(groups, ",")), adlist: &list})
+		}
+	}
+	if items.Clients {
+		for _, client := range st.Clients {
+			client := client
+			groups := resolveGroupNames(client.Groups, names)
+			add(mergeEntry{item: ItemClients, key: client.Client, modified: client.DateModified, groups: groups,
+				content: fmt.Sprintf("%s|%s", client.Comment, strings.Join(groups, ",")), client: &client})
+		}
+	}
+	return entries
+}
+
+// mergeVersion is one instance's change of an entry; entry is nil when the
+// instance deleted it.
+type mergeVersion struct {
+	host  string
+	entry *mergeEntry
+}
+
+func (v mergeVersion) sameAs(other mergeVersion) bool {
+	if v.entry == nil || other.entry == nil {
+		return v.entry == nil && other.entry == nil
+	}
+	return v.entry.content == other.entry.content
+}
+
+// MergeStates merges the changes every input made since base into one state
+// for the items enabled in items. Changes that agree, or that only one
+// instance made, are taken as they are; differing changes of the same entry
+// are resolved by policy:
+//
+//   - last_writer_wins keeps the version with the newest date_modified
+//   - master_wins keeps master's change if it made one, and otherwise falls
+//     back to last_writer_wins
+//   - union keeps the entry if any instance kept it, with the group
+//     memberships of all versions, enabled if any version is, and the
+//     other fields of the newest version
+//
+// With last_writer_wins and union an edit wins over a concurrent deletion,
+// since the time of a deletion is unknown.
+func MergeStates(master string, inputs []MergeInput, base *State, items config.SyncItems, policy string) (*State, []MergeConflict) {
+	baseEntries := mergeEntries(base, items)
+	inputEntries := make([]map[string]mergeEntry, len(inputs))
+	keys := make(map[string]bool)
+	for key := range baseEntries {
+		keys[key] = true
+	}
+	for i, input := range inputs {
+		inputEntries[i] = mergeEntries(input.State, items)
+		for key := range inputEntries[i] {
+			keys[key] = true
+		}
+	}
+	sortedKeys := make([]string, 0, len(keys))
+	for key := range keys {
+		sortedKeys = append(sortedKeys, key)
+	}
+	sort.Strings(sortedKeys)
+
+	var merged []mergeEntry
+	var conflicts []MergeConflict
+	for _, key := range sortedKeys {
+		baseEntry, inBase := baseEntries[key]
+
+		var changes []mergeVersion
+		for i, input := range inputs {
+			entry, ok := inputEntries[i][key]
+			switch {
+			case ok && inBase && entry.content == baseEntry.content:
+			case !ok && (!inBase || !input.Known):
+				// Instances that missed the last merge cannot delete
+			case ok:
+				changes = append(changes, mergeVersion{host: input.Host, entry: &entry})
+			default:
+				changes = append(changes, mergeVersion{host: input.Host})
+			}
+		}
+
+		if len(changes) == 0 {
+			if inBase {
+				merged = append(merged, baseEntry)
+			}
+			continue
+		}
+
+		agreed := true
+		for _, change := range changes[1:] {
+			if !change.sameAs(changes[0]) {
+				agreed = false
+			}
+		}
+		winner := changes[0]
+		if !agreed {
+			var conflict MergeConflict
+			winner, conflict = resolveConflict(master, changes, policy)
+			conflicts = append(conflicts, conflict)
+		}
+		if winner.entry != nil {
+			merged = append(merged, *winner.entry)
+		}
+	}
+
+	return buildMergedState(merged, inputs, master, items), conflicts
+}
+
+// resolveConflict picks the version of an entry to keep among differing
+// changes.
+func resolveConflict(master string, changes []mergeVersion, policy string) (mergeVersion, MergeConflict) {
+	first := changes[0].entry
+	for _, change := range changes {
+		if change.entry != nil {
+			first = change.entry
+			break
+		}
+	}
+	conflict := MergeConflict{Item: first.item, Key: first.key}
+	for _, change := range changes {
+		conflict.Hosts = append(conflict.Hosts, change.host)
+	}
+
+	var winner mergeVersion
+	switch {
+	case policy == config.ConflictMasterWins && hasHost(changes, master):
+		for _, change := range changes {
+			if change.host == master {
+				winner = change
+			}
+		}
+	case policy == config.ConflictUnion:
+		winner = unionVersions(changes)
+	default:
+		winner = newestVersion(changes)
+	}
+
+	conflict.Winner = winner.host
+	conflict.Deleted = winner.entry == nil
+	return winner, conflict
+}
+
+func hasHost(changes []mergeVersion, host string) bool {
+	for _, change := range changes {
+		if change.host == host {
+			return true
+		}
+	}
+	return false
+}
+
+// newestVersion returns the kept version with the newest date_modified. Ties
+// go to the earlier input.
+func newestVersion(changes []mergeVersion) mergeVersion {
+	var newest mergeVersion
+	for _, change := range changes {
+		if change.entry != nil && (newest.entry == nil || change.entry.modified > newest.entry.modified) {
+			newest = change
+		}
+	}
+	return newest
+}
+
+// unionVersions combines the kept versions of an entry. A single kept
+// version is returned as it is.
+func unionVersions(changes []mergeVersion) mergeVersion {
+	newest := newestVersion(changes)
+	var kept []*mergeEntry
+	for _, change := range changes {
+		if change.entry != nil {
+			kept = append(kept, change.entry)
+		}
+	}
+	if len(kept) == 1 {
+		return newest
+	}
+
+	combined := *newest.entry
+	groups := make(map[string]bool)
+	for _, entry := range kept {
+		combined.enabled = combined.enabled || entry.enabled
+		for _, group := range entry.groups {
+			groups[group] = true
+		}
+	}
+	combined.groups = make([]string, 0, len(groups))
+	for group := range groups {
+		combined.groups = append(combined.groups, group)
+	}
+	sort.Strings(combined.groups)
+	return mergeVersion{entry: &combined}
+}
+
+// buildMergedState turns the merged entries into a State. Groups get fresh
+// ids, which ComputePlan and Verify only use to resolve names. Without
+// merged groups the master's groups, or the first readable instance's, are
+// used. Memberships of groups that no longer exist are dropped.
+func buildMergedState(entries []mergeEntry, inputs []MergeInput, master string, items config.SyncItems) *State {
+	st := &State{}
+
+	if items.Groups {
+		st.Groups = []pihole.Group{}
+		for _, entry := range entries {
+			if entry.group != nil {
+				st.Groups = append(st.Groups, *entry.group)
+			}
+		}
+	} else {
+		for _, input := range inputs {
+			if input.State != nil && (input.Host == master || st.Groups == nil) {
+				// Copied, as the ids are renumbered below
+				st.Groups = slices.Clone(input.State.Groups)
+			}
+		}
+	}
+
+	ids := make(map[string]int)
+	for i := range st.Groups {
+		group := st.Groups[i]
+		if group.ID != 0 || group.Name != "Default" {
+			group.ID = i + 1
+		}
+		ids[group.Name] = group.ID
+		st.Groups[i] = group
+	}
+	groupIDs := func(names []string) []int {
+		resolved := []int{}
+		for _, name := range names {
+			if id, ok := ids[name]; ok {
+				resolved = append(resolved, id)
+			}
+		}
+		if len(resolved) == 0 {
+			resolved = append(resolved, 0)
+		}
+		return resolved
+	}
+
+	for _, entry := range entries {
+		switch {
+		case entry.domain != nil:
+			domain := *entry.domain
+			domain.Enabled = entry.enabled
+			domain.Groups = groupIDs(entry.groups)
+			st.Domains = append(st.Domains, domain)
+		case entry.adlist != nil:
+			list := *entry.adlist
+			list.Enabled = entry.enabled
+			list.Groups = groupIDs(entry.groups)
+			st.Adlists = append(st.Adlists, list)
+		case entry.client != nil:
+			client := *entry.client
+			client.Groups = groupIDs(entry.groups)
+			st.Clients = append(st.Clients, client)
+		}
+	}
+	return st
+}
@@ -0,0 +1,94 @@
+package sync
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/arimakouyou/pihole-sync/internal/config"
+	"github.com/arimakouyou/pihole-sync/internal/pihole"
+)
+
+func denyDomain(name, comment string, modified int64, groups ...int) pihole.Domain {
+	if len(groups) == 0 {
+		groups = []int{0}
+	}
+	return pihole.Domain{Domain: name, Type: pihole.DomainDeny, Kind: pihole.DomainExact, Comment: comment,
+		Groups: groups, Enabled: true, DateModified: modified}
+}
+
+func domainNames(st *State) []string {
+	var names []string
+	for _, domain := range st.Domains {
+		names = append(names, domain.Domain)
+	}
+	return names
+}
+
+func TestMergeStatesCombinesChanges(t *testing.T) {
+	items := config.SyncItems{Blacklist: true}
+	base := &State{Domains: []pihole.Domain{denyDomain("a.example.com", "", 1), denyDomain("b.example.com", "", 1)}}
+
+	// The master added c, the slave deleted b, and a new instance that never
+	// received the base knows about d but not a
+	master := &State{Domains: []pihole.Domain{denyDomain("a.example.com", "", 1), denyDomain("b.example.com", "", 1), denyDomain("c.example.com", "", 2)}}
+	slave := &State{Domains: []pihole.Domain{denyDomain("a.example.com", "", 1)}}
+	added := &State{Domains: []pihole.Domain{denyDomain("d.example.com", "", 3)}}
+
+	merged, conflicts := MergeStates("master", []MergeInput{
+		{Host: "master", State: master, Known: true},
+		{Host: "slave", State: slave, Known: true},
+		{Host: "added", State: added},
+	}, base, items, config.ConflictLastWriterWins)
+
+	assert.Empty(t, conflicts)
+	assert.Equal(t, []string{"a.example.com", "c.example.com", "d.example.com"}, domainNames(merged))
+}
+
+func TestMergeStatesConflictPolicies(t *testing.T) {
+	items := config.SyncItems{Blacklist: true, Groups: true}
+	groups := []pihole.Group{{ID: 0, Name: "Default", Enabled: true}, {ID: 1, Name: "kids", Enabled: true}, {ID: 2, Name: "iot", Enabled: true}}
+	base := &State{Groups: groups, Domains: []pihole.Domain{denyDomain("edited.example.com", "old", 1), denyDomain("deleted.example.com", "", 1)}}
+
+	// Both instances edited one entry; the master deleted another the slave
+	// edited
+	master := &State{Groups: groups, Domains: []pihole.Domain{denyDomain("edited.example.com", "master", 5, 1)}}
+	slave := &State{Groups: groups, Domains: []pihole.Domain{denyDomain("edited.example.com", "slave", 9, 2), denyDomain("deleted.example.com", "kept", 2)}}
+	inputs := []MergeInput{{Host: "master", State: master, Known: true}, {Host: "slave", State: slave, Known: true}}
+
+	tests := []struct {
+		policy  string
+		comment string
+		groups  []string
+		kept    bool
+		winners []string
+	}{
+		{config.ConflictLastWriterWins, "slave", []string{"iot"}, true, []string{"slave", "slave"}},
+		{config.ConflictMasterWins, "master", []string{"kids"}, false, []string{"master", "master"}},
+		{config.ConflictUnion, "slave", []string{"iot", "kids"}, true, []string{"slave", ""}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			merged, conflicts := MergeStates("master", inputs, base, items, tt.policy)
+
+			require.Len(t, conflicts, 2)
+			assert.Equal(t, "deny/exact/deleted.example.com", conflicts[0].Key)
+			assert.Equal(t, []string{"master", "slave"}, conflicts[0].Hosts)
+			assert.Equal(t, !tt.kept, conflicts[0].Deleted)
+			assert.Equal(t, tt.winners, []string{conflicts[0].Winner, conflicts[1].Winner})
+
+			var edited *pihole.Domain
+			for i, domain := range merged.Domains {
+				if domain.Domain == "edited.example.com" {
+					edited = &merged.Domains[i]
+				}
+			}
+			require.NotNil(t, edited)
+			assert.Equal(t, tt.comment, edited.Comment)
+			assert.ElementsMatch(t, tt.groups, resolveGroupNames(edited.Groups, merged.groupNames()))
+			assert.Equal(t, tt.kept, len(merged.Domains) == 2)
+		})
+	}
+}
@@ -0,0 +1,326 @@
+package sync
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	gosync "sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/arimakouyou/pihole-sync/internal/config"
+	"github.com/arimakouyou/pihole-sync/internal/logger"
+	"github.com/arimakouyou/pihole-sync/internal/metrics"
+	"github.com/arimakouyou/pihole-sync/internal/pihole"
+)
+
+// mergeBase is the state of the last multi-master merge and the hosts that
+// received it. Changes are detected against it, so an entry missing on one
+// of these hosts was deleted there.
+type mergeBase struct {
+	State    *State    `json:"state"`
+	Hosts    []string  `json:"hosts"`
+	MergedAt time.Time `json:"merged_at"`
+}
+
+func (b *mergeBase) received(host string) bool {
+	for _, h := range b.Hosts {
+		if h == host {
+			return true
+		}
+	}
+	return false
+}
+
+// participant is one instance taking part in a multi-master sync.
+type participant struct {
+	host   string
+	client *pihole.Client
+	// err is set when building the client failed
+	err error
+}
+
+// participants returns the master followed by the slaves. A slave with the
+// master's host is left out.
+func (s *Syncer) participants() []participant {
+	participants := []participant{{host: s.config.Master.Host, client: s.masterClient, err: s.masterErr}}
+	for i, slave := range s.config.Slaves {
+		if slave.Host == s.config.Master.Host {
+			continue
+		}
+		participants = append(participants, participant{host: slave.Host, client: s.slaveClients[i], err: s.slaveErrs[i]})
+	}
+	return participants
+}
+
+// statePath returns where the last merged state is kept.
+func (s *Syncer) statePath() string {
+	return s.config.MultiMasterStatePath()
+}
+
+// loadMergeBase reads the last merged state. A missing file means no merge
+// happened yet.
+func (s *Syncer) loadMergeBase() (*mergeBase, error) {
+	data, err := os.ReadFile(s.statePath())
+	if errors.Is(err, os.ErrNotExist) {
+		return &mergeBase{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read multi-master state: %w", err)
+	}
+	var base mergeBase
+	if err := json.Unmarshal(data, &base); err != nil {
+		return nil, fmt.Errorf("failed to parse multi-master state: %w", err)
+	}
+	return &base, nil
+}
+
+// saveMergeBase writes base next to the old file and renames it so a crash
+// never leaves a truncated state.
+func (s *Syncer) saveMergeBase(base *mergeBase) error {
+	data, err := json.Marshal(base)
+	if err != nil {
+		return fmt.Errorf("failed to marshal multi-master state: %w", err)
+	}
+	path := s.statePath()
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed to write multi-master state: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write multi-master state: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write multi-master state: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write multi-master state: %w", err)
+	}
+	return nil
+}
+
+// currentMergeBase returns the last merged state, loading it on first use.
+// An unreadable file is treated like a first merge, which only adds.
+func (s *Syncer) currentMergeBase() *mergeBase {
+	s.baseMu.Lock()
+	defer s.baseMu.Unlock()
+	if s.base == nil {
+		base, err := s.loadMergeBase()
+		if err != nil {
+			if logger.Logger != nil {
+				logger.Logger.Warn("Ignoring multi-master state, deletions are not merged until the next sync",
+					zap.String("path", s.statePath()),
+					zap.Error(err))
+			}
+			base = &mergeBase{}
+		}
+		s.base = base
+	}
+	return s.base
+}
+
+// merge reads every participant and merges their changes since the last
+// merge. states holds what was read, nil for participants that could not be
+// read, and errs why.
+func (s *Syncer) merge(ctx context.Context, participants []participant) (merged *State, conflicts []MergeConflict, states []*State, errs []error, err error) {
+	policy := s.config.MultiMaster.Policy()
+	switch policy {
+	case config.ConflictLastWriterWins, config.ConflictMasterWins, config.ConflictUnion:
+	default:
+		return nil, nil, nil, nil, fmt.Errorf("unknown conflict policy %q", policy)
+	}
+
+	states = make([]*State, len(participants))
+	errs = make([]error, len(participants))
+	semaphore := make(chan struct{}, s.maxConcurrent())
+	var wg gosync.WaitGroup
+	for i, p := range participants {
+		if p.err != nil {
+			errs[i] = fmt.Errorf("failed to create client: %w", p.err)
+			continue
+		}
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(i int, p participant) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			states[i], errs[i] = ReadState(ctx, p.client)
+			if errs[i] != nil {
+				errs[i] = fmt.Errorf("failed to read state: %w", errs[i])
+			}
+		}(i, p)
+	}
+	wg.Wait()
+
+	// Without the master's changes master_wins could not be honored
+	if errs[0] != nil {
+		return nil, nil, nil, nil, fmt.Errorf("failed to read master state: %w", errs[0])
+	}
+
+	base := s.currentMergeBase()
+	var inputs []MergeInput
+	for i, p := range participants {
+		if states[i] != nil {
+			inputs = append(inputs, MergeInput{Host: p.host, State: states[i], Known: base.received(p.host)})
+		}
+	}
+	merged, conflicts = MergeStates(participants[0].host, inputs, base.State, s.config.MultiMaster.SyncItems, policy)
+	return merged, conflicts, states, errs, nil
+}
+
+// runMultiMaster merges the changes made on every instance since the last
+// merge and writes the merged state to all of them. Instances that end up
+// matching it become the base of the next merge.
+func (s *Syncer) runMultiMaster(ctx context.Context, opts SyncOptions) (*SyncResult, error) {
+	policy := s.config.MultiMaster.Policy()
+	if logger.Logger != nil {
+		logger.Logger.Info("Starting multi-master synchronization", zap.String("conflict_policy", policy))
+	}
+
+	participants := s.participants()
+	merged, conflicts, states, errs, err := s.merge(ctx, participants)
+	if err != nil {
+		return nil, err
+	}
+	for _, conflict := range conflicts {
+		metrics.IncrementMergeConflicts(s.config.ClusterName(), conflict.Item, policy)
+		if logger.Logger != nil {
+			logger.Logger.Warn("Conflicting changes on several instances",
+				zap.String("item", conflict.Item),
+				zap.String("key", conflict.Key),
+				zap.Strings("hosts", conflict.Hosts),
+				zap.String("winner", conflict.Winner),
+				zap.Bool("deleted", conflict.Deleted))
+		}
+	}
+
+	items := s.config.MultiMaster.SyncItems
+	details := make([]SlaveResult, len(participants))
+	semaphore := make(chan struct{}, s.maxConcurrent())
+	var wg gosync.WaitGroup
+	for i, p := range participants {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(i int, p participant) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+
+			instanceCtx := ctx
+			if timeout := s.config.SyncParallelism.SlaveTimeout; timeout > 0 {
+				var cancel context.CancelFunc
+				instanceCtx, cancel = context.WithTimeout(ctx, timeout)
+				defer cancel()
+			}
+
+			instanceCtx = withSlaveEvents(instanceCtx, opts, i, p.host)
+			emitSlaveEvent(instanceCtx, Event{Type: EventSlaveStarted})
+			started := time.Now()
+			var result SlaveResult
+			if states[i] == nil {
+				result = SlaveResult{Host: p.host, Result: "error", Error: errs[i].Error(), Strategy: config.StrategyAPI}
+			} else {
+				instance := config.SlaveConfig{Host: p.host, Strategy: config.StrategyAPI, SyncItems: items}
+				result = s.syncSlaveWithAPI(instanceCtx, p.client, instance, merged)
+				if result.Result == "ok" {
+					s.verifySlave(instanceCtx, p.client, instance, &result, func() (*State, error) { return merged, nil })
+				}
+			}
+			result.DurationMs = time.Since(started).Milliseconds()
+			details[i] = result
+
+			event := Event{Type: EventSlaveDone, Error: result.Error, SlaveResult: &result}
+			if !succeeded(result) {
+				event.Type = EventSlaveFailed
+			}
+			emitSlaveEvent(instanceCtx, event)
+		}(i, p)
+	}
+	wg.Wait()
+
+	syncedAt := time.Now()
+	allSuccess := true
+	changes := 0
+	base := &mergeBase{State: merged, MergedAt: syncedAt}
+	for _, result := range details {
+		changes += result.Changes
+		if succeeded(result) {
+			base.Hosts = append(base.Hosts, result.Host)
+		} else {
+			allSuccess = false
+		}
+	}
+
+	s.baseMu.Lock()
+	s.base = base
+	s.baseMu.Unlock()
+	if err := s.saveMergeBase(base); err != nil && logger.Logger != nil {
+		logger.Logger.Error("Failed to save multi-master state", zap.Error(err))
+	}
+
+	s.lastSyncMu.Lock()
+	s.lastSync = syncedAt
+	s.lastSyncMu.Unlock()
+
+	syncResult := &SyncResult{
+		Success:        allSuccess,
+		SyncedAt:       syncedAt,
+		Master:         participants[0].host,
+		ConflictPolicy: policy,
+		Conflicts:      conflicts,
+		Details:        details,
+	}
+
+	if allSuccess && changes == 0 {
+		syncResult.Message = "すべてのインスタンスが一致しているため変更はありませんでした"
+	} else if allSuccess && len(conflicts) > 0 {
+		syncResult.Message = fmt.Sprintf("マルチマスター同期完了（競合 %d 件を解決）", len(conflicts))
+	} else if allSuccess {
+		syncResult.Message = "マルチマスター同期完了"
+	} else if allSynced(details) {
+		syncResult.Message = "同期は完了しましたが、マージ結果と一致しないインスタンスがあります"
+	} else {
+		syncResult.Message = "同期中にエラーが発生しました"
+	}
+
+	return syncResult, nil
+}
+
+// dryRunMultiMaster computes the merge and the changes writing it would make
+// on every instance.
+func (s *Syncer) dryRunMultiMaster(ctx context.Context) (*DryRunResult, error) {
+	participants := s.participants()
+	merged, conflicts, states, errs, err := s.merge(ctx, participants)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &DryRunResult{
+		Success:   true,
+		PlannedAt: time.Now(),
+		Conflicts: conflicts,
+	}
+	for i, p := range participants {
+		plan := SlavePlan{Host: p.host, Strategy: config.StrategyAPI}
+		if states[i] == nil {
+			plan.Error = errs[i].Error()
+			result.Success = false
+		} else {
+			plan.Plan = ComputePlan(merged, states[i], s.config.MultiMaster.SyncItems)
+		}
+		result.Details = append(result.Details, plan)
+	}
+
+	if result.Success {
+		result.Message = "差分の計算が完了しました"
+	} else {
+		result.Message = "差分の計算中にエラーが発生しました"
+	}
+	return result, nil
+}
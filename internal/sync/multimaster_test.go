@@ -0,0 +1,145 @@
+package sync
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/arimakouyou/pihole-sync/internal/config"
+	"github.com/arimakouyou/pihole-sync/internal/pihole"
+)
+
+func TestMultiMasterSync(t *testing.T) {
+	master := newFakePihole()
+	defer master.Close()
+	slave := newFakePihole()
+	defer slave.Close()
+	master.domains = []pihole.Domain{denyDomain("master.example.com", "", 1)}
+	slave.domains = []pihole.Domain{denyDomain("slave.example.com", "", 1)}
+
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	cfg := &config.Config{
+		Master: config.MasterConfig{Host: master.URL(), Password: "test-password"},
+		Slaves: []config.SlaveConfig{{Host: slave.URL(), Password: "test-password"}},
+		MultiMaster: config.MultiMasterConfig{
+			Enabled:   true,
+			SyncItems: config.SyncItems{Blacklist: true},
+			StatePath: statePath,
+		},
+	}
+	syncer := NewSyncer(cfg, pihole.NewPool())
+
+	// The first merge only adds
+	result := syncNowForTest(t, syncer, SyncOptions{})
+	require.True(t, result.Success, "%+v", result.Details)
+	require.Len(t, result.Details, 2)
+	assert.Equal(t, config.ConflictLastWriterWins, result.ConflictPolicy)
+	assert.ElementsMatch(t, []string{"master.example.com", "slave.example.com"}, domainNames(&State{Domains: master.domains}))
+	assert.ElementsMatch(t, []string{"master.example.com", "slave.example.com"}, domainNames(&State{Domains: slave.domains}))
+	assert.FileExists(t, statePath)
+
+	// A deletion on the slave reaches the master, also after a restart
+	slave.domains = []pihole.Domain{denyDomain("slave.example.com", "from slave", 6)}
+	syncer = NewSyncer(cfg, pihole.NewPool())
+	result = syncNowForTest(t, syncer, SyncOptions{})
+	require.True(t, result.Success, "%+v", result.Details)
+	assert.Empty(t, result.Conflicts)
+	for _, fake := range []*fakePihole{master, slave} {
+		require.Len(t, fake.domains, 1)
+		assert.Equal(t, "slave.example.com", fake.domains[0].Domain)
+		assert.Equal(t, "from slave", fake.domains[0].Comment)
+	}
+
+	// Concurrent edits go to the newest
+	master.domains[0].Comment, master.domains[0].DateModified = "newer", 20
+	slave.domains[0].Comment, slave.domains[0].DateModified = "older", 10
+	result = syncNowForTest(t, syncer, SyncOptions{})
+	require.True(t, result.Success, "%+v", result.Details)
+	require.Len(t, result.Conflicts, 1)
+	assert.Equal(t, master.URL(), result.Conflicts[0].Winner)
+	assert.Equal(t, "newer", slave.domains[0].Comment)
+
+	dryRun, err := syncer.DryRun(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, dryRun.Conflicts)
+	for _, plan := range dryRun.Details {
+		assert.True(t, plan.Plan.Empty(), plan.Host)
+	}
+}
+
+func TestMultiMasterSyncIgnoresBrokenState(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	require.NoError(t, os.WriteFile(statePath, []byte("{"), 0644))
+
+	syncer := NewSyncer(&config.Config{MultiMaster: config.MultiMasterConfig{Enabled: true, StatePath: statePath}}, pihole.NewPool())
+	base := syncer.currentMergeBase()
+	assert.Nil(t, base.State)
+	assert.False(t, base.received("master"))
+}
+
+func TestMultiMasterDryRunKeepsGroupIDs(t *testing.T) {
+	// Group ids that are not 1..n, as left behind by deleted groups
+	groups := []pihole.Group{{ID: 0, Name: "Default", Enabled: true}, {ID: 1, Name: "kids", Enabled: true}, {ID: 2, Name: "iot", Enabled: true}}
+	master := newFakePihole()
+	defer master.Close()
+	slave := newFakePihole()
+	defer slave.Close()
+	for _, fake := range []*fakePihole{master, slave} {
+		fake.groups = append([]pihole.Group(nil), groups...)
+		fake.domains = []pihole.Domain{denyDomain("kids.example.com", "", 1, 1), denyDomain("iot.example.com", "", 1, 2)}
+	}
+
+	cfg := &config.Config{
+		Master: config.MasterConfig{Host: master.URL(), Password: "test-password"},
+		Slaves: []config.SlaveConfig{{Host: slave.URL(), Password: "test-password"}},
+		MultiMaster: config.MultiMasterConfig{
+			Enabled:   true,
+			SyncItems: config.SyncItems{Blacklist: true},
+			StatePath: filepath.Join(t.TempDir(), "state.json"),
+		},
+	}
+	syncer := NewSyncer(cfg, pihole.NewPool())
+
+	// Groups are not merged, so the master's are used and must be left as
+	// they are on the master
+	dryRun, err := syncer.DryRun(context.Background())
+	require.NoError(t, err)
+	require.True(t, dryRun.Success, "%+v", dryRun.Details)
+	for _, plan := range dryRun.Details {
+		assert.True(t, plan.Plan.Empty(), "%s: %+v", plan.Host, plan.Plan)
+	}
+}
+
+func TestMultiMasterStateRoundTrip(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	syncer := NewSyncer(&config.Config{MultiMaster: config.MultiMasterConfig{Enabled: true, StatePath: statePath}}, pihole.NewPool())
+
+	// A missing file is a first merge
+	base, err := syncer.loadMergeBase()
+	require.NoError(t, err)
+	assert.Nil(t, base.State)
+
+	mergedAt := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	saved := &mergeBase{
+		State:    &State{Domains: []pihole.Domain{denyDomain("a.example.com", "", 1)}},
+		Hosts:    []string{"master", "slave"},
+		MergedAt: mergedAt,
+	}
+	require.NoError(t, syncer.saveMergeBase(saved))
+
+	base, err = syncer.loadMergeBase()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a.example.com"}, domainNames(base.State))
+	assert.True(t, base.received("slave"))
+	assert.False(t, base.received("other"))
+	assert.True(t, base.MergedAt.Equal(mergedAt))
+
+	entries, err := os.ReadDir(filepath.Dir(statePath))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1, "no temporary file is left behind")
+}
@@ -0,0 +1,273 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/arimakouyou/pihole-sync/internal/config"
+	"github.com/arimakouyou/pihole-sync/internal/logger"
+	"github.com/arimakouyou/pihole-sync/internal/pihole"
+)
+
+// Health checks run on a slave after a rollout sync
+const (
+	HealthAPI      = "api"
+	HealthBlocking = "blocking"
+	HealthDNS      = "dns"
+)
+
+// HealthCheck is the outcome of one health check of a slave.
+type HealthCheck struct {
+	Check  string `json:"check"`
+	Passed bool   `json:"passed"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Outcomes of a rollout wave
+const (
+	WaveOK     = "ok"
+	WaveFailed = "failed"
+	// WaveHalted waves were not synced because an earlier wave failed or
+	// the run was cancelled while waiting for them
+	WaveHalted = "halted"
+)
+
+// WaveResult is the outcome of one wave of a staged rollout.
+type WaveResult struct {
+	// Wave numbers the waves from 1; the canary, if any, is the first
+	Wave   int      `json:"wave"`
+	Canary bool     `json:"canary,omitempty"`
+	Hosts  []string `json:"hosts"`
+	Result string   `json:"result"`
+	Error  string   `json:"error,omitempty"`
+	// DurationMs is the time spent syncing the wave, without the wait
+	// before it
+	DurationMs int64 `json:"duration_ms"`
+}
+
+// rolloutHalted reports whether a wave of the rollout failed.
+func rolloutHalted(waves []WaveResult) bool {
+	for _, wave := range waves {
+		if wave.Result != WaveOK {
+			return true
+		}
+	}
+	return false
+}
+
+// rolloutWaves splits slaves into the canary and the waves after it. The
+// canary is the configured one, or the first slave, but never master, the
+// host this run syncs from. It returns whether the first wave is a canary.
+func (s *Syncer) rolloutWaves(master string, slaves []*tierSlave) ([][]*tierSlave, bool) {
+	canary := -1
+	for n, ts := range slaves {
+		if ts.slave.Host == master {
+			continue
+		}
+		if ts.slave.Host == s.config.Rollout.Canary {
+			canary = n
+			break
+		}
+		if canary < 0 {
+			canary = n
+		}
+	}
+
+	var waves [][]*tierSlave
+	var rest []*tierSlave
+	for n, ts := range slaves {
+		if n == canary {
+			waves = append(waves, []*tierSlave{ts})
+		} else {
+			rest = append(rest, ts)
+		}
+	}
+
+	size := s.config.Rollout.WaveSize
+	if size <= 0 {
+		size = len(rest)
+	}
+	for len(rest) > 0 {
+		n := min(size, len(rest))
+		waves = append(waves, rest[:n])
+		rest = rest[n:]
+	}
+	return waves, canary >= 0
+}
+
+// rollout syncs slaves in waves, canary first, and health checks every
+// slave synced. A wave with a slave that failed its sync or a health check
+// halts the rollout: the slaves of later waves are left untouched and the
+// alert set by SetAlert is called. Cancelling ctx while waiting between
+// waves halts the remaining waves the same way, without an alert.
+func (s *Syncer) rollout(ctx context.Context, opts SyncOptions, master string, slaves []*tierSlave, details []SlaveResult) []WaveResult {
+	waves, canary := s.rolloutWaves(master, slaves)
+	results := make([]WaveResult, len(waves))
+	var halt string
+	for n, wave := range waves {
+		results[n] = WaveResult{Wave: n + 1, Canary: canary && n == 0}
+		for _, ts := range wave {
+			results[n].Hosts = append(results[n].Hosts, ts.slave.Host)
+		}
+
+		if interval := s.config.Rollout.WaveInterval; halt == "" && n > 0 && interval > 0 {
+			select {
+			case <-ctx.Done():
+				halt = fmt.Sprintf("rollout cancelled before wave %d: %v", n+1, ctx.Err())
+			case <-time.After(interval):
+			}
+		}
+
+		if halt != "" {
+			for _, ts := range wave {
+				ts.halt = halt
+			}
+			s.syncTier(ctx, opts, master, wave, details)
+			results[n].Result = WaveHalted
+			continue
+		}
+
+		started := time.Now()
+		for _, ts := range wave {
+			ts.input.healthCheck = true
+		}
+		s.syncTier(ctx, opts, master, wave, details)
+		results[n].DurationMs = time.Since(started).Milliseconds()
+
+		var failed []string
+		for _, ts := range wave {
+			if result := details[ts.index]; !succeeded(result) {
+				failed = append(failed, fmt.Sprintf("%s: %s", ts.slave.Host, result.Error))
+			}
+		}
+		if len(failed) == 0 {
+			results[n].Result = WaveOK
+			continue
+		}
+
+		name := fmt.Sprintf("wave %d", n+1)
+		if results[n].Canary {
+			name = "canary"
+		}
+		results[n].Result = WaveFailed
+		results[n].Error = fmt.Sprintf("%s failed: %s", name, strings.Join(failed, "; "))
+		halt = fmt.Sprintf("rollout halted after %s failed", name)
+
+		remaining := 0
+		for _, later := range waves[n+1:] {
+			remaining += len(later)
+		}
+		if logger.Logger != nil {
+			logger.Logger.Error("Rollout wave failed, halting the rollout",
+				zap.Int("wave", n+1),
+				zap.Bool("canary", results[n].Canary),
+				zap.Strings("failures", failed),
+				zap.Int("remaining_slaves", remaining))
+		}
+		if alert := s.currentAlert(); alert != nil {
+			target := fmt.Sprintf("第%dウェーブ", n+1)
+			if results[n].Canary {
+				target = "カナリア"
+			}
+			alert("段階的同期の中止", fmt.Sprintf("%sの同期またはヘルスチェックに失敗したため、残り %d 台のスレーブへの同期を中止しました\n%s",
+				target, remaining, strings.Join(failed, "\n")))
+		}
+	}
+	return results
+}
+
+// checkSlaveHealth runs the rollout health checks on slave and records them
+// in result. If one fails, result becomes an error and it returns false.
+func (s *Syncer) checkSlaveHealth(ctx context.Context, client *pihole.Client, slave config.SlaveConfig, result *SlaveResult) bool {
+	hc := s.config.Rollout.HealthCheck
+	timeout := hc.Timeout
+	if timeout <= 0 {
+		timeout = config.DefaultRolloutTimeout
+	}
+	check := func(name string, fn func(ctx context.Context) error) HealthCheck {
+		checkCtx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		if err := fn(checkCtx); err != nil {
+			return HealthCheck{Check: name, Error: err.Error()}
+		}
+		return HealthCheck{Check: name, Passed: true}
+	}
+
+	result.Health = []HealthCheck{
+		check(HealthAPI, client.Ping),
+		check(HealthBlocking, func(ctx context.Context) error {
+			blocking, err := client.GetBlocking(ctx)
+			if err != nil {
+				return err
+			}
+			if blocking != pihole.BlockingEnabled {
+				return fmt.Errorf("blocking is %s", blocking)
+			}
+			return nil
+		}),
+		check(HealthDNS, func(ctx context.Context) error {
+			return resolveTestDomain(ctx, slave.Host, hc)
+		}),
+	}
+
+	var failed []string
+	for _, c := range result.Health {
+		if !c.Passed {
+			failed = append(failed, c.Check+": "+c.Error)
+		}
+	}
+	emitSlaveEvent(ctx, Event{Type: EventSlaveHealthChecked, Health: result.Health})
+	if len(failed) == 0 {
+		return true
+	}
+
+	result.Result = "error"
+	result.Error = fmt.Sprintf("slave failed health checks after sync: %s", strings.Join(failed, "; "))
+	if logger.Logger != nil {
+		logger.Logger.Warn("Slave failed rollout health checks",
+			zap.String("host", slave.Host),
+			zap.Strings("failures", failed))
+	}
+	return false
+}
+
+// resolveTestDomain asks the DNS server of the Pi-hole at host for the test
+// domain's IPv4 addresses. It fails unless at least one is returned.
+func resolveTestDomain(ctx context.Context, host string, hc config.RolloutHealthCheck) error {
+	server := host
+	if u, err := url.Parse(host); err == nil && u.Hostname() != "" {
+		server = u.Hostname()
+	}
+	port := hc.DNSPort
+	if port <= 0 {
+		port = config.DefaultRolloutDNSPort
+	}
+	domain := hc.TestDomain
+	if domain == "" {
+		domain = config.DefaultRolloutTestDomain
+	}
+
+	address := net.JoinHostPort(server, strconv.Itoa(port))
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, address)
+		},
+	}
+	addrs, err := resolver.LookupNetIP(ctx, "ip4", strings.TrimSuffix(domain, ".")+".")
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s via %s: %w", domain, address, err)
+	}
+	if len(addrs) == 0 {
+		return fmt.Errorf("no address for %s via %s", domain, address)
+	}
+	return nil
+}
@@ -0,0 +1,226 @@
+package sync
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/arimakouyou/pihole-sync/internal/config"
+	"github.com/arimakouyou/pihole-sync/internal/pihole"
+)
+
+// newFakeDNS serves A records for the given names on a local UDP port and
+// answers NXDOMAIN for everything else. It returns the port.
+func newFakeDNS(t *testing.T, names ...string) int {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	known := make(map[string]bool)
+	for _, name := range names {
+		known[strings.ToLower(name)+"."] = true
+	}
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			query := buf[:n]
+			if len(query) < 12 {
+				continue
+			}
+
+			// The question is the name's labels followed by type and class
+			end := 12
+			var labels []string
+			for end < len(query) && query[end] != 0 {
+				length := int(query[end])
+				labels = append(labels, string(query[end+1:end+1+length]))
+				end += 1 + length
+			}
+			end += 5
+			name := strings.ToLower(strings.Join(labels, ".")) + "."
+
+			resp := make([]byte, 12, 64)
+			copy(resp, query[:2])
+			binary.BigEndian.PutUint16(resp[2:], 0x8180)
+			binary.BigEndian.PutUint16(resp[4:], 1)
+			resp = append(resp, query[12:end]...)
+			if known[name] {
+				binary.BigEndian.PutUint16(resp[6:], 1)
+				resp = append(resp, 0xc0, 0x0c, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4, 192, 0, 2, 1)
+			} else {
+				binary.BigEndian.PutUint16(resp[2:], 0x8183)
+			}
+			conn.WriteTo(resp, addr)
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// rolloutSetup has a master with one domain and four Teleporter slaves
+// staged in waves of two after the canary.
+func rolloutSetup(t *testing.T) (master *fakePihole, slaves []*fakePihole, cfg *config.Config) {
+	master = newFakePihole()
+	t.Cleanup(master.Close)
+	master.domains = []pihole.Domain{denyDomain("ads.example.com", "", 0)}
+
+	cfg = &config.Config{
+		Master: config.MasterConfig{Host: master.URL(), Password: "test-password"},
+		Rollout: config.RolloutConfig{
+			Enabled:  true,
+			WaveSize: 2,
+			HealthCheck: config.RolloutHealthCheck{
+				TestDomain: "pi.hole",
+				DNSPort:    newFakeDNS(t, "pi.hole"),
+			},
+		},
+	}
+	for range 4 {
+		slave := newFakePihole()
+		t.Cleanup(slave.Close)
+		slaves = append(slaves, slave)
+		cfg.Slaves = append(cfg.Slaves, config.SlaveConfig{
+			Host:      slave.URL(),
+			Password:  "test-password",
+			SyncItems: config.SyncItems{Blacklist: true},
+		})
+	}
+	return master, slaves, cfg
+}
+
+func TestRolloutSyncsInWaves(t *testing.T) {
+	_, slaves, cfg := rolloutSetup(t)
+	cfg.Rollout.Canary = slaves[2].URL()
+	syncer := NewSyncer(cfg, pihole.NewPool())
+
+	result := syncNowForTest(t, syncer, SyncOptions{})
+	require.True(t, result.Success, "%+v", result.Details)
+	require.Len(t, result.Waves, 3)
+	assert.Equal(t, WaveResult{Wave: 1, Canary: true, Hosts: []string{slaves[2].URL()}, Result: WaveOK}, withoutDuration(result.Waves[0]))
+	assert.Equal(t, []string{slaves[0].URL(), slaves[1].URL()}, result.Waves[1].Hosts)
+	assert.Equal(t, []string{slaves[3].URL()}, result.Waves[2].Hosts)
+
+	for i, slave := range slaves {
+		assert.Len(t, slave.restores, 1)
+		assert.Equal(t, []HealthCheck{
+			{Check: HealthAPI, Passed: true},
+			{Check: HealthBlocking, Passed: true},
+			{Check: HealthDNS, Passed: true},
+		}, result.Details[i].Health)
+	}
+}
+
+func TestRolloutHaltsWhenCanaryFails(t *testing.T) {
+	_, slaves, cfg := rolloutSetup(t)
+	slaves[0].blocking = pihole.BlockingDisabled
+	syncer := NewSyncer(cfg, pihole.NewPool())
+	alerts := &alertLog{}
+	syncer.SetAlert(alerts.add)
+
+	result := syncNowForTest(t, syncer, SyncOptions{})
+	assert.False(t, result.Success)
+	assert.Equal(t, "同期またはヘルスチェックに失敗したため段階的同期を中止しました", result.Message)
+
+	canary := result.Details[0]
+	assert.Equal(t, "error", canary.Result)
+	assert.Contains(t, canary.Error, "blocking: blocking is disabled")
+	assert.Equal(t, RollbackSucceeded, canary.Rollback)
+	assert.Empty(t, slaves[0].domains, "the canary is rolled back")
+
+	require.Len(t, result.Waves, 3)
+	assert.Equal(t, WaveFailed, result.Waves[0].Result)
+	assert.Contains(t, result.Waves[0].Error, "canary failed")
+	assert.Equal(t, WaveHalted, result.Waves[1].Result)
+	assert.Equal(t, WaveHalted, result.Waves[2].Result)
+	for i, slave := range slaves[1:] {
+		assert.Equal(t, "halted", result.Details[i+1].Result)
+		assert.Empty(t, slave.restores)
+	}
+
+	require.Len(t, alerts.titles, 1)
+	assert.Contains(t, alerts.details[0], "残り 3 台")
+
+	// Once the canary is healthy the rollout goes through
+	slaves[0].blocking = pihole.BlockingEnabled
+	result = syncNowForTest(t, syncer, SyncOptions{})
+	require.True(t, result.Success, "%+v", result.Details)
+	assert.False(t, rolloutHalted(result.Waves))
+}
+
+func TestRolloutHaltsWhenWaveFails(t *testing.T) {
+	_, slaves, cfg := rolloutSetup(t)
+	cfg.Slaves[1].Strategy = config.StrategyAPI
+	slaves[1].blocking = pihole.BlockingDisabled
+	syncer := NewSyncer(cfg, pihole.NewPool())
+
+	result := syncNowForTest(t, syncer, SyncOptions{})
+	assert.False(t, result.Success)
+	assert.Equal(t, WaveOK, result.Waves[0].Result)
+	assert.Equal(t, WaveFailed, result.Waves[1].Result)
+	assert.Contains(t, result.Waves[1].Error, "wave 2 failed")
+	assert.Equal(t, WaveHalted, result.Waves[2].Result)
+
+	assert.Equal(t, "ok", result.Details[2].Result, "the rest of a failed wave is synced")
+	failed := result.Details[1]
+	assert.Equal(t, "error", failed.Result)
+	assert.Empty(t, failed.Rollback, "API syncs are not rolled back")
+	assert.Equal(t, "halted", result.Details[3].Result)
+}
+
+func TestRolloutHaltsWhenCancelledBetweenWaves(t *testing.T) {
+	_, slaves, cfg := rolloutSetup(t)
+	cfg.Rollout.WaveInterval = time.Minute
+	syncer := NewSyncer(cfg, pihole.NewPool())
+	alerts := &alertLog{}
+	syncer.SetAlert(alerts.add)
+
+	// Cancel once the canary is done, while the rollout waits for wave 2
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	opts := SyncOptions{Events: func(event Event) {
+		if event.Type == EventSlaveDone {
+			cancel()
+		}
+	}}
+
+	started := time.Now()
+	result, err := syncer.syncNow(ctx, opts)
+	require.NoError(t, err)
+	assert.Less(t, time.Since(started), cfg.Rollout.WaveInterval, "the wait is cut short")
+
+	require.Len(t, result.Waves, 3)
+	assert.Equal(t, WaveOK, result.Waves[0].Result)
+	assert.Equal(t, WaveHalted, result.Waves[1].Result)
+	assert.Equal(t, WaveHalted, result.Waves[2].Result)
+	assert.Len(t, slaves[0].restores, 1)
+	for i, slave := range slaves[1:] {
+		assert.Equal(t, "halted", result.Details[i+1].Result)
+		assert.Contains(t, result.Details[i+1].Error, "rollout cancelled before wave 2")
+		assert.Empty(t, slave.restores)
+	}
+	assert.Empty(t, alerts.titles, "a cancelled rollout did not fail")
+}
+
+func TestResolveTestDomain(t *testing.T) {
+	port := newFakeDNS(t, "pi.hole")
+	ctx := context.Background()
+
+	require.NoError(t, resolveTestDomain(ctx, "http://127.0.0.1:8080", config.RolloutHealthCheck{DNSPort: port}))
+	err := resolveTestDomain(ctx, "http://127.0.0.1:8080", config.RolloutHealthCheck{TestDomain: "missing.example", DNSPort: port})
+	assert.ErrorContains(t, err, "failed to resolve missing.example via 127.0.0.1:")
+}
+
+func withoutDuration(wave WaveResult) WaveResult {
+	wave.DurationMs = 0
+	return wave
+}
@@ -1,101 +1,458 @@
 package sync
 
 import (
+	"context"
 	"fmt"
+	"maps"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	gosync "sync"
 	"time"
 
 	"go.uber.org/zap"
 
 	"github.com/arimakouyou/pihole-sync/internal/config"
 	"github.com/arimakouyou/pihole-sync/internal/logger"
+	"github.com/arimakouyou/pihole-sync/internal/metrics"
 	"github.com/arimakouyou/pihole-sync/internal/pihole"
 )
 
 type Syncer struct {
 	config       *config.Config
 	masterClient *pihole.Client
+	masterErr    error
 	slaveClients []*pihole.Client
-	lastSync     time.Time
+	// slaveErrs holds, per slave, the error from building its client (e.g. a
+	// broken TLS setting); the matching slaveClients entry is nil.
+	slaveErrs []error
+	recorder  Recorder
+
+	// lastSyncMu guards lastSync, which triggers may read concurrently
+	lastSyncMu gosync.Mutex
+	lastSync   time.Time
+
+	// received holds, per slave host, the master fingerprint of the items
+	// the slave last received successfully.
+	receivedMu gosync.Mutex
+	received   map[string]Fingerprint
+
+	breakers *breakers
+
+	// masters is the master priority list, starting with the configured
+	// master; active indexes the current sync source, which took over at
+	// promotedAt. mastersMu guards these, alert and the candidates' health.
+	mastersMu  gosync.Mutex
+	masters    []*masterCandidate
+	active     int
+	promotedAt time.Time
+	alert      func(title, details string)
+	// inSync holds, per host, when it last matched the master. It is
+	// guarded by receivedMu.
+	inSync map[string]time.Time
+
+	// base is the last multi-master merge, loaded on first use
+	baseMu gosync.Mutex
+	base   *mergeBase
+}
+
+// Sync triggers recorded in the history
+const (
+	TriggerAPI       = "api"
+	TriggerSchedule  = "schedule"
+	TriggerFileWatch = "file_watch"
+	TriggerDrift     = "drift"
+)
+
+// SyncOptions describes one sync request.
+type SyncOptions struct {
+	// Trigger is what started the sync, e.g. TriggerSchedule
+	Trigger string
+	// Force syncs every enabled item even if the master did not change
+	Force bool
+	// Events, if set, receives the run's lifecycle events. It is called
+	// from the goroutines syncing the slaves.
+	Events func(Event)
+}
+
+// Recorder persists the result of every sync run.
+type Recorder interface {
+	Record(result SyncResult) error
+	// LastSyncedAt returns the end time of the latest recorded run
+	LastSyncedAt() time.Time
 }
 
 type SyncResult struct {
-	Success  bool          `json:"success"`
-	Message  string        `json:"message"`
-	SyncedAt time.Time     `json:"synced_at"`
-	Details  []SlaveResult `json:"details"`
+	Success   bool      `json:"success"`
+	Message   string    `json:"message"`
+	Trigger   string    `json:"trigger,omitempty"`
+	StartedAt time.Time `json:"started_at"`
+	SyncedAt  time.Time `json:"synced_at"`
+	Error     string    `json:"error,omitempty"`
+	// Cluster is the name of the cluster the run synced
+	Cluster string `json:"cluster,omitempty"`
+	// Master is the host the run synced from
+	Master string `json:"master,omitempty"`
+	// ConflictPolicy and Conflicts are set by multi-master runs: the policy
+	// used and the entries it had to resolve
+	ConflictPolicy string          `json:"conflict_policy,omitempty"`
+	Conflicts      []MergeConflict `json:"conflicts,omitempty"`
+	// Waves reports the waves of a staged rollout, canary first
+	Waves []WaveResult `json:"waves,omitempty"`
+	// DurationMs is the wall time of the whole run
+	DurationMs int64         `json:"duration_ms"`
+	Details    []SlaveResult `json:"details"`
 }
 
 type SlaveResult struct {
-	Host   string `json:"host"`
-	Result string `json:"result"`
-	Error  string `json:"error,omitempty"`
+	Host     string `json:"host"`
+	Result   string `json:"result"`
+	Error    string `json:"error,omitempty"`
+	Strategy string `json:"strategy,omitempty"`
+	// Changes is the number of entries added, updated or deleted by the
+	// API strategy.
+	Changes int `json:"changes,omitempty"`
+	// Verification is "verified" when the slave's data read back after the
+	// sync matches the master, "diverged" when it does not (see Mismatches)
+	// and "unverified" when it could not be read back.
+	Verification string         `json:"verification,omitempty"`
+	Mismatches   []ItemMismatch `json:"mismatches,omitempty"`
+	VerifyError  string         `json:"verify_error,omitempty"`
+	// Rollback is set when the slave's pre-sync snapshot was restored after
+	// a failed restore or verification: "succeeded" or "failed".
+	Rollback      string `json:"rollback,omitempty"`
+	RollbackError string `json:"rollback_error,omitempty"`
+	// Health lists the health checks run after a rollout sync
+	Health []HealthCheck `json:"health,omitempty"`
+	// Retries counts the retried Pi-hole operations for this slave
+	Retries int `json:"retries"`
+	// SyncedItems lists the items this run synced when the master was
+	// fingerprinted; unchanged items are left out. Result is "skipped" when
+	// nothing changed.
+	SyncedItems []string `json:"synced_items,omitempty"`
+	// DurationMs is the time spent on this slave, including retries
+	DurationMs int64 `json:"duration_ms"`
+	// BytesTransferred counts the Teleporter archive bytes downloaded from
+	// and uploaded to this slave
+	BytesTransferred int64 `json:"bytes_transferred"`
+	// Breaker is the slave's circuit breaker state after this run, when
+	// circuit breakers are enabled
+	Breaker string `json:"breaker,omitempty"`
+	// ActingMaster is set for a slave that was skipped because it is the
+	// master candidate this run synced from
+	ActingMaster bool `json:"acting_master,omitempty"`
+	// Upstream is the relay the slave was synced from, if not the master
+	Upstream string `json:"upstream,omitempty"`
+}
+
+// InSync reports whether the slave matched the master after the run.
+func (r SlaveResult) InSync() bool {
+	return succeeded(r)
+}
+
+// Rollback outcomes reported in SlaveResult.
+const (
+	RollbackSucceeded = "succeeded"
+	RollbackFailed    = "failed"
+)
+
+// DryRunResult is the outcome of a dry run: what a sync would change on each
+// slave, without changing anything.
+type DryRunResult struct {
+	Success   bool        `json:"success"`
+	Message   string      `json:"message"`
+	PlannedAt time.Time   `json:"planned_at"`
+	Details   []SlavePlan `json:"details"`
+	// Conflicts lists the entries a multi-master sync would have to resolve
+	Conflicts []MergeConflict `json:"conflicts,omitempty"`
 }
 
-func NewSyncer(cfg *config.Config) *Syncer {
-	masterClient := pihole.NewClient(cfg.Master.Host, cfg.Master.Password)
+// SlavePlan lists the changes a sync would make on one slave.
+type SlavePlan struct {
+	Host     string `json:"host"`
+	Strategy string `json:"strategy"`
+	Error    string `json:"error,omitempty"`
+	Plan     *Plan  `json:"plan,omitempty"`
+	// Unplanned lists enabled sync items whose changes cannot be previewed
+	// (dns_records, dhcp and settings are restored wholesale by Teleporter).
+	Unplanned []string `json:"unplanned,omitempty"`
+	// Upstream is the relay the slave is planned against, if not the master
+	Upstream string `json:"upstream,omitempty"`
+}
+
+// NewSyncer creates a syncer for cfg. Clients are taken from pool so that the
+// syncer shares its Pi-hole sessions with the rest of the process.
+func NewSyncer(cfg *config.Config, pool *pihole.Pool) *Syncer {
+	masterClient, masterErr := pool.Get(cfg.Master.Host, cfg.Master.ClientOptions())
+	masters := []*masterCandidate{{config: cfg.Master, client: masterClient, err: masterErr, health: MasterUnchecked}}
+	for _, candidate := range cfg.MasterCandidates()[1:] {
+		client, err := pool.Get(candidate.Host, candidate.ClientOptions())
+		masters = append(masters, &masterCandidate{config: candidate, client: client, err: err, health: MasterUnchecked})
+	}
 
 	var slaveClients []*pihole.Client
+	var slaveErrs []error
 	for _, slave := range cfg.Slaves {
-		slaveClients = append(slaveClients, pihole.NewClient(slave.Host, slave.Password))
+		slaveClient, err := pool.Get(slave.Host, slave.ClientOptions())
+		slaveClients = append(slaveClients, slaveClient)
+		slaveErrs = append(slaveErrs, err)
 	}
 
-	return &Syncer{
+	warnCoarseImports(cfg)
+
+	syncer := &Syncer{
 		config:       cfg,
 		masterClient: masterClient,
+		masterErr:    masterErr,
 		slaveClients: slaveClients,
+		slaveErrs:    slaveErrs,
+		received:     make(map[string]Fingerprint),
+		breakers:     newBreakers(cfg.ClusterName(), cfg.CircuitBreaker),
+		masters:      masters,
+		inSync:       make(map[string]time.Time),
+	}
+	if cfg.Failover.Enabled {
+		metrics.SetActiveMaster(cfg.ClusterName(), syncer.masterHosts(), cfg.Master.Host)
 	}
+	return syncer
 }
 
-func (s *Syncer) CanSync() bool {
-	return time.Since(s.lastSync) >= 10*time.Second
+// SetRecorder makes the syncer persist every run to recorder. The last sync
+// time and, with failover, the active master resume from the recorded runs,
+// so they survive restarts.
+func (s *Syncer) SetRecorder(recorder Recorder) {
+	s.recorder = recorder
+	if recorder, ok := recorder.(masterRecorder); ok {
+		s.restoreActiveMaster(recorder)
+	}
+	s.lastSyncMu.Lock()
+	defer s.lastSyncMu.Unlock()
+	if last := recorder.LastSyncedAt(); last.After(s.lastSync) {
+		s.lastSync = last
+	}
+}
+
+// Inherit takes over the run state of prev, the syncer this one replaces on
+// a configuration reload, so that the reload neither resyncs every slave,
+// closes open circuit breakers nor moves the sync source back to a stale
+// master. Only the state of hosts still configured is kept. It must be called before
+// s is used; prev may be nil.
+func (s *Syncer) Inherit(prev *Syncer) {
+	if prev == nil {
+		return
+	}
+
+	var hosts []string
+	for _, slave := range s.config.Slaves {
+		hosts = append(hosts, slave.Host)
+	}
+	s.breakers.inherit(prev.breakers, hosts)
+	s.inheritFailover(prev, append(s.masterHosts(), hosts...))
+
+	prev.receivedMu.Lock()
+	defer prev.receivedMu.Unlock()
+	for _, host := range hosts {
+		if fingerprint, ok := prev.received[host]; ok {
+			s.received[host] = maps.Clone(fingerprint)
+		}
+	}
 }
 
 func (s *Syncer) GetLastSync() time.Time {
+	s.lastSyncMu.Lock()
+	defer s.lastSyncMu.Unlock()
 	return s.lastSync
 }
 
-func (s *Syncer) Sync() (*SyncResult, error) {
-	if !s.CanSync() {
-		return &SyncResult{
-			Success: false,
-			Message: "10秒以内に呼び出し済みのため、処理は実行されませんでした",
-		}, nil
+// syncNow converges every slave to the master, either by restoring the
+// master's Teleporter backup or, for slaves using the "api" strategy, by
+// applying only the differences. Cancelling ctx aborts in-flight Pi-hole calls
+// and any pending retries. Every run is recorded.
+//
+// syncNow does not prevent overlapping runs; triggers go through a
+// Coordinator.
+func (s *Syncer) syncNow(ctx context.Context, opts SyncOptions) (*SyncResult, error) {
+	startedAt := time.Now()
+	cluster := s.config.ClusterName()
+	if events := opts.Events; events != nil {
+		opts.Events = func(event Event) {
+			event.Cluster = cluster
+			events(event)
+		}
+	}
+	opts.emit(Event{Type: EventSyncStarted, Trigger: opts.Trigger, Hosts: s.syncHosts()})
+
+	result, err := s.run(ctx, opts)
+	if result != nil {
+		result.Trigger = opts.Trigger
+		result.Cluster = cluster
+		result.StartedAt = startedAt
+		result.DurationMs = result.SyncedAt.Sub(startedAt).Milliseconds()
+	}
+	s.record(opts, startedAt, result, err)
+
+	finished := Event{Type: EventSyncFinished, Trigger: opts.Trigger, SyncResult: result}
+	if err != nil {
+		finished.Error = err.Error()
+	}
+	opts.emit(finished)
+	return result, err
+}
+
+// syncHosts returns the hosts a run writes to, in the order of its Details:
+// the slaves, or every participant in multi-master mode.
+func (s *Syncer) syncHosts() []string {
+	hosts := []string{}
+	if s.config.MultiMaster.Enabled {
+		for _, p := range s.participants() {
+			hosts = append(hosts, p.host)
+		}
+		return hosts
+	}
+	for _, slave := range s.config.Slaves {
+		hosts = append(hosts, slave.Host)
+	}
+	return hosts
+}
+
+// record hands a finished run to the recorder. Runs that failed before any
+// slave was touched are recorded with their error.
+func (s *Syncer) record(opts SyncOptions, startedAt time.Time, result *SyncResult, err error) {
+	if s.recorder == nil {
+		return
+	}
+
+	entry := SyncResult{
+		Success:   false,
+		Message:   "同期エラー",
+		Trigger:   opts.Trigger,
+		Cluster:   s.config.ClusterName(),
+		StartedAt: startedAt,
+		SyncedAt:  time.Now(),
+	}
+	entry.DurationMs = entry.SyncedAt.Sub(startedAt).Milliseconds()
+	if err != nil {
+		entry.Error = err.Error()
+	} else {
+		entry = *result
+	}
+
+	if err := s.recorder.Record(entry); err != nil && logger.Logger != nil {
+		logger.Logger.Error("Failed to record sync history", zap.Error(err))
 	}
+}
 
+// run performs one sync of all slaves, tier by tier: slaves with an upstream
+// relay are synced from it after it was synced itself. With a rollout
+// configured, the slaves synced from the master go in waves. Unless opts.Force is
+// set, each slave only receives the items whose content on its source
+// changed since its last successful sync, and is skipped when nothing
+// changed.
+func (s *Syncer) run(ctx context.Context, opts SyncOptions) (*SyncResult, error) {
 	// Safe logging - check if logger is initialized
 	if logger.Logger != nil {
-		logger.Logger.Info("Starting synchronization")
+		logger.Logger.Info("Starting synchronization", zap.Bool("force", opts.Force))
 	}
 
-	// Teleporter APIを使用してマスターからバックアップをダウンロード
-	masterBackup, err := s.masterClient.GetBackup()
+	if s.config.MultiMaster.Enabled {
+		return s.runMultiMaster(ctx, opts)
+	}
+
+	tiers, err := s.config.SlaveTiers()
 	if err != nil {
-		return nil, fmt.Errorf("failed to get master backup: %w", err)
+		return nil, fmt.Errorf("invalid relay topology: %w", err)
 	}
 
-	var details []SlaveResult
-	allSuccess := true
+	master, err := s.selectMaster(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
 
-	for i, slaveClient := range s.slaveClients {
-		slave := s.config.Slaves[i]
-		result := s.syncSlaveWithBackup(slaveClient, slave, masterBackup)
-		details = append(details, result)
+	// The first tier is synced from the master. An unreadable master fails
+	// the whole run.
+	details := make([]SlaveResult, len(s.config.Slaves))
+	var first []*tierSlave
+	if len(tiers) > 0 {
+		first = s.tierSlaves(tiers[0])
+	}
+	if err := s.prepareSource(ctx, opts, master.config.Host, sourceMaster, master.client, first); err != nil {
+		return nil, err
+	}
+	var waves []WaveResult
+	if s.config.Rollout.Enabled {
+		waves = s.rollout(ctx, opts, master.config.Host, first, details)
+	} else {
+		s.syncTier(ctx, opts, master.config.Host, first, details)
+	}
 
-		if result.Result != "ok" {
+	// Every further tier is synced from its relays once they are done. A
+	// relay that did not end up in sync would pass on stale data, so its
+	// slaves are left alone.
+	for _, tier := range tiers[min(1, len(tiers)):] {
+		slaves := s.tierSlaves(tier)
+		var byUpstream [][]*tierSlave
+		relays := make(map[string]int)
+		for _, slave := range slaves {
+			i, ok := relays[slave.upstream]
+			if !ok {
+				i = len(byUpstream)
+				relays[slave.upstream] = i
+				byUpstream = append(byUpstream, nil)
+			}
+			byUpstream[i] = append(byUpstream[i], slave)
+		}
+
+		for _, group := range byUpstream {
+			upstream := group[0].upstream
+			relay := slices.IndexFunc(s.config.Slaves, func(slave config.SlaveConfig) bool { return slave.Host == upstream })
+			if !succeeded(details[relay]) {
+				if logger.Logger != nil {
+					logger.Logger.Warn("Relay is not in sync, skipping its slaves", zap.String("relay", upstream))
+				}
+				for _, slave := range group {
+					slave.err = fmt.Sprintf("upstream %s is not in sync with the master, skipping slave", upstream)
+				}
+				continue
+			}
+			if err := s.prepareSource(ctx, opts, master.config.Host, sourceRelay, s.slaveClients[relay], group); err != nil {
+				for _, slave := range group {
+					slave.err = err.Error()
+				}
+			}
+		}
+		s.syncTier(ctx, opts, master.config.Host, slaves, details)
+	}
+
+	allSuccess := true
+	for _, result := range details {
+		if !succeeded(result) {
 			allSuccess = false
 		}
 	}
 
-	s.lastSync = time.Now()
+	syncedAt := time.Now()
+	s.markInSync(master.config.Host, details, syncedAt)
+	s.lastSyncMu.Lock()
+	s.lastSync = syncedAt
+	s.lastSyncMu.Unlock()
 
 	syncResult := &SyncResult{
 		Success:  allSuccess,
-		SyncedAt: s.lastSync,
+		SyncedAt: syncedAt,
+		Master:   master.config.Host,
+		Waves:    waves,
 		Details:  details,
 	}
 
-	if allSuccess {
+	if allSuccess && allSkipped(details) {
+		syncResult.Message = "マスターに変更がないため同期をスキップしました"
+	} else if allSuccess {
 		syncResult.Message = "同期完了"
+	} else if rolloutHalted(waves) {
+		syncResult.Message = "同期またはヘルスチェックに失敗したため段階的同期を中止しました"
+	} else if allSynced(details) {
+		syncResult.Message = "同期は完了しましたが、マスターと一致しないスレーブがあります"
 	} else {
 		syncResult.Message = "同期中にエラーが発生しました"
 	}
@@ -103,68 +460,777 @@ func (s *Syncer) Sync() (*SyncResult, error) {
 	return syncResult, nil
 }
 
-func (s *Syncer) syncSlaveWithBackup(client *pihole.Client, slave config.SlaveConfig, masterBackup []byte) SlaveResult {
+// tierSlave is a slave of one tier and what it receives in this run.
+type tierSlave struct {
+	index int
+	// slave has its SyncItems narrowed to the items that changed upstream
+	slave config.SlaveConfig
+	// upstream is the relay the slave is synced from, empty for the master
+	upstream string
+	skipped  bool
+	input    slaveSyncInput
+	// err, if set, fails the slave without touching it
+	err string
+	// halt, if set, leaves the slave out of a halted rollout
+	halt string
+}
+
+// tierSlaves returns the slaves with the given indexes.
+func (s *Syncer) tierSlaves(indexes []int) []*tierSlave {
+	slaves := make([]*tierSlave, len(indexes))
+	for n, i := range indexes {
+		slave := s.config.Slaves[i]
+		upstream := slave.Upstream
+		if upstream == s.config.Master.Host {
+			upstream = ""
+		}
+		slaves[n] = &tierSlave{index: i, slave: slave, upstream: upstream}
+	}
+	return slaves
+}
+
+// Kinds of sources a tier is synced from
+const (
+	sourceMaster = "master"
+	sourceRelay  = "relay"
+)
+
+// prepareSource reads from the source, the master or a relay, what slaves
+// need: its fingerprint, which narrows every slave to the items that changed
+// since it last received them, and its backup or state for the slaves still
+// to sync. With no slaves the backup is still downloaded so that an
+// unreachable master is reported. master is the host this run syncs from.
+func (s *Syncer) prepareSource(ctx context.Context, opts SyncOptions, master, source string, client *pihole.Client, slaves []*tierSlave) error {
+	// Without a fingerprint every slave gets a full sync
+	var fingerprint Fingerprint
+	var state *State
+	var stateErr error
+	if len(slaves) > 0 {
+		var err error
+		fingerprint, state, err = readFingerprint(ctx, client)
+		if err != nil && logger.Logger != nil {
+			logger.Logger.Warn("Could not fingerprint sync source, syncing all items",
+				zap.String("source", source),
+				zap.Error(err))
+		}
+	}
+
+	for _, ts := range slaves {
+		// A promoted standby that is also a slave is the source of this run
+		if ts.slave.Host == master {
+			ts.skipped = true
+			continue
+		}
+		// Slaves with an unknown strategy fall through to report the error
+		strategy := ts.slave.SyncStrategy()
+		knownStrategy := strategy == config.StrategyTeleporter || strategy == config.StrategyAPI
+		if fingerprint != nil && !opts.Force && knownStrategy {
+			ts.slave.SyncItems = changedItems(ts.slave.SyncItems, fingerprint, s.receivedFingerprint(ts.slave.Host))
+			ts.skipped = len(enabledItems(ts.slave.SyncItems)) == 0
+		}
+	}
+
+	// The backup is only needed for Teleporter slaves
+	needBackup := len(slaves) == 0
+	needState := false
+	for _, ts := range slaves {
+		if ts.skipped {
+			continue
+		}
+		if ts.slave.SyncStrategy() == config.StrategyAPI {
+			needState = true
+		} else {
+			needBackup = true
+		}
+	}
+
+	// Teleporter APIを使用して同期元からバックアップをダウンロード
+	var backup []byte
+	if needBackup {
+		var err error
+		backup, err = client.GetBackup(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to get %s backup: %w", source, err)
+		}
+		if source == sourceMaster {
+			opts.emit(Event{Type: EventMasterBackup, Bytes: int64(len(backup))})
+		}
+	}
+
+	if needState && state == nil {
+		state, stateErr = ReadState(ctx, client)
+		if stateErr != nil {
+			return fmt.Errorf("failed to read %s state: %w", source, stateErr)
+		}
+	}
+	// Teleporter-only setups read the state lazily, for verification.
+	// Slaves run concurrently, so the first one to ask reads it.
+	var stateMu gosync.Mutex
+	verifyState := func() (*State, error) {
+		stateMu.Lock()
+		defer stateMu.Unlock()
+		if state == nil && stateErr == nil {
+			state, stateErr = ReadState(ctx, client)
+		}
+		return state, stateErr
+	}
+
+	for _, ts := range slaves {
+		ts.input = slaveSyncInput{
+			masterBackup: backup,
+			masterState:  state,
+			verifyState:  verifyState,
+			fingerprint:  fingerprint,
+		}
+	}
+	return nil
+}
+
+// syncTier syncs slaves concurrently, at most maxConcurrent at a time, and
+// writes each result to details at the slave's index so Details keeps
+// config order.
+func (s *Syncer) syncTier(ctx context.Context, opts SyncOptions, master string, slaves []*tierSlave, details []SlaveResult) {
+	semaphore := make(chan struct{}, s.maxConcurrent())
+	var wg gosync.WaitGroup
+
+	for _, ts := range slaves {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(ts *tierSlave) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+
+			slaveCtx := ctx
+			if timeout := s.config.SyncParallelism.SlaveTimeout; timeout > 0 {
+				var cancel context.CancelFunc
+				slaveCtx, cancel = context.WithTimeout(ctx, timeout)
+				defer cancel()
+			}
+
+			slaveCtx = withSlaveEvents(slaveCtx, opts, ts.index, ts.slave.Host)
+			emitSlaveEvent(slaveCtx, Event{Type: EventSlaveStarted})
+			started := time.Now()
+			var result SlaveResult
+			switch {
+			case ts.slave.Host == master:
+				result = SlaveResult{Host: ts.slave.Host, Result: "skipped", Strategy: ts.slave.SyncStrategy(), ActingMaster: true}
+			case ts.err != "":
+				result = SlaveResult{Host: ts.slave.Host, Result: "error", Error: ts.err, Strategy: ts.slave.SyncStrategy()}
+			case ts.halt != "":
+				result = SlaveResult{Host: ts.slave.Host, Result: "halted", Error: ts.halt, Strategy: ts.slave.SyncStrategy()}
+			default:
+				result = s.syncSlave(slaveCtx, ts.index, s.slaveClients[ts.index], ts.slave, ts.skipped, ts.input)
+			}
+			result.Upstream = ts.upstream
+			result.DurationMs = time.Since(started).Milliseconds()
+			details[ts.index] = result
+
+			event := Event{Type: EventSlaveDone, Error: result.Error, SlaveResult: &result}
+			if !succeeded(result) {
+				event.Type = EventSlaveFailed
+			}
+			emitSlaveEvent(slaveCtx, event)
+		}(ts)
+	}
+	wg.Wait()
+}
+
+// slaveSyncInput is the source data shared by all slaves of one tier.
+type slaveSyncInput struct {
+	masterBackup []byte
+	masterState  *State
+	verifyState  func() (*State, error)
+	fingerprint  Fingerprint
+	// healthCheck makes slaves pass the rollout health checks after the sync
+	healthCheck bool
+}
+
+// syncSlave syncs the i-th slave and returns its result. It is safe to run
+// for several slaves at once.
+func (s *Syncer) syncSlave(ctx context.Context, i int, client *pihole.Client, slave config.SlaveConfig, skipped bool, input slaveSyncInput) SlaveResult {
+	if err := s.slaveErrs[i]; err != nil {
+		if logger.Logger != nil {
+			logger.Logger.Error("Skipping slave with invalid client configuration",
+				zap.String("host", slave.Host),
+				zap.Error(err))
+		}
+		return SlaveResult{
+			Host:   slave.Host,
+			Result: "error",
+			Error:  fmt.Sprintf("failed to create client: %v", err),
+		}
+	}
+
+	if skipped {
+		if logger.Logger != nil {
+			logger.Logger.Info("Master unchanged since last sync, skipping slave",
+				zap.String("host", slave.Host))
+		}
+		return SlaveResult{
+			Host:     slave.Host,
+			Result:   "skipped",
+			Strategy: slave.SyncStrategy(),
+		}
+	}
+
+	if ok, openUntil := s.breakers.allow(slave.Host); !ok {
+		return SlaveResult{
+			Host:     slave.Host,
+			Result:   "error",
+			Error:    fmt.Sprintf("circuit breaker open after repeated failures, skipping slave until %s", openUntil.Format(time.RFC3339)),
+			Strategy: slave.SyncStrategy(),
+			Breaker:  BreakerOpen,
+		}
+	}
+
+	var result SlaveResult
+	switch slave.SyncStrategy() {
+	case config.StrategyTeleporter:
+		result = s.syncSlaveWithBackup(ctx, client, slave, input.masterBackup, input.verifyState, input.healthCheck)
+	case config.StrategyAPI:
+		result = s.syncSlaveWithAPI(ctx, client, slave, input.masterState)
+		if result.Result == "ok" {
+			s.verifySlave(ctx, client, slave, &result, input.verifyState)
+		}
+		// Differential changes cannot be undone, the slave is only reported
+		if result.Result == "ok" && result.Verification != VerificationDiverged && input.healthCheck {
+			s.checkSlaveHealth(ctx, client, slave, &result)
+		}
+	default:
+		return SlaveResult{
+			Host:     slave.Host,
+			Result:   "error",
+			Error:    fmt.Sprintf("unknown sync strategy %q", slave.Strategy),
+			Strategy: slave.Strategy,
+		}
+	}
+
+	result.Breaker = s.breakers.record(slave.Host, result.Result == "error")
+
+	if input.fingerprint != nil {
+		result.SyncedItems = enabledItems(slave.SyncItems)
+		if result.Result == "ok" && result.Verification != VerificationDiverged {
+			s.markReceived(slave.Host, input.fingerprint, slave.SyncItems)
+		}
+	}
+	return result
+}
+
+// maxConcurrent returns how many slaves may be synced at once.
+func (s *Syncer) maxConcurrent() int {
+	if n := s.config.SyncParallelism.MaxConcurrent; n > 0 {
+		return n
+	}
+	return config.DefaultMaxConcurrentSlaves
+}
+
+// receivedFingerprint returns what host last received from the master.
+func (s *Syncer) receivedFingerprint(host string) Fingerprint {
+	s.receivedMu.Lock()
+	defer s.receivedMu.Unlock()
+	return s.received[host]
+}
+
+// markReceived records that host now holds the master's content for items.
+func (s *Syncer) markReceived(host string, fingerprint Fingerprint, items config.SyncItems) {
+	s.receivedMu.Lock()
+	defer s.receivedMu.Unlock()
+
+	received := s.received[host]
+	if received == nil {
+		received = make(Fingerprint)
+		s.received[host] = received
+	}
+	for _, item := range enabledItems(items) {
+		received[item] = fingerprint[item]
+	}
+}
+
+// forgetReceived drops what host is known to have received, so that the
+// next run syncs every enabled item to it even if the master is unchanged.
+func (s *Syncer) forgetReceived(host string) {
+	s.receivedMu.Lock()
+	defer s.receivedMu.Unlock()
+	delete(s.received, host)
+}
+
+// succeeded reports whether a slave ended up matching the master.
+func succeeded(result SlaveResult) bool {
+	return (result.Result == "ok" || result.Result == "skipped") && result.Verification != VerificationDiverged
+}
+
+// allSkipped reports whether no slave needed a sync.
+func allSkipped(details []SlaveResult) bool {
+	for _, detail := range details {
+		if detail.Result != "skipped" {
+			return false
+		}
+	}
+	return len(details) > 0
+}
+
+// DryRun computes, for every slave, the changes a sync would make to the data
+// selected by its SyncItems. Slaves of a relay are compared with the relay's
+// current data. Nothing is written to any Pi-hole and the last sync time is
+// not updated.
+func (s *Syncer) DryRun(ctx context.Context) (*DryRunResult, error) {
+	if s.config.MultiMaster.Enabled {
+		return s.dryRunMultiMaster(ctx)
+	}
+
+	if _, err := s.config.SlaveTiers(); err != nil {
+		return nil, fmt.Errorf("invalid relay topology: %w", err)
+	}
+
+	master, err := s.currentMaster()
+	if err != nil {
+		return nil, err
+	}
+
+	masterState, err := ReadState(ctx, master.client)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read master state: %w", err)
+	}
+
+	result := &DryRunResult{
+		Success:   true,
+		PlannedAt: time.Now(),
+	}
+
+	// Relays are read once, however many slaves they feed
+	relayStates := make(map[string]*State)
+	relayErrs := make(map[string]error)
+	sourceState := func(upstream string) (*State, error) {
+		if upstream == "" {
+			return masterState, nil
+		}
+		if state, ok := relayStates[upstream]; ok {
+			return state, relayErrs[upstream]
+		}
+		relay := slices.IndexFunc(s.config.Slaves, func(slave config.SlaveConfig) bool { return slave.Host == upstream })
+		var state *State
+		err := s.slaveErrs[relay]
+		if err == nil {
+			state, err = ReadState(ctx, s.slaveClients[relay])
+		}
+		relayStates[upstream], relayErrs[upstream] = state, err
+		return state, err
+	}
+
+	for i, slaveClient := range s.slaveClients {
+		slave := s.config.Slaves[i]
+		slavePlan := SlavePlan{
+			Host:      slave.Host,
+			Strategy:  slave.SyncStrategy(),
+			Unplanned: unplannedItems(slave),
+		}
+		if slave.Upstream != s.config.Master.Host {
+			slavePlan.Upstream = slave.Upstream
+		}
+
+		if err := s.slaveErrs[i]; err != nil {
+			slavePlan.Error = fmt.Sprintf("failed to create client: %v", err)
+		} else if upstreamState, err := sourceState(slavePlan.Upstream); err != nil {
+			slavePlan.Error = fmt.Sprintf("failed to read upstream state: %v", err)
+		} else if slaveState, err := ReadState(ctx, slaveClient); err != nil {
+			slavePlan.Error = fmt.Sprintf("failed to read slave state: %v", err)
+		} else {
+			slavePlan.Plan = ComputePlan(upstreamState, slaveState, slave.SyncItems)
+		}
+
+		if slavePlan.Error != "" {
+			result.Success = false
+			if logger.Logger != nil {
+				logger.Logger.Error("Failed to plan sync for slave",
+					zap.String("host", slave.Host),
+					zap.String("error", slavePlan.Error))
+			}
+		}
+		result.Details = append(result.Details, slavePlan)
+	}
+
+	if result.Success {
+		result.Message = "差分の計算が完了しました"
+	} else {
+		result.Message = "差分の計算中にエラーが発生しました"
+	}
+
+	return result, nil
+}
+
+// plannedItems returns the sync items of the i-th plan of a dry run.
+func (s *Syncer) plannedItems(i int) config.SyncItems {
+	if s.config.MultiMaster.Enabled {
+		return s.config.MultiMaster.SyncItems
+	}
+	return s.config.Slaves[i].SyncItems
+}
+
+// unplannedItems returns the enabled sync items of slave that a dry run
+// cannot preview.
+func unplannedItems(slave config.SlaveConfig) []string {
+	if slave.SyncStrategy() != config.StrategyTeleporter {
+		return nil
+	}
+	var items []string
+	if slave.SyncItems.DNSRecords {
+		items = append(items, ItemDNSRecords)
+	}
+	if slave.SyncItems.DHCP {
+		items = append(items, ItemDHCP)
+	}
+	if slave.SyncItems.Settings {
+		items = append(items, ItemSettings)
+	}
+	return items
+}
+
+// allSynced reports whether every slave was written successfully, regardless
+// of verification.
+func allSynced(details []SlaveResult) bool {
+	for _, detail := range details {
+		if detail.Result != "ok" && detail.Result != "skipped" {
+			return false
+		}
+	}
+	return true
+}
+
+// syncSlaveWithBackup restores the master's backup on the slave and verifies
+// the result, then runs the rollout health checks if healthCheck is set.
+// The slave's own backup is taken first; if the restore, the verification
+// or a health check fails, that snapshot is restored to undo the import.
+func (s *Syncer) syncSlaveWithBackup(ctx context.Context, client *pihole.Client, slave config.SlaveConfig, masterBackup []byte, masterState func() (*State, error), healthCheck bool) SlaveResult {
 	result := SlaveResult{
-		Host:   slave.Host,
-		Result: "ok",
+		Host:     slave.Host,
+		Result:   "ok",
+		Strategy: config.StrategyTeleporter,
 	}
 
 	// 設定に基づいてインポートオプションを生成
 	importOptions := s.generateImportOptions(slave.SyncItems)
 
+	// リストア前にスレーブ自身のバックアップを取得
+	var snapshot []byte
+	err := s.retry(ctx, slave.Host, &result.Retries, func() error {
+		var err error
+		snapshot, err = client.GetBackup(ctx)
+		result.BytesTransferred += int64(len(snapshot))
+		return err
+	})
+	if err != nil {
+		result.Result = "error"
+		result.Error = fmt.Sprintf("failed to snapshot slave before restore: %v", err)
+		return result
+	}
+
+	err = s.retry(ctx, slave.Host, &result.Retries, func() error {
+		result.BytesTransferred += int64(len(masterBackup))
+		return client.RestoreBackupWithOptions(ctx, masterBackup, importOptions)
+	})
+	if err != nil {
+		result.Result = "error"
+		result.Error = err.Error()
+		s.rollback(ctx, client, slave, snapshot, importOptions, &result)
+		return result
+	}
+
+	s.verifySlave(ctx, client, slave, &result, masterState)
+	if result.Verification == VerificationDiverged {
+		var items []string
+		for _, mismatch := range result.Mismatches {
+			items = append(items, mismatch.Item)
+		}
+		result.Result = "error"
+		result.Error = fmt.Sprintf("slave diverges from master after restore: %s", strings.Join(items, ", "))
+		s.rollback(ctx, client, slave, snapshot, importOptions, &result)
+		return result
+	}
+
+	if healthCheck && !s.checkSlaveHealth(ctx, client, slave, &result) {
+		s.rollback(ctx, client, slave, snapshot, importOptions, &result)
+		return result
+	}
+
+	if logger.Logger != nil {
+		logger.Logger.Info("Successfully synced slave using Teleporter API",
+			zap.String("host", slave.Host))
+	}
+	return result
+}
+
+// rollback restores the slave's pre-sync snapshot for the same import
+// options and records the outcome in result. It runs even if ctx was
+// cancelled or timed out, so that an interrupted restore is still undone,
+// and gets its own slave timeout.
+func (s *Syncer) rollback(ctx context.Context, client *pihole.Client, slave config.SlaveConfig, snapshot []byte, importOptions *pihole.ImportOptions, result *SlaveResult) {
+	if logger.Logger != nil {
+		logger.Logger.Warn("Rolling back slave to its pre-sync snapshot",
+			zap.String("host", slave.Host),
+			zap.String("reason", result.Error))
+	}
+
+	rollbackCtx := context.WithoutCancel(ctx)
+	if timeout := s.config.SyncParallelism.SlaveTimeout; timeout > 0 {
+		var cancel context.CancelFunc
+		rollbackCtx, cancel = context.WithTimeout(rollbackCtx, timeout)
+		defer cancel()
+	}
+	err := s.retry(rollbackCtx, slave.Host, &result.Retries, func() error {
+		result.BytesTransferred += int64(len(snapshot))
+		return client.RestoreBackupWithOptions(rollbackCtx, snapshot, importOptions)
+	})
+	if err != nil {
+		result.Rollback = RollbackFailed
+		result.RollbackError = err.Error()
+		if logger.Logger != nil {
+			logger.Logger.Error("Rollback failed, slave is in an unknown state",
+				zap.String("host", slave.Host),
+				zap.Error(err))
+		}
+		return
+	}
+
+	result.Rollback = RollbackSucceeded
+	if logger.Logger != nil {
+		logger.Logger.Info("Rolled back slave to its pre-sync snapshot",
+			zap.String("host", slave.Host))
+	}
+}
+
+// syncSlaveWithAPI reads the slave's state, computes the differences to the
+// master for the enabled sync items and applies only those. The plan is
+// recomputed on every retry so a partially applied plan is completed.
+func (s *Syncer) syncSlaveWithAPI(ctx context.Context, client *pihole.Client, slave config.SlaveConfig, masterState *State) SlaveResult {
+	result := SlaveResult{
+		Host:     slave.Host,
+		Result:   "ok",
+		Strategy: config.StrategyAPI,
+	}
+
+	if slave.SyncItems.DNSRecords || slave.SyncItems.DHCP || slave.SyncItems.Settings {
+		if logger.Logger != nil {
+			logger.Logger.Warn("dns_records, dhcp and settings are only synced by the teleporter strategy",
+				zap.String("host", slave.Host))
+		}
+	}
+
+	err := s.retry(ctx, slave.Host, &result.Retries, func() error {
+		slaveState, err := ReadState(ctx, client)
+		if err != nil {
+			return fmt.Errorf("failed to read slave state: %w", err)
+		}
+
+		plan := ComputePlan(masterState, slaveState, slave.SyncItems)
+		if err := ApplyPlan(ctx, client, plan); err != nil {
+			return err
+		}
+		result.Changes += len(plan.Changes)
+		return nil
+	})
+	if err != nil {
+		result.Result = "error"
+		result.Error = err.Error()
+		return result
+	}
+
+	if logger.Logger != nil {
+		logger.Logger.Info("Successfully synced slave using differential API sync",
+			zap.String("host", slave.Host),
+			zap.Int("changes", result.Changes))
+	}
+	return result
+}
+
+// verifySlave reads the slave's data back after a sync and records in result
+// whether every synced item matches the master.
+func (s *Syncer) verifySlave(ctx context.Context, client *pihole.Client, slave config.SlaveConfig, result *SlaveResult, masterState func() (*State, error)) {
+	defer func() {
+		emitSlaveEvent(ctx, Event{
+			Type:         EventSlaveVerified,
+			Verification: result.Verification,
+			Error:        result.VerifyError,
+			Mismatches:   result.Mismatches,
+		})
+	}()
+
+	master, err := masterState()
+	if err != nil {
+		result.Verification = VerificationUnverified
+		result.VerifyError = fmt.Sprintf("failed to read master state: %v", err)
+		return
+	}
+	slaveState, err := ReadState(ctx, client)
+	if err != nil {
+		result.Verification = VerificationUnverified
+		result.VerifyError = fmt.Sprintf("failed to read slave state: %v", err)
+		if logger.Logger != nil {
+			logger.Logger.Warn("Could not verify slave after sync",
+				zap.String("host", slave.Host),
+				zap.Error(err))
+		}
+		return
+	}
+
+	result.Mismatches = Verify(master, slaveState, slave.SyncItems)
+	if len(result.Mismatches) == 0 {
+		result.Verification = VerificationVerified
+		return
+	}
+
+	result.Verification = VerificationDiverged
+	if logger.Logger != nil {
+		for _, mismatch := range result.Mismatches {
+			logger.Logger.Error("Slave diverges from master after sync",
+				zap.String("host", slave.Host),
+				zap.String("item", mismatch.Item),
+				zap.Int("master_count", mismatch.Master.Count),
+				zap.Int("slave_count", mismatch.Slave.Count))
+		}
+	}
+}
+
+// retry runs op until it succeeds, fails with an error that is not
+// transient, the configured retry count is exhausted or ctx is cancelled, and
+// returns the last error. Retries wait with exponential backoff and jitter.
+// Each retry increments *retries.
+func (s *Syncer) retry(ctx context.Context, host string, retries *int, op func() error) error {
 	retryCount := 0
 	maxRetries := s.config.SyncRetry.Count
 	if !s.config.SyncRetry.Enabled {
 		maxRetries = 0
 	}
 
-	for retryCount <= maxRetries {
-		err := client.RestoreBackupWithOptions(masterBackup, importOptions)
+	for {
+		err := op()
 		if err == nil {
-			if logger.Logger != nil {
-				logger.Logger.Info("Successfully synced slave using Teleporter API",
-					zap.String("host", slave.Host))
-			}
-			break
+			return nil
 		}
 
-		if retryCount == maxRetries {
-			result.Result = "error"
-			result.Error = err.Error()
+		if retryCount == maxRetries || ctx.Err() != nil {
 			if logger.Logger != nil {
 				logger.Logger.Error("Failed to sync slave after retries",
-					zap.String("host", slave.Host),
+					zap.String("host", host),
 					zap.Int("max_retries", maxRetries),
 					zap.Error(err))
 			}
-			break
+			return err
+		}
+		if !pihole.IsTransient(err) {
+			if logger.Logger != nil {
+				logger.Logger.Error("Failed to sync slave, error is not transient, not retrying",
+					zap.String("host", host),
+					zap.Error(err))
+			}
+			return err
 		}
 
 		retryCount++
+		*retries++
+		wait := s.backoff(retryCount)
+		emitSlaveEvent(ctx, Event{Type: EventSlaveRetry, Attempt: retryCount, Error: err.Error()})
 		if logger.Logger != nil {
 			logger.Logger.Warn("Sync failed for slave, retrying",
-				zap.String("host", slave.Host),
+				zap.String("host", host),
 				zap.Int("retry", retryCount),
 				zap.Int("max_retries", maxRetries),
+				zap.Duration("backoff", wait),
 				zap.Error(err))
 		}
-		time.Sleep(time.Duration(retryCount) * time.Second)
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
+}
 
-	return result
+// backoff returns the wait before the n-th retry: the initial backoff
+// multiplied for every earlier retry, capped at the maximum and randomized
+// by the jitter fraction so slaves failing together do not retry in step.
+func (s *Syncer) backoff(n int) time.Duration {
+	cfg := s.config.SyncRetry
+	initial := cfg.InitialBackoff
+	if initial <= 0 {
+		initial = config.DefaultInitialBackoff
+	}
+	maxBackoff := cfg.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = config.DefaultMaxBackoff
+	}
+	multiplier := cfg.Multiplier
+	if multiplier < 1 {
+		multiplier = config.DefaultBackoffMultiplier
+	}
+	jitter := config.DefaultBackoffJitter
+	if cfg.Jitter != nil && *cfg.Jitter >= 0 && *cfg.Jitter <= 1 {
+		jitter = *cfg.Jitter
+	}
+
+	wait := min(float64(initial)*math.Pow(multiplier, float64(n-1)), float64(maxBackoff))
+	wait *= 1 + jitter*(2*rand.Float64()-1)
+	return time.Duration(wait)
+}
+
+// generateImportOptions translates SyncItems into the Pi-hole v6 Teleporter
+// import schema:
+//
+//	adlists                     -> gravity.adlist, gravity.adlist_by_group
+//	blacklist, whitelist, regex -> gravity.domainlist, gravity.domainlist_by_group
+//	groups                      -> gravity.group
+//	clients                     -> gravity.client, gravity.client_by_group
+//	dns_records, dhcp, settings -> config
+//	dhcp                        -> dhcp_leases
+//
+// The *_by_group tables and dhcp_leases can be overridden individually.
+// Teleporter replaces whole tables and files, so the domain items and the
+// config items can only be imported together.
+func (s *Syncer) generateImportOptions(syncItems config.SyncItems) *pihole.ImportOptions {
+	domains := syncItems.Blacklist || syncItems.Whitelist || syncItems.Regex
+	configFile := syncItems.DNSRecords || syncItems.DHCP || syncItems.Settings
+
+	return &pihole.ImportOptions{
+		Config:     configFile,
+		DHCPLeases: override(syncItems.DHCPLeases, syncItems.DHCP),
+		Gravity: pihole.GravityImportOptions{
+			Group:             syncItems.Groups,
+			Adlist:            syncItems.Adlists,
+			AdlistByGroup:     override(syncItems.AdlistByGroup, syncItems.Adlists),
+			Domainlist:        domains,
+			DomainlistByGroup: override(syncItems.DomainlistByGroup, domains),
+			Client:            syncItems.Clients,
+			ClientByGroup:     override(syncItems.ClientByGroup, syncItems.Clients),
+		},
+	}
+}
+
+// warnCoarseImports logs the Teleporter slaves whose sync items select only
+// part of a table or file that Teleporter imports as a whole.
+func warnCoarseImports(cfg *config.Config) {
+	if logger.Logger == nil {
+		return
+	}
+	for _, slave := range cfg.Slaves {
+		if slave.SyncStrategy() != config.StrategyTeleporter {
+			continue
+		}
+		items := slave.SyncItems
+		if (items.Blacklist || items.Whitelist || items.Regex) && !(items.Blacklist && items.Whitelist && items.Regex) {
+			logger.Logger.Warn("Teleporter imports blacklist, whitelist and regex together as the domainlist table",
+				zap.String("host", slave.Host))
+		}
+		if (items.DNSRecords || items.DHCP || items.Settings) && !(items.DNSRecords && items.DHCP && items.Settings) {
+			logger.Logger.Warn("Teleporter imports dns_records, dhcp and settings together as pihole.toml",
+				zap.String("host", slave.Host))
+		}
+	}
 }
 
-// generateImportOptions converts SyncItems config to Pi-hole import options
-func (s *Syncer) generateImportOptions(syncItems config.SyncItems) map[string]bool {
-	return map[string]bool{
-		"adlists":     syncItems.Adlists,
-		"blacklist":   syncItems.Blacklist,
-		"whitelist":   syncItems.Whitelist,
-		"regex":       syncItems.Regex,
-		"groups":      syncItems.Groups,
-		"dns_records": syncItems.DNSRecords,
-		"dhcp":        syncItems.DHCP,
-		"clients":     syncItems.Clients,
-		"settings":    syncItems.Settings,
+// override returns *value if set, otherwise fallback.
+func override(value *bool, fallback bool) bool {
+	if value != nil {
+		return *value
 	}
+	return fallback
 }
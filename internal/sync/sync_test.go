@@ -1,12 +1,17 @@
 package sync
 
 import (
+	"context"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/arimakouyou/pihole-sync/internal/config"
+	"github.com/arimakouyou/pihole-sync/internal/pihole"
 )
 
 func TestNewSyncer(t *testing.T) {
@@ -23,7 +28,7 @@ func TestNewSyncer(t *testing.T) {
 		},
 	}
 
-	syncer := NewSyncer(cfg)
+	syncer := NewSyncer(cfg, pihole.NewPool())
 
 	assert.NotNil(t, syncer)
 	assert.Equal(t, cfg, syncer.config)
@@ -31,19 +36,6 @@ func TestNewSyncer(t *testing.T) {
 	assert.Len(t, syncer.slaveClients, 1)
 }
 
-func TestCanSync(t *testing.T) {
-	cfg := &config.Config{}
-	syncer := NewSyncer(cfg)
-
-	assert.True(t, syncer.CanSync())
-
-	syncer.lastSync = time.Now()
-	assert.False(t, syncer.CanSync())
-
-	syncer.lastSync = time.Now().Add(-11 * time.Second)
-	assert.True(t, syncer.CanSync())
-}
-
 func TestSyncWithRetryLogic(t *testing.T) {
 	tests := []struct {
 		name         string
@@ -78,8 +70,8 @@ func TestSyncWithRetryLogic(t *testing.T) {
 				},
 			}
 
-			syncer := NewSyncer(cfg)
-			result, err := syncer.Sync()
+			syncer := NewSyncer(cfg, pihole.NewPool())
+			result, err := syncer.syncNow(context.Background(), SyncOptions{})
 
 			if tt.expectError {
 				assert.Error(t, err)
@@ -99,8 +91,8 @@ func TestSyncWithNilMasterData(t *testing.T) {
 		},
 	}
 
-	syncer := NewSyncer(cfg)
-	_, err := syncer.Sync()
+	syncer := NewSyncer(cfg, pihole.NewPool())
+	_, err := syncer.syncNow(context.Background(), SyncOptions{})
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "failed to get master backup")
 }
@@ -135,31 +127,12 @@ func TestSyncWithMultipleSlaves(t *testing.T) {
 		},
 	}
 
-	syncer := NewSyncer(cfg)
-	_, err := syncer.Sync()
+	syncer := NewSyncer(cfg, pihole.NewPool())
+	_, err := syncer.syncNow(context.Background(), SyncOptions{})
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "failed to get master backup")
 }
 
-func TestSyncRateLimiting(t *testing.T) {
-	cfg := &config.Config{
-		Master: config.MasterConfig{
-			Host:     "http://test-master.local",
-			Password: "test-password",
-		},
-	}
-
-	syncer := NewSyncer(cfg)
-
-	syncer.lastSync = time.Now().Add(-5 * time.Second)
-	assert.False(t, syncer.CanSync(), "Should not allow sync within 10 seconds")
-
-	result, err := syncer.Sync()
-	assert.NoError(t, err)
-	assert.False(t, result.Success)
-	assert.Contains(t, result.Message, "10秒以内に呼び出し済み")
-}
-
 func TestSyncWithDisabledRetry(t *testing.T) {
 	cfg := &config.Config{
 		Master: config.MasterConfig{
@@ -181,15 +154,620 @@ func TestSyncWithDisabledRetry(t *testing.T) {
 		},
 	}
 
-	syncer := NewSyncer(cfg)
-	_, err := syncer.Sync()
+	syncer := NewSyncer(cfg, pihole.NewPool())
+	_, err := syncer.syncNow(context.Background(), SyncOptions{})
 	assert.Error(t, err)
 }
 
 func TestGetLastSyncInitialValue(t *testing.T) {
 	cfg := &config.Config{}
-	syncer := NewSyncer(cfg)
+	syncer := NewSyncer(cfg, pihole.NewPool())
 
 	lastSync := syncer.GetLastSync()
 	assert.True(t, lastSync.IsZero(), "Initial last sync should be zero time")
 }
+
+func TestSyncContextCanceled(t *testing.T) {
+	cfg := &config.Config{
+		Master: config.MasterConfig{
+			Host:     "http://invalid-master.local",
+			Password: "test-password",
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	syncer := NewSyncer(cfg, pihole.NewPool())
+	_, err := syncer.syncNow(ctx, SyncOptions{})
+	assert.Error(t, err)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestNewSyncerSharesPooledClients(t *testing.T) {
+	cfg := &config.Config{
+		Master: config.MasterConfig{
+			Host:     "http://master.local",
+			Password: "master-password",
+		},
+		Slaves: []config.SlaveConfig{
+			{
+				Host:     "http://slave.local",
+				Password: "slave-password",
+			},
+		},
+	}
+
+	pool := pihole.NewPool()
+	first := NewSyncer(cfg, pool)
+	second := NewSyncer(cfg, pool)
+
+	assert.Same(t, first.masterClient, second.masterClient)
+	assert.Same(t, first.slaveClients[0], second.slaveClients[0])
+}
+
+func TestSyncReportsInvalidSlaveTLS(t *testing.T) {
+	master := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/auth" {
+			w.Write([]byte(`{"session": {"sid": "test-sid", "csrf": "test-csrf"}}`))
+			return
+		}
+		w.Write([]byte("backup-data"))
+	}))
+	defer master.Close()
+
+	cfg := &config.Config{
+		Master: config.MasterConfig{
+			Host:     master.URL,
+			Password: "test-password",
+		},
+		Slaves: []config.SlaveConfig{
+			{
+				Host:     "https://slave.local",
+				Password: "test-password",
+				TLS: config.TLSConfig{
+					CAFile: "/nonexistent/ca.pem",
+				},
+			},
+		},
+	}
+
+	syncer := NewSyncer(cfg, pihole.NewPool())
+	result, err := syncer.syncNow(context.Background(), SyncOptions{})
+	require.NoError(t, err)
+
+	assert.False(t, result.Success)
+	require.Len(t, result.Details, 1)
+	assert.Equal(t, "error", result.Details[0].Result)
+	assert.Contains(t, result.Details[0].Error, "invalid TLS configuration")
+}
+
+func TestSyncWithAPIStrategy(t *testing.T) {
+	master := newFakePihole()
+	defer master.Close()
+	master.domains = []pihole.Domain{
+		{ID: 1, Domain: "ads.example.com", Type: pihole.DomainDeny, Kind: pihole.DomainExact, Groups: []int{0}, Enabled: true},
+	}
+	master.lists = []pihole.Adlist{
+		{ID: 1, Address: "https://lists.example/hosts", Type: pihole.ListBlock, Groups: []int{0}, Enabled: true},
+	}
+
+	apiSlave := newFakePihole()
+	defer apiSlave.Close()
+	apiSlave.lists = []pihole.Adlist{
+		{ID: 1, Address: "https://lists.example/hosts", Type: pihole.ListBlock, Groups: []int{0}, Enabled: true},
+	}
+
+	teleporterSlave := newFakePihole()
+	defer teleporterSlave.Close()
+
+	cfg := &config.Config{
+		Master: config.MasterConfig{Host: master.URL(), Password: "test-password"},
+		Slaves: []config.SlaveConfig{
+			{
+				Host:      apiSlave.URL(),
+				Password:  "test-password",
+				Strategy:  config.StrategyAPI,
+				SyncItems: config.SyncItems{Adlists: true, Blacklist: true},
+			},
+			{
+				Host:      teleporterSlave.URL(),
+				Password:  "test-password",
+				SyncItems: config.SyncItems{Adlists: true},
+			},
+		},
+	}
+
+	syncer := NewSyncer(cfg, pihole.NewPool())
+	result, err := syncer.syncNow(context.Background(), SyncOptions{})
+	require.NoError(t, err)
+	require.True(t, result.Success, "%+v", result.Details)
+
+	assert.Equal(t, config.StrategyAPI, result.Details[0].Strategy)
+	assert.Equal(t, 1, result.Details[0].Changes)
+	assert.Equal(t, 1, apiSlave.mutations, "unchanged adlist must not be rewritten")
+	require.Len(t, apiSlave.domains, 1)
+	assert.Equal(t, "ads.example.com", apiSlave.domains[0].Domain)
+	assert.Empty(t, apiSlave.restores)
+
+	assert.Equal(t, config.StrategyTeleporter, result.Details[1].Strategy)
+	assert.Len(t, teleporterSlave.restores, 1)
+}
+
+func TestSyncWithUnknownStrategy(t *testing.T) {
+	master := newFakePihole()
+	defer master.Close()
+
+	cfg := &config.Config{
+		Master: config.MasterConfig{Host: master.URL(), Password: "test-password"},
+		Slaves: []config.SlaveConfig{
+			{Host: "http://slave.local", Password: "test-password", Strategy: "rsync"},
+		},
+	}
+
+	syncer := NewSyncer(cfg, pihole.NewPool())
+	result, err := syncer.syncNow(context.Background(), SyncOptions{})
+	require.NoError(t, err)
+	assert.False(t, result.Success)
+	assert.Contains(t, result.Details[0].Error, `unknown sync strategy "rsync"`)
+}
+
+func TestDryRun(t *testing.T) {
+	master := newFakePihole()
+	defer master.Close()
+	master.domains = []pihole.Domain{
+		{ID: 1, Domain: "ads.example.com", Type: pihole.DomainDeny, Kind: pihole.DomainExact, Groups: []int{0}, Enabled: true},
+	}
+
+	slave := newFakePihole()
+	defer slave.Close()
+	slave.domains = []pihole.Domain{
+		{ID: 1, Domain: "old.example.com", Type: pihole.DomainDeny, Kind: pihole.DomainExact, Groups: []int{0}, Enabled: true},
+	}
+
+	cfg := &config.Config{
+		Master: config.MasterConfig{Host: master.URL(), Password: "test-password"},
+		Slaves: []config.SlaveConfig{
+			{
+				Host:      slave.URL(),
+				Password:  "test-password",
+				SyncItems: config.SyncItems{Blacklist: true, DNSRecords: true},
+			},
+		},
+	}
+
+	syncer := NewSyncer(cfg, pihole.NewPool())
+	result, err := syncer.DryRun(context.Background())
+	require.NoError(t, err)
+	require.True(t, result.Success, "%+v", result.Details)
+	require.Len(t, result.Details, 1)
+
+	detail := result.Details[0]
+	assert.Equal(t, config.StrategyTeleporter, detail.Strategy)
+	assert.Equal(t, []string{"dns_records"}, detail.Unplanned)
+	assert.Equal(t, []string{
+		"add blacklist ads.example.com",
+		"delete blacklist old.example.com",
+	}, changeSummary(detail.Plan))
+
+	// Nothing was written and no sync is recorded
+	assert.Zero(t, slave.mutations)
+	assert.Empty(t, slave.restores)
+	assert.True(t, syncer.GetLastSync().IsZero())
+}
+
+func TestSyncVerifiesSlaves(t *testing.T) {
+	master := newFakePihole()
+	defer master.Close()
+	master.domains = []pihole.Domain{
+		{ID: 1, Domain: "ads.example.com", Type: pihole.DomainDeny, Kind: pihole.DomainExact, Groups: []int{0}, Enabled: true},
+	}
+
+	t.Run("verified", func(t *testing.T) {
+		slave := newFakePihole()
+		defer slave.Close()
+
+		cfg := &config.Config{
+			Master: config.MasterConfig{Host: master.URL(), Password: "test-password"},
+			Slaves: []config.SlaveConfig{
+				{Host: slave.URL(), Password: "test-password", SyncItems: config.SyncItems{Blacklist: true, Groups: true}},
+			},
+		}
+
+		result, err := NewSyncer(cfg, pihole.NewPool()).syncNow(context.Background(), SyncOptions{})
+		require.NoError(t, err)
+		assert.True(t, result.Success)
+		assert.Equal(t, VerificationVerified, result.Details[0].Verification)
+		assert.Empty(t, result.Details[0].Mismatches)
+	})
+
+	t.Run("diverged", func(t *testing.T) {
+		// The slave accepts the upload but silently imports nothing
+		slave := newFakePihole()
+		defer slave.Close()
+		slave.domains = []pihole.Domain{
+			{ID: 7, Domain: "stale.example.com", Type: pihole.DomainDeny, Kind: pihole.DomainExact, Groups: []int{0}, Enabled: true},
+		}
+		master.backup = []byte("not-a-snapshot")
+		defer func() { master.backup = nil }()
+
+		cfg := &config.Config{
+			Master: config.MasterConfig{Host: master.URL(), Password: "test-password"},
+			Slaves: []config.SlaveConfig{
+				{Host: slave.URL(), Password: "test-password", SyncItems: config.SyncItems{Blacklist: true, Groups: true}},
+			},
+		}
+
+		result, err := NewSyncer(cfg, pihole.NewPool()).syncNow(context.Background(), SyncOptions{})
+		require.NoError(t, err)
+		assert.False(t, result.Success)
+
+		detail := result.Details[0]
+		assert.Equal(t, "error", detail.Result)
+		assert.Contains(t, detail.Error, "diverges from master")
+		assert.Equal(t, VerificationDiverged, detail.Verification)
+		assert.Equal(t, RollbackSucceeded, detail.Rollback)
+		require.Len(t, detail.Mismatches, 1)
+		assert.Equal(t, ItemBlacklist, detail.Mismatches[0].Item)
+		assert.Equal(t, 1, detail.Mismatches[0].Master.Count)
+		assert.NotEqual(t, detail.Mismatches[0].Master.Hash, detail.Mismatches[0].Slave.Hash)
+	})
+}
+
+func TestSyncRollsBackFailedRestore(t *testing.T) {
+	master := newFakePihole()
+	defer master.Close()
+	master.domains = []pihole.Domain{
+		{ID: 1, Domain: "ads.example.com", Type: pihole.DomainDeny, Kind: pihole.DomainExact, Groups: []int{0}, Enabled: true},
+	}
+
+	tests := []struct {
+		name        string
+		failRestore int
+		rollback    string
+	}{
+		{name: "rollback succeeds", failRestore: 1, rollback: RollbackSucceeded},
+		{name: "rollback fails", failRestore: 2, rollback: RollbackFailed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			slave := newFakePihole()
+			defer slave.Close()
+			slave.domains = []pihole.Domain{
+				{ID: 7, Domain: "local.example.com", Type: pihole.DomainDeny, Kind: pihole.DomainExact, Groups: []int{0}, Enabled: true},
+			}
+			slave.failRestore = tt.failRestore
+
+			cfg := &config.Config{
+				Master: config.MasterConfig{Host: master.URL(), Password: "test-password"},
+				Slaves: []config.SlaveConfig{
+					{Host: slave.URL(), Password: "test-password", SyncItems: config.SyncItems{Blacklist: true}},
+				},
+			}
+
+			result, err := NewSyncer(cfg, pihole.NewPool()).syncNow(context.Background(), SyncOptions{})
+			require.NoError(t, err)
+			assert.False(t, result.Success)
+
+			detail := result.Details[0]
+			assert.Equal(t, "error", detail.Result)
+			assert.Equal(t, tt.rollback, detail.Rollback)
+			if tt.rollback == RollbackFailed {
+				assert.NotEmpty(t, detail.RollbackError)
+			} else {
+				assert.Empty(t, detail.RollbackError)
+				require.Len(t, slave.restores, 1)
+				assert.Equal(t, "local.example.com", slave.domains[0].Domain)
+			}
+		})
+	}
+}
+
+type memoryRecorder struct {
+	results []SyncResult
+	last    time.Time
+}
+
+func (m *memoryRecorder) Record(result SyncResult) error {
+	m.results = append(m.results, result)
+	return nil
+}
+
+func (m *memoryRecorder) LastSyncedAt() time.Time {
+	return m.last
+}
+
+func TestSyncRecordsRuns(t *testing.T) {
+	master := newFakePihole()
+	defer master.Close()
+	slave := newFakePihole()
+	defer slave.Close()
+	slave.failRestore = 1
+
+	cfg := &config.Config{
+		Master: config.MasterConfig{Host: master.URL(), Password: "test-password"},
+		Slaves: []config.SlaveConfig{
+			{Host: slave.URL(), Password: "test-password", SyncItems: config.SyncItems{Blacklist: true}},
+		},
+		SyncRetry: config.SyncRetry{Enabled: true, Count: 1},
+	}
+
+	recorder := &memoryRecorder{}
+	syncer := NewSyncer(cfg, pihole.NewPool())
+	syncer.SetRecorder(recorder)
+
+	result, err := syncer.syncNow(context.Background(), SyncOptions{Trigger: TriggerSchedule})
+	require.NoError(t, err)
+	require.True(t, result.Success, "%+v", result.Details)
+
+	require.Len(t, recorder.results, 1)
+	recorded := recorder.results[0]
+	assert.Equal(t, TriggerSchedule, recorded.Trigger)
+	assert.False(t, recorded.StartedAt.After(recorded.SyncedAt))
+	assert.Equal(t, 1, recorded.Details[0].Retries)
+	assert.Positive(t, recorded.Details[0].BytesTransferred)
+}
+
+func TestSyncRecordsFailedRuns(t *testing.T) {
+	cfg := &config.Config{
+		Master: config.MasterConfig{Host: "http://127.0.0.1:1", Password: "test-password"},
+	}
+
+	recorder := &memoryRecorder{}
+	syncer := NewSyncer(cfg, pihole.NewPool())
+	syncer.SetRecorder(recorder)
+
+	_, err := syncer.syncNow(context.Background(), SyncOptions{Trigger: TriggerAPI})
+	require.Error(t, err)
+
+	require.Len(t, recorder.results, 1)
+	assert.False(t, recorder.results[0].Success)
+	assert.Contains(t, recorder.results[0].Error, "failed to get master backup")
+}
+
+func TestSetRecorderRestoresLastSync(t *testing.T) {
+	syncer := NewSyncer(&config.Config{}, pihole.NewPool())
+	last := time.Now().Add(-time.Minute)
+	syncer.SetRecorder(&memoryRecorder{last: last})
+
+	assert.Equal(t, last, syncer.GetLastSync())
+}
+
+func TestSyncSlavesConcurrently(t *testing.T) {
+	master := newFakePihole()
+	defer master.Close()
+
+	const delay = 300 * time.Millisecond
+	var slaves []config.SlaveConfig
+	for i := 0; i < 3; i++ {
+		slave := newFakePihole()
+		defer slave.Close()
+		slave.restoreDelay = delay
+		slaves = append(slaves, config.SlaveConfig{Host: slave.URL(), Password: "test-password", SyncItems: config.SyncItems{Blacklist: true}})
+	}
+
+	cfg := &config.Config{
+		Master:          config.MasterConfig{Host: master.URL(), Password: "test-password"},
+		Slaves:          slaves,
+		SyncParallelism: config.SyncParallelism{MaxConcurrent: 3},
+	}
+
+	result, err := NewSyncer(cfg, pihole.NewPool()).syncNow(context.Background(), SyncOptions{})
+	require.NoError(t, err)
+	require.True(t, result.Success, "%+v", result.Details)
+
+	// Details keep config order regardless of completion order
+	require.Len(t, result.Details, 3)
+	for i, detail := range result.Details {
+		assert.Equal(t, slaves[i].Host, detail.Host)
+		assert.GreaterOrEqual(t, detail.DurationMs, delay.Milliseconds())
+	}
+	assert.GreaterOrEqual(t, result.DurationMs, delay.Milliseconds())
+	assert.Less(t, result.DurationMs, 3*delay.Milliseconds(), "slaves should be synced in parallel")
+}
+
+func TestSyncSlaveTimeout(t *testing.T) {
+	master := newFakePihole()
+	defer master.Close()
+
+	slow := newFakePihole()
+	defer slow.Close()
+	slow.restoreDelay = 500 * time.Millisecond
+
+	fast := newFakePihole()
+	defer fast.Close()
+
+	cfg := &config.Config{
+		Master: config.MasterConfig{Host: master.URL(), Password: "test-password"},
+		Slaves: []config.SlaveConfig{
+			{Host: slow.URL(), Password: "test-password", SyncItems: config.SyncItems{Blacklist: true}},
+			{Host: fast.URL(), Password: "test-password", SyncItems: config.SyncItems{Blacklist: true}},
+		},
+		SyncParallelism: config.SyncParallelism{MaxConcurrent: 1, SlaveTimeout: 100 * time.Millisecond},
+	}
+
+	result, err := NewSyncer(cfg, pihole.NewPool()).syncNow(context.Background(), SyncOptions{})
+	require.NoError(t, err)
+	assert.False(t, result.Success)
+
+	assert.Equal(t, "error", result.Details[0].Result)
+	assert.Contains(t, result.Details[0].Error, "deadline exceeded")
+	assert.Equal(t, "ok", result.Details[1].Result, "a slow slave must not fail the others")
+}
+
+func TestGenerateImportOptions(t *testing.T) {
+	off := false
+	on := true
+	tests := []struct {
+		name     string
+		items    config.SyncItems
+		expected pihole.ImportOptions
+	}{
+		{
+			name:     "nothing",
+			items:    config.SyncItems{},
+			expected: pihole.ImportOptions{},
+		},
+		{
+			name:  "adlists with group assignments",
+			items: config.SyncItems{Adlists: true, Groups: true},
+			expected: pihole.ImportOptions{Gravity: pihole.GravityImportOptions{
+				Group: true, Adlist: true, AdlistByGroup: true,
+			}},
+		},
+		{
+			name:  "any domain item imports the domainlist",
+			items: config.SyncItems{Regex: true},
+			expected: pihole.ImportOptions{Gravity: pihole.GravityImportOptions{
+				Domainlist: true, DomainlistByGroup: true,
+			}},
+		},
+		{
+			name:  "clients",
+			items: config.SyncItems{Clients: true},
+			expected: pihole.ImportOptions{Gravity: pihole.GravityImportOptions{
+				Client: true, ClientByGroup: true,
+			}},
+		},
+		{
+			name:     "dns records import the config",
+			items:    config.SyncItems{DNSRecords: true},
+			expected: pihole.ImportOptions{Config: true},
+		},
+		{
+			name:     "dhcp imports the config and leases",
+			items:    config.SyncItems{DHCP: true},
+			expected: pihole.ImportOptions{Config: true, DHCPLeases: true},
+		},
+		{
+			name: "overrides",
+			items: config.SyncItems{
+				Adlists: true, Blacklist: true, Clients: true, DHCP: true,
+				AdlistByGroup: &off, DomainlistByGroup: &off, ClientByGroup: &off, DHCPLeases: &off,
+			},
+			expected: pihole.ImportOptions{Config: true, Gravity: pihole.GravityImportOptions{
+				Adlist: true, Domainlist: true, Client: true,
+			}},
+		},
+		{
+			name:  "override enables a table on its own",
+			items: config.SyncItems{ClientByGroup: &on},
+			expected: pihole.ImportOptions{Gravity: pihole.GravityImportOptions{
+				ClientByGroup: true,
+			}},
+		},
+	}
+
+	syncer := NewSyncer(&config.Config{}, pihole.NewPool())
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, &tt.expected, syncer.generateImportOptions(tt.items))
+		})
+	}
+}
+
+func TestSyncSendsV6ImportSchema(t *testing.T) {
+	master := newFakePihole()
+	defer master.Close()
+	slave := newFakePihole()
+	defer slave.Close()
+
+	cfg := &config.Config{
+		Master: config.MasterConfig{Host: master.URL(), Password: "test-password"},
+		Slaves: []config.SlaveConfig{{Host: slave.URL(), Password: "test-password", SyncItems: config.SyncItems{
+			Adlists: true, Blacklist: true, Whitelist: true, Regex: true, Groups: true,
+		}}},
+	}
+
+	result, err := NewSyncer(cfg, pihole.NewPool()).syncNow(context.Background(), SyncOptions{Force: true})
+	require.NoError(t, err)
+	require.True(t, result.Success, "%+v", result.Details)
+
+	require.Len(t, slave.imports, 1)
+	assert.JSONEq(t, `{
+		"config": false,
+		"dhcp_leases": false,
+		"gravity": {
+			"group": true,
+			"adlist": true,
+			"adlist_by_group": true,
+			"domainlist": true,
+			"domainlist_by_group": true,
+			"client": false,
+			"client_by_group": false
+		}
+	}`, slave.imports[0])
+}
+
+func TestSyncThroughRelay(t *testing.T) {
+	master := newFakePihole()
+	defer master.Close()
+	master.domains = []pihole.Domain{denyDomain("ads.example.com", "", 0)}
+	master.lists = []pihole.Adlist{
+		{ID: 1, Address: "https://lists.example/hosts", Type: pihole.ListBlock, Groups: []int{0}, Enabled: true},
+	}
+
+	relay := newFakePihole()
+	defer relay.Close()
+	leaf := newFakePihole()
+	defer leaf.Close()
+
+	cfg := &config.Config{
+		Master: config.MasterConfig{Host: master.URL(), Password: "test-password"},
+		Slaves: []config.SlaveConfig{
+			{
+				Host:      leaf.URL(),
+				Password:  "test-password",
+				Strategy:  config.StrategyAPI,
+				SyncItems: config.SyncItems{Blacklist: true},
+				Upstream:  relay.URL(),
+			},
+			{
+				Host:      relay.URL(),
+				Password:  "test-password",
+				Strategy:  config.StrategyAPI,
+				SyncItems: config.SyncItems{Adlists: true, Blacklist: true},
+				Upstream:  master.URL(),
+			},
+		},
+	}
+	syncer := NewSyncer(cfg, pihole.NewPool())
+
+	// Slaves of a relay are planned against the relay's current data
+	relay.domains = []pihole.Domain{denyDomain("relay-only.example.com", "", 0)}
+	dryRun, err := syncer.DryRun(context.Background())
+	require.NoError(t, err)
+	require.True(t, dryRun.Success, "%+v", dryRun.Details)
+	assert.Equal(t, relay.URL(), dryRun.Details[0].Upstream)
+	assert.Empty(t, dryRun.Details[1].Upstream)
+	require.Len(t, dryRun.Details[0].Plan.Changes, 1)
+	assert.Equal(t, ActionAdd, dryRun.Details[0].Plan.Changes[0].Action)
+	assert.Contains(t, dryRun.Details[0].Plan.Changes[0].Key, "relay-only.example.com")
+	relay.domains = nil
+
+	result := syncNowForTest(t, syncer, SyncOptions{})
+	require.True(t, result.Success, "%+v", result.Details)
+	assert.Equal(t, relay.URL(), result.Details[0].Upstream)
+	assert.Empty(t, result.Details[1].Upstream)
+
+	assert.Len(t, relay.lists, 1)
+	assert.Equal(t, []string{"ads.example.com"}, domainNames(&State{Domains: relay.domains}))
+	assert.Equal(t, []string{"ads.example.com"}, domainNames(&State{Domains: leaf.domains}))
+	assert.Empty(t, leaf.lists, "the leaf's own sync items filter what the relay passes on")
+
+	// A relay that is not in sync must not pass stale data on
+	master.domains = append(master.domains, denyDomain("tracker.example.com", "", 0))
+	relay.setDown(true)
+	result = syncNowForTest(t, syncer, SyncOptions{})
+	assert.False(t, result.Success)
+	assert.Equal(t, "error", result.Details[1].Result)
+	assert.Equal(t, "error", result.Details[0].Result)
+	assert.Contains(t, result.Details[0].Error, "is not in sync with the master")
+	assert.Len(t, leaf.domains, 1)
+
+	relay.setDown(false)
+	result = syncNowForTest(t, syncer, SyncOptions{})
+	require.True(t, result.Success, "%+v", result.Details)
+	assert.Equal(t, []string{"ads.example.com", "tracker.example.com"}, domainNames(&State{Domains: leaf.domains}))
+}
@@ -0,0 +1,92 @@
+package sync
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/arimakouyou/pihole-sync/internal/config"
+)
+
+// Verification statuses reported in SlaveResult.
+const (
+	VerificationVerified   = "verified"
+	VerificationDiverged   = "diverged"
+	VerificationUnverified = "unverified"
+)
+
+// verifiableItems are the sync items whose content can be read back through
+// the API, in reporting order.
+var verifiableItems = []string{ItemAdlists, ItemBlacklist, ItemWhitelist, ItemRegex, ItemGroups, ItemClients}
+
+// ItemDigest summarizes the entries of one sync item: how many there are and
+// a hash over their content, with group memberships resolved to names so
+// that digests of different instances are comparable.
+type ItemDigest struct {
+	Count int    `json:"count"`
+	Hash  string `json:"hash"`
+}
+
+// ItemMismatch is a sync item whose digest differs between master and slave.
+type ItemMismatch struct {
+	Item   string     `json:"item"`
+	Master ItemDigest `json:"master"`
+	Slave  ItemDigest `json:"slave"`
+}
+
+// Digest returns the digest of item in st.
+func (st *State) Digest(item string) ItemDigest {
+	groups := st.groupNames()
+	var lines []string
+
+	switch item {
+	case ItemGroups:
+		for _, group := range st.Groups {
+			lines = append(lines, fmt.Sprintf("%s|%t|%s", group.Name, group.Enabled, group.Comment))
+		}
+	case ItemAdlists:
+		for _, list := range st.Adlists {
+			lines = append(lines, fmt.Sprintf("%s|%t|%s|%s", adlistKey(list), list.Enabled, list.Comment,
+				strings.Join(resolveGroupNames(list.Groups, groups), ",")))
+		}
+	case ItemClients:
+		for _, client := range st.Clients {
+			lines = append(lines, fmt.Sprintf("%s|%s|%s", client.Client, client.Comment,
+				strings.Join(resolveGroupNames(client.Groups, groups), ",")))
+		}
+	default:
+		for _, domain := range st.Domains {
+			if domainItem(domain) != item {
+				continue
+			}
+			lines = append(lines, fmt.Sprintf("%s|%t|%s|%s", domainKey(domain), domain.Enabled, domain.Comment,
+				strings.Join(resolveGroupNames(domain.Groups, groups), ",")))
+		}
+	}
+
+	sort.Strings(lines)
+	sum := sha256.New()
+	for _, line := range lines {
+		sum.Write([]byte(line))
+		sum.Write([]byte{'\n'})
+	}
+	return ItemDigest{Count: len(lines), Hash: hex.EncodeToString(sum.Sum(nil))}
+}
+
+// Verify compares master and slave for every verifiable item enabled in
+// items and returns the items that differ.
+func Verify(master, slave *State, items config.SyncItems) []ItemMismatch {
+	var mismatches []ItemMismatch
+	for _, item := range verifiableItems {
+		if !itemEnabled(items, item) {
+			continue
+		}
+		masterDigest, slaveDigest := master.Digest(item), slave.Digest(item)
+		if masterDigest != slaveDigest {
+			mismatches = append(mismatches, ItemMismatch{Item: item, Master: masterDigest, Slave: slaveDigest})
+		}
+	}
+	return mismatches
+}
@@ -0,0 +1,42 @@
+package sync
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/arimakouyou/pihole-sync/internal/config"
+	"github.com/arimakouyou/pihole-sync/internal/pihole"
+)
+
+func TestVerify(t *testing.T) {
+	master := &State{
+		Groups: []pihole.Group{{ID: 0, Name: "Default", Enabled: true}, {ID: 1, Name: "kids", Enabled: true}},
+		Domains: []pihole.Domain{
+			{Domain: "ads.example.com", Type: pihole.DomainDeny, Kind: pihole.DomainExact, Groups: []int{1}, Enabled: true},
+			{Domain: "good.example.com", Type: pihole.DomainAllow, Kind: pihole.DomainExact, Enabled: true},
+		},
+	}
+	// Same content with different group ids and order
+	slave := &State{
+		Groups: []pihole.Group{{ID: 9, Name: "kids", Enabled: true}, {ID: 0, Name: "Default", Enabled: true}},
+		Domains: []pihole.Domain{
+			{Domain: "ads.example.com", Type: pihole.DomainDeny, Kind: pihole.DomainExact, Groups: []int{9}, Enabled: true},
+		},
+	}
+
+	assert.Equal(t, master.Digest(ItemBlacklist), slave.Digest(ItemBlacklist))
+	assert.Empty(t, Verify(master, slave, config.SyncItems{Blacklist: true, Groups: true}))
+
+	// Whitelist is only compared once it is synced
+	mismatches := Verify(master, slave, config.SyncItems{Blacklist: true, Whitelist: true})
+	assert.Len(t, mismatches, 1)
+	assert.Equal(t, ItemWhitelist, mismatches[0].Item)
+	assert.Equal(t, 1, mismatches[0].Master.Count)
+	assert.Equal(t, 0, mismatches[0].Slave.Count)
+
+	slave.Domains[0].Enabled = false
+	mismatches = Verify(master, slave, config.SyncItems{Blacklist: true})
+	assert.Len(t, mismatches, 1)
+	assert.Equal(t, 1, mismatches[0].Slave.Count)
+}